@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/rajatchopra/ovn-kube/pkg/cni"
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+)
+
+func main() {
+	err := run()
+	if err != nil {
+		cniErr, ok := err.(*cni.Error)
+		if !ok {
+			cniErr = &cni.Error{Code: cni.ErrInternal, Msg: err.Error()}
+		}
+		if cniErr.CNIVersion == "" {
+			cniErr.CNIVersion = cni.NewVersionInfo().CNIVersion
+		}
+		json.NewEncoder(os.Stdout).Encode(cniErr)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	args, err := cni.ArgsFromEnv(os.Getenv)
+	if err != nil {
+		return err
+	}
+	if args.Command == "VERSION" {
+		return json.NewEncoder(os.Stdout).Encode(cni.NewVersionInfo())
+	}
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return &cni.Error{Code: cni.ErrInvalidNetConf, Msg: "failed to read the network configuration", Details: err.Error()}
+	}
+	conf, err := cni.ParseNetConf(stdin)
+	if err != nil {
+		return err
+	}
+
+	plugin := &cni.Plugin{
+		Exec:              execCommand,
+		AnnotationTimeout: 30 * time.Second,
+	}
+	switch args.Command {
+	case "ADD":
+		plugin.Kube, err = createKube(conf)
+		if err != nil {
+			return &cni.Error{CNIVersion: conf.CNIVersion, Code: cni.ErrInternal, Msg: "failed to create the kubernetes client", Details: err.Error()}
+		}
+		result, err := plugin.CmdAdd(args, conf)
+		if err != nil {
+			return withVersion(err, conf)
+		}
+		return json.NewEncoder(os.Stdout).Encode(result)
+	case "DEL":
+		return withVersion(plugin.CmdDel(args, conf), conf)
+	case "CHECK":
+		plugin.Kube, err = createKube(conf)
+		if err != nil {
+			return &cni.Error{CNIVersion: conf.CNIVersion, Code: cni.ErrInternal, Msg: "failed to create the kubernetes client", Details: err.Error()}
+		}
+		return withVersion(plugin.CmdCheck(args, conf), conf)
+	}
+	return &cni.Error{CNIVersion: conf.CNIVersion, Code: cni.ErrInvalidEnvironment, Msg: "unknown CNI_COMMAND " + args.Command}
+}
+
+func withVersion(err error, conf *cni.NetConf) error {
+	if cniErr, ok := err.(*cni.Error); ok {
+		cniErr.CNIVersion = conf.CNIVersion
+	}
+	return err
+}
+
+func execCommand(cmd string, args ...string) (string, error) {
+	out, err := exec.Command(cmd, args...).CombinedOutput()
+	return string(out), err
+}
+
+// getOvsExternalID returns an external_ids value of the Open_vSwitch table,
+// empty if it is not set
+func getOvsExternalID(key string) (string, error) {
+	out, err := execCommand("ovs-vsctl", "--if-exists", "get", "Open_vSwitch", ".", "external_ids:"+key)
+	if err != nil {
+		return "", fmt.Errorf("Error reading external_ids:%s - %v (%s)", key, err, out)
+	}
+	return strings.Trim(strings.TrimSpace(out), `"`), nil
+}
+
+// createKube connects to the api server with the kubeconfig of the network
+// configuration, or else with the credentials saved by the node setup
+func createKube(conf *cni.NetConf) (kube.KubeInterface, error) {
+	var config *restclient.Config
+	var err error
+	if conf.Kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", conf.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		server, err := getOvsExternalID("k8s-api-server")
+		if err != nil {
+			return nil, err
+		}
+		token, err := getOvsExternalID("k8s-api-token")
+		if err != nil {
+			return nil, err
+		}
+		caCert, err := getOvsExternalID("k8s-ca-certificate")
+		if err != nil {
+			return nil, err
+		}
+		if server == "" {
+			return nil, fmt.Errorf("no kubeconfig in the network configuration and no k8s-api-server in the Open_vSwitch external_ids")
+		}
+		config = &restclient.Config{
+			Host:            server,
+			BearerToken:     token,
+			TLSClientConfig: restclient.TLSClientConfig{CAFile: caCert},
+		}
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &kube.Kube{KClient: clientset}, nil
+}
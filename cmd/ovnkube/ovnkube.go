@@ -1,17 +1,28 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
 
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	certutil "k8s.io/client-go/util/cert"
 
+	"github.com/rajatchopra/ovn-kube/pkg/cluster"
 	ovnfactory "github.com/rajatchopra/ovn-kube/pkg/factory"
+	"github.com/rajatchopra/ovn-kube/pkg/ovn"
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
 )
 
 func main() {
@@ -20,7 +31,28 @@ func main() {
 	server := flag.String("apiserver", "https://localhost:8443", "url to the kubernetes apiserver")
 	rootCAFile := flag.String("ca-cert", "", "CA cert for the api server")
 	token := flag.String("token", "", "Bearer token to use for establishing ovn infrastructure")
-	clusterSubnet := flag.String("cluster-subnet", "11.11.0.0/16", "Cluster wide IP subnet to use")
+	clusterSubnet := flag.String("cluster-subnet", "11.11.0.0/16", "Cluster wide IP subnets to use, comma separated, each optionally followed by the prefix length of its host subnets, e.g. 10.128.0.0/14/23. IPv6 subnets, alone or with IPv4 ones for dual stack nodes and pods, have /64 host subnets.")
+	hostPrefixLength := flag.Int("host-prefix-length", 24, "Prefix length of the host subnets of the IPv4 cluster subnets that do not give one")
+
+	// northbound database flags
+	nbAddress := flag.String("nb-address", "unix:/var/run/openvswitch/ovnnb_db.sock", "Address of the OVN northbound database (tcp:host:port, ssl:host:port or unix:path)")
+	nbPrivKey := flag.String("nb-client-privkey", "", "Private key of the client for ssl connections to the northbound database")
+	nbCert := flag.String("nb-client-cert", "", "Certificate of the client for ssl connections to the northbound database")
+	nbCACert := flag.String("nb-client-cacert", "", "CA certificate for ssl connections to the northbound database")
+
+	// node flags
+	ovsAddress := flag.String("ovs-address", "unix:/var/run/openvswitch/db.sock", "Address of the local Open_vSwitch database of the node")
+	sbAddress := flag.String("sb-address", "", "Address of the OVN southbound database that ovn-controller connects to, and where the master removes the chassis of the deleted nodes, tcp on port 6642 of the apiserver host if empty")
+	encapType := flag.String("encap-type", "geneve", "Tunnel type of the node")
+	encapIP := flag.String("encap-ip", "", "Tunnel endpoint ip of the node, the InternalIP of the node, followed when it changes, if empty")
+	gatewayInterface := flag.String("gateway-interface", "", "Interface or OVS bridge of the node on the physical network, a gateway router is set up for the node when given")
+	gatewayIP := flag.String("gateway-ip", "", "Address of the gateway router on the physical network with its prefix length, the node ip if empty")
+	gatewayNextHop := flag.String("gateway-nexthop", "", "Default gateway of the physical network, required with --gateway-interface")
+
+	// controller flags
+	podWorkers := flag.Int("pod-workers", 4, "Number of pods processed concurrently by the central controller")
+	serviceWorkers := flag.Int("service-workers", 2, "Number of services and of endpoints processed concurrently by the central controller")
+	perServiceLBs := flag.Bool("per-service-lbs", false, "Give every service load balancers of its own instead of sharing the cluster wide ones")
 
 	// mode flags
 	netController := flag.Bool("net-controller", false, "Flag to start the central controller that watches pods/services/policies")
@@ -51,39 +83,123 @@ func main() {
 	}
 
 	// create factory and start the controllers asked for
-	factory := ovnfactory.NewDefaultFactory(clientset)
+	stopChan := make(chan struct{})
+	factory := ovnfactory.NewDefaultFactory(clientset, stopChan)
 	clusterController := factory.CreateClusterController()
 
 	if *master != "" || *node != "" {
 		clusterController.KubeServer = *server
 		clusterController.CACert = *rootCAFile
 		clusterController.Token = *token
-		clusterController.HostSubnetLength = 8
-		_, clusterController.ClusterIPNet, err = net.ParseCIDR(*clusterSubnet)
+		clusterController.ClusterNetworks, err = cluster.ParseClusterNetworks(*clusterSubnet, *hostPrefixLength)
 		if err != nil {
-			panic(err.Error)
+			panic(err.Error())
 		}
 	}
-	ovnController := factory.CreateOvnController()
 
+	if *master != "" || *node != "" {
+		clusterController.SouthboundAddress = *sbAddress
+		if clusterController.SouthboundAddress == "" {
+			clusterController.SouthboundAddress, err = defaultSouthboundAddress(*server)
+			if err != nil {
+				panic(err.Error())
+			}
+		}
+	}
 	if *node != "" {
 		if *token == "" {
 			panic("Cannot initialize node without service account 'token'. Please provide one with --token argument")
-			return
 		}
 
-		clusterController.StartClusterNode(*node)
+		clusterController.EncapType = *encapType
+		clusterController.EncapIP = *encapIP
+		clusterController.GatewayInterface = *gatewayInterface
+		clusterController.GatewayIP = *gatewayIP
+		clusterController.GatewayNextHop = *gatewayNextHop
+		clusterController.Exec = execCommand
+	}
+	var nbClient, sbClient *ovsdb.Client
+	if *master != "" || *node != "" || *netController {
+		tables := ovsdb.NBTables
+		if *netController {
+			// the ACLs and address sets are only written by the policies
+			tables = append(tables[:len(tables):len(tables)], ovsdb.NBPolicyTables...)
+		}
+		if *perServiceLBs {
+			// the group is looked up for every service, it is read from
+			// the server otherwise
+			tables = append(tables[:len(tables):len(tables)], ovsdb.LoadBalancerGroupTable)
+		}
+		nbClient, err = CreateNBClient(*nbAddress, *nbPrivKey, *nbCert, *nbCACert, tables)
+		if err != nil {
+			panic(err.Error())
+		}
 	}
 	if *master != "" {
-		// run the cluster controller to init the master
-		clusterController.StartClusterMaster(*master)
+		// run the cluster controller to init the master, before the
+		// node that needs the cluster router
+		sbClient, err = CreateSBClient(clusterController.SouthboundAddress)
+		if err != nil {
+			panic(err.Error())
+		}
+		clusterController.OvnNB = nbClient
+		clusterController.OvnSB = sbClient
+		err = clusterController.StartClusterMaster(*master, stopChan)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	var ovsClient *ovsdb.Client
+	if *node != "" {
+		ovsClient, err = CreateOVSClient(*ovsAddress)
+		if err != nil {
+			panic(err.Error())
+		}
+		clusterController.OvnNB = nbClient
+		clusterController.OvsDB = ovsClient
+		err = clusterController.StartClusterNode(*node)
+		if err != nil {
+			panic(err.Error())
+		}
 	}
+	var ovnController *ovn.OvnController
 	if *netController {
-		ovnController.Run()
+		ovnController = factory.CreateOvnController()
+		ovnController.OvnNB = ovn.NewOvsdbNorthbound(nbClient)
+		ovnController.PodWorkers = *podWorkers
+		ovnController.ServiceWorkers = *serviceWorkers
+		ovnController.PerServiceLoadBalancers = *perServiceLBs
+		ovnController.Run(stopChan)
 	}
-	if *master != "" || *netController {
-		// run forever
-		select {}
+	if *master != "" || *node != "" || *netController {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+		// only the watches asked for by the controllers are started, the
+		// node agent only watches its own node
+		err = factory.Start()
+		if err != nil {
+			panic(err.Error())
+		}
+		if ovnController != nil {
+			// clean up after the objects deleted while we were down
+			ovnController.RunReconciler(factory.ResyncInterval, stopChan)
+		}
+
+		// run until asked to stop
+		sig := <-signals
+		glog.Infof("Received %s, shutting down", sig)
+		close(stopChan)
+		if nbClient != nil {
+			nbClient.Close()
+		}
+		if sbClient != nil {
+			sbClient.Close()
+		}
+		if ovsClient != nil {
+			ovsClient.Close()
+		}
+		glog.Flush()
 	}
 }
 
@@ -103,3 +219,66 @@ func CreateConfig(server, token, rootCAFile string) (*restclient.Config, error)
 		TLSClientConfig: tlsClientConfig,
 	}, nil
 }
+
+func CreateNBClient(address, privKey, cert, caCert string, tables []string) (*ovsdb.Client, error) {
+	var tlsConfig *tls.Config
+	var err error
+	if strings.HasPrefix(address, "ssl:") {
+		tlsConfig, err = ovsdb.NewTLSConfig(privKey, cert, caCert)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := ovsdb.Dial(address, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to the northbound database at %s: %v", address, err)
+	}
+	err = client.Monitor(ovsdb.NBDatabase, tables...)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Error monitoring the northbound database: %v", err)
+	}
+	return client, nil
+}
+
+func CreateSBClient(address string) (*ovsdb.Client, error) {
+	client, err := ovsdb.Dial(address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to the southbound database at %s: %v", address, err)
+	}
+	err = client.Monitor(ovsdb.SBDatabase, ovsdb.SBTables...)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Error monitoring the southbound database: %v", err)
+	}
+	return client, nil
+}
+
+func CreateOVSClient(address string) (*ovsdb.Client, error) {
+	client, err := ovsdb.Dial(address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to the Open_vSwitch database at %s: %v", address, err)
+	}
+	err = client.Monitor(ovsdb.OVSDatabase, ovsdb.OVSTables...)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Error monitoring the Open_vSwitch database: %v", err)
+	}
+	return client, nil
+}
+
+// defaultSouthboundAddress returns the southbound database address on the
+// host of the apiserver, where the master runs
+func defaultSouthboundAddress(server string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("Cannot find the master host in apiserver %q, please provide --sb-address", server)
+	}
+	return "tcp:" + net.JoinHostPort(u.Hostname(), "6642"), nil
+}
+
+func execCommand(cmd string, args ...string) (string, error) {
+	out, err := exec.Command(cmd, args...).CombinedOutput()
+	return string(out), err
+}
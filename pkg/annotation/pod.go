@@ -0,0 +1,163 @@
+// Package annotation defines the annotations ovnkube sets on kubernetes
+// objects, for the CNI plugin and any other tool that consumes them.
+package annotation
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	kapi "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// PodNetworkAnnotation is the key of the pod annotation holding its PodNetwork
+	PodNetworkAnnotation = "ovn"
+	// PodNetworkVersion is the version of the PodNetwork written by ovnkube
+	PodNetworkVersion = 1
+)
+
+// PodNetwork is the network of a pod, as allocated by the ovn controller
+type PodNetwork struct {
+	// Version of the annotation, missing in the annotations written before
+	// it was versioned which are the same as version 1
+	Version int `json:"version,omitempty"`
+	// IPAddress is the address of the pod in CIDR notation, as in "10.128.1.2/24"
+	IPAddress string `json:"ip_address"`
+	// MACAddress is the mac address of the pod interface
+	MACAddress string `json:"mac_address"`
+	// GatewayIP is the default gateway of the pod
+	GatewayIP string `json:"gateway_ip"`
+	// IPAddresses are the addresses of a pod with an address of each IP
+	// family, the first one being IPAddress. They are only set for dual
+	// stack pods, see Addresses.
+	IPAddresses []string `json:"ip_addresses,omitempty"`
+	// GatewayIPs are the default gateways of the families of IPAddresses,
+	// in the same order
+	GatewayIPs []string `json:"gateway_ips,omitempty"`
+	// Routes are extra routes for the pod, besides the default route
+	Routes []PodRoute `json:"routes,omitempty"`
+}
+
+// PodRoute is a route of a pod
+type PodRoute struct {
+	// Dest is the destination of the route in CIDR notation
+	Dest string `json:"dest"`
+	// NextHop is the gateway of the route, the pod gateway of the family of
+	// the destination when empty
+	NextHop string `json:"nexthop,omitempty"`
+}
+
+// MarshalPodNetwork validates the pod network and encodes it as the value
+// of the PodNetworkAnnotation
+func MarshalPodNetwork(pn *PodNetwork) (string, error) {
+	if pn.Version == 0 {
+		c := *pn
+		c.Version = PodNetworkVersion
+		pn = &c
+	}
+	if err := pn.validate(); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(pn)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// UnmarshalPodNetwork decodes and validates the value of a PodNetworkAnnotation
+func UnmarshalPodNetwork(value string) (*PodNetwork, error) {
+	pn := &PodNetwork{}
+	if err := json.Unmarshal([]byte(value), pn); err != nil {
+		return nil, fmt.Errorf("invalid pod network annotation %q: %v", value, err)
+	}
+	if pn.Version == 0 {
+		pn.Version = PodNetworkVersion
+	}
+	if err := pn.validate(); err != nil {
+		return nil, err
+	}
+	return pn, nil
+}
+
+// GetPodNetwork returns the pod network of a pod, or an error if the pod has
+// not been given one yet
+func GetPodNetwork(pod *kapi.Pod) (*PodNetwork, error) {
+	value, ok := pod.Annotations[PodNetworkAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("pod %s/%s has no %s annotation", pod.Namespace, pod.Name, PodNetworkAnnotation)
+	}
+	return UnmarshalPodNetwork(value)
+}
+
+// Addresses returns the addresses of the pod in CIDR notation with the
+// default gateway of each, a single one for the pods that are not dual stack
+func (pn *PodNetwork) Addresses() ([]string, []string) {
+	if len(pn.IPAddresses) == 0 {
+		return []string{pn.IPAddress}, []string{pn.GatewayIP}
+	}
+	return pn.IPAddresses, pn.GatewayIPs
+}
+
+// Gateway returns the default gateway of the family of ip, empty if the pod
+// has no address of that family
+func (pn *PodNetwork) Gateway(ip net.IP) string {
+	addresses, gateways := pn.Addresses()
+	for i, address := range addresses {
+		podIP, _, err := net.ParseCIDR(address)
+		if err == nil && isIPv6(podIP) == isIPv6(ip) {
+			return gateways[i]
+		}
+	}
+	return ""
+}
+
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil
+}
+
+func (pn *PodNetwork) validate() error {
+	if pn.Version > PodNetworkVersion {
+		return fmt.Errorf("unsupported pod network annotation version %d", pn.Version)
+	}
+	if _, _, err := net.ParseCIDR(pn.IPAddress); err != nil {
+		return fmt.Errorf("invalid ip_address %q: %v", pn.IPAddress, err)
+	}
+	if _, err := net.ParseMAC(pn.MACAddress); err != nil {
+		return fmt.Errorf("invalid mac_address %q: %v", pn.MACAddress, err)
+	}
+	if net.ParseIP(pn.GatewayIP) == nil {
+		return fmt.Errorf("invalid gateway_ip %q", pn.GatewayIP)
+	}
+	if len(pn.IPAddresses) > 0 {
+		if pn.IPAddresses[0] != pn.IPAddress || len(pn.GatewayIPs) != len(pn.IPAddresses) ||
+			len(pn.GatewayIPs) > 0 && pn.GatewayIPs[0] != pn.GatewayIP {
+			return fmt.Errorf("ip_addresses %v and gateway_ips %v do not start with ip_address and gateway_ip", pn.IPAddresses, pn.GatewayIPs)
+		}
+		families := make(map[bool]bool)
+		for i, address := range pn.IPAddresses {
+			ip, _, err := net.ParseCIDR(address)
+			if err != nil {
+				return fmt.Errorf("invalid ip_addresses entry %q: %v", address, err)
+			}
+			gateway := net.ParseIP(pn.GatewayIPs[i])
+			if gateway == nil || isIPv6(gateway) != isIPv6(ip) {
+				return fmt.Errorf("invalid gateway_ips entry %q for %s", pn.GatewayIPs[i], address)
+			}
+			if families[isIPv6(ip)] {
+				return fmt.Errorf("ip_addresses %v has two addresses of the same family", pn.IPAddresses)
+			}
+			families[isIPv6(ip)] = true
+		}
+	}
+	for _, route := range pn.Routes {
+		if _, _, err := net.ParseCIDR(route.Dest); err != nil {
+			return fmt.Errorf("invalid route dest %q: %v", route.Dest, err)
+		}
+		if route.NextHop != "" && net.ParseIP(route.NextHop) == nil {
+			return fmt.Errorf("invalid route nexthop %q", route.NextHop)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package annotation
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPodNetwork(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		pn    *PodNetwork
+	}{
+		{
+			name:  "unversioned annotation",
+			value: `{"ip_address":"10.128.1.2/24", "mac_address":"0a:00:0a:80:01:02", "gateway_ip": "10.128.1.1"}`,
+			pn: &PodNetwork{
+				Version:    1,
+				IPAddress:  "10.128.1.2/24",
+				MACAddress: "0a:00:0a:80:01:02",
+				GatewayIP:  "10.128.1.1",
+			},
+		},
+		{
+			name:  "routes",
+			value: `{"version":1,"ip_address":"10.128.1.2/24","mac_address":"0a:00:0a:80:01:02","gateway_ip":"10.128.1.1","routes":[{"dest":"172.30.0.0/16"},{"dest":"10.0.0.0/8","nexthop":"10.128.1.254"}]}`,
+			pn: &PodNetwork{
+				Version:    1,
+				IPAddress:  "10.128.1.2/24",
+				MACAddress: "0a:00:0a:80:01:02",
+				GatewayIP:  "10.128.1.1",
+				Routes: []PodRoute{
+					{Dest: "172.30.0.0/16"},
+					{Dest: "10.0.0.0/8", NextHop: "10.128.1.254"},
+				},
+			},
+		},
+		{
+			name:  "dual stack",
+			value: `{"version":1,"ip_address":"10.128.1.2/24","mac_address":"0a:00:0a:80:01:02","gateway_ip":"10.128.1.1","ip_addresses":["10.128.1.2/24","fd00:10:128:1::2/64"],"gateway_ips":["10.128.1.1","fd00:10:128:1::1"]}`,
+			pn: &PodNetwork{
+				Version:     1,
+				IPAddress:   "10.128.1.2/24",
+				MACAddress:  "0a:00:0a:80:01:02",
+				GatewayIP:   "10.128.1.1",
+				IPAddresses: []string{"10.128.1.2/24", "fd00:10:128:1::2/64"},
+				GatewayIPs:  []string{"10.128.1.1", "fd00:10:128:1::1"},
+			},
+		},
+		{
+			name:  "IPv6",
+			value: `{"version":1,"ip_address":"fd00:10:128:1::2/64","mac_address":"0a:00:00:00:00:02","gateway_ip":"fd00:10:128:1::1"}`,
+			pn: &PodNetwork{
+				Version:    1,
+				IPAddress:  "fd00:10:128:1::2/64",
+				MACAddress: "0a:00:00:00:00:02",
+				GatewayIP:  "fd00:10:128:1::1",
+			},
+		},
+		{name: "not json", value: `ip_address=10.128.1.2/24`},
+		{name: "dual stack gateway of another family", value: `{"ip_address":"10.128.1.2/24","mac_address":"0a:00:0a:80:01:02","gateway_ip":"10.128.1.1","ip_addresses":["10.128.1.2/24","fd00:10:128:1::2/64"],"gateway_ips":["10.128.1.1","10.128.1.1"]}`},
+		{name: "dual stack without ip_address first", value: `{"ip_address":"10.128.1.2/24","mac_address":"0a:00:0a:80:01:02","gateway_ip":"10.128.1.1","ip_addresses":["fd00:10:128:1::2/64"],"gateway_ips":["fd00:10:128:1::1"]}`},
+		{name: "newer version", value: `{"version":2,"ip_address":"10.128.1.2/24","mac_address":"0a:00:0a:80:01:02","gateway_ip":"10.128.1.1"}`},
+		{name: "address without prefix", value: `{"ip_address":"10.128.1.2","mac_address":"0a:00:0a:80:01:02","gateway_ip":"10.128.1.1"}`},
+		{name: "invalid mac", value: `{"ip_address":"10.128.1.2/24","mac_address":"0a:00","gateway_ip":"10.128.1.1"}`},
+		{name: "invalid route", value: `{"ip_address":"10.128.1.2/24","mac_address":"0a:00:0a:80:01:02","gateway_ip":"10.128.1.1","routes":[{"dest":"default"}]}`},
+	}
+
+	for _, test := range tests {
+		pn, err := UnmarshalPodNetwork(test.value)
+		if test.pn == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, pn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(pn, test.pn) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.pn, pn)
+		}
+
+		value, err := MarshalPodNetwork(pn)
+		if err != nil {
+			t.Errorf("%s: marshal failed: %v", test.name, err)
+			continue
+		}
+		again, err := UnmarshalPodNetwork(value)
+		if err != nil || !reflect.DeepEqual(again, test.pn) {
+			t.Errorf("%s: round trip through %s gave %+v (%v)", test.name, value, again, err)
+		}
+	}
+}
+
+func TestPodNetworkGateway(t *testing.T) {
+	pn := &PodNetwork{
+		IPAddress:   "10.128.1.2/24",
+		GatewayIP:   "10.128.1.1",
+		IPAddresses: []string{"10.128.1.2/24", "fd00:10:128:1::2/64"},
+		GatewayIPs:  []string{"10.128.1.1", "fd00:10:128:1::1"},
+	}
+	if gw := pn.Gateway(net.ParseIP("172.30.0.1")); gw != "10.128.1.1" {
+		t.Errorf("expected the IPv4 gateway, got %q", gw)
+	}
+	if gw := pn.Gateway(net.ParseIP("fd00:172:30::1")); gw != "fd00:10:128:1::1" {
+		t.Errorf("expected the IPv6 gateway, got %q", gw)
+	}
+	pn = &PodNetwork{IPAddress: "10.128.1.2/24", GatewayIP: "10.128.1.1"}
+	if gw := pn.Gateway(net.ParseIP("fd00:172:30::1")); gw != "" {
+		t.Errorf("expected no IPv6 gateway for an IPv4 pod, got %q", gw)
+	}
+}
@@ -0,0 +1,203 @@
+package cluster
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+)
+
+// subnetAllocator hands out the host subnets of the cluster networks of each
+// IP family, from the first network of the family until it is exhausted and
+// then from the next, and keeps track of the ones in use, including the ones
+// found on the nodes
+type subnetAllocator struct {
+	mutex  sync.Mutex
+	ranges []*subnetRange
+}
+
+// subnetRange is a cluster network with the host subnets allocated in it
+type subnetRange struct {
+	network   *net.IPNet
+	prefixLen int
+	next      uint64
+	allocated map[string]bool
+}
+
+func newSubnetAllocator() *subnetAllocator {
+	return &subnetAllocator{}
+}
+
+// addRange adds a cluster network to draw host subnets of prefixLen from
+func (a *subnetAllocator) addRange(network *net.IPNet, prefixLen int) error {
+	ones, bits := network.Mask.Size()
+	if prefixLen <= ones || prefixLen > bits {
+		return fmt.Errorf("host subnets of /%d do not fit in the cluster network %s", prefixLen, network)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, r := range a.ranges {
+		if r.network.Contains(network.IP) || network.Contains(r.network.IP) {
+			return fmt.Errorf("cluster network %s overlaps %s", network, r.network)
+		}
+	}
+	a.ranges = append(a.ranges, &subnetRange{
+		network:   network,
+		prefixLen: prefixLen,
+		allocated: make(map[string]bool),
+	})
+	return nil
+}
+
+// networks returns the cluster networks as a comma separated list
+func (a *subnetAllocator) networks() string {
+	networks := make([]string, 0, len(a.ranges))
+	for _, r := range a.ranges {
+		networks = append(networks, r.network.String())
+	}
+	return strings.Join(networks, ",")
+}
+
+// families returns the IP families of the cluster networks, in the order of
+// their first network
+func (a *subnetAllocator) families() []ipFamily {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	families := make([]ipFamily, 0, 2)
+	seen := make(map[ipFamily]bool)
+	for _, r := range a.ranges {
+		if f := familyOf(r.network.IP); !seen[f] {
+			seen[f] = true
+			families = append(families, f)
+		}
+	}
+	return families
+}
+
+// count returns the number of host subnets of the range, up to 2^63
+func (r *subnetRange) count() uint64 {
+	ones, _ := r.network.Mask.Size()
+	n := uint(r.prefixLen - ones)
+	if n > 63 {
+		n = 63
+	}
+	return 1 << n
+}
+
+// subnet returns the host subnet at index of the range
+func (r *subnetRange) subnet(index uint64) *net.IPNet {
+	_, bits := r.network.Mask.Size()
+	offset := new(big.Int).Lsh(new(big.Int).SetUint64(index), uint(bits-r.prefixLen))
+	sum := new(big.Int).Add(new(big.Int).SetBytes(r.network.IP), offset).Bytes()
+	ip := make(net.IP, len(r.network.IP))
+	copy(ip[len(ip)-len(sum):], sum)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(r.prefixLen, bits)}
+}
+
+// allocate returns the next free host subnet of the range, nil if there is
+// none left
+func (r *subnetRange) allocate() *net.IPNet {
+	count := r.count()
+	for i := uint64(0); i < count; i++ {
+		index := (r.next + i) % count
+		subnet := r.subnet(index)
+		if !r.allocated[subnet.String()] {
+			r.allocated[subnet.String()] = true
+			r.next = index + 1
+			return subnet
+		}
+	}
+	return nil
+}
+
+// rangeOf returns the range of the cluster network that contains the subnet
+func (a *subnetAllocator) rangeOf(subnet *net.IPNet) *subnetRange {
+	for _, r := range a.ranges {
+		if r.network.Contains(subnet.IP) {
+			return r
+		}
+	}
+	return nil
+}
+
+// validate parses a host subnet, which must be a subnet of a cluster network
+// with the host subnet prefix length of that network
+func (a *subnetAllocator) validate(subnet string) (*net.IPNet, error) {
+	ip, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a subnet", subnet)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	r := a.rangeOf(ipnet)
+	if r == nil {
+		return nil, fmt.Errorf("%s is out of the cluster networks %s", subnet, a.networks())
+	}
+	if ones, _ := ipnet.Mask.Size(); ones != r.prefixLen {
+		return nil, fmt.Errorf("%s is not a /%d host subnet of %s", subnet, r.prefixLen, r.network)
+	}
+	if !ip.Equal(ipnet.IP) {
+		return nil, fmt.Errorf("%s is not the address of a subnet, %s is", subnet, ipnet)
+	}
+	return ipnet, nil
+}
+
+// markAllocated records a subnet as in use, it fails when it already is
+func (a *subnetAllocator) markAllocated(subnet *net.IPNet) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	r := a.rangeOf(subnet)
+	if r == nil {
+		return fmt.Errorf("%s is out of the cluster networks %s", subnet, a.networks())
+	}
+	if r.allocated[subnet.String()] {
+		return fmt.Errorf("%s is already in use", subnet)
+	}
+	r.allocated[subnet.String()] = true
+	return nil
+}
+
+// allocate returns the next free host subnet of the family
+func (a *subnetAllocator) allocate(family ipFamily) (*net.IPNet, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, r := range a.ranges {
+		if familyOf(r.network.IP) != family {
+			continue
+		}
+		if subnet := r.allocate(); subnet != nil {
+			return subnet, nil
+		}
+	}
+	return nil, fmt.Errorf("no free %s host subnet left in the cluster networks %s", family, a.networks())
+}
+
+// allocateFirst returns the first host subnet of the cluster network, which
+// must be free
+func (a *subnetAllocator) allocateFirst(network *net.IPNet) (*net.IPNet, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	r := a.rangeOf(network)
+	if r == nil {
+		return nil, fmt.Errorf("%s is not a cluster network", network)
+	}
+	subnet := r.subnet(0)
+	if r.allocated[subnet.String()] {
+		return nil, fmt.Errorf("%s is already in use", subnet)
+	}
+	r.allocated[subnet.String()] = true
+	return subnet, nil
+}
+
+// release returns a host subnet to the pool
+func (a *subnetAllocator) release(subnet *net.IPNet) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	r := a.rangeOf(subnet)
+	if r == nil || !r.allocated[subnet.String()] {
+		return fmt.Errorf("%s is not allocated", subnet)
+	}
+	delete(r.allocated, subnet.String())
+	return nil
+}
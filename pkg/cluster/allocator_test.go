@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// newTestAllocator returns an allocator of the network with the given
+// subnets in use
+func newTestAllocator(t *testing.T, network string, prefixLen int, inUse ...string) *subnetAllocator {
+	_, ipnet, _ := net.ParseCIDR(network)
+	a := newSubnetAllocator()
+	if err := a.addRange(ipnet, prefixLen); err != nil {
+		t.Fatal(err)
+	}
+	for _, subnet := range inUse {
+		sn, err := a.validate(subnet)
+		if err == nil {
+			err = a.markAllocated(sn)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+func TestSubnetAllocator(t *testing.T) {
+	a := newTestAllocator(t, "10.128.0.0/22", 24, "10.128.1.0/24")
+	for _, expected := range []string{"10.128.0.0/24", "10.128.2.0/24", "10.128.3.0/24"} {
+		if sn, err := a.allocate(ipv4); err != nil || sn.String() != expected {
+			t.Errorf("expected %s, got %v (%v)", expected, sn, err)
+		}
+	}
+	if sn, err := a.allocate(ipv4); err == nil {
+		t.Errorf("expected the pool to be exhausted, got %v", sn)
+	}
+
+	_, sn, _ := net.ParseCIDR("10.128.2.0/24")
+	if err := a.release(sn); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.release(sn); err == nil {
+		t.Errorf("expected an error releasing a free subnet")
+	}
+	if err := a.markAllocated(sn); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.markAllocated(sn); err == nil {
+		t.Errorf("expected an error marking a subnet in use")
+	}
+
+	// host subnets that do not end on an octet
+	a = newTestAllocator(t, "10.128.0.0/14", 26)
+	for _, expected := range []string{"10.128.0.0/26", "10.128.0.64/26"} {
+		if sn, err := a.allocate(ipv4); err != nil || sn.String() != expected {
+			t.Errorf("expected %s, got %v (%v)", expected, sn, err)
+		}
+	}
+	if err := newSubnetAllocator().addRange(sn, 24); err == nil {
+		t.Errorf("expected an error for host subnets as large as the network")
+	}
+}
+
+func TestSubnetAllocatorRanges(t *testing.T) {
+	a := newTestAllocator(t, "10.128.0.0/23", 24)
+	_, second, _ := net.ParseCIDR("10.132.0.0/22")
+	if err := a.addRange(second, 23); err != nil {
+		t.Fatal(err)
+	}
+	_, overlapping, _ := net.ParseCIDR("10.128.0.0/16")
+	if err := a.addRange(overlapping, 24); err == nil {
+		t.Errorf("expected an error for an overlapping cluster network")
+	}
+
+	// the second network is drawn from once the first is exhausted
+	if sn, err := a.allocateFirst(second); err != nil || sn.String() != "10.132.0.0/23" {
+		t.Errorf("expected the first subnet of the second network, got %v (%v)", sn, err)
+	}
+	for _, expected := range []string{"10.128.0.0/24", "10.128.1.0/24", "10.132.2.0/23"} {
+		if sn, err := a.allocate(ipv4); err != nil || sn.String() != expected {
+			t.Errorf("expected %s, got %v (%v)", expected, sn, err)
+		}
+	}
+	if sn, err := a.allocate(ipv4); err == nil {
+		t.Errorf("expected the pools to be exhausted, got %v", sn)
+	}
+
+	// each network has its own host prefix length
+	if _, err := a.validate("10.132.2.0/23"); err != nil {
+		t.Error(err)
+	}
+	if _, err := a.validate("10.132.2.0/24"); err == nil {
+		t.Errorf("expected an error for a host subnet of the prefix length of the other network")
+	}
+}
+
+func TestSubnetAllocatorFamilies(t *testing.T) {
+	a := newTestAllocator(t, "fd00:10:128::/63", 64)
+	_, network4, _ := net.ParseCIDR("10.128.0.0/23")
+	if err := a.addRange(network4, 24); err != nil {
+		t.Fatal(err)
+	}
+	if families := a.families(); !reflect.DeepEqual(families, []ipFamily{ipv6, ipv4}) {
+		t.Errorf("expected the IPv6 and IPv4 families, got %v", families)
+	}
+	// each family is drawn from its own networks
+	for _, expected := range []string{"fd00:10:128::/64", "fd00:10:128:1::/64"} {
+		if sn, err := a.allocate(ipv6); err != nil || sn.String() != expected {
+			t.Errorf("expected %s, got %v (%v)", expected, sn, err)
+		}
+	}
+	if sn, err := a.allocate(ipv6); err == nil {
+		t.Errorf("expected the IPv6 pool to be exhausted, got %v", sn)
+	}
+	if sn, err := a.allocate(ipv4); err != nil || sn.String() != "10.128.0.0/24" {
+		t.Errorf("expected 10.128.0.0/24, got %v (%v)", sn, err)
+	}
+	if _, err := a.validate("fd00:10:128:1::/64"); err != nil {
+		t.Error(err)
+	}
+	if _, err := a.validate("fd00:10:128:1::/80"); err == nil {
+		t.Errorf("expected an error for an IPv6 host subnet that is not /64")
+	}
+}
+
+func TestValidateSubnet(t *testing.T) {
+	a := newTestAllocator(t, "10.128.0.0/14", 24)
+	tests := []struct {
+		subnet string
+		valid  bool
+	}{
+		{"10.128.1.0/24", true},
+		{"10.131.255.0/24", true},
+		{"10.132.0.0/24", false},
+		{"10.128.1.0/25", false},
+		{"10.128.1.5/24", false},
+		{"10.128.1.0", false},
+		{"fd00::/24", false},
+	}
+	for _, test := range tests {
+		if _, err := a.validate(test.subnet); (err == nil) != test.valid {
+			t.Errorf("expected %s to be valid: %v, got %v", test.subnet, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package cluster
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	kapi "k8s.io/client-go/pkg/api/v1"
+
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+)
+
+// ownedByNode tells if a switch or router belongs to the node, by its
+// external_ids or, when it was set up before they were tagged, by its name
+func ownedByNode(name string, externalIDs map[string]string, nodeName string, names ...string) bool {
+	if externalIDs[OVN_MASTER_SWITCH] != "" || name == OVN_JOIN_SWITCH || name == OVN_CLUSTER_ROUTER {
+		return false
+	}
+	if owner, ok := externalIDs[OVN_NODE_OWNER]; ok {
+		return owner == nodeName
+	}
+	for _, n := range names {
+		if name == n {
+			return true
+		}
+	}
+	return false
+}
+
+// teardownNode removes the logical topology of the node: its switch with the
+// router port and the route of its subnet on the cluster router, its gateway
+// router with its load balancers, join port and external switch, and its
+// chassis from the southbound database. What is already gone is skipped, so
+// that it can be run again when it fails.
+func (cluster *OvnClusterController) teardownNode(nodeName string) error {
+	nb := cluster.OvnNB
+	chassis := make(map[string]bool)
+	subnets := make(map[string]bool)
+	switches := make(map[string]bool)
+	for _, ls := range nb.LogicalSwitches() {
+		if ownedByNode(ls.Name, ls.ExternalIDs, nodeName, nodeName, "ext_"+nodeName) {
+			switches[ls.UUID] = true
+			if id := ls.ExternalIDs[OVN_NODE_CHASSIS]; id != "" {
+				chassis[id] = true
+			}
+			if subnet := ls.OtherConfig["subnet"]; subnet != "" {
+				subnets[subnet] = true
+			}
+		}
+	}
+	routers := make(map[string]bool)
+	routerNames := make(map[string]bool)
+	for _, lr := range nb.LogicalRouters() {
+		if ownedByNode(lr.Name, lr.ExternalIDs, nodeName, "GR_"+nodeName) {
+			routers[lr.UUID] = true
+			routerNames[lr.Name] = true
+			if id := lr.Options["chassis"]; id != "" {
+				chassis[id] = true
+			}
+		}
+	}
+
+	// the names of the chassis are only known from the northbound rows,
+	// which are removed after them
+	err := cluster.deleteChassis(nodeName, chassis)
+	if err != nil {
+		return err
+	}
+
+	txn := newNBTransaction(nb)
+	routerPortRows := nb.Rows(ovsdb.LogicalRouterPortTable)
+	routerPorts := make(map[string]bool)
+	for _, lr := range nb.LogicalRouters() {
+		if !routers[lr.UUID] {
+			continue
+		}
+		for _, port := range lr.Ports {
+			routerPorts[routerPortRows[port].String("name")] = true
+			txn.delete(ovsdb.LogicalRouterPortTable, ovsdb.UUID{GoUUID: port})
+		}
+		for _, route := range lr.StaticRoutes {
+			txn.delete(ovsdb.StaticRouteTable, ovsdb.UUID{GoUUID: route})
+		}
+		for _, nat := range lr.Nat {
+			txn.delete(ovsdb.NATTable, ovsdb.UUID{GoUUID: nat})
+		}
+		txn.delete(ovsdb.LogicalRouterTable, ovsdb.UUID{GoUUID: lr.UUID})
+	}
+
+	// the switches of the node go with their ports, the other switches lose
+	// their ports to the routers of the node, e.g. the join switch
+	switchPortRows := nb.Rows(ovsdb.LogicalSwitchPortTable)
+	for _, ls := range nb.LogicalSwitches() {
+		for _, port := range ls.Ports {
+			peer := switchPortRows[port].StringMap("options")["router-port"]
+			if switches[ls.UUID] {
+				if peer != "" {
+					routerPorts[peer] = true
+				}
+				txn.delete(ovsdb.LogicalSwitchPortTable, ovsdb.UUID{GoUUID: port})
+			} else if peer != "" && routerPorts[peer] {
+				txn.detach(ovsdb.LogicalSwitchTable, ovsdb.UUID{GoUUID: ls.UUID}, "ports", ovsdb.UUID{GoUUID: port})
+				txn.delete(ovsdb.LogicalSwitchPortTable, ovsdb.UUID{GoUUID: port})
+			}
+		}
+		if switches[ls.UUID] {
+			txn.delete(ovsdb.LogicalSwitchTable, ovsdb.UUID{GoUUID: ls.UUID})
+		}
+	}
+
+	// the other routers, e.g. the cluster router, lose their ports to the
+	// switches of the node and the routes of its subnet
+	routeRows := nb.Rows(ovsdb.StaticRouteTable)
+	for _, lr := range nb.LogicalRouters() {
+		if routers[lr.UUID] {
+			continue
+		}
+		uuid := ovsdb.UUID{GoUUID: lr.UUID}
+		for _, port := range lr.Ports {
+			if routerPorts[routerPortRows[port].String("name")] {
+				txn.detach(ovsdb.LogicalRouterTable, uuid, "ports", ovsdb.UUID{GoUUID: port})
+				txn.delete(ovsdb.LogicalRouterPortTable, ovsdb.UUID{GoUUID: port})
+			}
+		}
+		for _, route := range lr.StaticRoutes {
+			if subnets[routeRows[route].String("ip_prefix")] {
+				txn.detach(ovsdb.LogicalRouterTable, uuid, "static_routes", ovsdb.UUID{GoUUID: route})
+				txn.delete(ovsdb.StaticRouteTable, ovsdb.UUID{GoUUID: route})
+			}
+		}
+	}
+
+	for _, lb := range nb.LoadBalancers() {
+		for _, protocol := range lbProtocols {
+			if routerNames[lb.ExternalIDs["k8s-gateway-lb-"+protocol]] {
+				txn.delete(ovsdb.LoadBalancerTable, ovsdb.UUID{GoUUID: lb.UUID})
+				break
+			}
+		}
+	}
+
+	if len(txn.ops) == 0 {
+		return nil
+	}
+	err = txn.commit()
+	if err != nil {
+		return fmt.Errorf("Error removing the logical topology of node %s - %v", nodeName, err)
+	}
+	glog.Infof("Removed the logical topology of node %s", nodeName)
+	return nil
+}
+
+// deleteChassis removes the chassis of the node from the southbound database,
+// the ones with the given names and the ones registered with its hostname
+func (cluster *OvnClusterController) deleteChassis(nodeName string, names map[string]bool) error {
+	if cluster.OvnSB == nil {
+		return nil
+	}
+	txn := newSBTransaction(cluster.OvnSB)
+	for _, ch := range cluster.OvnSB.Chassis() {
+		if names[ch.Name] || ch.Hostname == nodeName {
+			txn.delete(ovsdb.ChassisTable, ovsdb.UUID{GoUUID: ch.UUID})
+		}
+	}
+	err := txn.commit()
+	if err != nil {
+		return fmt.Errorf("Error deleting the chassis of node %s - %v", nodeName, err)
+	}
+	return nil
+}
+
+// teardownDeletedNodes removes the topology of the nodes that were deleted
+// while the master was down, the ones that own switches or routers but are
+// not among the given nodes
+func (cluster *OvnClusterController) teardownDeletedNodes(nodes []kapi.Node) {
+	existing := make(map[string]bool)
+	for _, node := range nodes {
+		existing[node.Name] = true
+	}
+	owners := make(map[string]bool)
+	for _, ls := range cluster.OvnNB.LogicalSwitches() {
+		if owner := ls.ExternalIDs[OVN_NODE_OWNER]; owner != "" {
+			owners[owner] = true
+		}
+	}
+	for _, lr := range cluster.OvnNB.LogicalRouters() {
+		if owner := lr.ExternalIDs[OVN_NODE_OWNER]; owner != "" {
+			owners[owner] = true
+		}
+	}
+	for owner := range owners {
+		if existing[owner] {
+			continue
+		}
+		err := cluster.teardownNode(owner)
+		if err != nil {
+			glog.Errorf("Error cleaning up deleted node %s: %v", owner, err)
+		}
+	}
+}
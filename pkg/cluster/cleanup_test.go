@@ -0,0 +1,184 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	listers "k8s.io/client-go/listers/core/v1"
+	kapi "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+)
+
+// waitFor polls until the condition holds in the cache
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never reached the cache", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func chassisNames(client *ovsdb.Client) map[string]bool {
+	names := make(map[string]bool)
+	for _, ch := range client.Chassis() {
+		names[ch.Name] = true
+	}
+	return names
+}
+
+func TestDeleteNode(t *testing.T) {
+	n := newTestNode(t)
+	defer n.close()
+	n.setup(t)
+	cluster := n.cluster
+	nbClient := cluster.OvnNB
+	sbServer, sbClient := newTestClient(t, ovsdb.SBDatabase, ovsdb.SBTables)
+	defer sbServer.Close()
+	defer sbClient.Close()
+	cluster.OvnSB = sbClient
+
+	// node1 has a gateway, node2 has not and another chassis
+	cluster.GatewayInterface = "eth1"
+	cluster.GatewayIP = "192.168.1.10/24"
+	cluster.GatewayNextHop = "192.168.1.1"
+	if err := cluster.SetupNode("node1", "10.0.0.2", "10.128.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	root, _ := cluster.OvsDB.OpenvSwitchRoot()
+	n.ovsServer.Update(ovsdb.OpenvSwitchTable, root.UUID, ovsdb.Row{
+		"external_ids": ovsdb.NewOvsMap(map[string]string{"system-id": "chassis2"}),
+	})
+	waitFor(t, "the system-id", func() bool {
+		root, _ := cluster.OvsDB.OpenvSwitchRoot()
+		return root.ExternalIDs["system-id"] == "chassis2"
+	})
+	cluster.GatewayInterface = ""
+	if err := cluster.SetupNode("node2", "10.0.0.3", "10.128.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	// the chassis of node1 and one it registered before under its hostname
+	sbServer.Insert(ovsdb.ChassisTable, ovsdb.Row{"name": "chassis1", "hostname": "host1"})
+	sbServer.Insert(ovsdb.ChassisTable, ovsdb.Row{"name": "old1", "hostname": "node1"})
+	sbServer.Insert(ovsdb.ChassisTable, ovsdb.Row{"name": "chassis2", "hostname": "host2"})
+	waitFor(t, "the chassis", func() bool { return len(sbClient.Chassis()) == 3 })
+
+	allocator := newTestAllocator(t, "10.128.0.0/22", 24, "10.128.0.0/24", "10.128.1.0/24", "10.128.2.0/24")
+	cluster.masterSubnetAllocator = allocator
+	cluster.setNodeSubnet("node1", OVN_HOST_SUBNET, "10.128.1.0/24")
+	node := &kapi.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node1",
+			Annotations: map[string]string{OVN_HOST_SUBNET: "10.128.1.0/24"},
+		},
+	}
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	cluster.NodeLister = listers.NewNodeLister(nodes)
+	cluster.nodeQueue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, 10*time.Millisecond))
+	defer cluster.nodeQueue.ShutDown()
+
+	// the southbound database is down, the teardown of the deleted node
+	// fails and its subnet is kept
+	downServer, downClient := newTestClient(t, ovsdb.SBDatabase, ovsdb.SBTables)
+	defer downClient.Close()
+	downServer.Insert(ovsdb.ChassisTable, ovsdb.Row{"name": "chassis1", "hostname": "node1"})
+	waitFor(t, "the chassis", func() bool { return len(downClient.Chassis()) == 1 })
+	downServer.Close()
+	cluster.OvnSB = downClient
+	cluster.queueNode("Delete", node)
+	cluster.processNextNode()
+	if _, err := nbClient.LogicalSwitchByName("node1"); err != nil {
+		t.Errorf("expected the logical switch of node1 to be kept when the teardown fails")
+	}
+	if _, ok := cluster.nodeSubnet("node1", OVN_HOST_SUBNET); !ok {
+		t.Errorf("expected the subnet of node1 to be kept when the teardown fails")
+	}
+
+	// the node registers again before the retry, which keeps it
+	nodes.Add(node)
+	cluster.processNextNode()
+	if _, err := nbClient.LogicalSwitchByName("node1"); err != nil {
+		t.Errorf("expected the logical switch of the registered node1 to be kept")
+	}
+
+	// and is deleted again, the retry once the database is back removes it
+	nodes.Delete(node)
+	cluster.queueNode("Delete", node)
+	cluster.processNextNode()
+	cluster.OvnSB = sbClient
+	cluster.processNextNode()
+	if cluster.nodeQueue.Len() != 0 {
+		t.Errorf("expected no node left in the queue, got %d", cluster.nodeQueue.Len())
+	}
+	// a second teardown finds nothing left to remove
+	if err := cluster.teardownNode("node1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"node1", "ext_node1"} {
+		if _, err := nbClient.LogicalSwitchByName(name); err == nil {
+			t.Errorf("expected the logical switch %s to be removed", name)
+		}
+	}
+	if _, err := nbClient.LogicalRouterByName("GR_node1"); err == nil {
+		t.Errorf("expected the gateway router to be removed")
+	}
+	for _, name := range []string{"stor-node1", "k8s-node1", "jtor-GR_node1", "etor-GR_node1", "eth1_node1"} {
+		if _, err := nbClient.LogicalSwitchPortByName(name); err == nil {
+			t.Errorf("expected the logical switch port %s to be removed", name)
+		}
+	}
+	for _, name := range []string{"rtos-node1", "rtoj-GR_node1", "rtoe-GR_node1"} {
+		if _, err := nbClient.LogicalRouterPortByName(name); err == nil {
+			t.Errorf("expected the logical router port %s to be removed", name)
+		}
+	}
+	ports := routerPortNames(t, nbClient, OVN_CLUSTER_ROUTER)
+	expected := []string{"rtoj-ovn_cluster_router", "rtos-master", "rtos-node2"}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("expected cluster router ports %v, got %v", expected, ports)
+	}
+	if routes := routerRoutes(t, nbClient, OVN_CLUSTER_ROUTER); len(routes) != 0 {
+		t.Errorf("expected the route of node1 to be removed, got %v", routes)
+	}
+	join, _ := nbClient.LogicalSwitchByName(OVN_JOIN_SWITCH)
+	if len(join.Ports) != 1 {
+		t.Errorf("expected the join switch to keep only the cluster router port, got %v", join.Ports)
+	}
+	for _, lb := range nbClient.LoadBalancers() {
+		for _, protocol := range lbProtocols {
+			if _, ok := lb.ExternalIDs["k8s-gateway-lb-"+protocol]; ok {
+				t.Errorf("expected the gateway load balancers to be removed, got %+v", lb)
+			}
+		}
+	}
+	if names := chassisNames(sbClient); !reflect.DeepEqual(names, map[string]bool{"chassis2": true}) {
+		t.Errorf("expected only the chassis of node2 to be left, got %v", names)
+	}
+	if sn, err := allocator.allocate(ipv4); err != nil || sn.String() != "10.128.1.0/24" {
+		t.Errorf("expected the subnet of node1 to be released, got %v (%v)", sn, err)
+	}
+
+	// the master switch is kept, even for a node of the same name
+	if err := cluster.teardownNode("master"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nbClient.LogicalSwitchByName("master"); err != nil {
+		t.Errorf("expected the master switch to be kept")
+	}
+
+	// node2 is deleted while the master is down
+	cluster.teardownDeletedNodes(nil)
+	if _, err := nbClient.LogicalSwitchByName("node2"); err == nil {
+		t.Errorf("expected the logical switch of the deleted node2 to be removed")
+	}
+	if len(sbClient.Chassis()) != 0 {
+		t.Errorf("expected the chassis of node2 to be removed, got %v", chassisNames(sbClient))
+	}
+}
@@ -1,26 +1,220 @@
 package cluster
 
 import (
+	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 
-	"github.com/openshift/origin/pkg/util/netutils"
 	"github.com/rajatchopra/ovn-kube/pkg/kube"
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+	listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
 type OvnClusterController struct {
-	Kube                  kube.KubeInterface
-	masterSubnetAllocator *netutils.SubnetAllocator
+	Kube  kube.KubeInterface
+	OvnNB *ovsdb.Client
+	// OvnSB is the southbound database of the master, the chassis of the
+	// deleted nodes are removed from it when set
+	OvnSB                 *ovsdb.Client
+	masterSubnetAllocator *subnetAllocator
+	// nodeSubnets are the subnets the master allocated, by node name and
+	// annotation key, that the annotations of the nodes are held to
+	nodeSubnets map[string]map[string]string
+	subnetMutex sync.Mutex
 
-	KubeServer       string
-	CACert           string
-	Token            string
-	ClusterIPNet     *net.IPNet
-	HostSubnetLength uint32
+	// OvsDB is the local Open_vSwitch database of a node
+	OvsDB *ovsdb.Client
+	// Exec runs a command on the host and returns its combined output
+	Exec func(cmd string, args ...string) (string, error)
 
-	StartNodeWatch func(handler cache.ResourceEventHandler)
+	KubeServer string
+	CACert     string
+	Token      string
+	// ClusterNetworks are the networks the host subnets are drawn from, in
+	// order, the nodes get a host subnet of each IP family of the networks
+	ClusterNetworks []ClusterNetwork
+
+	// SouthboundAddress is the ovn-remote of ovn-controller on the nodes
+	SouthboundAddress string
+	// EncapType is the tunnel type of the node, and EncapIP its tunnel
+	// endpoint, the node ip when empty
+	EncapType string
+	EncapIP   string
+
+	// GatewayInterface is the interface, or OVS bridge, that connects the
+	// gateway router of a node to the physical network. The nodes have no
+	// gateway router when it is empty.
+	GatewayInterface string
+	// GatewayIP is the address of the gateway router on the physical network
+	// with its prefix length, the node ip when empty
+	GatewayIP string
+	// GatewayNextHop is the default gateway of the physical network
+	GatewayNextHop string
+
+	// StartNodeWatch watches all the nodes, StartLocalNodeWatch only the node
+	// of the given name
+	StartNodeWatch      func(handler cache.ResourceEventHandler)
+	StartLocalNodeWatch func(name string, handler cache.ResourceEventHandler)
+	// NodeLister lists the nodes of the node watch of the master
+	NodeLister listers.NodeLister
+	// nodeQueue holds the names of the nodes the master has to sync
+	nodeQueue workqueue.RateLimitingInterface
 }
 
 const (
-	OVN_HOST_SUBNET = "ovn_host_subnet"
+	// the node annotations with the IPv4 and the IPv6 host subnet of the node
+	OVN_HOST_SUBNET    = "ovn_host_subnet"
+	OVN_HOST_SUBNET_V6 = "ovn_host_subnet_v6"
+
+	// the distributed router all the node switches are connected to
+	OVN_CLUSTER_ROUTER = "ovn_cluster_router"
+	// the switch that connects the gateway routers to the cluster router, on
+	// a subnet of 100.64.0.0/10 sized for the cluster, see joinSubnet
+	OVN_JOIN_SWITCH = "join"
+	// the address of the cluster router on the join switch, the one it had
+	// on the former 100.64.1.0/24 join subnet
+	OVN_JOIN_ROUTER_IP = "100.64.1.1"
+	// the group of the load balancers of single services, on every node
+	// switch and gateway router
+	OVN_CLUSTER_LB_GROUP = "k8s-cluster-lb-group"
+
+	// the external_ids keys of the logical switches and routers of a node,
+	// with the name of the node and the system-id of its chassis, by which
+	// they are removed when the node is deleted
+	OVN_NODE_OWNER   = "k8s-node"
+	OVN_NODE_CHASSIS = "k8s-chassis"
+	// the external_ids key of the switch of the master, which is kept
+	OVN_MASTER_SWITCH = "k8s-master-switch"
 )
+
+// maxAnnotationAttempts is how many times the subnet annotation of a node
+// that keeps changing is tried
+const maxAnnotationAttempts = 5
+
+// lbProtocols are the protocols of the cluster and gateway load balancers
+var lbProtocols = []string{"tcp", "udp", "sctp"}
+
+// lbOptions are the options of the cluster and gateway load balancers, the
+// connections to a vip without endpoints are rejected
+var lbOptions = map[string]string{"reject": "true"}
+
+// ipFamily is the IP family of an address or a network
+type ipFamily string
+
+const (
+	ipv4 ipFamily = "IPv4"
+	ipv6 ipFamily = "IPv6"
+)
+
+// ipv6HostPrefixLength is the prefix length of the IPv6 host subnets,
+// ovn-northd only allocates addresses in an ipv6_prefix of /64
+const ipv6HostPrefixLength = 64
+
+func familyOf(ip net.IP) ipFamily {
+	if ip.To4() == nil {
+		return ipv6
+	}
+	return ipv4
+}
+
+// joinSubnet returns the subnet of the join switch, with room for the
+// cluster router and a gateway router on every IPv4 host subnet of the
+// cluster networks. It is 100.64.0.0/23 at the least, to keep the address of
+// the cluster router, and 100.64.0.0/10 at the most.
+func (cluster *OvnClusterController) joinSubnet() *net.IPNet {
+	const minPrefixLen, maxPrefixLen = 10, 23
+	// the network, broadcast and cluster router addresses
+	addresses := uint64(3)
+	for _, network := range cluster.ClusterNetworks {
+		if familyOf(network.CIDR.IP) != ipv4 {
+			continue
+		}
+		ones, _ := network.CIDR.Mask.Size()
+		if network.HostPrefixLength-ones >= 32-minPrefixLen {
+			addresses = 1 << (32 - minPrefixLen)
+			break
+		}
+		addresses += 1 << uint(network.HostPrefixLength-ones)
+	}
+	prefixLen := maxPrefixLen
+	for prefixLen > minPrefixLen && uint64(1)<<uint(32-prefixLen) < addresses {
+		prefixLen--
+	}
+	return &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(prefixLen, 32)}
+}
+
+// hostSubnetAnnotation returns the key of the node annotation with the host
+// subnet of the family
+func hostSubnetAnnotation(family ipFamily) string {
+	if family == ipv6 {
+		return OVN_HOST_SUBNET_V6
+	}
+	return OVN_HOST_SUBNET
+}
+
+// ClusterNetwork is a cluster CIDR with the prefix length of the host subnets
+// of the nodes drawn from it
+type ClusterNetwork struct {
+	CIDR             *net.IPNet
+	HostPrefixLength int
+}
+
+// ParseClusterNetworks parses comma separated cluster CIDRs, each optionally
+// followed by the prefix length of its host subnets, e.g. 10.128.0.0/14/23,
+// hostPrefixLength being the one of the IPv4 CIDRs that have none. The IPv6
+// CIDRs have host subnets of /64.
+func ParseClusterNetworks(networks string, hostPrefixLength int) ([]ClusterNetwork, error) {
+	parsed := make([]ClusterNetwork, 0)
+	for _, network := range strings.Split(networks, ",") {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		cidr, prefixLength := network, hostPrefixLength
+		if strings.Contains(network, ":") {
+			prefixLength = ipv6HostPrefixLength
+		}
+		if parts := strings.Split(network, "/"); len(parts) == 3 {
+			cidr = parts[0] + "/" + parts[1]
+			n, err := strconv.Atoi(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid host prefix length in cluster network %q", network)
+			}
+			prefixLength = n
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster network %q - %v", network, err)
+		}
+		ones, bits := ipnet.Mask.Size()
+		if prefixLength <= ones || prefixLength > bits {
+			return nil, fmt.Errorf("host subnets of /%d do not fit in the cluster network %s", prefixLength, ipnet)
+		}
+		if familyOf(ipnet.IP) == ipv6 && prefixLength != ipv6HostPrefixLength {
+			return nil, fmt.Errorf("the host subnets of the IPv6 cluster network %s must be /%d", ipnet, ipv6HostPrefixLength)
+		}
+		parsed = append(parsed, ClusterNetwork{CIDR: ipnet, HostPrefixLength: prefixLength})
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("no cluster network in %q", networks)
+	}
+	return parsed, nil
+}
+
+// clusterFamilies returns the IP families of the cluster networks, in the
+// order of their first network
+func (cluster *OvnClusterController) clusterFamilies() []ipFamily {
+	families := make([]ipFamily, 0, 2)
+	seen := make(map[ipFamily]bool)
+	for _, network := range cluster.ClusterNetworks {
+		if f := familyOf(network.CIDR.IP); !seen[f] {
+			seen[f] = true
+			families = append(families, f)
+		}
+	}
+	return families
+}
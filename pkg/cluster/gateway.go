@@ -0,0 +1,240 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+)
+
+// the physical network of the localnet ports on the gateway bridges
+const physicalNetworkName = "physnet"
+
+// joinAddressBackoff is how the setup of a gateway router is retried when
+// another node took the join address it picked first
+var joinAddressBackoff = wait.Backoff{Duration: 100 * time.Millisecond, Factor: 2, Steps: 8}
+
+// errJoinAddressTaken is returned when another node took the join address
+// picked from the cache first
+var errJoinAddressTaken = errors.New("join address taken by another node")
+
+// setupGateway creates the gateway router of the node, bound to the chassis of
+// the node, between the join switch and an external switch on the physical
+// network. The pods of the node reach the outside world through it, with the
+// address of the gateway as their source.
+func (cluster *OvnClusterController) setupGateway(nodeName, nodeIP, subnet string) error {
+	var err error
+	backoffErr := wait.ExponentialBackoff(joinAddressBackoff, func() (bool, error) {
+		err = cluster.setupGatewayRouter(nodeName, nodeIP, subnet)
+		if err == errJoinAddressTaken {
+			// the cache catches up with the port of the other node
+			glog.V(4).Infof("The join address of node %s was taken by another node, retrying", nodeName)
+			return false, nil
+		}
+		return true, err
+	})
+	if backoffErr == wait.ErrWaitTimeout {
+		return fmt.Errorf("Error setting up the gateway router of node %s - %v", nodeName, err)
+	}
+	return err
+}
+
+// setupGatewayRouter sets up the gateway router of the node on a free join
+// address, it returns errJoinAddressTaken when the address turns out to be
+// taken by another node
+func (cluster *OvnClusterController) setupGatewayRouter(nodeName, nodeIP, subnet string) error {
+	if cluster.GatewayNextHop == "" {
+		return fmt.Errorf("no next hop given for the gateway of node %s", nodeName)
+	}
+	var err error
+	gatewayIP := cluster.GatewayIP
+	if gatewayIP == "" {
+		gatewayIP, err = hostAddressWithPrefix(nodeIP)
+		if err != nil {
+			return err
+		}
+	}
+	externalIP, _, err := net.ParseCIDR(gatewayIP)
+	if err != nil {
+		return fmt.Errorf("invalid gateway ip %q - %v", gatewayIP, err)
+	}
+
+	root, err := cluster.OvsDB.OpenvSwitchRoot()
+	if err != nil {
+		return fmt.Errorf("no Open_vSwitch row - %v", err)
+	}
+	chassis := root.ExternalIDs["system-id"]
+	if chassis == "" {
+		return fmt.Errorf("no system-id in the Open_vSwitch external_ids of node %s", nodeName)
+	}
+	clusterRouter, err := cluster.OvnNB.LogicalRouterByName(OVN_CLUSTER_ROUTER)
+	if err != nil {
+		return fmt.Errorf("no logical router %s, is the master set up? - %v", OVN_CLUSTER_ROUTER, err)
+	}
+	join, err := cluster.OvnNB.LogicalSwitchByName(OVN_JOIN_SWITCH)
+	if err != nil {
+		return fmt.Errorf("no logical switch %s, is the master set up? - %v", OVN_JOIN_SWITCH, err)
+	}
+	lbGroup, err := cluster.OvnNB.LoadBalancerGroupByName(OVN_CLUSTER_LB_GROUP)
+	if err != nil {
+		return fmt.Errorf("no load balancer group %s, is the master set up? - %v", OVN_CLUSTER_LB_GROUP, err)
+	}
+
+	gatewayRouter := "GR_" + nodeName
+	joinAddress, free, err := cluster.joinAddress(gatewayRouter)
+	if err != nil {
+		return err
+	}
+	joinIP, _, _ := net.ParseCIDR(joinAddress)
+	clusterJoinIP := net.ParseIP(OVN_JOIN_ROUTER_IP)
+
+	txn := newNBTransaction(cluster.OvnNB)
+	joinWait := -1
+	if free {
+		// the nodes that start together pick the same address from their
+		// caches, the transactions of all but the first fail
+		joinWait = txn.waitNone(ovsdb.LogicalRouterPortTable,
+			ovsdb.NewCondition("networks", "includes", ovsdb.NewOvsSet(joinAddress)),
+			ovsdb.NewCondition("name", "!=", "rtoj-"+gatewayRouter))
+	}
+	gr := txn.logicalRouter(gatewayRouter,
+		map[string]string{"chassis": chassis},
+		map[string]string{"physical_ip": externalIP.String(), OVN_NODE_OWNER: nodeName})
+	err = txn.connectToRouter(gr, ovsdb.UUID{GoUUID: join.UUID}, "rtoj-"+gatewayRouter, "jtor-"+gatewayRouter, joinAddress)
+	if err != nil {
+		return err
+	}
+	// the pods of the node leave through its gateway router, which sends the
+	// replies back through the cluster router, the join switch and the
+	// physical network are IPv4 only
+	txn.staticRoute(ovsdb.UUID{GoUUID: clusterRouter.UUID}, subnet, joinIP.String(), "src-ip")
+	for _, network := range cluster.ClusterNetworks {
+		if familyOf(network.CIDR.IP) == ipv4 {
+			txn.staticRoute(gr, network.CIDR.String(), clusterJoinIP.String(), "")
+		}
+	}
+	txn.staticRoute(gr, "0.0.0.0/0", cluster.GatewayNextHop, "")
+	for _, network := range cluster.ClusterNetworks {
+		if familyOf(network.CIDR.IP) == ipv4 {
+			txn.snat(gr, network.CIDR.String(), externalIP.String())
+		}
+	}
+	// the node ports of the services are load balanced on the gateway
+	lbs := make([]ovsdb.UUID, 0, len(lbProtocols))
+	for _, protocol := range lbProtocols {
+		lbs = append(lbs, txn.loadBalancer(map[string]string{"k8s-gateway-lb-" + protocol: gatewayRouter}, protocol, lbOptions))
+	}
+	txn.attachRouterLoadBalancers(gr, lbs...)
+	txn.attachRouterLoadBalancerGroup(gr, ovsdb.UUID{GoUUID: lbGroup.UUID})
+
+	external := txn.logicalSwitch("ext_"+nodeName, nil, map[string]string{OVN_NODE_OWNER: nodeName})
+	err = txn.connectToRouter(gr, external, "rtoe-"+gatewayRouter, "etor-"+gatewayRouter, gatewayIP)
+	if err != nil {
+		return err
+	}
+
+	ovsTxn := newOVSTransaction(cluster.OvsDB)
+	physicalPort := cluster.GatewayInterface + "_" + nodeName
+	if _, err = cluster.OvsDB.BridgeByName(cluster.GatewayInterface); err == nil {
+		// a bridge is reached through a localnet port mapped to it
+		txn.logicalSwitchPort(external, physicalPort, ovsdb.Row{
+			"type":      "localnet",
+			"addresses": ovsdb.NewOvsSet("unknown"),
+			"options":   ovsdb.NewOvsMap(map[string]string{"network_name": physicalNetworkName}),
+		})
+		mappings := setBridgeMapping(root.ExternalIDs["ovn-bridge-mappings"], physicalNetworkName, cluster.GatewayInterface)
+		err = ovsTxn.setOpenvSwitchExternalIDs(map[string]string{"ovn-bridge-mappings": mappings})
+	} else {
+		// an interface is plugged into the integration bridge as is
+		txn.logicalSwitchPort(external, physicalPort, ovsdb.Row{
+			"addresses": ovsdb.NewOvsSet("unknown"),
+		})
+		err = ovsTxn.bridgePort("br-int", cluster.GatewayInterface, nil, map[string]string{"iface-id": physicalPort})
+	}
+	if err != nil {
+		return err
+	}
+
+	err = txn.commit()
+	if txnErr, ok := err.(*ovsdb.TransactionError); ok && txnErr.Index == joinWait {
+		return errJoinAddressTaken
+	}
+	if err != nil {
+		return fmt.Errorf("Error setting up the gateway router of node %s - %v", nodeName, err)
+	}
+	err = ovsTxn.commit()
+	if err != nil {
+		return fmt.Errorf("Error attaching the gateway of node %s to %s - %v", nodeName, cluster.GatewayInterface, err)
+	}
+	glog.Infof("Set up gateway router %s with %s on %s", gatewayRouter, gatewayIP, cluster.GatewayInterface)
+	return nil
+}
+
+// joinAddress returns the address of the gateway router on the join switch
+// and whether it was free, the one it already has, with the prefix length of
+// the join subnet, or else the first free one
+func (cluster *OvnClusterController) joinAddress(gatewayRouter string) (string, bool, error) {
+	joinSubnet := cluster.joinSubnet()
+	prefixLen, bits := joinSubnet.Mask.Size()
+	routerPort := "rtoj-" + gatewayRouter
+	used := map[string]bool{OVN_JOIN_ROUTER_IP: true}
+	for _, lrp := range cluster.OvnNB.LogicalRouterPorts() {
+		for _, network := range lrp.Networks {
+			ip, _, err := net.ParseCIDR(network)
+			if err != nil || !joinSubnet.Contains(ip) {
+				continue
+			}
+			if lrp.Name == routerPort {
+				return fmt.Sprintf("%s/%d", ip, prefixLen), false, nil
+			}
+			used[ip.String()] = true
+		}
+	}
+	// the first and the last addresses are the network and the broadcast
+	for i := 1; i < 1<<uint(bits-prefixLen)-1; i++ {
+		address, err := subnetAddress(joinSubnet.String(), i)
+		if err != nil {
+			return "", false, err
+		}
+		ip, _, _ := net.ParseCIDR(address)
+		if !used[ip.String()] {
+			return address, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("no free address left on the join switch %s for %s", joinSubnet, gatewayRouter)
+}
+
+// setBridgeMapping sets the bridge of network in the comma separated
+// network:bridge pairs of ovn-bridge-mappings
+func setBridgeMapping(mappings, network, bridge string) string {
+	pairs := []string{network + ":" + bridge}
+	for _, pair := range strings.Split(mappings, ",") {
+		if pair != "" && !strings.HasPrefix(pair, network+":") {
+			pairs = append(pairs, pair)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// hostAddressWithPrefix returns the address of the host with the prefix
+// length of its subnet
+func hostAddressWithPrefix(ip string) (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.String() == ip {
+			prefixLen, _ := ipnet.Mask.Size()
+			return fmt.Sprintf("%s/%d", ip, prefixLen), nil
+		}
+	}
+	return "", fmt.Errorf("no host interface has the address %s", ip)
+}
@@ -0,0 +1,233 @@
+package cluster
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+)
+
+// routerRoutes returns the sorted "[policy ]prefix via nexthop" routes of the router
+func routerRoutes(t *testing.T, client *ovsdb.Client, router string) []string {
+	lr, err := client.LogicalRouterByName(router)
+	if err != nil {
+		t.Fatalf("no logical router %s: %v", router, err)
+	}
+	rows := client.Rows(ovsdb.StaticRouteTable)
+	routes := make([]string, 0)
+	for _, uuid := range lr.StaticRoutes {
+		route := ovsdb.NewStaticRoute(rows[uuid])
+		prefix := route.IPPrefix
+		if route.Policy != "" {
+			prefix = route.Policy + " " + prefix
+		}
+		routes = append(routes, prefix+" via "+route.Nexthop)
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+func TestSetupGateway(t *testing.T) {
+	n := newTestNode(t)
+	defer n.close()
+	n.setup(t)
+	cluster := n.cluster
+	cluster.GatewayInterface = "eth1"
+	cluster.GatewayIP = "192.168.1.10/24"
+	cluster.GatewayNextHop = "192.168.1.1"
+	nbClient := cluster.OvnNB
+
+	// a second run must leave the same gateway
+	for i := 0; i < 2; i++ {
+		if err := cluster.SetupNode("node1", "10.0.0.2", "10.128.1.0/24"); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+
+		gr, err := nbClient.LogicalRouterByName("GR_node1")
+		if err != nil {
+			t.Fatalf("run %d: no gateway router: %v", i, err)
+		}
+		if gr.Options["chassis"] != "chassis1" || gr.ExternalIDs["physical_ip"] != "192.168.1.10" {
+			t.Errorf("run %d: unexpected gateway router %+v", i, gr)
+		}
+		ports := routerPortNames(t, nbClient, "GR_node1")
+		if !reflect.DeepEqual(ports, []string{"rtoe-GR_node1", "rtoj-GR_node1"}) {
+			t.Errorf("run %d: unexpected gateway router ports %v", i, ports)
+		}
+		lrp, err := nbClient.LogicalRouterPortByName("rtoj-GR_node1")
+		if err != nil || !reflect.DeepEqual(lrp.Networks, []string{"100.64.0.1/21"}) {
+			t.Errorf("run %d: unexpected join port %+v (%v)", i, lrp, err)
+		}
+
+		routes := routerRoutes(t, nbClient, "GR_node1")
+		expected := []string{"0.0.0.0/0 via 192.168.1.1", "10.128.0.0/14 via 100.64.1.1"}
+		if !reflect.DeepEqual(routes, expected) {
+			t.Errorf("run %d: expected gateway routes %v, got %v", i, expected, routes)
+		}
+		routes = routerRoutes(t, nbClient, OVN_CLUSTER_ROUTER)
+		expected = []string{"src-ip 10.128.1.0/24 via 100.64.0.1"}
+		if !reflect.DeepEqual(routes, expected) {
+			t.Errorf("run %d: expected cluster routes %v, got %v", i, expected, routes)
+		}
+
+		if len(gr.Nat) != 1 {
+			t.Fatalf("run %d: expected 1 nat rule, got %v", i, gr.Nat)
+		}
+		nat := ovsdb.NewNAT(nbClient.Rows(ovsdb.NATTable)[gr.Nat[0]])
+		if nat.Type != "snat" || nat.LogicalIP != "10.128.0.0/14" || nat.ExternalIP != "192.168.1.10" {
+			t.Errorf("run %d: unexpected nat rule %+v", i, nat)
+		}
+
+		lbs := nbClient.Rows(ovsdb.LoadBalancerTable)
+		protocols := make([]string, 0)
+		for _, uuid := range gr.LoadBalancer {
+			lb := ovsdb.NewLoadBalancer(lbs[uuid])
+			if lb.ExternalIDs["k8s-gateway-lb-"+lb.Protocol] == "GR_node1" {
+				protocols = append(protocols, lb.Protocol)
+			}
+		}
+		sort.Strings(protocols)
+		if !reflect.DeepEqual(protocols, []string{"sctp", "tcp", "udp"}) {
+			t.Errorf("run %d: expected the sctp, tcp and udp gateway load balancers, got %v", i, protocols)
+		}
+		if len(gr.LoadBalancerGroup) != 1 {
+			t.Errorf("run %d: expected the gateway router to have the load balancer group, got %v", i, gr.LoadBalancerGroup)
+		}
+
+		ext, err := nbClient.LogicalSwitchByName("ext_node1")
+		if err != nil || len(ext.Ports) != 2 {
+			t.Errorf("run %d: expected the external switch to have 2 ports, got %+v (%v)", i, ext, err)
+		}
+		iface, err := cluster.OvsDB.InterfaceByName("eth1")
+		if err != nil || iface.ExternalIDs["iface-id"] != "eth1_node1" {
+			t.Errorf("run %d: expected eth1 to be plugged as eth1_node1, got %+v (%v)", i, iface, err)
+		}
+	}
+
+	// the next gateway gets the next join address, on a bridge
+	cluster.GatewayInterface = "br-ex"
+	cluster.GatewayIP = "192.168.1.11/24"
+	if err := cluster.SetupNode("node2", "10.0.0.3", "10.128.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	lrp, err := nbClient.LogicalRouterPortByName("rtoj-GR_node2")
+	if err != nil || !reflect.DeepEqual(lrp.Networks, []string{"100.64.0.2/21"}) {
+		t.Errorf("unexpected join port of the second gateway %+v (%v)", lrp, err)
+	}
+	lsp, err := nbClient.LogicalSwitchPortByName("br-ex_node2")
+	if err != nil || lsp.Type != "localnet" || lsp.Options["network_name"] != physicalNetworkName {
+		t.Errorf("expected a localnet port for the bridge, got %+v (%v)", lsp, err)
+	}
+	root, _ := cluster.OvsDB.OpenvSwitchRoot()
+	if root.ExternalIDs["ovn-bridge-mappings"] != "physnet:br-ex" {
+		t.Errorf("expected the bridge mapping physnet:br-ex, got %q", root.ExternalIDs["ovn-bridge-mappings"])
+	}
+}
+
+func TestJoinAddress(t *testing.T) {
+	n := newTestNode(t)
+	defer n.close()
+	n.setup(t)
+	cluster := n.cluster
+	cluster.GatewayInterface = "eth1"
+	cluster.GatewayIP = "192.168.1.10/24"
+	cluster.GatewayNextHop = "192.168.1.1"
+	nbClient := cluster.OvnNB
+
+	// a gateway router set up on the former /24 join subnet keeps its address
+	n.nbServer.Insert(ovsdb.LogicalRouterPortTable, ovsdb.Row{"name": "rtoj-GR_node1", "networks": "100.64.1.2/24"})
+	waitFor(t, "the join port", func() bool {
+		_, err := nbClient.LogicalRouterPortByName("rtoj-GR_node1")
+		return err == nil
+	})
+	if err := cluster.SetupNode("node1", "10.0.0.2", "10.128.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	lrp, err := nbClient.LogicalRouterPortByName("rtoj-GR_node1")
+	if err != nil || !reflect.DeepEqual(lrp.Networks, []string{"100.64.1.2/21"}) {
+		t.Errorf("expected the join port to keep its address, got %+v (%v)", lrp, err)
+	}
+
+	// a node whose cache misses the router ports picks the address of node2
+	if err := cluster.SetupNode("node2", "10.0.0.3", "10.128.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := ovsdb.Dial(n.nbServer.Address(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stale.Close()
+	tables := make([]string, 0, len(ovsdb.NBTables))
+	for _, table := range ovsdb.NBTables {
+		if table != ovsdb.LogicalRouterPortTable {
+			tables = append(tables, table)
+		}
+	}
+	if err := stale.Monitor(ovsdb.NBDatabase, tables...); err != nil {
+		t.Fatal(err)
+	}
+	staleCluster := &OvnClusterController{
+		OvnNB:             stale,
+		OvsDB:             cluster.OvsDB,
+		Exec:              cluster.Exec,
+		KubeServer:        cluster.KubeServer,
+		Token:             cluster.Token,
+		ClusterNetworks:   cluster.ClusterNetworks,
+		SouthboundAddress: cluster.SouthboundAddress,
+		GatewayInterface:  cluster.GatewayInterface,
+		GatewayIP:         cluster.GatewayIP,
+		GatewayNextHop:    cluster.GatewayNextHop,
+	}
+	defer func(backoff wait.Backoff) { joinAddressBackoff = backoff }(joinAddressBackoff)
+	joinAddressBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+	if err := staleCluster.SetupNode("node3", "10.0.0.4", "10.128.3.0/24"); err == nil {
+		t.Errorf("expected an error setting up a gateway on a join address in use")
+	}
+	if _, err := nbClient.LogicalRouterPortByName("rtoj-GR_node3"); err == nil {
+		t.Errorf("expected no join port for the gateway on a join address in use")
+	}
+}
+
+func TestJoinSubnet(t *testing.T) {
+	tests := []struct {
+		networks []string
+		expected string
+	}{
+		{nil, "100.64.0.0/23"},
+		{[]string{"10.128.0.0/16/24"}, "100.64.0.0/23"},
+		{[]string{"10.128.0.0/14/24", "fd00:10:128::/48/64"}, "100.64.0.0/21"},
+		{[]string{"10.128.0.0/14/24", "10.132.0.0/14/24"}, "100.64.0.0/20"},
+		{[]string{"10.0.0.0/8/30"}, "100.64.0.0/10"},
+	}
+	for _, test := range tests {
+		networks, err := ParseClusterNetworks(strings.Join(test.networks, ","), 24)
+		if err != nil && test.networks != nil {
+			t.Fatal(err)
+		}
+		cluster := &OvnClusterController{ClusterNetworks: networks}
+		if subnet := cluster.joinSubnet().String(); subnet != test.expected {
+			t.Errorf("expected the join subnet %s for %v, got %s", test.expected, test.networks, subnet)
+		}
+	}
+}
+
+func TestSetBridgeMapping(t *testing.T) {
+	tests := []struct {
+		mappings string
+		expected string
+	}{
+		{"", "physnet:br-ex"},
+		{"physnet:br-old", "physnet:br-ex"},
+		{"other:br-other,physnet:br-old", "physnet:br-ex,other:br-other"},
+	}
+	for _, test := range tests {
+		if mappings := setBridgeMapping(test.mappings, "physnet", "br-ex"); mappings != test.expected {
+			t.Errorf("expected %q for %q, got %q", test.expected, test.mappings, mappings)
+		}
+	}
+}
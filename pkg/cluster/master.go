@@ -3,140 +3,431 @@ package cluster
 import (
 	"fmt"
 	"net"
-	"os/exec"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 
-	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	kapi "k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 
-	"github.com/openshift/origin/pkg/util/netutils"
-)
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
 
-func (cluster *OvnClusterController) StartClusterMaster(masterNodeName string) error {
-	clusterNetwork := cluster.ClusterIPNet
-	hostSubnetLength := cluster.HostSubnetLength
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+)
 
-	subrange := make([]string, 0)
+func (cluster *OvnClusterController) StartClusterMaster(masterNodeName string, stopChan <-chan struct{}) error {
 	existingNodes, err := cluster.Kube.GetNodes()
 	if err != nil {
 		glog.Errorf("Error in initializing/fetching subnets: %v", err)
 		return err
 	}
-	for _, node := range existingNodes.Items {
-		hostsubnet, ok := node.Annotations[OVN_HOST_SUBNET]
-		if ok {
-			subrange = append(subrange, hostsubnet)
-		}
-	}
-	masterSwitchNetwork, err := calculateMasterSwitchNetwork(clusterNetwork.String(), hostSubnetLength)
+	masterSwitchNetworks, err := cluster.initSubnets(existingNodes.Items)
 	if err != nil {
 		return err
 	}
-	subrange = append(subrange, masterSwitchNetwork)
-	cluster.masterSubnetAllocator, err = netutils.NewSubnetAllocator(clusterNetwork.String(), hostSubnetLength, subrange)
+
+	err = cluster.SetupMaster(masterNodeName, masterSwitchNetworks...)
 	if err != nil {
 		return err
 	}
+	cluster.teardownDeletedNodes(existingNodes.Items)
 
-	// now go over the 'existing' list again and create annotations for those who do not have it
-	for _, node := range existingNodes.Items {
-		_, ok := node.Annotations[OVN_HOST_SUBNET]
-		if !ok {
-			err := cluster.addNode(&node)
+	cluster.nodeQueue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "nodes")
+	cluster.watchNodes()
+	cluster.runNodeQueue(stopChan)
+	return nil
+}
+
+// initSubnets sets up the subnet allocator with the subnets of the nodes and
+// returns the subnets of the master switch, one of each IP family. The
+// annotations that are not valid host subnets, or the same as the one of an
+// older node, are reported and replaced.
+func (cluster *OvnClusterController) initSubnets(nodes []kapi.Node) ([]string, error) {
+	if len(cluster.ClusterNetworks) == 0 {
+		return nil, fmt.Errorf("no cluster network")
+	}
+	cluster.masterSubnetAllocator = newSubnetAllocator()
+	for _, network := range cluster.ClusterNetworks {
+		err := cluster.masterSubnetAllocator.addRange(network.CIDR, network.HostPrefixLength)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the first subnet of the first cluster network of each family is the
+	// one of the master switch, it is taken in the range of that network
+	masterSubnets := make([]string, 0, 2)
+	seen := make(map[ipFamily]bool)
+	for _, network := range cluster.ClusterNetworks {
+		if family := familyOf(network.CIDR.IP); !seen[family] {
+			seen[family] = true
+			masterSubnet, err := cluster.masterSubnetAllocator.allocateFirst(network.CIDR)
 			if err != nil {
-				glog.Errorf("error creating subnet for node %s: %v", node.Name, err)
+				return nil, err
 			}
+			masterSubnets = append(masterSubnets, masterSubnet.String())
 		}
 	}
 
-	cluster.SetupMaster(masterNodeName, masterSwitchNetwork)
+	// the nodes keep their valid subnets, the oldest node when two have the
+	// same one, the others get new ones
+	nodes = append([]kapi.Node(nil), nodes...)
+	sort.Sort(nodesByAge(nodes))
+	repair := make([]*kapi.Node, 0)
+	for i := range nodes {
+		node := &nodes[i]
+		valid := true
+		for _, family := range cluster.masterSubnetAllocator.families() {
+			key := hostSubnetAnnotation(family)
+			sub, ok := node.Annotations[key]
+			if !ok {
+				valid = false
+				continue
+			}
+			err := cluster.adoptSubnet(node.Name, key, sub)
+			if err != nil {
+				cluster.reportNode(node, "HostSubnetRejected", fmt.Sprintf("Rejected %s %q - %v, allocating another subnet", key, sub, err))
+				valid = false
+			}
+		}
+		if !valid {
+			repair = append(repair, node)
+		}
+	}
+	for _, node := range repair {
+		err := cluster.addNode(node)
+		if err != nil {
+			glog.Errorf("error creating subnet for node %s: %v", node.Name, err)
+		}
+	}
 
-	go utilwait.Forever(cluster.watchNodes, 0)
-	return nil
+	return masterSubnets, nil
 }
 
-func calculateMasterSwitchNetwork(clusterNetwork string, hostSubnetLength uint32) (string, error) {
-	subAllocator, err := netutils.NewSubnetAllocator(clusterNetwork, hostSubnetLength, make([]string, 0))
-	sn, err := subAllocator.GetNetwork()
-	return sn.String(), err
+// nodesByAge sorts nodes from the oldest, then by name
+type nodesByAge []kapi.Node
+
+func (n nodesByAge) Len() int      { return len(n) }
+func (n nodesByAge) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n nodesByAge) Less(i, j int) bool {
+	ti, tj := n[i].CreationTimestamp.Time, n[j].CreationTimestamp.Time
+	if !ti.Equal(tj) {
+		return ti.Before(tj)
+	}
+	return n[i].Name < n[j].Name
 }
 
-func (cluster *OvnClusterController) SetupMaster(masterNodeName string, masterSwitchNetwork string) {
-	out, err := exec.Command("ovnkube-setup-master", cluster.Token, cluster.KubeServer, masterSwitchNetwork, cluster.ClusterIPNet.String(), masterNodeName).CombinedOutput()
+// SetupMaster creates the logical topology shared by the nodes: the cluster
+// router, the join switch for the gateway routers, the load balancers of the
+// cluster ips with the group of the per service ones and the logical switch
+// of the master, on a subnet of each IP family. It can be run again, the
+// parts that already exist are kept and updated.
+func (cluster *OvnClusterController) SetupMaster(masterNodeName string, masterSwitchNetworks ...string) error {
+	txn := newNBTransaction(cluster.OvnNB)
+	router := txn.logicalRouter(OVN_CLUSTER_ROUTER, nil, map[string]string{"k8s-cluster-router": "yes"})
+	lbs := make([]ovsdb.UUID, 0, len(lbProtocols))
+	for _, protocol := range lbProtocols {
+		lbs = append(lbs, txn.loadBalancer(map[string]string{"k8s-cluster-lb-" + protocol: "yes"}, protocol, lbOptions))
+	}
+	lbGroup := txn.loadBalancerGroup(OVN_CLUSTER_LB_GROUP)
+
+	join := txn.logicalSwitch(OVN_JOIN_SWITCH, nil, nil)
+	joinPrefixLen, _ := cluster.joinSubnet().Mask.Size()
+	joinAddress := fmt.Sprintf("%s/%d", OVN_JOIN_ROUTER_IP, joinPrefixLen)
+	err := txn.connectToRouter(router, join, "rtoj-"+OVN_CLUSTER_ROUTER, "jtor-"+OVN_CLUSTER_ROUTER, joinAddress)
 	if err != nil {
-		glog.Errorf("Error setting up master node - %v(%v)", string(out), err)
+		return err
 	}
-}
 
-func (cluster *OvnClusterController) addNode(node *kapi.Node) error {
-	// Create new subnet
-	sn, err := cluster.masterSubnetAllocator.GetNetwork()
+	otherConfig, switchIDs, gateways, err := subnetSwitchConfig(masterSwitchNetworks)
 	if err != nil {
-		return fmt.Errorf("Error allocating network for node %s: %v", node.Name, err)
+		return err
 	}
+	switchIDs[OVN_MASTER_SWITCH] = "yes"
+	masterSwitch := txn.logicalSwitch(masterNodeName, otherConfig, switchIDs)
+	err = txn.connectToRouter(router, masterSwitch, "rtos-"+masterNodeName, "stor-"+masterNodeName, gateways...)
+	if err != nil {
+		return err
+	}
+	txn.attachLoadBalancers(masterSwitch, lbs...)
+	txn.attachLoadBalancerGroup(masterSwitch, lbGroup)
 
-	err = cluster.Kube.SetAnnotationOnNode(node, OVN_HOST_SUBNET, sn.String())
+	err = txn.commit()
 	if err != nil {
-		cluster.masterSubnetAllocator.ReleaseNetwork(sn)
-		return fmt.Errorf("Error creating subnet %s for node %s: %v", sn.String(), node.Name, err)
+		return fmt.Errorf("Error setting up the master logical topology - %v", err)
 	}
-	glog.Infof("Created HostSubnet %s", sn.String())
+	glog.Infof("Set up the master logical topology with switch %s for %s", masterNodeName, strings.Join(masterSwitchNetworks, ","))
 	return nil
 }
 
-func (cluster *OvnClusterController) deleteNode(node *kapi.Node) error {
-	sub, ok := node.Annotations[OVN_HOST_SUBNET]
-	if !ok {
-		return fmt.Errorf("Error in obtaining host subnet for node %q for deletion", node.Name)
+// nodeSubnet returns the subnet of the annotation key the master allocated to
+// the node
+func (cluster *OvnClusterController) nodeSubnet(name, key string) (string, bool) {
+	cluster.subnetMutex.Lock()
+	defer cluster.subnetMutex.Unlock()
+	subnet, ok := cluster.nodeSubnets[name][key]
+	return subnet, ok
+}
+
+// setNodeSubnet records the subnet of the annotation key allocated to the
+// node
+func (cluster *OvnClusterController) setNodeSubnet(name, key, subnet string) {
+	cluster.subnetMutex.Lock()
+	defer cluster.subnetMutex.Unlock()
+	if cluster.nodeSubnets == nil {
+		cluster.nodeSubnets = make(map[string]map[string]string)
+	}
+	if cluster.nodeSubnets[name] == nil {
+		cluster.nodeSubnets[name] = make(map[string]string)
 	}
+	cluster.nodeSubnets[name][key] = subnet
+}
 
-	_, subnet, err := net.ParseCIDR(sub)
+// forgetNode drops the subnets recorded for the node and returns them, by
+// annotation key
+func (cluster *OvnClusterController) forgetNode(name string) map[string]string {
+	cluster.subnetMutex.Lock()
+	defer cluster.subnetMutex.Unlock()
+	subnets := cluster.nodeSubnets[name]
+	delete(cluster.nodeSubnets, name)
+	return subnets
+}
+
+// adoptSubnet records the subnet of the annotation key of a node as
+// allocated to it, when it is a valid host subnet of the family of the key
+// that is not in use
+func (cluster *OvnClusterController) adoptSubnet(nodeName, key, sub string) error {
+	subnet, err := cluster.masterSubnetAllocator.validate(sub)
 	if err != nil {
-		return fmt.Errorf("Error in parsing hostsubnet - %v", err)
+		return err
 	}
-	err = cluster.masterSubnetAllocator.ReleaseNetwork(subnet)
+	if hostSubnetAnnotation(familyOf(subnet.IP)) != key {
+		return fmt.Errorf("%s is not an %s subnet", sub, familyOfAnnotation(key))
+	}
+	err = cluster.masterSubnetAllocator.markAllocated(subnet)
 	if err != nil {
-		return fmt.Errorf("Error deleting subnet %v for node %q: %v", sub, node.Name, err)
+		return err
 	}
+	cluster.setNodeSubnet(nodeName, key, subnet.String())
+	return nil
+}
 
-	glog.Infof("Deleted HostSubnet %s for node %s", sub, node.Name)
+// familyOfAnnotation returns the IP family of the host subnet annotation key
+func familyOfAnnotation(key string) ipFamily {
+	if key == OVN_HOST_SUBNET_V6 {
+		return ipv6
+	}
+	return ipv4
+}
+
+// reportNode logs a problem with the node and records it as an event of the
+// node
+func (cluster *OvnClusterController) reportNode(node *kapi.Node, reason, message string) {
+	glog.Warningf("Node %s: %s", node.Name, message)
+	cluster.Kube.RecordNodeEvent(node, kapi.EventTypeWarning, reason, message)
+}
+
+// missingFamilies returns the IP families the master has not allocated a
+// subnet of to the node
+func (cluster *OvnClusterController) missingFamilies(nodeName string) []ipFamily {
+	missing := make([]ipFamily, 0, 2)
+	for _, family := range cluster.masterSubnetAllocator.families() {
+		if _, ok := cluster.nodeSubnet(nodeName, hostSubnetAnnotation(family)); !ok {
+			missing = append(missing, family)
+		}
+	}
+	return missing
+}
+
+// addNode allocates new subnets to the node, of the IP families it has none
+// of. The annotations are set by an update guarded by the resourceVersion of
+// the node, a node that changed in the meantime, e.g. annotated by another
+// master, is read again rather than overwritten.
+func (cluster *OvnClusterController) addNode(node *kapi.Node) error {
+	for attempt := 0; attempt < maxAnnotationAttempts; attempt++ {
+		missing := cluster.missingFamilies(node.Name)
+		if len(missing) == 0 {
+			return nil
+		}
+		annotations := make(map[string]string, len(missing))
+		allocated := make([]*net.IPNet, 0, len(missing))
+		for _, family := range missing {
+			sn, err := cluster.masterSubnetAllocator.allocate(family)
+			if err != nil {
+				for _, sn := range allocated {
+					cluster.masterSubnetAllocator.release(sn)
+				}
+				cluster.reportNode(node, "HostSubnetExhausted", fmt.Sprintf("No subnet for the node - %v", err))
+				return fmt.Errorf("Error allocating network for node %s: %v", node.Name, err)
+			}
+			annotations[hostSubnetAnnotation(family)] = sn.String()
+			allocated = append(allocated, sn)
+		}
+
+		err := cluster.Kube.UpdateAnnotationsOnNode(node, annotations)
+		if err == nil {
+			for key, sub := range annotations {
+				cluster.setNodeSubnet(node.Name, key, sub)
+				glog.Infof("Created HostSubnet %s", sub)
+			}
+			return nil
+		}
+		for _, sn := range allocated {
+			cluster.masterSubnetAllocator.release(sn)
+		}
+		if !apierrors.IsConflict(err) {
+			return fmt.Errorf("Error creating subnets %v for node %s: %v", annotations, node.Name, err)
+		}
+
+		latest, err := cluster.Kube.GetNode(node.Name)
+		if err != nil {
+			return fmt.Errorf("Error reading node %s again: %v", node.Name, err)
+		}
+		node = latest
+		for key := range annotations {
+			if sub, ok := node.Annotations[key]; ok && cluster.adoptSubnet(node.Name, key, sub) == nil {
+				glog.Infof("Node %s got HostSubnet %s in the meantime", node.Name, sub)
+			}
+		}
+	}
+	return fmt.Errorf("Error creating subnet for node %s: the node kept changing", node.Name)
+}
+
+// syncNodeSubnet holds the subnet annotations of the node to the subnets the
+// master allocated: a removed annotation is restored and an edited one is
+// rejected with an event and restored, as the node cannot move to another
+// subnet. A node the master has not allocated a subnet of a family to keeps
+// the subnet of its annotation if it can, or gets a new one.
+func (cluster *OvnClusterController) syncNodeSubnet(node *kapi.Node) error {
+	allocate := false
+	for _, family := range cluster.masterSubnetAllocator.families() {
+		key := hostSubnetAnnotation(family)
+		current, annotated := node.Annotations[key]
+		allocated, ok := cluster.nodeSubnet(node.Name, key)
+		if !ok {
+			if annotated {
+				err := cluster.adoptSubnet(node.Name, key, current)
+				if err == nil {
+					continue
+				}
+				cluster.reportNode(node, "HostSubnetRejected", fmt.Sprintf("Rejected %s %q - %v, allocating another subnet", key, current, err))
+			}
+			allocate = true
+			continue
+		}
+		if current == allocated {
+			continue
+		}
+
+		if annotated {
+			cluster.reportNode(node, "HostSubnetRejected", fmt.Sprintf("Rejected the change of %s to %q, the node keeps its subnet %s", key, current, allocated))
+		} else {
+			glog.Infof("Restoring the removed HostSubnet %s of node %s", allocated, node.Name)
+		}
+		err := cluster.Kube.SetAnnotationOnNode(node, key, allocated)
+		if err != nil {
+			return fmt.Errorf("Error restoring subnet %s for node %s: %v", allocated, node.Name, err)
+		}
+	}
+	if allocate {
+		return cluster.addNode(node)
+	}
+	return nil
+}
+
+// deleteNode removes the logical topology of a deleted node and then
+// releases its subnets, they are kept until nothing of the node is left for
+// a new node with them to collide with
+func (cluster *OvnClusterController) deleteNode(name string) error {
+	err := cluster.teardownNode(name)
+	if err != nil {
+		return err
+	}
+	for _, sub := range cluster.forgetNode(name) {
+		_, subnet, err := net.ParseCIDR(sub)
+		if err == nil {
+			err = cluster.masterSubnetAllocator.release(subnet)
+		}
+		if err != nil {
+			glog.Errorf("Error deleting subnet %s for node %q: %v", sub, name, err)
+			continue
+		}
+		glog.Infof("Deleted HostSubnet %s for node %s", subnet, name)
+	}
 	return nil
 }
 
+// syncNode brings the master to the node of the lister: a node that exists
+// keeps or gets its subnets, one that is gone is torn down. The node is
+// looked up on every attempt, so that a node that registers again under the
+// same name is not torn down.
+func (cluster *OvnClusterController) syncNode(name string) error {
+	node, err := cluster.NodeLister.Get(name)
+	if apierrors.IsNotFound(err) {
+		return cluster.deleteNode(name)
+	}
+	if err != nil {
+		return err
+	}
+	return cluster.syncNodeSubnet(node)
+}
+
+// runNodeQueue processes the queued nodes until stopChan is closed
+func (cluster *OvnClusterController) runNodeQueue(stopChan <-chan struct{}) {
+	go wait.Until(func() {
+		for cluster.processNextNode() {
+		}
+	}, time.Second, stopChan)
+	go func() {
+		<-stopChan
+		cluster.nodeQueue.ShutDown()
+	}()
+}
+
+// processNextNode syncs the next queued node. The events of a node are merged
+// in the queue and a node is never synced twice at once, the node is retried
+// until it syncs, e.g. for the subnets of a deleted node to be released.
+func (cluster *OvnClusterController) processNextNode() bool {
+	item, quit := cluster.nodeQueue.Get()
+	if quit {
+		return false
+	}
+	defer cluster.nodeQueue.Done(item)
+	name := item.(string)
+	err := cluster.syncNode(name)
+	if err != nil {
+		glog.Errorf("Error syncing node %s, retrying: %v", name, err)
+		cluster.nodeQueue.AddRateLimited(name)
+		return true
+	}
+	cluster.nodeQueue.Forget(name)
+	return true
+}
+
+// queueNode queues the sync of the node of an event, a deleted one included
+func (cluster *OvnClusterController) queueNode(event string, obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Couldn't get key for node %+v: %v", obj, err)
+		return
+	}
+	glog.V(5).Infof("%s event for Node %q", event, key)
+	cluster.nodeQueue.Add(key)
+}
+
 func (cluster *OvnClusterController) watchNodes() {
 	handler := cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			node := obj.(*kapi.Node)
-			glog.V(5).Infof("Added event for Node %q", node.Name)
-			err := cluster.addNode(node)
-			if err != nil {
-				glog.Errorf("error creating subnet for node %s: %v", node.Name, err)
-			}
-			return
+			cluster.queueNode("Added", obj)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			cluster.queueNode("Updated", new)
 		},
-		UpdateFunc: func(old, new interface{}) { return },
 		DeleteFunc: func(obj interface{}) {
-			node, ok := obj.(*kapi.Node)
-			if !ok {
-				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
-				if !ok {
-					glog.Errorf("couldn't get object from tombstone %+v", obj)
-					return
-				}
-				node, ok = tombstone.Obj.(*kapi.Node)
-				if !ok {
-					glog.Errorf("tombstone contained object that is not a node %#v", obj)
-					return
-				}
-			}
-			glog.V(5).Infof("Delete event for Node %q", node.Name)
-			err := cluster.deleteNode(node)
-			if err != nil {
-				glog.Errorf("Error deleting node %s: %v", node.Name, err)
-			}
-			return
+			cluster.queueNode("Delete", obj)
 		},
 	}
 	cluster.StartNodeWatch(handler)
@@ -0,0 +1,385 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kapi "k8s.io/client-go/pkg/api/v1"
+
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb/fake"
+)
+
+func newTestClient(t *testing.T, db string, tables []string) (*fake.Server, *ovsdb.Client) {
+	server := fake.NewServer(db)
+	address, err := server.Start()
+	if err != nil {
+		t.Fatalf("failed to start the fake server: %v", err)
+	}
+	client, err := ovsdb.Dial(address, nil)
+	if err != nil {
+		server.Close()
+		t.Fatalf("failed to connect to the fake server: %v", err)
+	}
+	if err := client.Monitor(db, tables...); err != nil {
+		client.Close()
+		server.Close()
+		t.Fatalf("failed to monitor: %v", err)
+	}
+	return server, client
+}
+
+// routerPortNames returns the sorted names of the ports of the router
+func routerPortNames(t *testing.T, client *ovsdb.Client, router string) []string {
+	lr, err := client.LogicalRouterByName(router)
+	if err != nil {
+		t.Fatalf("no logical router %s: %v", router, err)
+	}
+	rows := client.Rows(ovsdb.LogicalRouterPortTable)
+	names := make([]string, 0)
+	for _, uuid := range lr.Ports {
+		names = append(names, rows[uuid].String("name"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSetupMaster(t *testing.T) {
+	server, client := newTestClient(t, ovsdb.NBDatabase, ovsdb.NBTables)
+	defer server.Close()
+	defer client.Close()
+	cluster := &OvnClusterController{OvnNB: client}
+
+	// a second run must leave the same topology
+	for i := 0; i < 2; i++ {
+		if err := cluster.SetupMaster("master", "10.128.0.0/24"); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+
+		if n := len(server.Rows(ovsdb.LogicalRouterTable)); n != 1 {
+			t.Errorf("run %d: expected 1 logical router, got %d", i, n)
+		}
+		if n := len(server.Rows(ovsdb.LoadBalancerTable)); n != 3 {
+			t.Errorf("run %d: expected 3 load balancers, got %d", i, n)
+		}
+		for _, row := range client.Rows(ovsdb.LoadBalancerTable) {
+			if lb := ovsdb.NewLoadBalancer(row); lb.Options["reject"] != "true" {
+				t.Errorf("run %d: expected load balancer %+v to reject without endpoints", i, lb)
+			}
+		}
+		if n := len(server.Rows(ovsdb.LoadBalancerGroupTable)); n != 1 {
+			t.Errorf("run %d: expected 1 load balancer group, got %d", i, n)
+		}
+		if n := len(server.Rows(ovsdb.LogicalSwitchTable)); n != 2 {
+			t.Errorf("run %d: expected the join and master switches, got %d", i, n)
+		}
+		ports := routerPortNames(t, client, OVN_CLUSTER_ROUTER)
+		expected := []string{"rtoj-ovn_cluster_router", "rtos-master"}
+		if !reflect.DeepEqual(ports, expected) {
+			t.Errorf("run %d: expected router ports %v, got %v", i, expected, ports)
+		}
+
+		lrp, err := client.LogicalRouterPortByName("rtos-master")
+		if err != nil || lrp.MAC != "0a:58:0a:80:00:01" || !reflect.DeepEqual(lrp.Networks, []string{"10.128.0.1/24"}) {
+			t.Errorf("run %d: unexpected router port %+v (%v)", i, lrp, err)
+		}
+		ls, err := client.LogicalSwitchByName("master")
+		if err != nil {
+			t.Fatalf("run %d: no master switch: %v", i, err)
+		}
+		if ls.OtherConfig["subnet"] != "10.128.0.0/24" || ls.ExternalIDs["gateway_ip"] != "10.128.0.1/24" {
+			t.Errorf("run %d: unexpected master switch config %v %v", i, ls.OtherConfig, ls.ExternalIDs)
+		}
+		if len(ls.LoadBalancer) != 3 || len(ls.LoadBalancerGroup) != 1 || len(ls.Ports) != 1 {
+			t.Errorf("run %d: expected the master switch to have 3 load balancers, the group and 1 port, got %+v", i, ls)
+		}
+		lsp, err := client.LogicalSwitchPortByName("jtor-ovn_cluster_router")
+		if err != nil || lsp.Type != "router" || lsp.Options["router-port"] != "rtoj-ovn_cluster_router" ||
+			!reflect.DeepEqual(lsp.Addresses, []string{"0a:58:64:40:01:01"}) {
+			t.Errorf("run %d: unexpected join switch port %+v (%v)", i, lsp, err)
+		}
+		lrp, err = client.LogicalRouterPortByName("rtoj-ovn_cluster_router")
+		if err != nil || !reflect.DeepEqual(lrp.Networks, []string{"100.64.1.1/23"}) {
+			t.Errorf("run %d: unexpected join router port %+v (%v)", i, lrp, err)
+		}
+	}
+}
+
+func TestSyncNodeSubnet(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	allocator := newTestAllocator(t, "10.128.0.0/22", 24, "10.128.0.0/24")
+	cluster := &OvnClusterController{Kube: fakeKube, masterSubnetAllocator: allocator}
+	fakeKube.AddNode(&kapi.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	node, _ := fakeKube.GetNode("node1")
+	if err := cluster.addNode(node); err != nil {
+		t.Fatal(err)
+	}
+	node, _ = fakeKube.GetNode("node1")
+	subnet := node.Annotations[OVN_HOST_SUBNET]
+	if subnet != "10.128.1.0/24" {
+		t.Fatalf("expected the subnet 10.128.1.0/24, got %q", subnet)
+	}
+
+	// another add event of the node keeps its subnet
+	if err := cluster.syncNodeSubnet(node); err != nil {
+		t.Fatal(err)
+	}
+	if node, _ = fakeKube.GetNode("node1"); node.Annotations[OVN_HOST_SUBNET] != subnet {
+		t.Errorf("expected the node to keep its subnet, got %q", node.Annotations[OVN_HOST_SUBNET])
+	}
+
+	// a removed annotation is restored
+	delete(node.Annotations, OVN_HOST_SUBNET)
+	fakeKube.AddNode(node)
+	if err := cluster.syncNodeSubnet(node); err != nil {
+		t.Fatal(err)
+	}
+	if node, _ = fakeKube.GetNode("node1"); node.Annotations[OVN_HOST_SUBNET] != subnet {
+		t.Errorf("expected the removed subnet to be restored, got %q", node.Annotations[OVN_HOST_SUBNET])
+	}
+	if events := fakeKube.Events(); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+
+	// an edited annotation is rejected
+	node.Annotations[OVN_HOST_SUBNET] = "10.128.3.0/24"
+	fakeKube.AddNode(node)
+	if err := cluster.syncNodeSubnet(node); err != nil {
+		t.Fatal(err)
+	}
+	if node, _ = fakeKube.GetNode("node1"); node.Annotations[OVN_HOST_SUBNET] != subnet {
+		t.Errorf("expected the edited subnet to be restored, got %q", node.Annotations[OVN_HOST_SUBNET])
+	}
+	events := fakeKube.Events()
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning HostSubnetRejected node1:") {
+		t.Errorf("expected an event rejecting the edit, got %v", events)
+	}
+}
+
+func TestInitSubnets(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	_, clusterNet, _ := net.ParseCIDR("10.128.0.0/22")
+	cluster := &OvnClusterController{Kube: fakeKube, ClusterNetworks: []ClusterNetwork{{CIDR: clusterNet, HostPrefixLength: 24}}}
+	start := time.Now()
+	nodes := []struct {
+		name   string
+		subnet string
+	}{
+		{"old", "10.128.1.0/24"},
+		{"copy", "10.128.1.0/24"},
+		{"master", "10.128.0.0/24"},
+		{"outside", "10.130.0.0/24"},
+		{"small", "10.128.2.0/25"},
+		{"new", ""},
+	}
+	for i, n := range nodes {
+		node := &kapi.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:              n.name,
+			CreationTimestamp: metav1.NewTime(start.Add(time.Duration(i) * time.Second)),
+		}}
+		if n.subnet != "" {
+			node.Annotations = map[string]string{OVN_HOST_SUBNET: n.subnet}
+		}
+		fakeKube.AddNode(node)
+	}
+	list, _ := fakeKube.GetNodes()
+
+	masterSwitchNetworks, err := cluster.initSubnets(list.Items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(masterSwitchNetworks, []string{"10.128.0.0/24"}) {
+		t.Errorf("expected the master switch network 10.128.0.0/24, got %v", masterSwitchNetworks)
+	}
+	// the pool only has 3 node subnets, the last node to get one finds none
+	subnets := make(map[string]string)
+	for _, n := range nodes {
+		node, _ := fakeKube.GetNode(n.name)
+		subnets[n.name] = node.Annotations[OVN_HOST_SUBNET]
+	}
+	expected := map[string]string{
+		"old":     "10.128.1.0/24",
+		"copy":    "10.128.2.0/24",
+		"master":  "10.128.3.0/24",
+		"outside": "10.130.0.0/24",
+		"small":   "10.128.2.0/25",
+		"new":     "",
+	}
+	if !reflect.DeepEqual(subnets, expected) {
+		t.Errorf("expected subnets %v, got %v", expected, subnets)
+	}
+	events := fakeKube.Events()
+	reasons := make([]string, 0, len(events))
+	for _, event := range events {
+		reasons = append(reasons, strings.SplitN(event, ":", 2)[0])
+	}
+	expectedReasons := []string{
+		"Warning HostSubnetRejected copy",
+		"Warning HostSubnetRejected master",
+		"Warning HostSubnetRejected outside",
+		"Warning HostSubnetRejected small",
+		"Warning HostSubnetExhausted outside",
+		"Warning HostSubnetExhausted small",
+		"Warning HostSubnetExhausted new",
+	}
+	if !reflect.DeepEqual(reasons, expectedReasons) {
+		t.Errorf("expected events %v, got %v", expectedReasons, events)
+	}
+}
+
+func TestAddNodeConflict(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	cluster := &OvnClusterController{
+		Kube:                  fakeKube,
+		masterSubnetAllocator: newTestAllocator(t, "10.128.0.0/22", 24, "10.128.0.0/24"),
+	}
+	fakeKube.AddNode(&kapi.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	fakeKube.AddNode(&kapi.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}})
+
+	// node1 changed since it was read, it is read again and gets the next
+	// subnet, the allocator moves on from the released ones
+	stale, _ := fakeKube.GetNode("node1")
+	fakeKube.SetAnnotationOnNode(stale, "other", "value")
+	if err := cluster.addNode(stale); err != nil {
+		t.Fatal(err)
+	}
+	node, _ := fakeKube.GetNode("node1")
+	if node.Annotations[OVN_HOST_SUBNET] != "10.128.2.0/24" || node.Annotations["other"] != "value" {
+		t.Errorf("expected node1 to get 10.128.2.0/24 and keep its other annotation, got %v", node.Annotations)
+	}
+
+	// node2 was given a subnet by another master in the meantime, which it keeps
+	stale, _ = fakeKube.GetNode("node2")
+	fakeKube.SetAnnotationOnNode(stale, OVN_HOST_SUBNET, "10.128.3.0/24")
+	if err := cluster.addNode(stale); err != nil {
+		t.Fatal(err)
+	}
+	node, _ = fakeKube.GetNode("node2")
+	if node.Annotations[OVN_HOST_SUBNET] != "10.128.3.0/24" {
+		t.Errorf("expected node2 to keep 10.128.3.0/24, got %v", node.Annotations)
+	}
+	if subnet, _ := cluster.nodeSubnet("node2", OVN_HOST_SUBNET); subnet != "10.128.3.0/24" {
+		t.Errorf("expected 10.128.3.0/24 to be recorded for node2, got %q", subnet)
+	}
+	if sn, err := cluster.masterSubnetAllocator.allocate(ipv4); err != nil || sn.String() != "10.128.1.0/24" {
+		t.Errorf("expected only 10.128.1.0/24 to be left, got %v (%v)", sn, err)
+	}
+}
+
+func TestParseClusterNetworks(t *testing.T) {
+	networks, err := ParseClusterNetworks("10.128.0.0/14, 10.132.0.0/16/23, fd00:10:128::/48", 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := make([]string, 0)
+	for _, network := range networks {
+		parsed = append(parsed, fmt.Sprintf("%s/%d", network.CIDR, network.HostPrefixLength))
+	}
+	expected := []string{"10.128.0.0/14/24", "10.132.0.0/16/23", "fd00:10:128::/48/64"}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("expected %v, got %v", expected, parsed)
+	}
+
+	for _, invalid := range []string{"", "10.128.0.0", "10.128.0.0/14/x", "10.128.0.0/24/24", "10.128.0.0/14/33", "fd00:10:128::/48/56"} {
+		if _, err := ParseClusterNetworks(invalid, 24); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestSubnetAddress(t *testing.T) {
+	tests := []struct {
+		subnet  string
+		index   int
+		address string
+	}{
+		{"10.128.1.0/24", 1, "10.128.1.1/24"},
+		{"10.128.1.5/24", 1, "10.128.1.1/24"},
+		{"10.128.1.0/24", 2, "10.128.1.2/24"},
+		{"100.64.1.0/24", 1, "100.64.1.1/24"},
+		{"11.11.0.0/16", 300, "11.11.1.44/16"},
+		{"fd00:10:128:1::/64", 1, "fd00:10:128:1::1/64"},
+		{"fd00:10:128:1::/64", 256, "fd00:10:128:1::100/64"},
+	}
+	for _, test := range tests {
+		address, err := subnetAddress(test.subnet, test.index)
+		if err != nil || address != test.address {
+			t.Errorf("expected %s for %d of %s, got %s (%v)", test.address, test.index, test.subnet, address, err)
+		}
+	}
+	if _, err := subnetAddress("10.128.1.0", 1); err == nil {
+		t.Errorf("expected an error for a subnet without a prefix length")
+	}
+	if _, err := subnetAddress("10.128.1.0/31", 2); err == nil {
+		t.Errorf("expected an error for an address out of the subnet")
+	}
+}
+
+func TestIPToMAC(t *testing.T) {
+	if mac := ipToMAC(net.ParseIP("10.128.1.1")); mac != "0a:58:0a:80:01:01" {
+		t.Errorf("expected 0a:58:0a:80:01:01, got %s", mac)
+	}
+	// the IPv6 gateways of the host subnets only differ in their prefix
+	mac1 := ipToMAC(net.ParseIP("fd00:10:128:1::1"))
+	mac2 := ipToMAC(net.ParseIP("fd00:10:128:2::1"))
+	if mac1 == mac2 || mac1 != ipToMAC(net.ParseIP("fd00:10:128:1::1")) || !strings.HasPrefix(mac1, "0a:58:") {
+		t.Errorf("expected distinct and stable macs, got %s and %s", mac1, mac2)
+	}
+}
+
+func TestAddNodeDualStack(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	allocator := newTestAllocator(t, "10.128.0.0/22", 24, "10.128.0.0/24")
+	_, clusterNet6, _ := net.ParseCIDR("fd00:10:128::/62")
+	if err := allocator.addRange(clusterNet6, 64); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allocator.allocateFirst(clusterNet6); err != nil {
+		t.Fatal(err)
+	}
+	cluster := &OvnClusterController{Kube: fakeKube, masterSubnetAllocator: allocator}
+	fakeKube.AddNode(&kapi.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	// node2 was set up before the cluster was dual stack
+	fakeKube.AddNode(&kapi.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "node2",
+		Annotations: map[string]string{OVN_HOST_SUBNET: "10.128.2.0/24"},
+	}})
+
+	node, _ := fakeKube.GetNode("node1")
+	if err := cluster.syncNodeSubnet(node); err != nil {
+		t.Fatal(err)
+	}
+	node, _ = fakeKube.GetNode("node1")
+	if node.Annotations[OVN_HOST_SUBNET] != "10.128.1.0/24" || node.Annotations[OVN_HOST_SUBNET_V6] != "fd00:10:128:1::/64" {
+		t.Errorf("expected node1 to get a subnet of each family, got %v", node.Annotations)
+	}
+
+	node, _ = fakeKube.GetNode("node2")
+	if err := cluster.syncNodeSubnet(node); err != nil {
+		t.Fatal(err)
+	}
+	node, _ = fakeKube.GetNode("node2")
+	if node.Annotations[OVN_HOST_SUBNET] != "10.128.2.0/24" || node.Annotations[OVN_HOST_SUBNET_V6] != "fd00:10:128:2::/64" {
+		t.Errorf("expected node2 to keep its subnet and get an IPv6 one, got %v", node.Annotations)
+	}
+
+	// an IPv4 subnet in the IPv6 annotation is rejected and restored
+	node.Annotations[OVN_HOST_SUBNET_V6] = "10.128.3.0/24"
+	fakeKube.AddNode(node)
+	if err := cluster.syncNodeSubnet(node); err != nil {
+		t.Fatal(err)
+	}
+	if node, _ = fakeKube.GetNode("node2"); node.Annotations[OVN_HOST_SUBNET_V6] != "fd00:10:128:2::/64" {
+		t.Errorf("expected the IPv6 subnet to be restored, got %v", node.Annotations)
+	}
+	if err := cluster.adoptSubnet("node3", OVN_HOST_SUBNET_V6, "10.128.3.0/24"); err == nil {
+		t.Errorf("expected an error adopting an IPv4 subnet as the IPv6 one")
+	}
+}
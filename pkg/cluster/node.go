@@ -1,65 +1,305 @@
 package cluster
 
 import (
+	"fmt"
 	"net"
-	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
 	kapi "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/openshift/origin/pkg/util/netutils"
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+)
+
+// nodeSubnetInterval and nodeSubnetTimeout are how the node waits for the
+// master to annotate it with its subnets
+var (
+	nodeSubnetInterval = time.Second
+	nodeSubnetTimeout  = 30 * time.Second
 )
 
 func (cluster *OvnClusterController) StartClusterNode(name string) error {
-	count := 30
-	var err error
 	var node *kapi.Node
-	var subnet *net.IPNet
+	var subnets []string
+	var lastErr error
 
-	for count > 0 {
-		if count != 30 {
-			count--
-			time.Sleep(time.Second)
+	err := wait.PollImmediate(nodeSubnetInterval, nodeSubnetTimeout, func() (bool, error) {
+		// setup the node, create the logical switch
+		node, lastErr = cluster.Kube.GetNode(name)
+		if lastErr != nil {
+			glog.Errorf("Error starting node %s, no node found - %v", name, lastErr)
+			return false, nil
 		}
 
-		// setup the node, create the logical switch
-		node, err = cluster.Kube.GetNode(name)
+		// a subnet of each family of the cluster networks
+		subnets = make([]string, 0, 2)
+		for _, family := range cluster.clusterFamilies() {
+			key := hostSubnetAnnotation(family)
+			sub, ok := node.Annotations[key]
+			if !ok {
+				lastErr = fmt.Errorf("no annotation %s found on node for subnet", key)
+				glog.Errorf("Error starting node %s, %v", name, lastErr)
+				return false, nil
+			}
+			_, subnet, err := net.ParseCIDR(sub)
+			if err != nil {
+				glog.Errorf("Invalid hostsubnet found for node %s - %v", node.Name, err)
+				return false, err
+			}
+			subnets = append(subnets, subnet.String())
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		glog.Errorf("Failed to get node/node-annotation for %s - %v", name, lastErr)
+		return lastErr
+	} else if err != nil {
+		return err
+	}
+
+	nodeIP := nodeInternalIP(node)
+	if nodeIP == "" {
+		nodeIP, err = netutils.GetNodeIP(node.Name)
 		if err != nil {
-			glog.Errorf("Error starting node %s, no node found - %v", name, err)
-			continue
+			glog.Errorf("Failed to obtain node's IP: %v", err)
+			return err
 		}
+	}
 
-		sub, ok := node.Annotations[OVN_HOST_SUBNET]
-		if !ok {
-			glog.Errorf("Error starting node %s, no annotation found on node for subnet - %v", name, err)
-			continue
+	glog.Infof("Node %s ready for ovn initialization with subnets %s", node.Name, strings.Join(subnets, ","))
+
+	err = cluster.SetupNode(node.Name, nodeIP, subnets...)
+	if err != nil {
+		glog.Errorf("Error in setting up node %s - %v", node.Name, err)
+		return err
+	}
+	cluster.watchNodeAddress(node.Name)
+	return nil
+}
+
+// nodeInternalIP returns the first InternalIP address of the node, empty if
+// it has none
+func nodeInternalIP(node *kapi.Node) string {
+	for _, address := range node.Status.Addresses {
+		if address.Type == kapi.NodeInternalIP {
+			return address.Address
 		}
-		_, subnet, err = net.ParseCIDR(sub)
+	}
+	return ""
+}
+
+// watchNodeAddress moves the tunnel endpoint of the node along with its
+// InternalIP, unless it was given an encap ip of its own
+func (cluster *OvnClusterController) watchNodeAddress(name string) {
+	if cluster.EncapIP != "" || cluster.StartLocalNodeWatch == nil {
+		return
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			node := new.(*kapi.Node)
+			if node.Name != name {
+				return
+			}
+			err := cluster.updateEncapIP(nodeInternalIP(node))
+			if err != nil {
+				glog.Errorf("Error updating the encap ip of node %s: %v", name, err)
+			}
+			return
+		},
+	}
+	cluster.StartLocalNodeWatch(name, handler)
+}
+
+// updateEncapIP points the tunnels of the node at ip when ovn-controller has
+// another encap ip
+func (cluster *OvnClusterController) updateEncapIP(ip string) error {
+	if ip == "" {
+		return nil
+	}
+	root, err := cluster.OvsDB.OpenvSwitchRoot()
+	if err != nil {
+		return fmt.Errorf("no Open_vSwitch row - %v", err)
+	}
+	if root.ExternalIDs["ovn-encap-ip"] == ip {
+		return nil
+	}
+	ovsTxn := newOVSTransaction(cluster.OvsDB)
+	err = ovsTxn.setOpenvSwitchExternalIDs(map[string]string{"ovn-encap-ip": ip})
+	if err != nil {
+		return err
+	}
+	err = ovsTxn.commit()
+	if err != nil {
+		return fmt.Errorf("Error setting the encap ip %s - %v", ip, err)
+	}
+	glog.Infof("Moved the tunnel endpoint of the node to %s", ip)
+	return nil
+}
+
+// SetupNode points ovn-controller at the southbound database, creates the
+// logical switch of the node, on a subnet of each IP family, on the cluster
+// router and plugs the management port of the host into it. It can be run
+// again, the parts that already exist are kept and updated.
+func (cluster *OvnClusterController) SetupNode(nodeName, nodeIP string, subnets ...string) error {
+	encapIP := cluster.EncapIP
+	if encapIP == "" {
+		encapIP = nodeIP
+	}
+	encapType := cluster.EncapType
+	if encapType == "" {
+		encapType = "geneve"
+	}
+	// the api server credentials are there for the cni plugin
+	ovsTxn := newOVSTransaction(cluster.OvsDB)
+	err := ovsTxn.setOpenvSwitchExternalIDs(map[string]string{
+		"ovn-remote":         cluster.SouthboundAddress,
+		"ovn-encap-ip":       encapIP,
+		"ovn-encap-type":     encapType,
+		"k8s-api-server":     cluster.KubeServer,
+		"k8s-api-token":      cluster.Token,
+		"k8s-ca-certificate": cluster.CACert,
+	})
+	if err != nil {
+		return err
+	}
+
+	otherConfig, switchIDs, gateways, err := subnetSwitchConfig(subnets)
+	if err != nil {
+		return err
+	}
+	mgmtAddresses := make([]string, 0, len(subnets))
+	mgmtIPs := make([]string, 0, len(subnets))
+	for _, subnet := range subnets {
+		mgmtAddress, err := subnetAddress(subnet, 2)
 		if err != nil {
-			glog.Errorf("Invalid hostsubnet found for node %s - %v", node.Name, err)
 			return err
 		}
-		break
+		mgmtIP, _, _ := net.ParseCIDR(mgmtAddress)
+		mgmtAddresses = append(mgmtAddresses, mgmtAddress)
+		mgmtIPs = append(mgmtIPs, mgmtIP.String())
+	}
+	if len(mgmtIPs) == 0 {
+		return fmt.Errorf("no host subnet given for node %s", nodeName)
 	}
+	mgmtMAC := ipToMAC(net.ParseIP(mgmtIPs[0]))
 
-	if count == 0 {
-		glog.Errorf("Failed to get node/node-annotation for %s - %v", name, err)
+	// the logical topology, the master must have created the cluster router
+	// and load balancers
+	router, err := cluster.OvnNB.LogicalRouterByName(OVN_CLUSTER_ROUTER)
+	if err != nil {
+		return fmt.Errorf("no logical router %s, is the master set up? - %v", OVN_CLUSTER_ROUTER, err)
+	}
+	lbGroup, err := cluster.OvnNB.LoadBalancerGroupByName(OVN_CLUSTER_LB_GROUP)
+	if err != nil {
+		return fmt.Errorf("no load balancer group %s, is the master set up? - %v", OVN_CLUSTER_LB_GROUP, err)
+	}
+	lbs := make([]ovsdb.UUID, 0)
+	for _, lb := range cluster.OvnNB.LoadBalancers() {
+		for _, protocol := range lbProtocols {
+			if lb.ExternalIDs["k8s-cluster-lb-"+protocol] == "yes" {
+				lbs = append(lbs, ovsdb.UUID{GoUUID: lb.UUID})
+			}
+		}
+	}
+	// the switch is tagged with the node and its chassis, to be cleaned up
+	// when the node is deleted
+	switchIDs[OVN_NODE_OWNER] = nodeName
+	if root, err := cluster.OvsDB.OpenvSwitchRoot(); err == nil && root.ExternalIDs["system-id"] != "" {
+		switchIDs[OVN_NODE_CHASSIS] = root.ExternalIDs["system-id"]
+	}
+	nbTxn := newNBTransaction(cluster.OvnNB)
+	nodeSwitch := nbTxn.logicalSwitch(nodeName, otherConfig, switchIDs)
+	err = nbTxn.connectToRouter(ovsdb.UUID{GoUUID: router.UUID}, nodeSwitch, "rtos-"+nodeName, "stor-"+nodeName, gateways...)
+	if err != nil {
 		return err
 	}
+	if len(lbs) > 0 {
+		nbTxn.attachLoadBalancers(nodeSwitch, lbs...)
+	}
+	nbTxn.attachLoadBalancerGroup(nodeSwitch, ovsdb.UUID{GoUUID: lbGroup.UUID})
+	nbTxn.logicalSwitchPort(nodeSwitch, "k8s-"+nodeName, ovsdb.Row{
+		"addresses": ovsdb.NewOvsSet(mgmtMAC + " " + strings.Join(mgmtIPs, " ")),
+	})
+	err = nbTxn.commit()
+	if err != nil {
+		return fmt.Errorf("Error setting up the logical switch of node %s - %v", nodeName, err)
+	}
 
-	nodeIP, err := netutils.GetNodeIP(node.Name)
+	// the management port gives the host access to the pods
+	mgmtInterface := managementInterfaceName(nodeName)
+	err = ovsTxn.internalPort("br-int", mgmtInterface, mgmtMAC, map[string]string{"iface-id": "k8s-" + nodeName})
+	if err != nil {
+		return err
+	}
+	err = ovsTxn.commit()
+	if err != nil {
+		return fmt.Errorf("Error setting up Open_vSwitch on node %s - %v", nodeName, err)
+	}
+	err = cluster.configureManagementInterface(mgmtInterface, mgmtAddresses, gateways)
 	if err != nil {
-		glog.Errorf("Failed to obtain node's IP: %v", err)
 		return err
 	}
 
-	glog.Infof("Node %s ready for ovn initialization with subnet %s", node.Name, subnet.String())
+	if cluster.GatewayInterface != "" {
+		// the gateway router only carries the IPv4 traffic of the pods
+		for _, subnet := range subnets {
+			if _, ipnet, _ := net.ParseCIDR(subnet); familyOf(ipnet.IP) == ipv4 {
+				return cluster.setupGateway(nodeName, nodeIP, subnet)
+			}
+		}
+		return fmt.Errorf("the gateway router of node %s needs an IPv4 host subnet, the node has %s", nodeName, strings.Join(subnets, ","))
+	}
+	return nil
+}
 
-	out, err := exec.Command("ovnkube-setup-node", cluster.Token, nodeIP, cluster.KubeServer, subnet.String(), cluster.ClusterIPNet.String(), name).CombinedOutput()
-	if err != nil {
-		glog.Errorf("Error in setting up node - %s (%v)", string(out), err)
+// managementInterfaceName returns the name of the management port of the
+// host, within the 15 characters allowed for interface names
+func managementInterfaceName(nodeName string) string {
+	name := "k8s-" + nodeName
+	if len(name) > 15 {
+		return name[:15]
 	}
+	return name
+}
 
-	return err
+// configureManagementInterface gives the management interface its addresses
+// and routes the cluster networks through the gateway of their IP family on
+// the node router port
+func (cluster *OvnClusterController) configureManagementInterface(iface string, addresses, gateways []string) error {
+	commands := [][]string{
+		{"ip", "link", "set", "dev", iface, "up"},
+		{"ip", "addr", "flush", "dev", iface},
+	}
+	for _, address := range addresses {
+		// the address is unique on the node switch, it is used right away
+		// rather than after duplicate address detection
+		cmd := []string{"ip", "addr", "add", address, "dev", iface}
+		if ip, _, _ := net.ParseCIDR(address); familyOf(ip) == ipv6 {
+			cmd = append(cmd, "nodad")
+		}
+		commands = append(commands, cmd)
+	}
+	gatewayIPs := make(map[ipFamily]string)
+	for _, gateway := range gateways {
+		ip, _, _ := net.ParseCIDR(gateway)
+		gatewayIPs[familyOf(ip)] = ip.String()
+	}
+	for _, network := range cluster.ClusterNetworks {
+		gatewayIP, ok := gatewayIPs[familyOf(network.CIDR.IP)]
+		if !ok {
+			continue
+		}
+		commands = append(commands, []string{"ip", "route", "replace", network.CIDR.String(), "via", gatewayIP, "dev", iface})
+	}
+	for _, cmd := range commands {
+		out, err := cluster.Exec(cmd[0], cmd[1:]...)
+		if err != nil {
+			return fmt.Errorf("%s failed - %v (%s)", strings.Join(cmd, " "), err, strings.TrimSpace(out))
+		}
+	}
+	return nil
 }
@@ -0,0 +1,286 @@
+package cluster
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kapi "k8s.io/client-go/pkg/api/v1"
+
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb/fake"
+)
+
+// testNode is a cluster controller of a node on fake northbound and
+// Open_vSwitch databases, with a master set up and the commands it runs
+// recorded
+type testNode struct {
+	cluster   *OvnClusterController
+	nbServer  *fake.Server
+	ovsServer *fake.Server
+	commands  []string
+}
+
+func newTestNode(t *testing.T) *testNode {
+	nbServer, nbClient := newTestClient(t, ovsdb.NBDatabase, ovsdb.NBTables)
+	ovsServer, ovsClient := newTestClient(t, ovsdb.OVSDatabase, ovsdb.OVSTables)
+	_, clusterNet, _ := net.ParseCIDR("10.128.0.0/14")
+	n := &testNode{nbServer: nbServer, ovsServer: ovsServer}
+	n.cluster = &OvnClusterController{
+		OvnNB:             nbClient,
+		OvsDB:             ovsClient,
+		KubeServer:        "https://10.0.0.1:8443",
+		Token:             "secret",
+		ClusterNetworks:   []ClusterNetwork{{CIDR: clusterNet, HostPrefixLength: 24}},
+		SouthboundAddress: "tcp:10.0.0.1:6642",
+		Exec: func(cmd string, args ...string) (string, error) {
+			n.commands = append(n.commands, strings.Join(append([]string{cmd}, args...), " "))
+			return "", nil
+		},
+	}
+	return n
+}
+
+// setup sets up the master and the local Open_vSwitch database
+func (n *testNode) setup(t *testing.T) {
+	if err := n.cluster.SetupMaster("master", "10.128.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	n.ovsServer.Insert(ovsdb.OpenvSwitchTable, ovsdb.Row{
+		"external_ids": ovsdb.NewOvsMap(map[string]string{"system-id": "chassis1"}),
+	})
+	n.ovsServer.Insert(ovsdb.BridgeTable, ovsdb.Row{"name": "br-int"})
+	n.ovsServer.Insert(ovsdb.BridgeTable, ovsdb.Row{"name": "br-ex"})
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := n.cluster.OvsDB.BridgeByName("br-ex"); err != nil; _, err = n.cluster.OvsDB.BridgeByName("br-ex") {
+		if time.Now().After(deadline) {
+			t.Fatalf("the bridges never reached the cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (n *testNode) close() {
+	n.cluster.OvnNB.Close()
+	n.cluster.OvsDB.Close()
+	n.nbServer.Close()
+	n.ovsServer.Close()
+}
+
+func TestSetupNode(t *testing.T) {
+	n := newTestNode(t)
+	defer n.close()
+	cluster := n.cluster
+	nbClient := cluster.OvnNB
+	ovsClient := cluster.OvsDB
+
+	// the node needs the cluster router of the master
+	if err := cluster.SetupNode("node1", "10.0.0.2", "10.128.1.0/24"); err == nil {
+		t.Errorf("expected an error before the master is set up")
+	}
+	n.setup(t)
+
+	// a second run must leave the same setup
+	for i := 0; i < 2; i++ {
+		n.commands = nil
+		if err := cluster.SetupNode("node1", "10.0.0.2", "10.128.1.0/24"); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+
+		root, err := ovsClient.OpenvSwitchRoot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedIDs := map[string]string{
+			"system-id":          "chassis1",
+			"ovn-remote":         "tcp:10.0.0.1:6642",
+			"ovn-encap-ip":       "10.0.0.2",
+			"ovn-encap-type":     "geneve",
+			"k8s-api-server":     "https://10.0.0.1:8443",
+			"k8s-api-token":      "secret",
+			"k8s-ca-certificate": "",
+		}
+		if !reflect.DeepEqual(root.ExternalIDs, expectedIDs) {
+			t.Errorf("run %d: expected external_ids %v, got %v", i, expectedIDs, root.ExternalIDs)
+		}
+
+		ls, err := nbClient.LogicalSwitchByName("node1")
+		if err != nil {
+			t.Fatalf("run %d: no node switch: %v", i, err)
+		}
+		if ls.OtherConfig["subnet"] != "10.128.1.0/24" || ls.ExternalIDs["gateway_ip"] != "10.128.1.1/24" {
+			t.Errorf("run %d: unexpected node switch config %v %v", i, ls.OtherConfig, ls.ExternalIDs)
+		}
+		if len(ls.LoadBalancer) != 3 || len(ls.LoadBalancerGroup) != 1 || len(ls.Ports) != 2 {
+			t.Errorf("run %d: expected the node switch to have 3 load balancers, the group and 2 ports, got %+v", i, ls)
+		}
+		ports := routerPortNames(t, nbClient, OVN_CLUSTER_ROUTER)
+		expectedPorts := []string{"rtoj-ovn_cluster_router", "rtos-master", "rtos-node1"}
+		if !reflect.DeepEqual(ports, expectedPorts) {
+			t.Errorf("run %d: expected router ports %v, got %v", i, expectedPorts, ports)
+		}
+		lsp, err := nbClient.LogicalSwitchPortByName("k8s-node1")
+		if err != nil || !reflect.DeepEqual(lsp.Addresses, []string{"0a:58:0a:80:01:02 10.128.1.2"}) {
+			t.Errorf("run %d: unexpected management logical port %+v (%v)", i, lsp, err)
+		}
+
+		br, _ := ovsClient.BridgeByName("br-int")
+		iface, err := ovsClient.InterfaceByName("k8s-node1")
+		if len(br.Ports) != 1 || err != nil || iface.Type != "internal" || iface.MAC != "0a:58:0a:80:01:02" ||
+			iface.ExternalIDs["iface-id"] != "k8s-node1" {
+			t.Errorf("run %d: unexpected management port %+v on %+v (%v)", i, iface, br, err)
+		}
+
+		expectedCommands := []string{
+			"ip link set dev k8s-node1 up",
+			"ip addr flush dev k8s-node1",
+			"ip addr add 10.128.1.2/24 dev k8s-node1",
+			"ip route replace 10.128.0.0/14 via 10.128.1.1 dev k8s-node1",
+		}
+		if !reflect.DeepEqual(n.commands, expectedCommands) {
+			t.Errorf("run %d: expected commands %v, got %v", i, expectedCommands, n.commands)
+		}
+	}
+}
+
+func TestSetupNodeDualStack(t *testing.T) {
+	n := newTestNode(t)
+	defer n.close()
+	n.setup(t)
+	cluster := n.cluster
+	nbClient := cluster.OvnNB
+	_, clusterNet6, _ := net.ParseCIDR("fd00:10:128::/48")
+	cluster.ClusterNetworks = append(cluster.ClusterNetworks, ClusterNetwork{CIDR: clusterNet6, HostPrefixLength: 64})
+	if err := cluster.SetupMaster("master", "10.128.0.0/24", "fd00:10:128::/64"); err != nil {
+		t.Fatal(err)
+	}
+	n.commands = nil
+	if err := cluster.SetupNode("node1", "10.0.0.2", "10.128.1.0/24", "fd00:10:128:1::/64"); err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := nbClient.LogicalSwitchByName("node1")
+	if err != nil {
+		t.Fatalf("no node switch: %v", err)
+	}
+	if ls.OtherConfig["subnet"] != "10.128.1.0/24" || ls.OtherConfig["ipv6_prefix"] != "fd00:10:128:1::" ||
+		ls.ExternalIDs["gateway_ip"] != "10.128.1.1/24" || ls.ExternalIDs["gateway_ip_v6"] != "fd00:10:128:1::1/64" {
+		t.Errorf("unexpected node switch config %v %v", ls.OtherConfig, ls.ExternalIDs)
+	}
+	lrp, err := nbClient.LogicalRouterPortByName("rtos-node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks := append([]string(nil), lrp.Networks...)
+	sort.Strings(networks)
+	if lrp.MAC != "0a:58:0a:80:01:01" || !reflect.DeepEqual(networks, []string{"10.128.1.1/24", "fd00:10:128:1::1/64"}) {
+		t.Errorf("unexpected router port %+v", lrp)
+	}
+	lsp, err := nbClient.LogicalSwitchPortByName("k8s-node1")
+	if err != nil || !reflect.DeepEqual(lsp.Addresses, []string{"0a:58:0a:80:01:02 10.128.1.2 fd00:10:128:1::2"}) {
+		t.Errorf("unexpected management logical port %+v (%v)", lsp, err)
+	}
+	expectedCommands := []string{
+		"ip link set dev k8s-node1 up",
+		"ip addr flush dev k8s-node1",
+		"ip addr add 10.128.1.2/24 dev k8s-node1",
+		"ip addr add fd00:10:128:1::2/64 dev k8s-node1 nodad",
+		"ip route replace 10.128.0.0/14 via 10.128.1.1 dev k8s-node1",
+		"ip route replace fd00:10:128::/48 via fd00:10:128:1::1 dev k8s-node1",
+	}
+	if !reflect.DeepEqual(n.commands, expectedCommands) {
+		t.Errorf("expected commands %v, got %v", expectedCommands, n.commands)
+	}
+
+	// an IPv6 only node has no gateway router
+	cluster.GatewayInterface = "eth1"
+	cluster.GatewayNextHop = "192.168.1.1"
+	if err := cluster.SetupNode("node2", "10.0.0.3", "fd00:10:128:2::/64"); err == nil {
+		t.Errorf("expected an error setting up the gateway of an IPv6 only node")
+	}
+}
+
+func TestUpdateEncapIP(t *testing.T) {
+	n := newTestNode(t)
+	defer n.close()
+	n.setup(t)
+	cluster := n.cluster
+	if err := cluster.SetupNode("node1", "10.0.0.2", "10.128.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	node := &kapi.Node{Status: kapi.NodeStatus{Addresses: []kapi.NodeAddress{
+		{Type: kapi.NodeHostName, Address: "node1"},
+		{Type: kapi.NodeInternalIP, Address: "10.0.0.12"},
+	}}}
+	if err := cluster.updateEncapIP(nodeInternalIP(node)); err != nil {
+		t.Fatal(err)
+	}
+	root, _ := cluster.OvsDB.OpenvSwitchRoot()
+	if root.ExternalIDs["ovn-encap-ip"] != "10.0.0.12" || root.ExternalIDs["ovn-remote"] != "tcp:10.0.0.1:6642" {
+		t.Errorf("expected the encap ip to move to 10.0.0.12, got %v", root.ExternalIDs)
+	}
+
+	// a node without an address keeps the encap ip
+	if err := cluster.updateEncapIP(nodeInternalIP(&kapi.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	if root, _ = cluster.OvsDB.OpenvSwitchRoot(); root.ExternalIDs["ovn-encap-ip"] != "10.0.0.12" {
+		t.Errorf("expected the encap ip to stay 10.0.0.12, got %v", root.ExternalIDs)
+	}
+}
+
+func TestManagementInterfaceName(t *testing.T) {
+	if name := managementInterfaceName("node1"); name != "k8s-node1" {
+		t.Errorf("expected k8s-node1, got %s", name)
+	}
+	if name := managementInterfaceName("ip-10-0-0-2.ec2.internal"); name != "k8s-ip-10-0-0-2" {
+		t.Errorf("expected the name to be truncated to 15 characters, got %s", name)
+	}
+}
+
+func TestStartClusterNodeWithoutSubnet(t *testing.T) {
+	defer func(interval, timeout time.Duration) {
+		nodeSubnetInterval, nodeSubnetTimeout = interval, timeout
+	}(nodeSubnetInterval, nodeSubnetTimeout)
+	nodeSubnetInterval, nodeSubnetTimeout = 10*time.Millisecond, 100*time.Millisecond
+
+	_, clusterNet, _ := net.ParseCIDR("10.128.0.0/14")
+	fakeKube := kube.NewFakeKube()
+	cluster := &OvnClusterController{
+		Kube:            fakeKube,
+		ClusterNetworks: []ClusterNetwork{{CIDR: clusterNet, HostPrefixLength: 24}},
+	}
+
+	// the node is not registered yet
+	start := time.Now()
+	err := cluster.StartClusterNode("node1")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected the node not to be found, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < nodeSubnetTimeout {
+		t.Errorf("expected the node to be waited for %v, gave up after %v", nodeSubnetTimeout, elapsed)
+	}
+
+	// the master has not annotated the node yet
+	fakeKube.AddNode(&kapi.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	err = cluster.StartClusterNode("node1")
+	if err == nil || !strings.Contains(err.Error(), "no annotation") {
+		t.Errorf("expected the missing subnet annotation to be reported, got %v", err)
+	}
+
+	fakeKube.AddNode(&kapi.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "node1",
+		Annotations: map[string]string{hostSubnetAnnotation(ipv4): "not-a-subnet"},
+	}})
+	start = time.Now()
+	err = cluster.StartClusterNode("node1")
+	if err == nil || time.Since(start) >= nodeSubnetTimeout {
+		t.Errorf("expected an invalid subnet to fail without waiting, got %v", err)
+	}
+}
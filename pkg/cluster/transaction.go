@@ -0,0 +1,442 @@
+package cluster
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+)
+
+// transaction collects the operations that create the missing rows of a
+// setup and update the rows that already exist, so that running the setup
+// again converges instead of failing or duplicating rows. Rows inserted by the
+// transaction are referred to by named uuids until it is committed.
+type transaction struct {
+	client *ovsdb.Client
+	db     string
+	ops    []ovsdb.Operation
+	named  int
+}
+
+// newNBTransaction returns a transaction on the OVN northbound database
+func newNBTransaction(client *ovsdb.Client) *transaction {
+	return &transaction{client: client, db: ovsdb.NBDatabase}
+}
+
+// newOVSTransaction returns a transaction on the local Open_vSwitch database
+func newOVSTransaction(client *ovsdb.Client) *transaction {
+	return &transaction{client: client, db: ovsdb.OVSDatabase}
+}
+
+// newSBTransaction returns a transaction on the OVN southbound database
+func newSBTransaction(client *ovsdb.Client) *transaction {
+	return &transaction{client: client, db: ovsdb.SBDatabase}
+}
+
+func (t *transaction) insert(table string, row ovsdb.Row) ovsdb.UUID {
+	t.named++
+	name := fmt.Sprintf("row%d", t.named)
+	t.ops = append(t.ops, ovsdb.Operation{
+		Op:       "insert",
+		Table:    table,
+		Row:      row,
+		UUIDName: name,
+	})
+	return ovsdb.UUID{GoUUID: name}
+}
+
+func (t *transaction) update(table string, uuid ovsdb.UUID, row ovsdb.Row) {
+	t.ops = append(t.ops, ovsdb.Operation{
+		Op:    "update",
+		Table: table,
+		Where: []ovsdb.Condition{ovsdb.NewCondition("_uuid", "==", uuid)},
+		Row:   row,
+	})
+}
+
+func (t *transaction) mutate(table string, uuid ovsdb.UUID, mutations ...ovsdb.Mutation) {
+	if len(mutations) == 0 {
+		return
+	}
+	t.ops = append(t.ops, ovsdb.Operation{
+		Op:        "mutate",
+		Table:     table,
+		Where:     []ovsdb.Condition{ovsdb.NewCondition("_uuid", "==", uuid)},
+		Mutations: mutations,
+	})
+}
+
+func (t *transaction) delete(table string, uuid ovsdb.UUID) {
+	t.ops = append(t.ops, ovsdb.Operation{
+		Op:    "delete",
+		Table: table,
+		Where: []ovsdb.Condition{ovsdb.NewCondition("_uuid", "==", uuid)},
+	})
+}
+
+// waitNone makes the transaction fail unless no row of the table matches the
+// conditions, e.g. when another client took the value picked from the cache.
+// It returns the index of the operation, at which the transaction fails.
+func (t *transaction) waitNone(table string, where ...ovsdb.Condition) int {
+	t.ops = append(t.ops, ovsdb.Operation{
+		Op:      "wait",
+		Table:   table,
+		Where:   where,
+		Columns: []string{"name"},
+		Until:   "==",
+		Rows:    []ovsdb.Row{},
+	})
+	return len(t.ops) - 1
+}
+
+// detach removes the referenced row from the set column of the row
+func (t *transaction) detach(table string, uuid ovsdb.UUID, column string, ref ovsdb.UUID) {
+	t.mutate(table, uuid, ovsdb.NewMutation(column, "delete", ovsdb.NewOvsSet(ref)))
+}
+
+// setKeys returns the mutations that set the given keys of a map column and
+// leave its other keys alone, a map insert does not overwrite existing keys
+func setKeys(column string, m map[string]string) []ovsdb.Mutation {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return []ovsdb.Mutation{
+		ovsdb.NewMutation(column, "delete", ovsdb.NewOvsSet(keys)),
+		ovsdb.NewMutation(column, "insert", ovsdb.NewOvsMap(m)),
+	}
+}
+
+// logicalRouter returns the router with the given name, creating it if
+// needed, and sets the given options and external_ids keys
+func (t *transaction) logicalRouter(name string, options, externalIDs map[string]string) ovsdb.UUID {
+	if lr, err := t.client.LogicalRouterByName(name); err == nil {
+		uuid := ovsdb.UUID{GoUUID: lr.UUID}
+		mutations := append(setKeys("options", options), setKeys("external_ids", externalIDs)...)
+		t.mutate(ovsdb.LogicalRouterTable, uuid, mutations...)
+		return uuid
+	}
+	return t.insert(ovsdb.LogicalRouterTable, ovsdb.Row{
+		"name":         name,
+		"options":      ovsdb.NewOvsMap(options),
+		"external_ids": ovsdb.NewOvsMap(externalIDs),
+	})
+}
+
+// cachedRouter returns the router if it is in the cache, nil if it does not
+// exist yet or is inserted by the transaction
+func (t *transaction) cachedRouter(router ovsdb.UUID) *ovsdb.LogicalRouter {
+	row, ok := t.client.Rows(ovsdb.LogicalRouterTable)[router.GoUUID]
+	if !ok {
+		return nil
+	}
+	return ovsdb.NewLogicalRouter(row)
+}
+
+// staticRoute creates or updates the route of the router for prefix, policy
+// is either empty, which routes on the destination, or src-ip
+func (t *transaction) staticRoute(router ovsdb.UUID, prefix, nexthop, policy string) {
+	columns := ovsdb.Row{"nexthop": nexthop}
+	if lr := t.cachedRouter(router); lr != nil {
+		rows := t.client.Rows(ovsdb.StaticRouteTable)
+		for _, uuid := range lr.StaticRoutes {
+			route := ovsdb.NewStaticRoute(rows[uuid])
+			if route.IPPrefix == prefix && route.Policy == policy {
+				t.update(ovsdb.StaticRouteTable, ovsdb.UUID{GoUUID: uuid}, columns)
+				return
+			}
+		}
+	}
+	columns["ip_prefix"] = prefix
+	if policy != "" {
+		columns["policy"] = policy
+	}
+	route := t.insert(ovsdb.StaticRouteTable, columns)
+	t.mutate(ovsdb.LogicalRouterTable, router,
+		ovsdb.NewMutation("static_routes", "insert", ovsdb.NewOvsSet(route)))
+}
+
+// snat creates or updates the rule of the router that translates the source
+// of the packets from logicalIP, an address or a subnet, to externalIP
+func (t *transaction) snat(router ovsdb.UUID, logicalIP, externalIP string) {
+	columns := ovsdb.Row{"external_ip": externalIP}
+	if lr := t.cachedRouter(router); lr != nil {
+		rows := t.client.Rows(ovsdb.NATTable)
+		for _, uuid := range lr.Nat {
+			nat := ovsdb.NewNAT(rows[uuid])
+			if nat.Type == "snat" && nat.LogicalIP == logicalIP {
+				t.update(ovsdb.NATTable, ovsdb.UUID{GoUUID: uuid}, columns)
+				return
+			}
+		}
+	}
+	columns["type"] = "snat"
+	columns["logical_ip"] = logicalIP
+	nat := t.insert(ovsdb.NATTable, columns)
+	t.mutate(ovsdb.LogicalRouterTable, router,
+		ovsdb.NewMutation("nat", "insert", ovsdb.NewOvsSet(nat)))
+}
+
+// logicalSwitch returns the switch with the given name, creating it if needed,
+// and sets the given other_config and external_ids keys
+func (t *transaction) logicalSwitch(name string, otherConfig, externalIDs map[string]string) ovsdb.UUID {
+	if ls, err := t.client.LogicalSwitchByName(name); err == nil {
+		uuid := ovsdb.UUID{GoUUID: ls.UUID}
+		mutations := append(setKeys("other_config", otherConfig), setKeys("external_ids", externalIDs)...)
+		t.mutate(ovsdb.LogicalSwitchTable, uuid, mutations...)
+		return uuid
+	}
+	return t.insert(ovsdb.LogicalSwitchTable, ovsdb.Row{
+		"name":         name,
+		"other_config": ovsdb.NewOvsMap(otherConfig),
+		"external_ids": ovsdb.NewOvsMap(externalIDs),
+	})
+}
+
+// logicalRouterPort creates or updates a port of the router
+func (t *transaction) logicalRouterPort(router ovsdb.UUID, name, mac string, networks []string) {
+	columns := ovsdb.Row{
+		"mac":      mac,
+		"networks": ovsdb.NewOvsSet(networks),
+	}
+	var port ovsdb.UUID
+	if lrp, err := t.client.LogicalRouterPortByName(name); err == nil {
+		port = ovsdb.UUID{GoUUID: lrp.UUID}
+		t.update(ovsdb.LogicalRouterPortTable, port, columns)
+	} else {
+		columns["name"] = name
+		port = t.insert(ovsdb.LogicalRouterPortTable, columns)
+	}
+	t.mutate(ovsdb.LogicalRouterTable, router,
+		ovsdb.NewMutation("ports", "insert", ovsdb.NewOvsSet(port)))
+}
+
+// logicalSwitchPort creates or updates a port of the switch with the given
+// columns
+func (t *transaction) logicalSwitchPort(ls ovsdb.UUID, name string, columns ovsdb.Row) {
+	var port ovsdb.UUID
+	if lsp, err := t.client.LogicalSwitchPortByName(name); err == nil {
+		port = ovsdb.UUID{GoUUID: lsp.UUID}
+		t.update(ovsdb.LogicalSwitchPortTable, port, columns)
+	} else {
+		row := ovsdb.Row{"name": name}
+		for column, value := range columns {
+			row[column] = value
+		}
+		port = t.insert(ovsdb.LogicalSwitchPortTable, row)
+	}
+	t.mutate(ovsdb.LogicalSwitchTable, ls,
+		ovsdb.NewMutation("ports", "insert", ovsdb.NewOvsSet(port)))
+}
+
+// connectToRouter connects the switch to the router through a pair of ports,
+// the router port gets the networks, addresses with their prefix length, and
+// a mac derived from the first one
+func (t *transaction) connectToRouter(router, ls ovsdb.UUID, routerPort, switchPort string, networks ...string) error {
+	var mac string
+	for _, network := range networks {
+		ip, _, err := net.ParseCIDR(network)
+		if err != nil {
+			return fmt.Errorf("invalid router port network %q - %v", network, err)
+		}
+		if mac == "" {
+			mac = ipToMAC(ip)
+		}
+	}
+	if mac == "" {
+		return fmt.Errorf("no network for router port %s", routerPort)
+	}
+
+	t.logicalRouterPort(router, routerPort, mac, networks)
+	t.logicalSwitchPort(ls, switchPort, ovsdb.Row{
+		"type":      "router",
+		"addresses": ovsdb.NewOvsSet(mac),
+		"options":   ovsdb.NewOvsMap(map[string]string{"router-port": routerPort}),
+	})
+	return nil
+}
+
+// loadBalancer returns the load balancer with all the given external_ids,
+// creating it if needed, with the given options set
+func (t *transaction) loadBalancer(externalIDs map[string]string, protocol string, options map[string]string) ovsdb.UUID {
+	for _, lb := range t.client.LoadBalancers() {
+		if hasExternalIDs(lb.ExternalIDs, externalIDs) {
+			uuid := ovsdb.UUID{GoUUID: lb.UUID}
+			t.mutate(ovsdb.LoadBalancerTable, uuid, setKeys("options", options)...)
+			return uuid
+		}
+	}
+	return t.insert(ovsdb.LoadBalancerTable, ovsdb.Row{
+		"protocol":     protocol,
+		"options":      ovsdb.NewOvsMap(options),
+		"external_ids": ovsdb.NewOvsMap(externalIDs),
+	})
+}
+
+// attachLoadBalancers adds the load balancers to the switch
+func (t *transaction) attachLoadBalancers(ls ovsdb.UUID, lbs ...ovsdb.UUID) {
+	t.mutate(ovsdb.LogicalSwitchTable, ls,
+		ovsdb.NewMutation("load_balancer", "insert", ovsdb.NewOvsSet(lbs)))
+}
+
+// loadBalancerGroup returns the load balancer group with the given name,
+// creating it if needed
+func (t *transaction) loadBalancerGroup(name string) ovsdb.UUID {
+	if group, err := t.client.LoadBalancerGroupByName(name); err == nil {
+		return ovsdb.UUID{GoUUID: group.UUID}
+	}
+	return t.insert(ovsdb.LoadBalancerGroupTable, ovsdb.Row{"name": name})
+}
+
+// attachLoadBalancerGroup adds the load balancer group to the switch
+func (t *transaction) attachLoadBalancerGroup(ls, group ovsdb.UUID) {
+	t.mutate(ovsdb.LogicalSwitchTable, ls,
+		ovsdb.NewMutation("load_balancer_group", "insert", ovsdb.NewOvsSet(group)))
+}
+
+// attachRouterLoadBalancerGroup adds the load balancer group to the router
+func (t *transaction) attachRouterLoadBalancerGroup(lr, group ovsdb.UUID) {
+	t.mutate(ovsdb.LogicalRouterTable, lr,
+		ovsdb.NewMutation("load_balancer_group", "insert", ovsdb.NewOvsSet(group)))
+}
+
+// attachRouterLoadBalancers adds the load balancers to the router
+func (t *transaction) attachRouterLoadBalancers(lr ovsdb.UUID, lbs ...ovsdb.UUID) {
+	t.mutate(ovsdb.LogicalRouterTable, lr,
+		ovsdb.NewMutation("load_balancer", "insert", ovsdb.NewOvsSet(lbs)))
+}
+
+// setOpenvSwitchExternalIDs sets the given external_ids keys of the
+// Open_vSwitch table
+func (t *transaction) setOpenvSwitchExternalIDs(externalIDs map[string]string) error {
+	root, err := t.client.OpenvSwitchRoot()
+	if err != nil {
+		return fmt.Errorf("no Open_vSwitch row - %v", err)
+	}
+	t.mutate(ovsdb.OpenvSwitchTable, ovsdb.UUID{GoUUID: root.UUID}, setKeys("external_ids", externalIDs)...)
+	return nil
+}
+
+// internalPort creates or updates an internal port of the bridge, with an
+// interface of the same name
+func (t *transaction) internalPort(bridge, name, mac string, externalIDs map[string]string) error {
+	return t.bridgePort(bridge, name, ovsdb.Row{"type": "internal", "mac": mac}, externalIDs)
+}
+
+// bridgePort creates or updates a port of the bridge, with an interface of
+// the same name that has the given columns
+func (t *transaction) bridgePort(bridge, name string, columns ovsdb.Row, externalIDs map[string]string) error {
+	br, err := t.client.BridgeByName(bridge)
+	if err != nil {
+		return fmt.Errorf("no bridge %s - %v", bridge, err)
+	}
+	if iface, err := t.client.InterfaceByName(name); err == nil {
+		uuid := ovsdb.UUID{GoUUID: iface.UUID}
+		if len(columns) > 0 {
+			t.update(ovsdb.InterfaceTable, uuid, columns)
+		}
+		t.mutate(ovsdb.InterfaceTable, uuid, setKeys("external_ids", externalIDs)...)
+	} else {
+		row := ovsdb.Row{
+			"name":         name,
+			"external_ids": ovsdb.NewOvsMap(externalIDs),
+		}
+		for column, value := range columns {
+			row[column] = value
+		}
+		uuid := t.insert(ovsdb.InterfaceTable, row)
+		port := t.insert(ovsdb.PortTable, ovsdb.Row{
+			"name":       name,
+			"interfaces": ovsdb.NewOvsSet(uuid),
+		})
+		t.mutate(ovsdb.BridgeTable, ovsdb.UUID{GoUUID: br.UUID},
+			ovsdb.NewMutation("ports", "insert", ovsdb.NewOvsSet(port)))
+	}
+	return nil
+}
+
+// commit runs the collected operations as a single transaction
+func (t *transaction) commit() error {
+	if len(t.ops) == 0 {
+		return nil
+	}
+	_, err := t.client.Transact(t.db, t.ops...)
+	return err
+}
+
+func hasExternalIDs(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// subnetAddress returns the address at index in the subnet with the prefix
+// length of the subnet, e.g. 10.128.1.1/24 for index 1 of 10.128.1.0/24
+func subnetAddress(subnet string, index int) (string, error) {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", fmt.Errorf("invalid subnet %q - %v", subnet, err)
+	}
+	ip := make(net.IP, len(ipnet.IP))
+	copy(ip, ipnet.IP)
+	for i := len(ip) - 1; i >= 0 && index > 0; i-- {
+		sum := int(ip[i]) + index
+		ip[i] = byte(sum)
+		index = sum >> 8
+	}
+	if !ipnet.Contains(ip) {
+		return "", fmt.Errorf("subnet %s is too small", subnet)
+	}
+	prefixLen, _ := ipnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, prefixLen), nil
+}
+
+// subnetSwitchConfig returns the other_config and the external_ids of the
+// logical switch of the subnets, one of each IP family, and their gateways,
+// the first address of each. ovn-northd allocates the addresses of the ports
+// in the subnet of the IPv4 one and in the /64 prefix of the IPv6 one.
+func subnetSwitchConfig(subnets []string) (map[string]string, map[string]string, []string, error) {
+	otherConfig := make(map[string]string)
+	externalIDs := make(map[string]string)
+	gateways := make([]string, 0, len(subnets))
+	for _, subnet := range subnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid subnet %q - %v", subnet, err)
+		}
+		gateway, err := subnetAddress(subnet, 1)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if familyOf(ipnet.IP) == ipv6 {
+			otherConfig["ipv6_prefix"] = ipnet.IP.String()
+			externalIDs["gateway_ip_v6"] = gateway
+		} else {
+			otherConfig["subnet"] = subnet
+			externalIDs["gateway_ip"] = gateway
+		}
+		gateways = append(gateways, gateway)
+	}
+	return otherConfig, externalIDs, gateways, nil
+}
+
+// ipToMAC derives a locally administered mac address from an address, so
+// that the router ports keep their mac when the setup runs again. The mac of
+// an IPv6 address is made of a hash of it, as the gateways of the host
+// subnets only differ in their prefix.
+func ipToMAC(ip net.IP) string {
+	b := ip.To4()
+	if b == nil {
+		h := fnv.New32a()
+		h.Write(ip.To16())
+		b = h.Sum(nil)
+	}
+	return fmt.Sprintf("0a:58:%02x:%02x:%02x:%02x", b[0], b[1], b[2], b[3])
+}
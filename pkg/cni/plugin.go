@@ -0,0 +1,201 @@
+package cni
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rajatchopra/ovn-kube/pkg/annotation"
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+)
+
+// Plugin plugs pods into the logical ports described by their ovn annotation
+type Plugin struct {
+	// Kube reads the pods, it is only needed by ADD and CHECK
+	Kube kube.KubeInterface
+	// Exec runs a command and returns its combined output
+	Exec func(cmd string, args ...string) (string, error)
+	// AnnotationTimeout is how long ADD waits for the pod to be annotated
+	AnnotationTimeout time.Duration
+}
+
+// hostInterfaceName returns the name of the host end of the veth pair, unique
+// per container and within the 15 characters allowed for interface names
+func hostInterfaceName(containerID string) string {
+	if len(containerID) > 15 {
+		return containerID[:15]
+	}
+	return containerID
+}
+
+func portName(args *Args) string {
+	return fmt.Sprintf("%s_%s", args.PodNamespace, args.PodName)
+}
+
+func (p *Plugin) run(cmd string, args ...string) error {
+	out, err := p.Exec(cmd, args...)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v (%s)", cmd, strings.Join(args, " "), err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// runInNetns runs a command in the network namespace of the pod
+func (p *Plugin) runInNetns(netns string, cmd string, args ...string) error {
+	return p.run("nsenter", append([]string{"--net=" + netns, cmd}, args...)...)
+}
+
+// waitForPodNetwork waits for the controller to annotate the pod
+func (p *Plugin) waitForPodNetwork(args *Args) (*annotation.PodNetwork, error) {
+	deadline := time.Now().Add(p.AnnotationTimeout)
+	for {
+		pod, err := p.Kube.GetPod(args.PodNamespace, args.PodName)
+		if err == nil {
+			var pn *annotation.PodNetwork
+			pn, err = annotation.GetPodNetwork(pod)
+			if err == nil {
+				return pn, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, newError(ErrTryAgainLater, "timed out waiting for the pod network annotation", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// CmdAdd creates a veth pair into the pod network namespace, configures the
+// pod end from the annotation and attaches the host end to the integration
+// bridge as the logical port of the pod. It returns the CNI result.
+func (p *Plugin) CmdAdd(args *Args, conf *NetConf) (interface{}, error) {
+	pn, err := p.waitForPodNetwork(args)
+	if err != nil {
+		return nil, err
+	}
+	result, err := newResult(conf.CNIVersion, args, pn)
+	if err != nil {
+		return nil, newError(ErrInternal, "invalid pod network annotation", err)
+	}
+
+	err = p.setupInterfaces(args, conf, pn)
+	if err != nil {
+		// leave nothing half configured behind
+		p.CmdDel(args, conf)
+		return nil, newError(ErrInternal, "failed to set up the pod interface", err)
+	}
+	return result, nil
+}
+
+func (p *Plugin) setupInterfaces(args *Args, conf *NetConf, pn *annotation.PodNetwork) error {
+	hostIf := hostInterfaceName(args.ContainerID)
+
+	// the pair is created in the pod namespace so that its path can be used,
+	// and the host end moved to the namespace of pid 1
+	err := p.runInNetns(args.Netns, "ip", "link", "add", args.IfName, "type", "veth", "peer", "name", hostIf)
+	if err != nil {
+		return err
+	}
+	err = p.runInNetns(args.Netns, "ip", "link", "set", "dev", hostIf, "netns", "1")
+	if err != nil {
+		return err
+	}
+
+	setup := [][]string{{"ip", "link", "set", "dev", args.IfName, "address", pn.MACAddress}}
+	if conf.MTU > 0 {
+		setup = append(setup, []string{"ip", "link", "set", "dev", args.IfName, "mtu", fmt.Sprint(conf.MTU)})
+	}
+	setup = append(setup, []string{"ip", "link", "set", "dev", args.IfName, "up"})
+	addresses, _ := pn.Addresses()
+	for _, address := range addresses {
+		// the addresses of the logical port are unique, the pod does not wait
+		// for duplicate address detection on its IPv6 address
+		cmd := []string{"ip", "addr", "add", address, "dev", args.IfName}
+		if ip, _, _ := net.ParseCIDR(address); ip.To4() == nil {
+			cmd = append(cmd, "nodad")
+		}
+		setup = append(setup, cmd)
+	}
+	for _, route := range podRoutes(pn) {
+		dst := route.Dst
+		if dst == "0.0.0.0/0" || dst == "::/0" {
+			dst = "default"
+		}
+		setup = append(setup, []string{"ip", "route", "add", dst, "via", route.GW, "dev", args.IfName})
+	}
+	for _, cmd := range setup {
+		err = p.runInNetns(args.Netns, cmd[0], cmd[1:]...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if conf.MTU > 0 {
+		err = p.run("ip", "link", "set", "dev", hostIf, "mtu", fmt.Sprint(conf.MTU))
+		if err != nil {
+			return err
+		}
+	}
+	err = p.run("ip", "link", "set", "dev", hostIf, "up")
+	if err != nil {
+		return err
+	}
+	return p.run("ovs-vsctl", "--may-exist", "add-port", conf.Bridge, hostIf,
+		"--", "set", "interface", hostIf,
+		"external_ids:attached_mac="+pn.MACAddress,
+		"external_ids:iface-id="+portName(args),
+		"external_ids:ip_address="+pn.IPAddress)
+}
+
+// CmdDel detaches the pod from the integration bridge and removes its veth
+// pair. Deleting a pod that is not plugged is not an error.
+func (p *Plugin) CmdDel(args *Args, conf *NetConf) error {
+	hostIf := hostInterfaceName(args.ContainerID)
+	err := p.run("ovs-vsctl", "--if-exists", "del-port", conf.Bridge, hostIf)
+	if err != nil {
+		return newError(ErrInternal, "failed to detach the pod interface", err)
+	}
+	// removing either end removes the pair, the host end is there even when
+	// the pod namespace is already gone
+	if out, err := p.Exec("ip", "link", "show", "dev", hostIf); err == nil && out != "" {
+		err = p.run("ip", "link", "del", "dev", hostIf)
+		if err != nil {
+			return newError(ErrInternal, "failed to remove the pod interface", err)
+		}
+	}
+	return nil
+}
+
+// CmdCheck verifies that the pod is still plugged as CmdAdd left it
+func (p *Plugin) CmdCheck(args *Args, conf *NetConf) error {
+	pod, err := p.Kube.GetPod(args.PodNamespace, args.PodName)
+	if err != nil {
+		return newError(ErrInternal, "failed to get the pod", err)
+	}
+	pn, err := annotation.GetPodNetwork(pod)
+	if err != nil {
+		return newError(ErrInternal, "invalid pod network annotation", err)
+	}
+
+	hostIf := hostInterfaceName(args.ContainerID)
+	out, err := p.Exec("ovs-vsctl", "--if-exists", "get", "interface", hostIf, "external_ids:iface-id")
+	if err != nil || strings.Trim(strings.TrimSpace(out), `"`) != portName(args) {
+		return newError(ErrInternal, "the pod interface is not attached to its logical port",
+			fmt.Errorf("%s has iface-id %q", hostIf, strings.TrimSpace(out)))
+	}
+
+	out, err = p.Exec("nsenter", "--net="+args.Netns, "ip", "-o", "addr", "show", "dev", args.IfName)
+	addresses, _ := pn.Addresses()
+	for _, address := range addresses {
+		if err != nil || !strings.Contains(out, " "+address+" ") {
+			return newError(ErrInternal, "the pod interface does not have its address",
+				fmt.Errorf("%s has no address %s", args.IfName, address))
+		}
+	}
+	out, err = p.Exec("nsenter", "--net="+args.Netns, "ip", "-o", "link", "show", "dev", args.IfName)
+	if err != nil || !strings.Contains(out, pn.MACAddress) {
+		return newError(ErrInternal, "the pod interface does not have its mac address",
+			fmt.Errorf("%s has no mac address %s", args.IfName, pn.MACAddress))
+	}
+	return nil
+}
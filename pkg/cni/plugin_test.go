@@ -0,0 +1,227 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kapi "k8s.io/client-go/pkg/api/v1"
+)
+
+// fakeExec records the commands run and fails the ones starting with a
+// prefix in failures
+type fakeExec struct {
+	commands []string
+	outputs  map[string]string
+	failures []string
+}
+
+func (f *fakeExec) exec(cmd string, args ...string) (string, error) {
+	line := strings.Join(append([]string{cmd}, args...), " ")
+	f.commands = append(f.commands, line)
+	for _, prefix := range f.failures {
+		if strings.HasPrefix(line, prefix) {
+			return "", fmt.Errorf("exit status 1")
+		}
+	}
+	return f.outputs[line], nil
+}
+
+func newTestArgs() *Args {
+	return &Args{
+		Command:      "ADD",
+		ContainerID:  "0123456789abcdef0123",
+		Netns:        "/proc/42/ns/net",
+		IfName:       "eth0",
+		PodNamespace: "default",
+		PodName:      "web",
+	}
+}
+
+func newAnnotatedPod() *kapi.Pod {
+	return &kapi.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "web",
+			Annotations: map[string]string{
+				"ovn": `{"version":1,"ip_address":"10.128.1.2/24","mac_address":"0a:00:0a:80:01:02","gateway_ip":"10.128.1.1"}`,
+			},
+		},
+	}
+}
+
+func TestArgsFromEnv(t *testing.T) {
+	env := map[string]string{
+		"CNI_COMMAND":     "ADD",
+		"CNI_CONTAINERID": "0123456789abcdef0123",
+		"CNI_NETNS":       "/proc/42/ns/net",
+		"CNI_IFNAME":      "eth0",
+		"CNI_ARGS":        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web;K8S_POD_INFRA_CONTAINER_ID=0123",
+	}
+	args, err := ArgsFromEnv(func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, newTestArgs()) {
+		t.Errorf("expected %+v, got %+v", newTestArgs(), args)
+	}
+
+	// DEL does not need the netns nor the pod
+	env = map[string]string{"CNI_COMMAND": "DEL", "CNI_CONTAINERID": "0123", "CNI_IFNAME": "eth0"}
+	if _, err = ArgsFromEnv(func(key string) string { return env[key] }); err != nil {
+		t.Errorf("unexpected error for DEL: %v", err)
+	}
+	env["CNI_COMMAND"] = "ADD"
+	if _, err = ArgsFromEnv(func(key string) string { return env[key] }); err == nil {
+		t.Errorf("expected an error for ADD without netns")
+	}
+}
+
+// dualStackNetwork is the ovn annotation of a dual stack pod
+const dualStackNetwork = `{"version":1,"ip_address":"10.128.1.2/24","mac_address":"0a:00:0a:80:01:02","gateway_ip":"10.128.1.1","ip_addresses":["10.128.1.2/24","fd00:10:128:1::2/64"],"gateway_ips":["10.128.1.1","fd00:10:128:1::1"],"routes":[{"dest":"fd00:172:30::/112"}]}`
+
+func TestAddResult(t *testing.T) {
+	tests := []struct {
+		version string
+		// network is the ovn annotation of the pod, the one of
+		// newAnnotatedPod when empty
+		network string
+		result  string
+	}{
+		{
+			version: "0.2.0",
+			result:  `{"cniVersion":"0.2.0","ip4":{"ip":"10.128.1.2/24","gateway":"10.128.1.1","routes":[{"dst":"0.0.0.0/0","gw":"10.128.1.1"}]}}`,
+		},
+		{
+			version: "0.3.1",
+			result:  `{"cniVersion":"0.3.1","interfaces":[{"name":"eth0","mac":"0a:00:0a:80:01:02","sandbox":"/proc/42/ns/net"}],"ips":[{"version":"4","interface":0,"address":"10.128.1.2/24","gateway":"10.128.1.1"}],"routes":[{"dst":"0.0.0.0/0","gw":"10.128.1.1"}],"dns":{}}`,
+		},
+		{
+			version: "0.2.0",
+			network: dualStackNetwork,
+			result:  `{"cniVersion":"0.2.0","ip4":{"ip":"10.128.1.2/24","gateway":"10.128.1.1","routes":[{"dst":"0.0.0.0/0","gw":"10.128.1.1"}]},"ip6":{"ip":"fd00:10:128:1::2/64","gateway":"fd00:10:128:1::1","routes":[{"dst":"::/0","gw":"fd00:10:128:1::1"},{"dst":"fd00:172:30::/112","gw":"fd00:10:128:1::1"}]}}`,
+		},
+		{
+			version: "0.3.1",
+			network: dualStackNetwork,
+			result:  `{"cniVersion":"0.3.1","interfaces":[{"name":"eth0","mac":"0a:00:0a:80:01:02","sandbox":"/proc/42/ns/net"}],"ips":[{"version":"4","interface":0,"address":"10.128.1.2/24","gateway":"10.128.1.1"},{"version":"6","interface":0,"address":"fd00:10:128:1::2/64","gateway":"fd00:10:128:1::1"}],"routes":[{"dst":"0.0.0.0/0","gw":"10.128.1.1"},{"dst":"::/0","gw":"fd00:10:128:1::1"},{"dst":"fd00:172:30::/112","gw":"fd00:10:128:1::1"}],"dns":{}}`,
+		},
+	}
+	for _, test := range tests {
+		fakeKube := kube.NewFakeKube()
+		pod := newAnnotatedPod()
+		if test.network != "" {
+			pod.Annotations["ovn"] = test.network
+		}
+		fakeKube.AddPod(pod)
+		f := &fakeExec{}
+		plugin := &Plugin{Kube: fakeKube, Exec: f.exec}
+
+		result, err := plugin.CmdAdd(newTestArgs(), &NetConf{CNIVersion: test.version, Bridge: "br-int"})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.version, err)
+			continue
+		}
+		data, _ := json.Marshal(result)
+		if string(data) != test.result {
+			t.Errorf("%s: expected result %s, got %s", test.version, test.result, string(data))
+		}
+	}
+}
+
+func TestAddCommands(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	fakeKube.AddPod(newAnnotatedPod())
+	f := &fakeExec{}
+	plugin := &Plugin{Kube: fakeKube, Exec: f.exec}
+
+	if _, err := plugin.CmdAdd(newTestArgs(), &NetConf{CNIVersion: "0.3.1", Bridge: "br-int", MTU: 1400}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"nsenter --net=/proc/42/ns/net ip link add eth0 type veth peer name 0123456789abcde",
+		"nsenter --net=/proc/42/ns/net ip link set dev 0123456789abcde netns 1",
+		"nsenter --net=/proc/42/ns/net ip link set dev eth0 address 0a:00:0a:80:01:02",
+		"nsenter --net=/proc/42/ns/net ip link set dev eth0 mtu 1400",
+		"nsenter --net=/proc/42/ns/net ip link set dev eth0 up",
+		"nsenter --net=/proc/42/ns/net ip addr add 10.128.1.2/24 dev eth0",
+		"nsenter --net=/proc/42/ns/net ip route add default via 10.128.1.1 dev eth0",
+		"ip link set dev 0123456789abcde mtu 1400",
+		"ip link set dev 0123456789abcde up",
+		"ovs-vsctl --may-exist add-port br-int 0123456789abcde -- set interface 0123456789abcde external_ids:attached_mac=0a:00:0a:80:01:02 external_ids:iface-id=default_web external_ids:ip_address=10.128.1.2/24",
+	}
+	if !reflect.DeepEqual(f.commands, expected) {
+		t.Errorf("expected commands\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(f.commands, "\n"))
+	}
+}
+
+func TestAddCommandsDualStack(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	pod := newAnnotatedPod()
+	pod.Annotations["ovn"] = dualStackNetwork
+	fakeKube.AddPod(pod)
+	f := &fakeExec{}
+	plugin := &Plugin{Kube: fakeKube, Exec: f.exec}
+
+	if _, err := plugin.CmdAdd(newTestArgs(), &NetConf{CNIVersion: "0.3.1", Bridge: "br-int"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"nsenter --net=/proc/42/ns/net ip addr add 10.128.1.2/24 dev eth0",
+		"nsenter --net=/proc/42/ns/net ip addr add fd00:10:128:1::2/64 dev eth0 nodad",
+		"nsenter --net=/proc/42/ns/net ip route add default via 10.128.1.1 dev eth0",
+		"nsenter --net=/proc/42/ns/net ip route add default via fd00:10:128:1::1 dev eth0",
+		"nsenter --net=/proc/42/ns/net ip route add fd00:172:30::/112 via fd00:10:128:1::1 dev eth0",
+	}
+	if !reflect.DeepEqual(f.commands[4:9], expected) {
+		t.Errorf("expected commands\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(f.commands, "\n"))
+	}
+}
+
+func TestAddFailureCleansUp(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	fakeKube.AddPod(newAnnotatedPod())
+	f := &fakeExec{
+		failures: []string{"nsenter --net=/proc/42/ns/net ip addr add"},
+		outputs:  map[string]string{"ip link show dev 0123456789abcde": "7: 0123456789abcde@if2: <BROADCAST,MULTICAST,UP,LOWER_UP>"},
+	}
+	plugin := &Plugin{Kube: fakeKube, Exec: f.exec}
+
+	_, err := plugin.CmdAdd(newTestArgs(), &NetConf{CNIVersion: "0.3.1", Bridge: "br-int"})
+	if cniErr, ok := err.(*Error); !ok || cniErr.Code != ErrInternal {
+		t.Fatalf("expected an internal error, got %v", err)
+	}
+	last := f.commands[len(f.commands)-3:]
+	expected := []string{
+		"ovs-vsctl --if-exists del-port br-int 0123456789abcde",
+		"ip link show dev 0123456789abcde",
+		"ip link del dev 0123456789abcde",
+	}
+	if !reflect.DeepEqual(last, expected) {
+		t.Errorf("expected the cleanup %v, got %v", expected, last)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	fakeKube.AddPod(newAnnotatedPod())
+	f := &fakeExec{outputs: map[string]string{
+		"ovs-vsctl --if-exists get interface 0123456789abcde external_ids:iface-id": "\"default_web\"\n",
+		"nsenter --net=/proc/42/ns/net ip -o addr show dev eth0":                    "3: eth0    inet 10.128.1.2/24 scope global eth0\\       valid_lft forever preferred_lft forever\n",
+		"nsenter --net=/proc/42/ns/net ip -o link show dev eth0":                    "3: eth0@if7: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP mode DEFAULT group default \\    link/ether 0a:00:0a:80:01:02 brd ff:ff:ff:ff:ff:ff\n",
+	}}
+	plugin := &Plugin{Kube: fakeKube, Exec: f.exec}
+	conf := &NetConf{CNIVersion: "0.4.0", Bridge: "br-int"}
+
+	if err := plugin.CmdCheck(newTestArgs(), conf); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	f.outputs["ovs-vsctl --if-exists get interface 0123456789abcde external_ids:iface-id"] = ""
+	if err := plugin.CmdCheck(newTestArgs(), conf); err == nil {
+		t.Errorf("expected an error for a detached interface")
+	}
+}
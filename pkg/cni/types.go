@@ -0,0 +1,290 @@
+// Package cni implements the CNI plugin that plugs pods into the OVN
+// logical ports the controller creates for them.
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rajatchopra/ovn-kube/pkg/annotation"
+)
+
+// SupportedVersions are the CNI spec versions the plugin speaks
+var SupportedVersions = []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0"}
+
+// the CNI error codes
+const (
+	ErrIncompatibleVersion uint = 1
+	ErrInvalidEnvironment  uint = 4
+	ErrDecodingFailure     uint = 6
+	ErrInvalidNetConf      uint = 7
+	ErrTryAgainLater       uint = 11
+	ErrInternal            uint = 999
+)
+
+// Error is the error a plugin prints on failure
+type Error struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Details == "" {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %s", e.Msg, e.Details)
+}
+
+func newError(code uint, msg string, err error) *Error {
+	e := &Error{Code: code, Msg: msg}
+	if err != nil {
+		e.Details = err.Error()
+	}
+	return e
+}
+
+// Args are the arguments the runtime passes to a plugin in its environment
+type Args struct {
+	Command     string
+	ContainerID string
+	Netns       string
+	IfName      string
+	Path        string
+
+	PodNamespace string
+	PodName      string
+}
+
+// ArgsFromEnv reads the plugin arguments with getenv, usually os.Getenv
+func ArgsFromEnv(getenv func(string) string) (*Args, error) {
+	args := &Args{
+		Command:     getenv("CNI_COMMAND"),
+		ContainerID: getenv("CNI_CONTAINERID"),
+		Netns:       getenv("CNI_NETNS"),
+		IfName:      getenv("CNI_IFNAME"),
+		Path:        getenv("CNI_PATH"),
+	}
+	if args.Command == "" {
+		return nil, newError(ErrInvalidEnvironment, "CNI_COMMAND is not set", nil)
+	}
+	if args.Command == "VERSION" {
+		return args, nil
+	}
+
+	required := map[string]string{"CNI_CONTAINERID": args.ContainerID, "CNI_IFNAME": args.IfName}
+	if args.Command != "DEL" {
+		// the network namespace may be gone by the time a pod is deleted
+		required["CNI_NETNS"] = args.Netns
+	}
+	for name, value := range required {
+		if value == "" {
+			return nil, newError(ErrInvalidEnvironment, name+" is not set", nil)
+		}
+	}
+
+	for _, kv := range strings.Split(getenv("CNI_ARGS"), ";") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, newError(ErrInvalidEnvironment, "invalid CNI_ARGS", fmt.Errorf("%q is not a key=value pair", kv))
+		}
+		switch parts[0] {
+		case "K8S_POD_NAMESPACE":
+			args.PodNamespace = parts[1]
+		case "K8S_POD_NAME":
+			args.PodName = parts[1]
+		}
+	}
+	if args.Command != "DEL" && (args.PodNamespace == "" || args.PodName == "") {
+		return nil, newError(ErrInvalidEnvironment, "CNI_ARGS has no K8S_POD_NAMESPACE and K8S_POD_NAME", nil)
+	}
+	return args, nil
+}
+
+// NetConf is the network configuration the runtime passes on stdin
+type NetConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	// Kubeconfig is the kubeconfig used to read the pods, when empty the api
+	// server and token saved in the Open_vSwitch external_ids by the node
+	// setup are used
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Bridge is the integration bridge, br-int by default
+	Bridge string `json:"bridge,omitempty"`
+	// MTU of the pod interface, left to the kernel default when 0
+	MTU int `json:"mtu,omitempty"`
+}
+
+// ParseNetConf decodes and checks the network configuration
+func ParseNetConf(data []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, newError(ErrDecodingFailure, "failed to decode the network configuration", err)
+	}
+	if conf.CNIVersion == "" {
+		conf.CNIVersion = "0.1.0"
+	}
+	if !isSupported(conf.CNIVersion) {
+		return nil, newError(ErrIncompatibleVersion, "unsupported CNI version",
+			fmt.Errorf("%s is not one of %v", conf.CNIVersion, SupportedVersions))
+	}
+	if conf.Bridge == "" {
+		conf.Bridge = "br-int"
+	}
+	if conf.MTU < 0 {
+		return nil, newError(ErrInvalidNetConf, "invalid mtu", fmt.Errorf("%d", conf.MTU))
+	}
+	return conf, nil
+}
+
+func isSupported(version string) bool {
+	for _, v := range SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// VersionInfo is the output of the VERSION command
+type VersionInfo struct {
+	CNIVersion        string   `json:"cniVersion"`
+	SupportedVersions []string `json:"supportedVersions"`
+}
+
+// NewVersionInfo returns the versions the plugin supports
+func NewVersionInfo() *VersionInfo {
+	return &VersionInfo{
+		CNIVersion:        SupportedVersions[len(SupportedVersions)-1],
+		SupportedVersions: SupportedVersions,
+	}
+}
+
+// the results of the 0.1.0 and 0.2.0 specs
+type legacyRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+type legacyIPConfig struct {
+	IP      string        `json:"ip"`
+	Gateway string        `json:"gateway,omitempty"`
+	Routes  []legacyRoute `json:"routes,omitempty"`
+}
+
+type legacyResult struct {
+	CNIVersion string          `json:"cniVersion"`
+	IP4        *legacyIPConfig `json:"ip4,omitempty"`
+	IP6        *legacyIPConfig `json:"ip6,omitempty"`
+}
+
+// the results of the 0.3.0 spec onwards
+type resultInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type resultIPConfig struct {
+	Version   string `json:"version"`
+	Interface *int   `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+}
+
+type result struct {
+	CNIVersion string            `json:"cniVersion"`
+	Interfaces []resultInterface `json:"interfaces,omitempty"`
+	IPs        []resultIPConfig  `json:"ips,omitempty"`
+	Routes     []legacyRoute     `json:"routes,omitempty"`
+	DNS        struct{}          `json:"dns"`
+}
+
+// podRoutes returns the default route of each family of the pod and its
+// extra routes
+func podRoutes(pn *annotation.PodNetwork) []legacyRoute {
+	routes := make([]legacyRoute, 0)
+	addresses, gateways := pn.Addresses()
+	for i, address := range addresses {
+		dst := "0.0.0.0/0"
+		if ip, _, _ := net.ParseCIDR(address); ip.To4() == nil {
+			dst = "::/0"
+		}
+		routes = append(routes, legacyRoute{Dst: dst, GW: gateways[i]})
+	}
+	for _, route := range pn.Routes {
+		gw := route.NextHop
+		if gw == "" {
+			dst, _, _ := net.ParseCIDR(route.Dest)
+			gw = pn.Gateway(dst)
+		}
+		routes = append(routes, legacyRoute{Dst: route.Dest, GW: gw})
+	}
+	return routes
+}
+
+// familyRoutes returns the routes of the family of ip
+func familyRoutes(routes []legacyRoute, ip net.IP) []legacyRoute {
+	family := make([]legacyRoute, 0)
+	for _, route := range routes {
+		dst, _, _ := net.ParseCIDR(route.Dst)
+		if (dst.To4() == nil) == (ip.To4() == nil) {
+			family = append(family, route)
+		}
+	}
+	return family
+}
+
+// newResult returns the result of an ADD in the format of the CNI version
+func newResult(version string, args *Args, pn *annotation.PodNetwork) (interface{}, error) {
+	addresses, gateways := pn.Addresses()
+	routes := podRoutes(pn)
+
+	if version == "0.1.0" || version == "0.2.0" {
+		legacy := &legacyResult{CNIVersion: version}
+		for i, address := range addresses {
+			ip, _, err := net.ParseCIDR(address)
+			if err != nil {
+				return nil, err
+			}
+			config := &legacyIPConfig{
+				IP:      address,
+				Gateway: gateways[i],
+				Routes:  familyRoutes(routes, ip),
+			}
+			if ip.To4() != nil {
+				legacy.IP4 = config
+			} else {
+				legacy.IP6 = config
+			}
+		}
+		return legacy, nil
+	}
+
+	index := 0
+	ips := make([]resultIPConfig, 0, len(addresses))
+	for i, address := range addresses {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, err
+		}
+		ipVersion := "4"
+		if ip.To4() == nil {
+			ipVersion = "6"
+		}
+		ips = append(ips, resultIPConfig{Version: ipVersion, Interface: &index, Address: address, Gateway: gateways[i]})
+	}
+	return &result{
+		CNIVersion: version,
+		Interfaces: []resultInterface{{Name: args.IfName, Mac: pn.MACAddress, Sandbox: args.Netns}},
+		IPs:        ips,
+		Routes:     routes,
+	}, nil
+}
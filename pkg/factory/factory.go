@@ -1,11 +1,15 @@
 package factory
 
 import (
+	"fmt"
 	"time"
 
-	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/fields"
 	informerfactory "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	kapi "k8s.io/client-go/pkg/api/v1"
+	extensions "k8s.io/client-go/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/tools/cache"
 
 	"github.com/rajatchopra/ovn-kube/pkg/cluster"
@@ -18,46 +22,109 @@ type Factory struct {
 	KClient        kubernetes.Interface
 	IFactory       informerfactory.SharedInformerFactory
 	ResyncInterval time.Duration
+
+	// stopChan stops all the informers when closed
+	stopChan <-chan struct{}
+	// informers are the informers that are not managed by IFactory
+	informers []cache.SharedIndexInformer
+	// synced are the sync checks of all the informers handed out
+	synced []cache.InformerSynced
 }
 
-// NewDefaultFactory initializes a default ovn controller factory.
-func NewDefaultFactory(c kubernetes.Interface) *Factory {
+// NewDefaultFactory initializes a default ovn controller factory. The watches
+// it creates run until stopChan is closed.
+func NewDefaultFactory(c kubernetes.Interface, stopChan <-chan struct{}) *Factory {
 	resyncInterval := 10 * time.Minute
 	return &Factory{
 		KClient:        c,
 		ResyncInterval: resyncInterval,
 		IFactory:       informerfactory.NewSharedInformerFactory(c, resyncInterval),
+		stopChan:       stopChan,
 	}
 }
 
-// Create begins listing and watching against the API server for the desired route and endpoint
-// resources. It spawns child goroutines that cannot be terminated.
-func (factory *Factory) CreateOvnController() *ovn.OvnController {
+// Start runs all the informers requested from the factory, each delivering its
+// events to its handlers in its own goroutine, and waits for their caches to
+// sync. It is safe to call Start again after creating more controllers.
+func (factory *Factory) Start() error {
+	factory.IFactory.Start(factory.stopChan)
+	for _, informer := range factory.informers {
+		go informer.Run(factory.stopChan)
+	}
+	factory.informers = nil
 
-	podInformer := factory.IFactory.Core().V1().Pods()
-	endpointsInformer := factory.IFactory.Core().V1().Endpoints()
+	if !cache.WaitForCacheSync(factory.stopChan, factory.synced...) {
+		return fmt.Errorf("Stopped before the informer caches were synced")
+	}
+	return nil
+}
 
-	return &ovn.OvnController{
-		StartPodWatch: func(handler cache.ResourceEventHandler) {
-			podInformer.Informer().AddEventHandler(handler)
-			podInformer.Informer().Run(utilwait.NeverStop)
-		},
-		StartEndpointWatch: func(handler cache.ResourceEventHandler) {
-			endpointsInformer.Informer().AddEventHandler(handler)
-			endpointsInformer.Informer().Run(utilwait.NeverStop)
-		},
+func (factory *Factory) track(informer cache.SharedIndexInformer) cache.SharedIndexInformer {
+	factory.synced = append(factory.synced, informer.HasSynced)
+	return informer
+}
+
+// CreateOvnController returns an ovn controller whose watches are created
+// when the controller registers their handlers, the events start flowing once
+// the factory is started. The listers are set along with their watches.
+func (factory *Factory) CreateOvnController() *ovn.OvnController {
+	oc := &ovn.OvnController{
 		Kube: &kube.Kube{KClient: factory.KClient},
 	}
+	oc.StartPodWatch = func(handler cache.ResourceEventHandler) {
+		informer := factory.track(factory.IFactory.Core().V1().Pods().Informer())
+		oc.PodLister = listers.NewPodLister(informer.GetIndexer())
+		informer.AddEventHandler(handler)
+	}
+	oc.StartEndpointWatch = func(handler cache.ResourceEventHandler) {
+		informer := factory.track(factory.IFactory.Core().V1().Endpoints().Informer())
+		oc.EndpointsLister = listers.NewEndpointsLister(informer.GetIndexer())
+		informer.AddEventHandler(handler)
+	}
+	oc.StartServiceWatch = func(handler cache.ResourceEventHandler) {
+		informer := factory.track(factory.IFactory.Core().V1().Services().Informer())
+		oc.ServiceLister = listers.NewServiceLister(informer.GetIndexer())
+		informer.AddEventHandler(handler)
+	}
+	oc.StartPolicyWatch = func(handler cache.ResourceEventHandler) {
+		// the shared informer factory has no informer for network policies yet
+		informer := factory.track(cache.NewSharedIndexInformer(
+			cache.NewListWatchFromClient(factory.KClient.Extensions().RESTClient(),
+				"networkpolicies", kapi.NamespaceAll, fields.Everything()),
+			&extensions.NetworkPolicy{}, factory.ResyncInterval, cache.Indexers{}))
+		factory.informers = append(factory.informers, informer)
+		oc.PolicyStore = informer.GetStore()
+		informer.AddEventHandler(handler)
+	}
+	oc.StartNamespaceWatch = func(handler cache.ResourceEventHandler) {
+		factory.track(factory.IFactory.Core().V1().Namespaces().Informer()).AddEventHandler(handler)
+	}
+	oc.StartNodeWatch = func(handler cache.ResourceEventHandler) {
+		factory.track(factory.IFactory.Core().V1().Nodes().Informer()).AddEventHandler(handler)
+	}
+	return oc
 }
 
+// CreateClusterController returns a cluster controller whose watches, like
+// the ones of the ovn controller, are created when their handlers are
+// registered, the node lister along with the node watch
 func (factory *Factory) CreateClusterController() *cluster.OvnClusterController {
-	nodeInformer := factory.IFactory.Core().V1().Nodes()
-	return &cluster.OvnClusterController{
-		StartNodeWatch: func(handler cache.ResourceEventHandler) {
-			nodeInformer.Informer().AddEventHandler(handler)
-			nodeInformer.Informer().Run(utilwait.NeverStop)
+	cc := &cluster.OvnClusterController{
+		StartLocalNodeWatch: func(name string, handler cache.ResourceEventHandler) {
+			// a node agent only needs its own node, not all the nodes
+			informer := factory.track(cache.NewSharedIndexInformer(
+				cache.NewListWatchFromClient(factory.KClient.Core().RESTClient(),
+					"nodes", kapi.NamespaceAll, fields.OneTermEqualSelector("metadata.name", name)),
+				&kapi.Node{}, factory.ResyncInterval, cache.Indexers{}))
+			factory.informers = append(factory.informers, informer)
+			informer.AddEventHandler(handler)
 		},
-		//NodeInformer: nodeInformer,
 		Kube: &kube.Kube{KClient: factory.KClient},
 	}
+	cc.StartNodeWatch = func(handler cache.ResourceEventHandler) {
+		informer := factory.track(factory.IFactory.Core().V1().Nodes().Informer())
+		cc.NodeLister = listers.NewNodeLister(informer.GetIndexer())
+		informer.AddEventHandler(handler)
+	}
+	return cc
 }
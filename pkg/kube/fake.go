@@ -0,0 +1,180 @@
+package kube
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kapi "k8s.io/client-go/pkg/api/v1"
+)
+
+// FakeKube is an in-memory KubeInterface for tests. Annotations set through
+// it are stored on its copy of the objects, and like the api server it hands
+// out copies of them and bumps the resourceVersion of the nodes it changes.
+type FakeKube struct {
+	mutex    sync.Mutex
+	pods     map[string]*kapi.Pod
+	nodes    map[string]*kapi.Node
+	services map[string]*kapi.Service
+	events   []string
+	version  int
+}
+
+func NewFakeKube() *FakeKube {
+	return &FakeKube{
+		pods:     make(map[string]*kapi.Pod),
+		nodes:    make(map[string]*kapi.Node),
+		services: make(map[string]*kapi.Service),
+	}
+}
+
+func (k *FakeKube) AddPod(pod *kapi.Pod) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	p := *pod
+	p.Annotations = copyAnnotations(pod.Annotations)
+	k.pods[pod.Namespace+"/"+pod.Name] = &p
+}
+
+func (k *FakeKube) AddNode(node *kapi.Node) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	n := *node
+	n.Annotations = copyAnnotations(node.Annotations)
+	k.nodes[node.Name] = &n
+	k.bumpVersion(&n)
+}
+
+func (k *FakeKube) bumpVersion(node *kapi.Node) {
+	k.version++
+	node.ResourceVersion = strconv.Itoa(k.version)
+}
+
+func (k *FakeKube) AddService(svc *kapi.Service) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.services[svc.Namespace+"/"+svc.Name] = svc
+}
+
+func copyAnnotations(annotations map[string]string) map[string]string {
+	if annotations == nil {
+		return nil
+	}
+	c := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		c[k] = v
+	}
+	return c
+}
+
+func (k *FakeKube) SetAnnotationOnPod(pod *kapi.Pod, key, value string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	p, ok := k.pods[pod.Namespace+"/"+pod.Name]
+	if !ok {
+		return fmt.Errorf("pod %s/%s not found", pod.Namespace, pod.Name)
+	}
+	if p.Annotations == nil {
+		p.Annotations = make(map[string]string)
+	}
+	p.Annotations[key] = value
+	return nil
+}
+
+func (k *FakeKube) SetAnnotationOnNode(node *kapi.Node, key, value string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	n, ok := k.nodes[node.Name]
+	if !ok {
+		return fmt.Errorf("node %s not found", node.Name)
+	}
+	if n.Annotations == nil {
+		n.Annotations = make(map[string]string)
+	}
+	n.Annotations[key] = value
+	k.bumpVersion(n)
+	return nil
+}
+
+func (k *FakeKube) UpdateAnnotationsOnNode(node *kapi.Node, annotations map[string]string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	n, ok := k.nodes[node.Name]
+	if !ok {
+		return fmt.Errorf("node %s not found", node.Name)
+	}
+	if n.ResourceVersion != node.ResourceVersion {
+		return apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, node.Name,
+			fmt.Errorf("the object has been modified"))
+	}
+	if n.Annotations == nil {
+		n.Annotations = make(map[string]string)
+	}
+	for key, value := range annotations {
+		n.Annotations[key] = value
+	}
+	k.bumpVersion(n)
+	return nil
+}
+
+func (k *FakeKube) GetPod(namespace, name string) (*kapi.Pod, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	p, ok := k.pods[namespace+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("pod %s/%s not found", namespace, name)
+	}
+	pod := *p
+	pod.Annotations = copyAnnotations(p.Annotations)
+	return &pod, nil
+}
+
+func (k *FakeKube) GetNodes() (*kapi.NodeList, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	list := &kapi.NodeList{}
+	for _, n := range k.nodes {
+		node := *n
+		node.Annotations = copyAnnotations(n.Annotations)
+		list.Items = append(list.Items, node)
+	}
+	return list, nil
+}
+
+func (k *FakeKube) GetNode(name string) (*kapi.Node, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	n, ok := k.nodes[name]
+	if !ok {
+		return nil, fmt.Errorf("node %s not found", name)
+	}
+	node := *n
+	node.Annotations = copyAnnotations(n.Annotations)
+	return &node, nil
+}
+
+func (k *FakeKube) GetService(namespace, name string) (*kapi.Service, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	svc, ok := k.services[namespace+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("service %s/%s not found", namespace, name)
+	}
+	return svc, nil
+}
+
+func (k *FakeKube) RecordNodeEvent(node *kapi.Node, eventType, reason, message string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.events = append(k.events, fmt.Sprintf("%s %s %s: %s", eventType, reason, node.Name, message))
+	return nil
+}
+
+// Events returns the recorded events as "type reason object: message"
+func (k *FakeKube) Events() []string {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return append([]string(nil), k.events...)
+}
@@ -1,9 +1,10 @@
 package kube
 
 import (
-	"fmt"
+	"encoding/json"
 
 	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
@@ -13,20 +14,34 @@ import (
 type KubeInterface interface {
 	SetAnnotationOnPod(pod *kapi.Pod, key, value string) error
 	SetAnnotationOnNode(node *kapi.Node, key, value string) error
+	UpdateAnnotationsOnNode(node *kapi.Node, annotations map[string]string) error
 	GetPod(namespace, name string) (*kapi.Pod, error)
 	GetNodes() (*kapi.NodeList, error)
 	GetNode(name string) (*kapi.Node, error)
 	GetService(namespace, name string) (*kapi.Service, error)
+	RecordNodeEvent(node *kapi.Node, eventType, reason, message string) error
 }
 
 type Kube struct {
 	KClient kubernetes.Interface
 }
 
+// annotationPatch returns the merge patch setting an annotation
+func annotationPatch(key, value string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	})
+}
+
 func (k *Kube) SetAnnotationOnPod(pod *kapi.Pod, key, value string) error {
 	glog.Infof("Setting annotations %s=%s on pod %s", key, value, pod.Name)
-	patchData := fmt.Sprintf(`{"metadata":{"annotations":{"%s":"%s"}}}`, key, value)
-	_, err := k.KClient.Core().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, []byte(patchData))
+	patchData, err := annotationPatch(key, value)
+	if err != nil {
+		return err
+	}
+	_, err = k.KClient.Core().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, patchData)
 	if err != nil {
 		glog.Errorf("Error in setting annotation on pod %s/%s: %v", pod.Name, pod.Namespace, err)
 	}
@@ -35,14 +50,36 @@ func (k *Kube) SetAnnotationOnPod(pod *kapi.Pod, key, value string) error {
 
 func (k *Kube) SetAnnotationOnNode(node *kapi.Node, key, value string) error {
 	glog.Infof("Setting annotations %s=%s on node %s", key, value, node.Name)
-	patchData := fmt.Sprintf(`{"metadata":{"annotations":{"%s":"%s"}}}`, key, value)
-	_, err := k.KClient.Core().Nodes().Patch(node.Name, types.MergePatchType, []byte(patchData))
+	patchData, err := annotationPatch(key, value)
+	if err != nil {
+		return err
+	}
+	_, err = k.KClient.Core().Nodes().Patch(node.Name, types.MergePatchType, patchData)
 	if err != nil {
 		glog.Errorf("Error in setting annotation on node %s: %v", node.Name, err)
 	}
 	return err
 }
 
+// UpdateAnnotationsOnNode sets annotations with an update of the node as it
+// was read, which fails with a conflict when the node changed since
+func (k *Kube) UpdateAnnotationsOnNode(node *kapi.Node, annotations map[string]string) error {
+	glog.Infof("Updating annotations %v on node %s", annotations, node.Name)
+	n := *node
+	n.Annotations = make(map[string]string, len(node.Annotations)+len(annotations))
+	for name, v := range node.Annotations {
+		n.Annotations[name] = v
+	}
+	for name, v := range annotations {
+		n.Annotations[name] = v
+	}
+	_, err := k.KClient.Core().Nodes().Update(&n)
+	if err != nil && !apierrors.IsConflict(err) {
+		glog.Errorf("Error in updating annotation on node %s: %v", node.Name, err)
+	}
+	return err
+}
+
 func (k *Kube) GetPod(namespace, name string) (*kapi.Pod, error) {
 	return k.KClient.Core().Pods(namespace).Get(name, metav1.GetOptions{})
 }
@@ -58,3 +95,32 @@ func (k *Kube) GetNode(name string) (*kapi.Node, error) {
 func (k *Kube) GetService(namespace, name string) (*kapi.Service, error) {
 	return k.KClient.Core().Services(namespace).Get(name, metav1.GetOptions{})
 }
+
+// RecordNodeEvent records an event about the node, in the default namespace
+// like the events of the kubelet
+func (k *Kube) RecordNodeEvent(node *kapi.Node, eventType, reason, message string) error {
+	now := metav1.Now()
+	event := &kapi.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: node.Name + ".",
+			Namespace:    metav1.NamespaceDefault,
+		},
+		InvolvedObject: kapi.ObjectReference{
+			Kind: "Node",
+			Name: node.Name,
+			UID:  node.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         kapi.EventSource{Component: "ovnkube"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := k.KClient.Core().Events(metav1.NamespaceDefault).Create(event)
+	if err != nil {
+		glog.Errorf("Error in recording event %s on node %s: %v", reason, node.Name, err)
+	}
+	return err
+}
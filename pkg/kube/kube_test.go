@@ -0,0 +1,27 @@
+package kube
+
+import (
+	"testing"
+)
+
+func TestAnnotationPatch(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		patch string
+	}{
+		{"ovn_host_subnet", "10.128.1.0/24", `{"metadata":{"annotations":{"ovn_host_subnet":"10.128.1.0/24"}}}`},
+		{"ovn", `{"ip_address":"10.128.1.2/24"}`, `{"metadata":{"annotations":{"ovn":"{\"ip_address\":\"10.128.1.2/24\"}"}}}`},
+		{"note", "a \\ b\n", `{"metadata":{"annotations":{"note":"a \\ b\n"}}}`},
+	}
+	for _, test := range tests {
+		patch, err := annotationPatch(test.key, test.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.key, err)
+			continue
+		}
+		if string(patch) != test.patch {
+			t.Errorf("%s: expected patch %s, got %s", test.key, test.patch, string(patch))
+		}
+	}
+}
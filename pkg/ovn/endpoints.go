@@ -3,122 +3,457 @@ package ovn
 import (
 	"fmt"
 	"github.com/golang/glog"
-	"os/exec"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
-	"unicode"
 
 	kapi "k8s.io/client-go/pkg/api/v1"
 )
 
-func (ovn *OvnController) getLoadBalancer(protocol kapi.Protocol) string {
-	var out []byte
-	if protocol == kapi.ProtocolTCP {
-		out, _ = exec.Command(OVN_NBCTL, "--data=bare", "--no-heading",
-			"--columns=_uuid", "find", "load_balancer",
-			"external_ids:k8s-cluster-lb-tcp=yes").CombinedOutput()
-	} else if protocol == kapi.ProtocolUDP {
-		out, _ = exec.Command(OVN_NBCTL, "--data=bare", "--no-heading",
-			"--columns=_uuid", "find", "load_balancer",
-			"external_ids:k8s-cluster-lb-udp=yes").CombinedOutput()
+// ProtocolSCTP is the SCTP service protocol, newer than the service api we
+// build against
+const ProtocolSCTP kapi.Protocol = "SCTP"
+
+// clusterProtocols are the protocols with a cluster wide load balancer, the
+// ports of the services with any other protocol are not load balanced
+var clusterProtocols = []kapi.Protocol{kapi.ProtocolTCP, kapi.ProtocolUDP, ProtocolSCTP}
+
+// loadBalancers are the load balancers that the vips of the services go to
+type loadBalancers struct {
+	// cluster are the cluster wide load balancers of the cluster IPs, by protocol
+	cluster map[kapi.Protocol]string
+	// gateways are the gateway routers, whose load balancers take the node ports
+	gateways []Gateway
+	// services are the load balancers of the services that have their own,
+	// by namespace/name and protocol
+	services map[string]map[kapi.Protocol]string
+	// perService gives every service load balancers of its own
+	perService bool
+}
+
+// all returns the uuids of all the load balancers
+func (lbs *loadBalancers) all() []string {
+	uuids := make([]string, 0)
+	for _, lb := range lbs.cluster {
+		uuids = append(uuids, lb)
 	}
-	outStr := strings.TrimFunc(string(out), unicode.IsSpace)
-	return string(outStr)
+	for _, gateway := range lbs.gateways {
+		for _, lb := range gateway.LoadBalancers {
+			uuids = append(uuids, lb)
+		}
+	}
+	for _, serviceLBs := range lbs.services {
+		for _, lb := range serviceLBs {
+			uuids = append(uuids, lb)
+		}
+	}
+	return uuids
 }
 
-func (ovn *OvnController) createLoadBalancerVIP(lb string, serviceIP string, port int32, ips []string, targetPort int32) error {
-	glog.V(4).Infof("Creating lb with %s, %s, %d, [%v], %d", lb, serviceIP, port, ips, targetPort)
+func (ovn *OvnController) getLoadBalancers() (*loadBalancers, error) {
+	lbs := &loadBalancers{
+		cluster:    make(map[kapi.Protocol]string),
+		perService: ovn.PerServiceLoadBalancers,
+	}
+	for _, protocol := range clusterProtocols {
+		externalID := "k8s-cluster-lb-" + strings.ToLower(string(protocol))
+		lb, err := ovn.OvnNB.FindLoadBalancer(map[string]string{externalID: "yes"})
+		if err != nil {
+			return nil, fmt.Errorf("Error finding the %s load balancer - %v", protocol, err)
+		}
+		lbs.cluster[protocol] = lb
+	}
+	gateways, err := ovn.OvnNB.ListGateways()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing the gateway routers - %v", err)
+	}
+	lbs.gateways = gateways
+	lbs.services, err = ovn.OvnNB.ListServiceLoadBalancers()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing the load balancers of the services - %v", err)
+	}
+	return lbs, nil
+}
 
-	// With service_ip:port as a VIP, create an entry in 'load_balancer'
-	// key is of the form "IP:port" (with quotes around)
-	key := fmt.Sprintf("\"%s:%d\"", serviceIP, port)
+// defaultAffinityTimeout is the ClientIP affinity timeout of kube-proxy
+const defaultAffinityTimeout = 10800
 
-	if len(ips) == 0 {
-		_, err := exec.Command(OVN_NBCTL, "remove", "load_balancer", lb, "vips", key).CombinedOutput()
-		return err
+// maxAffinityTimeout is the longest ClientIP affinity timeout kube-proxy takes
+const maxAffinityTimeout = 86400
+
+// AffinityTimeoutAnnotation sets the ClientIP affinity timeout of a service in
+// seconds, the service api we build against has no sessionAffinityConfig
+const AffinityTimeoutAnnotation = "ovn.kubernetes.io/session-affinity-timeout"
+
+// affinityTimeout returns the ClientIP affinity timeout of the service, the
+// default one when the annotation is missing or invalid
+func affinityTimeout(svc *kapi.Service) int {
+	value, ok := svc.Annotations[AffinityTimeoutAnnotation]
+	if !ok {
+		return defaultAffinityTimeout
+	}
+	timeout, err := strconv.Atoi(value)
+	if err != nil || timeout <= 0 || timeout > maxAffinityTimeout {
+		glog.Warningf("Invalid %s %q of service %s/%s, using %d", AffinityTimeoutAnnotation, value,
+			svc.Namespace, svc.Name, defaultAffinityTimeout)
+		return defaultAffinityTimeout
+	}
+	return timeout
+}
+
+// hasOwnLoadBalancers tells if the vips of the service go to load balancers
+// of its own rather than to the shared ones, either for all the services or
+// for options that apply to the whole load balancer like the session affinity
+func (lbs *loadBalancers) hasOwnLoadBalancers(svc *kapi.Service) bool {
+	return lbs.perService || svc.Spec.SessionAffinity == kapi.ServiceAffinityClientIP
+}
+
+// serviceLBOptions returns the options of the own load balancers of the
+// service, which reject the connections to vips without endpoints like the
+// shared ones do. With ClientIP affinity the same client is sent to the same
+// endpoint until it has been idle for the affinity timeout of the service.
+func serviceLBOptions(svc *kapi.Service) map[string]string {
+	options := map[string]string{"reject": "true"}
+	if svc.Spec.SessionAffinity == kapi.ServiceAffinityClientIP {
+		options["affinity_timeout"] = fmt.Sprintf("%d", affinityTimeout(svc))
+	}
+	return options
+}
+
+// ensureServiceLoadBalancers creates the own load balancers that the service
+// needs, one per protocol of its ports, and returns the ones it no longer
+// needs. The load balancers are updated in lbs.
+func (ovn *OvnController) ensureServiceLoadBalancers(svc *kapi.Service, lbs *loadBalancers) (map[string]bool, error) {
+	key := cacheKey(svc.Namespace, svc.Name)
+	needed := make(map[kapi.Protocol]bool)
+	if isLoadBalanced(svc) && lbs.hasOwnLoadBalancers(svc) {
+		for _, svcPort := range svc.Spec.Ports {
+			if _, ok := lbs.cluster[svcPort.Protocol]; ok {
+				needed[svcPort.Protocol] = true
+			}
+		}
+	}
+	if lbs.services[key] == nil {
+		lbs.services[key] = make(map[kapi.Protocol]string)
+	}
+	for protocol := range needed {
+		lb, err := ovn.OvnNB.EnsureServiceLoadBalancer(key, protocol, serviceLBOptions(svc))
+		if err != nil {
+			return nil, fmt.Errorf("Error creating the %s load balancer of service %s - %v", protocol, key, err)
+		}
+		lbs.services[key][protocol] = lb
 	}
+	unneeded := make(map[string]bool)
+	for protocol, lb := range lbs.services[key] {
+		if !needed[protocol] {
+			unneeded[lb] = true
+		}
+	}
+	return unneeded, nil
+}
 
-	var commaSeparatedEndpoints string
-	for i, ep := range ips {
-		comma := ","
-		if i == 0 {
-			comma = ""
+// deleteServiceLoadBalancers removes the own load balancers of a service
+func (ovn *OvnController) deleteServiceLoadBalancers(key string, lbs map[string]bool) error {
+	for lb := range lbs {
+		glog.V(4).Infof("Deleting load balancer %s of service %s", lb, key)
+		err := ovn.OvnNB.DeleteLoadBalancer(lb)
+		if err != nil {
+			return fmt.Errorf("Error deleting load balancer %s of service %s - %v", lb, key, err)
 		}
-		commaSeparatedEndpoints += fmt.Sprintf("%s%s:%d", comma, ep, targetPort)
 	}
-	target := fmt.Sprintf("vips:\"%s:%d\"=\"%s\"", serviceIP, port, commaSeparatedEndpoints)
+	return nil
+}
+
+// vipKey returns the "IP:port" form used for both the vips and the targets
+// of a load balancer, "[IP]:port" for an IPv6 address
+func vipKey(ip string, port int32) string {
+	return net.JoinHostPort(ip, strconv.Itoa(int(port)))
+}
+
+// sameFamily tells if the addresses are both IPv4 or both IPv6, a load
+// balancer vip only has targets of its own family
+func sameFamily(a, b string) bool {
+	return (net.ParseIP(a).To4() == nil) == (net.ParseIP(b).To4() == nil)
+}
+
+func (ovn *OvnController) deleteLoadBalancerVIP(lb string, vip string) error {
+	if lb == "" {
+		return fmt.Errorf("no load balancer found for vip %s", vip)
+	}
+	return ovn.OvnNB.DeleteLoadBalancerVIP(lb, vip)
+}
+
+func (ovn *OvnController) createLoadBalancerVIP(lb string, vip string, targets []string) error {
+	glog.V(4).Infof("Creating lb with %s, %s, [%v]", lb, vip, targets)
+
+	if lb == "" {
+		return fmt.Errorf("no load balancer found for vip %s", vip)
+	}
 
-	out, err := exec.Command(OVN_NBCTL, "set", "load_balancer", lb, target).CombinedOutput()
+	// With service_ip:port as a VIP, create an entry in 'load_balancer'
+	// whose value is the comma separated list of endpoint_ip:port. A vip
+	// without targets rejects the connections, the load balancers have the
+	// reject option.
+	err := ovn.OvnNB.SetLoadBalancerVIP(lb, vip, strings.Join(targets, ","))
 	if err != nil {
-		glog.Errorf("Error in creating load balancer: %v(%v)", string(out), err)
+		glog.Errorf("Error in creating load balancer: %v", err)
 	}
 	return err
 }
 
-func (ovn *OvnController) addEndpoints(ep *kapi.Endpoints) error {
-	// get service
-	svc, err := ovn.Kube.GetService(ep.Namespace, ep.Name)
-	if err != nil {
-		return err
+// lbVIPs holds vips and their sorted targets, by load balancer uuid
+type lbVIPs map[string]map[string][]string
+
+func (v lbVIPs) add(lb, vip string, targets []string) {
+	if v[lb] == nil {
+		v[lb] = make(map[string][]string)
 	}
-	tcpPortMap := make(map[int32]([]string))
-	udpPortMap := make(map[int32]([]string))
-	for _, s := range ep.Subsets {
-		for _, ip := range s.Addresses {
-			for _, port := range s.Ports {
-				var ips []string
-				var portMap map[int32]([]string)
-				var ok bool
-				if port.Protocol == kapi.ProtocolUDP {
-					portMap = udpPortMap
-				} else if port.Protocol == kapi.ProtocolTCP {
-					portMap = tcpPortMap
-				}
-				if ips, ok = portMap[port.Port]; !ok {
-					ips = make([]string, 0)
+	v[lb][vip] = targets
+}
+
+// isLoadBalanced tells if the service has vips at all, headless services
+// resolve to their endpoints and ExternalName services to another name
+func isLoadBalanced(svc *kapi.Service) bool {
+	if svc.Spec.Type == kapi.ServiceTypeExternalName {
+		return false
+	}
+	return svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != kapi.ClusterIPNone
+}
+
+// serviceExternalIPs returns the addresses the service is reached on from
+// outside the cluster, its external IPs and the ingress IPs of its load
+// balancer
+func serviceExternalIPs(svc *kapi.Service) []string {
+	ips := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, ip := range svc.Spec.ExternalIPs {
+		if !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+	}
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		// a load balancer known by its hostname only has nothing to program
+		if ingress.IP != "" && !seen[ingress.IP] {
+			seen[ingress.IP] = true
+			ips = append(ips, ingress.IP)
+		}
+	}
+	return ips
+}
+
+// serviceVIPKeys returns the vips of the ports of the service on each load
+// balancer: the cluster IP on the cluster load balancers, and the node ports
+// on the physical IP and the external IPs on the service ports of every
+// gateway router, the ones of the IP family of the cluster IP. A service with
+// load balancers of its own has all its vips on them, they are in the group of
+// every node switch and gateway router.
+func serviceVIPKeys(svc *kapi.Service, lbs *loadBalancers) map[string]map[string]kapi.ServicePort {
+	keys := make(map[string]map[string]kapi.ServicePort)
+	if !isLoadBalanced(svc) {
+		return keys
+	}
+	add := func(lb, vip string, svcPort kapi.ServicePort) {
+		if keys[lb] == nil {
+			keys[lb] = make(map[string]kapi.ServicePort)
+		}
+		keys[lb][vip] = svcPort
+	}
+	externalIPs := serviceExternalIPs(svc)
+	own := lbs.hasOwnLoadBalancers(svc)
+	for _, svcPort := range svc.Spec.Ports {
+		lb, ok := lbs.cluster[svcPort.Protocol]
+		if !ok {
+			continue
+		}
+		if own {
+			// the vips wait for the load balancer of the service
+			lb, ok = lbs.services[cacheKey(svc.Namespace, svc.Name)][svcPort.Protocol]
+			if !ok {
+				continue
+			}
+		}
+		add(lb, vipKey(svc.Spec.ClusterIP, svcPort.Port), svcPort)
+		for _, gateway := range lbs.gateways {
+			gatewayLB, ok := gateway.LoadBalancers[svcPort.Protocol]
+			if !ok {
+				continue
+			}
+			if own {
+				gatewayLB = lb
+			}
+			if svcPort.NodePort != 0 && sameFamily(gateway.PhysicalIP, svc.Spec.ClusterIP) {
+				add(gatewayLB, vipKey(gateway.PhysicalIP, svcPort.NodePort), svcPort)
+			}
+			for _, ip := range externalIPs {
+				if sameFamily(ip, svc.Spec.ClusterIP) {
+					add(gatewayLB, vipKey(ip, svcPort.Port), svcPort)
 				}
-				ips = append(ips, ip.IP)
-				portMap[port.Port] = ips
 			}
 		}
 	}
+	return keys
+}
 
-	glog.V(4).Infof("Tcp table: %v\nUdp table: %v", tcpPortMap, udpPortMap)
+// TolerateUnreadyEndpointsAnnotation asks for the endpoints that are not
+// ready to be load balanced too, the service api we build against has no
+// publishNotReadyAddresses field
+const TolerateUnreadyEndpointsAnnotation = "service.alpha.kubernetes.io/tolerate-unready-endpoints"
 
-	for targetPort, ips := range tcpPortMap {
-		for _, svcPort := range svc.Spec.Ports {
-			if svcPort.Protocol == kapi.ProtocolTCP && svcPort.TargetPort.IntVal == targetPort {
-				err = ovn.createLoadBalancerVIP(ovn.getLoadBalancer(svcPort.Protocol), svc.Spec.ClusterIP, svcPort.Port, ips, targetPort)
-				if err != nil {
-					return err
-				}
+// publishNotReadyAddresses tells if the service is load balanced to its
+// endpoints that are not ready
+func publishNotReadyAddresses(svc *kapi.Service) bool {
+	return svc.Annotations[TolerateUnreadyEndpointsAnnotation] == "true"
+}
+
+// serviceTargets returns the sorted targets of a service port. The endpoints
+// controller names the endpoint ports after the service ports, which resolves
+// named target ports as well as numeric ones.
+func serviceTargets(svcPort kapi.ServicePort, ep *kapi.Endpoints, notReady bool) []string {
+	targets := make([]string, 0)
+	for _, s := range ep.Subsets {
+		for _, port := range s.Ports {
+			if port.Protocol != svcPort.Protocol || port.Name != svcPort.Name {
+				continue
+			}
+			for _, ip := range s.Addresses {
+				targets = append(targets, vipKey(ip.IP, port.Port))
+			}
+			if !notReady {
+				continue
+			}
+			for _, ip := range s.NotReadyAddresses {
+				targets = append(targets, vipKey(ip.IP, port.Port))
 			}
 		}
 	}
-	for targetPort, ips := range udpPortMap {
-		for _, svcPort := range svc.Spec.Ports {
-			if svcPort.Protocol == kapi.ProtocolUDP && svcPort.TargetPort.IntVal == targetPort {
-				err := ovn.createLoadBalancerVIP(ovn.getLoadBalancer(svcPort.Protocol), svc.Spec.ClusterIP, svcPort.Port, ips, targetPort)
-				if err != nil {
-					return err
-				}
-			}
+	sort.Strings(targets)
+	return targets
+}
+
+// serviceVIPs computes the vips of the service on each load balancer. Once
+// the service has endpoints, all its vips are there and the ones without
+// targets reject the connections.
+func serviceVIPs(svc *kapi.Service, ep *kapi.Endpoints, lbs *loadBalancers) lbVIPs {
+	vips := make(lbVIPs)
+	if ep == nil {
+		return vips
+	}
+	notReady := publishNotReadyAddresses(svc)
+	for lb, keys := range serviceVIPKeys(svc, lbs) {
+		for vip, svcPort := range keys {
+			vips.add(lb, vip, serviceTargets(svcPort, ep, notReady))
 		}
 	}
-	return nil
+	return vips
 }
 
-func (ovn *OvnController) deleteEndpoints(ep *kapi.Endpoints) error {
-	svc, err := ovn.Kube.GetService(ep.Namespace, ep.Name)
+// syncServiceVIPs programs the vips of the service from its endpoints, only
+// touching the vips whose targets changed and removing the vips of the
+// stale versions of the service that it no longer has. A nil ep removes all
+// the vips of the service.
+func (ovn *OvnController) syncServiceVIPs(svc *kapi.Service, ep *kapi.Endpoints, stale ...*kapi.Service) error {
+	lbs, err := ovn.getLoadBalancers()
 	if err != nil {
 		return err
 	}
-	for _, svcPort := range svc.Spec.Ports {
-		lb := ovn.getLoadBalancer(svcPort.Protocol)
-		key := fmt.Sprintf("\"%s:%d\"", svc.Spec.ClusterIP, svcPort.Port)
-		_, err := exec.Command(OVN_NBCTL, "remove", "load_balancer", lb, "vips", key).CombinedOutput()
+	unneeded, err := ovn.ensureServiceLoadBalancers(svc, lbs)
+	if err != nil {
+		return err
+	}
+	return ovn.programServiceVIPs(svc, ep, lbs, unneeded, stale...)
+}
+
+// removeServiceVIPs removes the vips of a deleted service from the shared
+// load balancers and deletes the load balancers of its own, the ones that
+// are left of them. Unlike syncServiceVIPs it never creates a load balancer.
+func (ovn *OvnController) removeServiceVIPs(svc *kapi.Service) error {
+	lbs, err := ovn.getLoadBalancers()
+	if err != nil {
+		return err
+	}
+	unneeded := make(map[string]bool)
+	for _, lb := range lbs.services[cacheKey(svc.Namespace, svc.Name)] {
+		unneeded[lb] = true
+	}
+	return ovn.programServiceVIPs(svc, nil, lbs, unneeded)
+}
+
+// programServiceVIPs sets the vips of the service on the load balancers in
+// lbs but the unneeded ones, which are deleted once the vips are done
+func (ovn *OvnController) programServiceVIPs(svc *kapi.Service, ep *kapi.Endpoints, lbs *loadBalancers, unneeded map[string]bool, stale ...*kapi.Service) error {
+	desired := serviceVIPs(svc, ep, lbs)
+	owned := serviceVIPKeys(svc, lbs)
+	for _, old := range stale {
+		for lb, keys := range serviceVIPKeys(old, lbs) {
+			if owned[lb] == nil {
+				owned[lb] = keys
+				continue
+			}
+			for vip, svcPort := range keys {
+				owned[lb][vip] = svcPort
+			}
+		}
+	}
+	glog.V(4).Infof("Vips of service %s/%s: %v", svc.Namespace, svc.Name, desired)
+
+	for _, lb := range lbs.all() {
+		if len(owned[lb]) == 0 || unneeded[lb] {
+			continue
+		}
+		current, err := ovn.OvnNB.GetLoadBalancerVIPs(lb)
 		if err != nil {
-			glog.Errorf("Error in deleting endpoints: %v", err)
+			return err
+		}
+		for vip := range current {
+			_, isOwned := owned[lb][vip]
+			if _, ok := desired[lb][vip]; !ok && isOwned {
+				err = ovn.deleteLoadBalancerVIP(lb, vip)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for vip, targets := range desired[lb] {
+			if currentTargets, ok := current[vip]; ok && currentTargets == strings.Join(targets, ",") {
+				continue
+			}
+			err = ovn.createLoadBalancerVIP(lb, vip, targets)
+			if err != nil {
+				return err
+			}
 		}
 	}
-	return nil
+	// the load balancers the service no longer needs go with their vips,
+	// once the vips are on the load balancers that replace them
+	return ovn.deleteServiceLoadBalancers(cacheKey(svc.Namespace, svc.Name), unneeded)
+}
+
+func (ovn *OvnController) addEndpoints(ep *kapi.Endpoints) error {
+	ovn.lbMutex.Lock()
+	defer ovn.lbMutex.Unlock()
+
+	key := cacheKey(ep.Namespace, ep.Name)
+	ovn.endpointsCache[key] = ep
+	svc, ok := ovn.serviceCache[key]
+	if !ok {
+		// the vips are programmed once the service shows up
+		glog.V(4).Infof("No service found yet for endpoints %s", key)
+		return nil
+	}
+	return ovn.syncServiceVIPs(svc, ep)
+}
+
+func (ovn *OvnController) deleteEndpoints(ep *kapi.Endpoints) error {
+	ovn.lbMutex.Lock()
+	defer ovn.lbMutex.Unlock()
+
+	key := cacheKey(ep.Namespace, ep.Name)
+	delete(ovn.endpointsCache, key)
+	svc, ok := ovn.serviceCache[key]
+	if !ok {
+		return nil
+	}
+	return ovn.syncServiceVIPs(svc, nil)
 }
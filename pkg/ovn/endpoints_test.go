@@ -0,0 +1,365 @@
+package ovn
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kapi "k8s.io/client-go/pkg/api/v1"
+)
+
+func newService(name, clusterIP string, ports ...kapi.ServicePort) *kapi.Service {
+	return &kapi.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec: kapi.ServiceSpec{
+			ClusterIP: clusterIP,
+			Ports:     ports,
+		},
+	}
+}
+
+func newServicePort(name string, protocol kapi.Protocol, port int32, targetPort intstr.IntOrString) kapi.ServicePort {
+	return kapi.ServicePort{
+		Name:       name,
+		Protocol:   protocol,
+		Port:       port,
+		TargetPort: targetPort,
+	}
+}
+
+func newEndpoints(name string, subsets ...kapi.EndpointSubset) *kapi.Endpoints {
+	return &kapi.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Subsets:    subsets,
+	}
+}
+
+func newSubset(ips []string, ports ...kapi.EndpointPort) kapi.EndpointSubset {
+	subset := kapi.EndpointSubset{Ports: ports}
+	for _, ip := range ips {
+		subset.Addresses = append(subset.Addresses, kapi.EndpointAddress{IP: ip})
+	}
+	return subset
+}
+
+func newTestLBController() (*OvnController, *MemoryNorthbound, string, string) {
+	nb := NewMemoryNorthbound()
+	tcpLB := nb.AddLoadBalancer(map[string]string{"k8s-cluster-lb-tcp": "yes"})
+	udpLB := nb.AddLoadBalancer(map[string]string{"k8s-cluster-lb-udp": "yes"})
+	nb.AddLoadBalancer(map[string]string{"k8s-cluster-lb-sctp": "yes"})
+	return newTestController(kube.NewFakeKube(), nb), nb, tcpLB, udpLB
+}
+
+func TestAddEndpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		svc     *kapi.Service
+		ep      *kapi.Endpoints
+		tcpVIPs map[string]string
+		udpVIPs map[string]string
+	}{
+		{
+			name: "tcp service",
+			svc:  newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080))),
+			ep: newEndpoints("web", newSubset([]string{"10.128.1.2", "10.128.2.2"},
+				kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 8080})),
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.2:8080,10.128.2.2:8080"},
+			udpVIPs: map[string]string{},
+		},
+		{
+			name: "tcp and udp service",
+			svc: newService("dns", "172.30.0.53",
+				newServicePort("dns-tcp", kapi.ProtocolTCP, 53, intstr.FromInt(5353)),
+				newServicePort("dns", kapi.ProtocolUDP, 53, intstr.FromInt(5353))),
+			ep: newEndpoints("dns", newSubset([]string{"10.128.1.3"},
+				kapi.EndpointPort{Name: "dns-tcp", Protocol: kapi.ProtocolTCP, Port: 5353},
+				kapi.EndpointPort{Name: "dns", Protocol: kapi.ProtocolUDP, Port: 5353})),
+			tcpVIPs: map[string]string{"172.30.0.53:53": "10.128.1.3:5353"},
+			udpVIPs: map[string]string{"172.30.0.53:53": "10.128.1.3:5353"},
+		},
+		{
+			name: "named target ports",
+			svc: newService("web", "172.30.0.10",
+				newServicePort("http", kapi.ProtocolTCP, 80, intstr.FromString("web")),
+				newServicePort("https", kapi.ProtocolTCP, 443, intstr.FromString("web-tls"))),
+			// the pods may implement the named ports on different numbers
+			ep: newEndpoints("web",
+				newSubset([]string{"10.128.1.2"},
+					kapi.EndpointPort{Name: "http", Protocol: kapi.ProtocolTCP, Port: 8080},
+					kapi.EndpointPort{Name: "https", Protocol: kapi.ProtocolTCP, Port: 8443}),
+				newSubset([]string{"10.128.2.2"},
+					kapi.EndpointPort{Name: "http", Protocol: kapi.ProtocolTCP, Port: 9080},
+					kapi.EndpointPort{Name: "https", Protocol: kapi.ProtocolTCP, Port: 9443})),
+			tcpVIPs: map[string]string{
+				"172.30.0.10:80":  "10.128.1.2:8080,10.128.2.2:9080",
+				"172.30.0.10:443": "10.128.1.2:8443,10.128.2.2:9443",
+			},
+			udpVIPs: map[string]string{},
+		},
+		{
+			name: "IPv6 service",
+			svc:  newService("web", "fd00:172:30::10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080))),
+			ep: newEndpoints("web", newSubset([]string{"fd00:10:128:1::2", "fd00:10:128:2::2"},
+				kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 8080})),
+			tcpVIPs: map[string]string{"[fd00:172:30::10]:80": "[fd00:10:128:1::2]:8080,[fd00:10:128:2::2]:8080"},
+			udpVIPs: map[string]string{},
+		},
+		{
+			name: "endpoints without addresses",
+			svc:  newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080))),
+			ep:   newEndpoints("web"),
+			// the vip rejects the connections
+			tcpVIPs: map[string]string{"172.30.0.10:80": ""},
+			udpVIPs: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		oc, nb, tcpLB, udpLB := newTestLBController()
+		if err := oc.addService(test.svc); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if err := oc.addEndpoints(test.ep); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, test.tcpVIPs) {
+			t.Errorf("%s: expected tcp vips %v, got %v", test.name, test.tcpVIPs, vips)
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(udpLB); !reflect.DeepEqual(vips, test.udpVIPs) {
+			t.Errorf("%s: expected udp vips %v, got %v", test.name, test.udpVIPs, vips)
+		}
+	}
+}
+
+func TestDeleteEndpoints(t *testing.T) {
+	oc, nb, tcpLB, _ := newTestLBController()
+	oc.addService(newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080))))
+	oc.addService(newService("db", "172.30.0.11", newServicePort("", kapi.ProtocolTCP, 5432, intstr.FromInt(5432))))
+
+	web := newEndpoints("web", newSubset([]string{"10.128.1.2"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 8080}))
+	db := newEndpoints("db", newSubset([]string{"10.128.1.3"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 5432}))
+	for _, ep := range []*kapi.Endpoints{web, db} {
+		if err := oc.addEndpoints(ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := oc.deleteEndpoints(web); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"172.30.0.11:5432": "10.128.1.3:5432"}
+	if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, expected) {
+		t.Errorf("expected tcp vips %v, got %v", expected, vips)
+	}
+}
+
+func TestUpdateEndpoints(t *testing.T) {
+	web := newService("web", "172.30.0.10",
+		newServicePort("http", kapi.ProtocolTCP, 80, intstr.FromInt(8080)),
+		newServicePort("https", kapi.ProtocolTCP, 443, intstr.FromInt(8443)))
+	webPorts := []kapi.EndpointPort{
+		{Name: "http", Protocol: kapi.ProtocolTCP, Port: 8080},
+		{Name: "https", Protocol: kapi.ProtocolTCP, Port: 8443},
+	}
+
+	tests := []struct {
+		name    string
+		svc     *kapi.Service
+		ep      *kapi.Endpoints
+		tcpVIPs map[string]string
+	}{
+		{
+			name: "scale up",
+			svc:  web,
+			ep:   newEndpoints("web", newSubset([]string{"10.128.2.2", "10.128.1.2", "10.128.1.3"}, webPorts...)),
+			tcpVIPs: map[string]string{
+				"172.30.0.10:80":  "10.128.1.2:8080,10.128.1.3:8080,10.128.2.2:8080",
+				"172.30.0.10:443": "10.128.1.2:8443,10.128.1.3:8443,10.128.2.2:8443",
+				"172.30.0.11:80":  "10.128.3.2:80",
+			},
+		},
+		{
+			name: "scale down",
+			svc:  web,
+			ep:   newEndpoints("web", newSubset([]string{"10.128.2.2"}, webPorts...)),
+			tcpVIPs: map[string]string{
+				"172.30.0.10:80":  "10.128.2.2:8080",
+				"172.30.0.10:443": "10.128.2.2:8443",
+				"172.30.0.11:80":  "10.128.3.2:80",
+			},
+		},
+		{
+			name: "port removed from the endpoints",
+			svc:  web,
+			ep:   newEndpoints("web", newSubset([]string{"10.128.1.2"}, webPorts[0])),
+			tcpVIPs: map[string]string{
+				"172.30.0.10:80":  "10.128.1.2:8080",
+				"172.30.0.10:443": "",
+				"172.30.0.11:80":  "10.128.3.2:80",
+			},
+		},
+		{
+			name: "port removed from the service",
+			svc:  newService("web", "172.30.0.10", newServicePort("https", kapi.ProtocolTCP, 443, intstr.FromInt(8443))),
+			ep:   newEndpoints("web", newSubset([]string{"10.128.1.2"}, webPorts[1])),
+			tcpVIPs: map[string]string{
+				"172.30.0.10:443": "10.128.1.2:8443",
+				"172.30.0.11:80":  "10.128.3.2:80",
+			},
+		},
+		{
+			name: "scale to zero",
+			svc:  web,
+			ep:   newEndpoints("web"),
+			tcpVIPs: map[string]string{
+				"172.30.0.10:80":  "",
+				"172.30.0.10:443": "",
+				"172.30.0.11:80":  "10.128.3.2:80",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		oc, nb, tcpLB, _ := newTestLBController()
+		oc.addService(web)
+		oc.addService(newService("other", "172.30.0.11", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(80))))
+
+		initial := []*kapi.Endpoints{
+			newEndpoints("web", newSubset([]string{"10.128.1.2", "10.128.2.2"}, webPorts...)),
+			newEndpoints("other", newSubset([]string{"10.128.3.2"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 80})),
+		}
+		for _, ep := range initial {
+			if err := oc.addEndpoints(ep); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+
+		if err := oc.addService(test.svc); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if err := oc.addEndpoints(test.ep); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, test.tcpVIPs) {
+			t.Errorf("%s: expected tcp vips %v, got %v", test.name, test.tcpVIPs, vips)
+		}
+	}
+}
+
+func TestServiceProtocols(t *testing.T) {
+	oc, nb, tcpLB, udpLB := newTestLBController()
+	sctpLB, err := nb.FindLoadBalancer(map[string]string{"k8s-cluster-lb-sctp": "yes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := nb.AddGateway("GR_node1", "192.168.1.10")
+
+	sctpPort := newServicePort("diameter", ProtocolSCTP, 3868, intstr.FromInt(3868))
+	sctpPort.NodePort = 30868
+	svc := newService("diameter", "172.30.0.20",
+		sctpPort,
+		newServicePort("http", kapi.ProtocolTCP, 80, intstr.FromInt(8080)),
+		newServicePort("other", kapi.Protocol("DCCP"), 5000, intstr.FromInt(5000)))
+	ep := newEndpoints("diameter", newSubset([]string{"10.128.1.2"},
+		kapi.EndpointPort{Name: "diameter", Protocol: ProtocolSCTP, Port: 3868},
+		kapi.EndpointPort{Name: "http", Protocol: kapi.ProtocolTCP, Port: 8080},
+		kapi.EndpointPort{Name: "other", Protocol: kapi.Protocol("DCCP"), Port: 5000}))
+	if err := oc.addService(svc); err != nil {
+		t.Fatal(err)
+	}
+	// the port with an unknown protocol is skipped, not the whole service
+	if err := oc.addEndpoints(ep); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]map[string]string{
+		sctpLB:                             {"172.30.0.20:3868": "10.128.1.2:3868"},
+		gw.LoadBalancers[ProtocolSCTP]:     {"192.168.1.10:30868": "10.128.1.2:3868"},
+		tcpLB:                              {"172.30.0.20:80": "10.128.1.2:8080"},
+		udpLB:                              {},
+		gw.LoadBalancers[kapi.ProtocolTCP]: {},
+	}
+	for lb, expectedVIPs := range expected {
+		if vips, _ := nb.GetLoadBalancerVIPs(lb); !reflect.DeepEqual(vips, expectedVIPs) {
+			t.Errorf("expected vips %v on %s, got %v", expectedVIPs, lb, vips)
+		}
+	}
+
+	if err := oc.deleteService(svc); err != nil {
+		t.Fatal(err)
+	}
+	if vips, _ := nb.GetLoadBalancerVIPs(sctpLB); len(vips) != 0 {
+		t.Errorf("expected no sctp vips, got %v", vips)
+	}
+}
+
+func TestNotReadyAddresses(t *testing.T) {
+	tolerant := func(svc *kapi.Service) *kapi.Service {
+		svc.Annotations = map[string]string{TolerateUnreadyEndpointsAnnotation: "true"}
+		return svc
+	}
+	port := kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 8080}
+	subset := newSubset([]string{"10.128.1.2"}, port)
+	subset.NotReadyAddresses = []kapi.EndpointAddress{{IP: "10.128.1.3"}}
+	notReady := kapi.EndpointSubset{
+		NotReadyAddresses: []kapi.EndpointAddress{{IP: "10.128.1.3"}},
+		Ports:             []kapi.EndpointPort{port},
+	}
+
+	tests := []struct {
+		name    string
+		svc     *kapi.Service
+		ep      *kapi.Endpoints
+		tcpVIPs map[string]string
+	}{
+		{
+			name:    "unready endpoints left out",
+			svc:     newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080))),
+			ep:      newEndpoints("web", subset),
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.2:8080"},
+		},
+		{
+			name:    "unready endpoints published",
+			svc:     tolerant(newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080)))),
+			ep:      newEndpoints("web", subset),
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.2:8080,10.128.1.3:8080"},
+		},
+		{
+			name:    "no ready endpoint",
+			svc:     newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080))),
+			ep:      newEndpoints("web", notReady),
+			tcpVIPs: map[string]string{"172.30.0.10:80": ""},
+		},
+		{
+			name:    "no ready endpoint published",
+			svc:     tolerant(newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080)))),
+			ep:      newEndpoints("web", notReady),
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.3:8080"},
+		},
+	}
+
+	for _, test := range tests {
+		oc, nb, tcpLB, _ := newTestLBController()
+		oc.addService(test.svc)
+		if err := oc.addEndpoints(test.ep); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, test.tcpVIPs) {
+			t.Errorf("%s: expected tcp vips %v, got %v", test.name, test.tcpVIPs, vips)
+		}
+		// the endpoints going away still remove the vips
+		if err := oc.deleteEndpoints(test.ep); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); len(vips) != 0 {
+			t.Errorf("%s: expected no vips without endpoints, got %v", test.name, vips)
+		}
+	}
+}
@@ -0,0 +1,610 @@
+package ovn
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	kapi "k8s.io/client-go/pkg/api/v1"
+
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+)
+
+// ErrNoAddresses is returned for a port whose dynamic addresses have not been
+// allocated yet
+var ErrNoAddresses = errors.New("logical switch port has no dynamic addresses yet")
+
+// clusterLBGroup is the load balancer group of the per service load balancers,
+// on every node switch and gateway router
+const clusterLBGroup = "k8s-cluster-lb-group"
+
+// Gateway is the gateway router of a node on the physical network
+type Gateway struct {
+	// Router is the name of the gateway router
+	Router string
+	// PhysicalIP is the address of the router on the physical network
+	PhysicalIP string
+	// LoadBalancers are the uuids of the load balancers of the router, by protocol
+	LoadBalancers map[kapi.Protocol]string
+}
+
+// ACL is a to-lport ACL of a logical switch
+type ACL struct {
+	Priority    int
+	Match       string
+	Action      string
+	ExternalIDs map[string]string
+}
+
+type gatewaysByRouter []Gateway
+
+func (g gatewaysByRouter) Len() int           { return len(g) }
+func (g gatewaysByRouter) Less(i, j int) bool { return g[i].Router < g[j].Router }
+func (g gatewaysByRouter) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+
+// NorthboundClient is the part of the OVN northbound database that the
+// controller works with
+type NorthboundClient interface {
+	// AddLogicalSwitchPort adds a port with dynamic addresses to a logical
+	// switch. Adding a port that already exists on the switch is not an
+	// error, a port on another switch is moved with new addresses.
+	AddLogicalSwitchPort(logicalSwitch, portName string, externalIDs map[string]string) error
+	// DeleteLogicalSwitchPort removes a port from its logical switch.
+	// Deleting a port that does not exist is not an error.
+	DeleteLogicalSwitchPort(portName string) error
+	// GetLogicalSwitchPortAddresses returns the dynamic mac address of a port
+	// and its ip addresses, one of each family of the switch, or
+	// ErrNoAddresses until they are allocated
+	GetLogicalSwitchPortAddresses(portName string) (string, []string, error)
+	// GetLogicalSwitchExternalID returns an external_ids value of a logical switch
+	GetLogicalSwitchExternalID(logicalSwitch, key string) (string, error)
+	// ListLogicalSwitchPorts returns the names of the ports with all the given
+	// external_ids
+	ListLogicalSwitchPorts(externalIDs map[string]string) ([]string, error)
+
+	// FindLoadBalancer returns the uuid of the load balancer with all the
+	// given external_ids
+	FindLoadBalancer(externalIDs map[string]string) (string, error)
+	// SetLoadBalancerVIP points a vip of the load balancer to the comma
+	// separated targets, replacing the previous targets
+	SetLoadBalancerVIP(lb, vip, targets string) error
+	// DeleteLoadBalancerVIP removes a vip from the load balancer
+	DeleteLoadBalancerVIP(lb, vip string) error
+	// GetLoadBalancerVIPs returns the vips of the load balancer and their
+	// comma separated targets
+	GetLoadBalancerVIPs(lb string) (map[string]string, error)
+
+	// ListGateways returns the gateway routers of the nodes, sorted by name
+	ListGateways() ([]Gateway, error)
+
+	// EnsureServiceLoadBalancer returns the load balancer of a service for the
+	// protocol, creating it in the cluster load balancer group if needed. The
+	// options of the load balancer are set to the given ones.
+	EnsureServiceLoadBalancer(service string, protocol kapi.Protocol, options map[string]string) (string, error)
+	// ListServiceLoadBalancers returns the load balancers of the services that
+	// have their own, by namespace/name and protocol
+	ListServiceLoadBalancers() (map[string]map[kapi.Protocol]string, error)
+	// DeleteLoadBalancer removes a load balancer of a service. Deleting a
+	// load balancer that does not exist is not an error.
+	DeleteLoadBalancer(lb string) error
+
+	// SetACLs replaces the ACLs of the logical switch that have all the given
+	// external_ids with the given ones, at once
+	SetACLs(logicalSwitch string, externalIDs map[string]string, acls []ACL) error
+	// ListACLs returns the ACLs that have all the given external_ids, by
+	// logical switch
+	ListACLs(externalIDs map[string]string) (map[string][]ACL, error)
+	// SetAddressSet sets the addresses of the address set with the given
+	// name, creating it with the given external_ids if needed
+	SetAddressSet(name string, externalIDs map[string]string, addresses []string) error
+	// DeleteAddressSet removes an address set. Deleting an address set that
+	// does not exist is not an error.
+	DeleteAddressSet(name string) error
+	// ListAddressSets returns the external_ids of the address sets, by name
+	ListAddressSets() (map[string]map[string]string, error)
+}
+
+type ovsdbNorthbound struct {
+	client *ovsdb.Client
+}
+
+// NewOvsdbNorthbound returns a NorthboundClient backed by an OVSDB connection
+// monitoring the ovsdb.NBTables and the ovsdb.NBPolicyTables
+func NewOvsdbNorthbound(client *ovsdb.Client) NorthboundClient {
+	return &ovsdbNorthbound{client: client}
+}
+
+func uuidCondition(uuid string) []ovsdb.Condition {
+	return []ovsdb.Condition{ovsdb.NewCondition("_uuid", "==", ovsdb.UUID{GoUUID: uuid})}
+}
+
+func (nb *ovsdbNorthbound) AddLogicalSwitchPort(logicalSwitch, portName string, externalIDs map[string]string) error {
+	ls, err := nb.client.LogicalSwitchByName(logicalSwitch)
+	if err != nil {
+		return fmt.Errorf("error finding logical switch %s - %v", logicalSwitch, err)
+	}
+	// the port is looked up on the server, the cache may not have the port
+	// of a previous call yet
+	ports, err := nb.client.Select(ovsdb.NBDatabase, ovsdb.LogicalSwitchPortTable, ovsdb.NewCondition("name", "==", portName))
+	if err != nil {
+		return err
+	}
+	ops := make([]ovsdb.Operation, 0)
+	if len(ports) > 0 {
+		uuid := ovsdb.UUID{GoUUID: ports[0].UUID()}
+		owners, err := nb.client.Select(ovsdb.NBDatabase, ovsdb.LogicalSwitchTable, ovsdb.NewCondition("ports", "includes", ovsdb.NewOvsSet(uuid)))
+		if err != nil {
+			return err
+		}
+		for _, owner := range owners {
+			if owner.UUID() == ls.UUID {
+				return nil
+			}
+		}
+		// the port of a pod that moved to another node is created again,
+		// with addresses of the subnet of its new switch
+		glog.Infof("Moving logical port %s to switch %s", portName, logicalSwitch)
+		for _, owner := range owners {
+			ops = append(ops, ovsdb.Operation{
+				Op:    "mutate",
+				Table: ovsdb.LogicalSwitchTable,
+				Where: uuidCondition(owner.UUID()),
+				Mutations: []ovsdb.Mutation{
+					ovsdb.NewMutation("ports", "delete", ovsdb.NewOvsSet(uuid)),
+				},
+			})
+		}
+		ops = append(ops, ovsdb.Operation{
+			Op:    "delete",
+			Table: ovsdb.LogicalSwitchPortTable,
+			Where: uuidCondition(uuid.GoUUID),
+		})
+	}
+	ops = append(ops,
+		ovsdb.Operation{
+			Op:    "insert",
+			Table: ovsdb.LogicalSwitchPortTable,
+			Row: ovsdb.Row{
+				"name":         portName,
+				"addresses":    ovsdb.NewOvsSet("dynamic"),
+				"external_ids": ovsdb.NewOvsMap(externalIDs),
+			},
+			UUIDName: "lsp",
+		},
+		ovsdb.Operation{
+			Op:    "mutate",
+			Table: ovsdb.LogicalSwitchTable,
+			Where: uuidCondition(ls.UUID),
+			Mutations: []ovsdb.Mutation{
+				ovsdb.NewMutation("ports", "insert", ovsdb.NewOvsSet(ovsdb.UUID{GoUUID: "lsp"})),
+			},
+		})
+	_, err = nb.client.Transact(ovsdb.NBDatabase, ops...)
+	return err
+}
+
+func (nb *ovsdbNorthbound) DeleteLogicalSwitchPort(portName string) error {
+	lsp, err := nb.client.LogicalSwitchPortByName(portName)
+	if err == ovsdb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	ops := make([]ovsdb.Operation, 0)
+	for _, ls := range nb.client.LogicalSwitches() {
+		for _, port := range ls.Ports {
+			if port == lsp.UUID {
+				ops = append(ops, ovsdb.Operation{
+					Op:    "mutate",
+					Table: ovsdb.LogicalSwitchTable,
+					Where: uuidCondition(ls.UUID),
+					Mutations: []ovsdb.Mutation{
+						ovsdb.NewMutation("ports", "delete", ovsdb.NewOvsSet(ovsdb.UUID{GoUUID: lsp.UUID})),
+					},
+				})
+			}
+		}
+	}
+	ops = append(ops, ovsdb.Operation{
+		Op:    "delete",
+		Table: ovsdb.LogicalSwitchPortTable,
+		Where: uuidCondition(lsp.UUID),
+	})
+	_, err = nb.client.Transact(ovsdb.NBDatabase, ops...)
+	return err
+}
+
+func (nb *ovsdbNorthbound) GetLogicalSwitchPortAddresses(portName string) (string, []string, error) {
+	lsp, err := nb.client.LogicalSwitchPortByName(portName)
+	if err != nil {
+		return "", nil, err
+	}
+	// the mac followed by the IPv4 and the IPv6 address, as the switch has
+	// other_config:subnet and other_config:ipv6_prefix
+	addresses := strings.Fields(lsp.DynamicAddresses)
+	if len(addresses) < 2 {
+		return "", nil, ErrNoAddresses
+	}
+	return addresses[0], addresses[1:], nil
+}
+
+func (nb *ovsdbNorthbound) GetLogicalSwitchExternalID(logicalSwitch, key string) (string, error) {
+	ls, err := nb.client.LogicalSwitchByName(logicalSwitch)
+	if err != nil {
+		return "", err
+	}
+	value, ok := ls.ExternalIDs[key]
+	if !ok {
+		return "", fmt.Errorf("no external_ids:%s set on logical switch %s", key, logicalSwitch)
+	}
+	return value, nil
+}
+
+func (nb *ovsdbNorthbound) ListLogicalSwitchPorts(externalIDs map[string]string) ([]string, error) {
+	ports := make([]string, 0)
+	for _, lsp := range nb.client.LogicalSwitchPorts() {
+		if hasExternalIDs(lsp.ExternalIDs, externalIDs) {
+			ports = append(ports, lsp.Name)
+		}
+	}
+	return ports, nil
+}
+
+func (nb *ovsdbNorthbound) FindLoadBalancer(externalIDs map[string]string) (string, error) {
+	for _, lb := range nb.client.LoadBalancers() {
+		if hasExternalIDs(lb.ExternalIDs, externalIDs) {
+			return lb.UUID, nil
+		}
+	}
+	return "", ovsdb.ErrNotFound
+}
+
+func (nb *ovsdbNorthbound) SetLoadBalancerVIP(lb, vip, targets string) error {
+	// a map insert mutation does not overwrite existing keys
+	_, err := nb.client.Transact(ovsdb.NBDatabase, ovsdb.Operation{
+		Op:    "mutate",
+		Table: ovsdb.LoadBalancerTable,
+		Where: uuidCondition(lb),
+		Mutations: []ovsdb.Mutation{
+			ovsdb.NewMutation("vips", "delete", ovsdb.NewOvsSet(vip)),
+			ovsdb.NewMutation("vips", "insert", ovsdb.NewOvsMap(map[string]string{vip: targets})),
+		},
+	})
+	return err
+}
+
+func (nb *ovsdbNorthbound) DeleteLoadBalancerVIP(lb, vip string) error {
+	_, err := nb.client.Transact(ovsdb.NBDatabase, ovsdb.Operation{
+		Op:    "mutate",
+		Table: ovsdb.LoadBalancerTable,
+		Where: uuidCondition(lb),
+		Mutations: []ovsdb.Mutation{
+			ovsdb.NewMutation("vips", "delete", ovsdb.NewOvsSet(vip)),
+		},
+	})
+	return err
+}
+
+func (nb *ovsdbNorthbound) GetLoadBalancerVIPs(lb string) (map[string]string, error) {
+	row, ok := nb.client.Rows(ovsdb.LoadBalancerTable)[lb]
+	if !ok {
+		// a load balancer that was just created may not be cached yet
+		rows, err := nb.client.Select(ovsdb.NBDatabase, ovsdb.LoadBalancerTable, uuidCondition(lb)...)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return nil, ovsdb.ErrNotFound
+		}
+		row = rows[0]
+	}
+	return ovsdb.NewLoadBalancer(row).Vips, nil
+}
+
+func (nb *ovsdbNorthbound) ListGateways() ([]Gateway, error) {
+	lbs := make(map[string]*ovsdb.LoadBalancer)
+	for _, lb := range nb.client.LoadBalancers() {
+		lbs[lb.UUID] = lb
+	}
+	gateways := make([]Gateway, 0)
+	for _, lr := range nb.client.LogicalRouters() {
+		// the gateway routers are the ones bound to a chassis
+		if lr.Options["chassis"] == "" || lr.ExternalIDs["physical_ip"] == "" {
+			continue
+		}
+		gateway := Gateway{
+			Router:        lr.Name,
+			PhysicalIP:    lr.ExternalIDs["physical_ip"],
+			LoadBalancers: make(map[kapi.Protocol]string),
+		}
+		for _, uuid := range lr.LoadBalancer {
+			lb, ok := lbs[uuid]
+			if !ok {
+				continue
+			}
+			gateway.LoadBalancers[lbProtocol(lb)] = lb.UUID
+		}
+		gateways = append(gateways, gateway)
+	}
+	sort.Sort(gatewaysByRouter(gateways))
+	return gateways, nil
+}
+
+// lbProtocol returns the protocol of a load balancer, tcp if it has none
+func lbProtocol(lb *ovsdb.LoadBalancer) kapi.Protocol {
+	if lb.Protocol == "" {
+		return kapi.ProtocolTCP
+	}
+	return kapi.Protocol(strings.ToUpper(lb.Protocol))
+}
+
+func (nb *ovsdbNorthbound) EnsureServiceLoadBalancer(service string, protocol kapi.Protocol, options map[string]string) (string, error) {
+	// the load balancers are looked up on the server, the cache may not have
+	// the one of a previous call yet
+	rows, err := nb.client.Select(ovsdb.NBDatabase, ovsdb.LoadBalancerTable,
+		ovsdb.NewCondition("external_ids", "includes", ovsdb.NewOvsMap(map[string]string{"k8s-service": service})))
+	if err != nil {
+		return "", err
+	}
+	for _, row := range rows {
+		lb := ovsdb.NewLoadBalancer(row)
+		if lbProtocol(lb) != protocol {
+			continue
+		}
+		if reflect.DeepEqual(lb.Options, options) || (len(lb.Options) == 0 && len(options) == 0) {
+			return lb.UUID, nil
+		}
+		_, err = nb.client.Transact(ovsdb.NBDatabase, ovsdb.Operation{
+			Op:    "update",
+			Table: ovsdb.LoadBalancerTable,
+			Where: uuidCondition(lb.UUID),
+			Row:   ovsdb.Row{"options": ovsdb.NewOvsMap(options)},
+		})
+		return lb.UUID, err
+	}
+
+	group, err := nb.client.LoadBalancerGroupByName(clusterLBGroup)
+	if err != nil {
+		return "", fmt.Errorf("no load balancer group %s, is the master set up? - %v", clusterLBGroup, err)
+	}
+	result, err := nb.client.Transact(ovsdb.NBDatabase,
+		ovsdb.Operation{
+			Op:    "insert",
+			Table: ovsdb.LoadBalancerTable,
+			Row: ovsdb.Row{
+				"protocol":     strings.ToLower(string(protocol)),
+				"options":      ovsdb.NewOvsMap(options),
+				"external_ids": ovsdb.NewOvsMap(map[string]string{"k8s-service": service}),
+			},
+			UUIDName: "lb",
+		},
+		ovsdb.Operation{
+			Op:    "mutate",
+			Table: ovsdb.LoadBalancerGroupTable,
+			Where: uuidCondition(group.UUID),
+			Mutations: []ovsdb.Mutation{
+				ovsdb.NewMutation("load_balancer", "insert", ovsdb.NewOvsSet(ovsdb.UUID{GoUUID: "lb"})),
+			},
+		})
+	if err != nil {
+		return "", err
+	}
+	return result[0].UUID.GoUUID, nil
+}
+
+func (nb *ovsdbNorthbound) ListServiceLoadBalancers() (map[string]map[kapi.Protocol]string, error) {
+	lbs := make(map[string]map[kapi.Protocol]string)
+	for _, lb := range nb.client.LoadBalancers() {
+		service, ok := lb.ExternalIDs["k8s-service"]
+		if !ok {
+			continue
+		}
+		if lbs[service] == nil {
+			lbs[service] = make(map[kapi.Protocol]string)
+		}
+		lbs[service][lbProtocol(lb)] = lb.UUID
+	}
+	return lbs, nil
+}
+
+func (nb *ovsdbNorthbound) DeleteLoadBalancer(lb string) error {
+	if _, ok := nb.client.Rows(ovsdb.LoadBalancerTable)[lb]; !ok {
+		return nil
+	}
+	// the load balancer is only deleted once nothing refers to it
+	ops := make([]ovsdb.Operation, 0)
+	if group, err := nb.client.LoadBalancerGroupByName(clusterLBGroup); err == nil {
+		ops = append(ops, ovsdb.Operation{
+			Op:    "mutate",
+			Table: ovsdb.LoadBalancerGroupTable,
+			Where: uuidCondition(group.UUID),
+			Mutations: []ovsdb.Mutation{
+				ovsdb.NewMutation("load_balancer", "delete", ovsdb.NewOvsSet(ovsdb.UUID{GoUUID: lb})),
+			},
+		})
+	}
+	ops = append(ops, ovsdb.Operation{
+		Op:    "delete",
+		Table: ovsdb.LoadBalancerTable,
+		Where: uuidCondition(lb),
+	})
+	_, err := nb.client.Transact(ovsdb.NBDatabase, ops...)
+	return err
+}
+
+func (nb *ovsdbNorthbound) SetACLs(logicalSwitch string, externalIDs map[string]string, acls []ACL) error {
+	ls, err := nb.client.LogicalSwitchByName(logicalSwitch)
+	if err != nil {
+		return fmt.Errorf("error finding logical switch %s - %v", logicalSwitch, err)
+	}
+	onSwitch := make(map[string]bool, len(ls.ACLs))
+	for _, uuid := range ls.ACLs {
+		onSwitch[uuid] = true
+	}
+	existing := make([]*ovsdb.ACL, 0)
+	for _, acl := range nb.client.ACLs() {
+		if onSwitch[acl.UUID] && hasExternalIDs(acl.ExternalIDs, externalIDs) {
+			existing = append(existing, acl)
+		}
+	}
+	if sameACLs(existing, acls) {
+		return nil
+	}
+
+	ops := make([]ovsdb.Operation, 0)
+	for _, acl := range existing {
+		ops = append(ops, ovsdb.Operation{
+			Op:    "mutate",
+			Table: ovsdb.LogicalSwitchTable,
+			Where: uuidCondition(ls.UUID),
+			Mutations: []ovsdb.Mutation{
+				ovsdb.NewMutation("acls", "delete", ovsdb.NewOvsSet(ovsdb.UUID{GoUUID: acl.UUID})),
+			},
+		}, ovsdb.Operation{
+			Op:    "delete",
+			Table: ovsdb.ACLTable,
+			Where: uuidCondition(acl.UUID),
+		})
+	}
+	for i, acl := range acls {
+		name := fmt.Sprintf("acl%d", i)
+		ops = append(ops, ovsdb.Operation{
+			Op:    "insert",
+			Table: ovsdb.ACLTable,
+			Row: ovsdb.Row{
+				"priority":     acl.Priority,
+				"direction":    "to-lport",
+				"match":        acl.Match,
+				"action":       acl.Action,
+				"external_ids": ovsdb.NewOvsMap(acl.ExternalIDs),
+			},
+			UUIDName: name,
+		}, ovsdb.Operation{
+			Op:    "mutate",
+			Table: ovsdb.LogicalSwitchTable,
+			Where: uuidCondition(ls.UUID),
+			Mutations: []ovsdb.Mutation{
+				ovsdb.NewMutation("acls", "insert", ovsdb.NewOvsSet(ovsdb.UUID{GoUUID: name})),
+			},
+		})
+	}
+	_, err = nb.client.Transact(ovsdb.NBDatabase, ops...)
+	return err
+}
+
+// sameACLs tells if the existing ACLs are the given ones, in any order
+func sameACLs(existing []*ovsdb.ACL, acls []ACL) bool {
+	if len(existing) != len(acls) {
+		return false
+	}
+	matched := make([]bool, len(existing))
+	for _, acl := range acls {
+		found := false
+		for i, e := range existing {
+			if !matched[i] && e.Priority == acl.Priority && e.Direction == "to-lport" && e.Match == acl.Match &&
+				e.Action == acl.Action && reflect.DeepEqual(e.ExternalIDs, acl.ExternalIDs) {
+				matched[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (nb *ovsdbNorthbound) ListACLs(externalIDs map[string]string) (map[string][]ACL, error) {
+	rows := make(map[string]*ovsdb.ACL)
+	for _, acl := range nb.client.ACLs() {
+		rows[acl.UUID] = acl
+	}
+	acls := make(map[string][]ACL)
+	for _, ls := range nb.client.LogicalSwitches() {
+		for _, uuid := range ls.ACLs {
+			acl, ok := rows[uuid]
+			if !ok || !hasExternalIDs(acl.ExternalIDs, externalIDs) {
+				continue
+			}
+			acls[ls.Name] = append(acls[ls.Name], ACL{
+				Priority:    acl.Priority,
+				Match:       acl.Match,
+				Action:      acl.Action,
+				ExternalIDs: acl.ExternalIDs,
+			})
+		}
+	}
+	return acls, nil
+}
+
+func (nb *ovsdbNorthbound) SetAddressSet(name string, externalIDs map[string]string, addresses []string) error {
+	as, err := nb.client.AddressSetByName(name)
+	if err != nil && err != ovsdb.ErrNotFound {
+		return err
+	} else if err == nil {
+		if reflect.DeepEqual(sortedCopy(as.Addresses), sortedCopy(addresses)) {
+			return nil
+		}
+		_, err = nb.client.Transact(ovsdb.NBDatabase, ovsdb.Operation{
+			Op:    "update",
+			Table: ovsdb.AddressSetTable,
+			Where: uuidCondition(as.UUID),
+			Row:   ovsdb.Row{"addresses": ovsdb.NewOvsSet(addresses)},
+		})
+		return err
+	}
+	_, err = nb.client.Transact(ovsdb.NBDatabase, ovsdb.Operation{
+		Op:    "insert",
+		Table: ovsdb.AddressSetTable,
+		Row: ovsdb.Row{
+			"name":         name,
+			"addresses":    ovsdb.NewOvsSet(addresses),
+			"external_ids": ovsdb.NewOvsMap(externalIDs),
+		},
+	})
+	return err
+}
+
+func (nb *ovsdbNorthbound) DeleteAddressSet(name string) error {
+	as, err := nb.client.AddressSetByName(name)
+	if err == ovsdb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = nb.client.Transact(ovsdb.NBDatabase, ovsdb.Operation{
+		Op:    "delete",
+		Table: ovsdb.AddressSetTable,
+		Where: uuidCondition(as.UUID),
+	})
+	return err
+}
+
+func (nb *ovsdbNorthbound) ListAddressSets() (map[string]map[string]string, error) {
+	sets := make(map[string]map[string]string)
+	for _, as := range nb.client.AddressSets() {
+		sets[as.Name] = as.ExternalIDs
+	}
+	return sets, nil
+}
+
+func sortedCopy(values []string) []string {
+	sorted := make([]string, len(values))
+	copy(sorted, values)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func hasExternalIDs(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
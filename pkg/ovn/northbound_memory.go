@@ -0,0 +1,484 @@
+package ovn
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	kapi "k8s.io/client-go/pkg/api/v1"
+)
+
+// MemoryNorthbound is an in-memory NorthboundClient for tests. Like ovn-northd
+// it allocates the dynamic addresses of a port from the other_config:subnet
+// and other_config:ipv6_prefix of its logical switch, an address of each,
+// skipping the network and gateway addresses.
+type MemoryNorthbound struct {
+	mutex         sync.Mutex
+	switches      map[string]*memorySwitch
+	ports         map[string]*memoryPort
+	loadBalancers map[string]*memoryLoadBalancer
+	gateways      map[string]*Gateway
+	// lbGroup holds the load balancers in the cluster load balancer group
+	lbGroup map[string]bool
+	nextLB  int
+	// addressSets holds the address sets by name
+	addressSets map[string]*memoryAddressSet
+}
+
+type memorySwitch struct {
+	subnets     []*net.IPNet
+	externalIDs map[string]string
+	ports       map[string]bool
+	acls        []ACL
+}
+
+type memoryPort struct {
+	logicalSwitch string
+	mac           string
+	ips           []string
+	externalIDs   map[string]string
+}
+
+type memoryAddressSet struct {
+	externalIDs map[string]string
+	addresses   []string
+}
+
+type memoryLoadBalancer struct {
+	protocol    kapi.Protocol
+	options     map[string]string
+	externalIDs map[string]string
+	vips        map[string]string
+}
+
+func NewMemoryNorthbound() *MemoryNorthbound {
+	return &MemoryNorthbound{
+		switches:      make(map[string]*memorySwitch),
+		ports:         make(map[string]*memoryPort),
+		loadBalancers: make(map[string]*memoryLoadBalancer),
+		gateways:      make(map[string]*Gateway),
+		lbGroup:       make(map[string]bool),
+		addressSets:   make(map[string]*memoryAddressSet),
+	}
+}
+
+// AddLogicalSwitch creates a switch for the subnets, at most one of each IP
+// family, with their first address as the gateway_ip and gateway_ip_v6
+// external ids the way the node setup does
+func (nb *MemoryNorthbound) AddLogicalSwitch(name string, subnets ...string) error {
+	ls := &memorySwitch{
+		externalIDs: make(map[string]string),
+		ports:       make(map[string]bool),
+	}
+	for _, subnet := range subnets {
+		ip, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return err
+		}
+		gateway := nextIP(ip.Mask(ipnet.Mask))
+		prefixLen, _ := ipnet.Mask.Size()
+		key := "gateway_ip"
+		if ip.To4() == nil {
+			key = "gateway_ip_v6"
+		}
+		ls.subnets = append(ls.subnets, ipnet)
+		ls.externalIDs[key] = fmt.Sprintf("%s/%d", gateway, prefixLen)
+	}
+
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	nb.switches[name] = ls
+	return nil
+}
+
+// AddLoadBalancer creates a load balancer and returns its uuid
+func (nb *MemoryNorthbound) AddLoadBalancer(externalIDs map[string]string) string {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	return nb.addLoadBalancer("", externalIDs)
+}
+
+func (nb *MemoryNorthbound) addLoadBalancer(protocol kapi.Protocol, externalIDs map[string]string) string {
+	nb.nextLB++
+	uuid := fmt.Sprintf("lb-%d", nb.nextLB)
+	nb.loadBalancers[uuid] = &memoryLoadBalancer{
+		protocol:    protocol,
+		externalIDs: externalIDs,
+		vips:        make(map[string]string),
+	}
+	return uuid
+}
+
+// LoadBalancerOptions returns the options of a load balancer
+func (nb *MemoryNorthbound) LoadBalancerOptions(lb string) map[string]string {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	if l, ok := nb.loadBalancers[lb]; ok {
+		return l.options
+	}
+	return nil
+}
+
+// LoadBalancerGroup returns the load balancers of the cluster load balancer group
+func (nb *MemoryNorthbound) LoadBalancerGroup() []string {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	lbs := make([]string, 0, len(nb.lbGroup))
+	for lb := range nb.lbGroup {
+		lbs = append(lbs, lb)
+	}
+	sort.Strings(lbs)
+	return lbs
+}
+
+// AddGateway creates a gateway router with a load balancer per cluster
+// protocol, the way the gateway setup of a node does, and returns the gateway
+func (nb *MemoryNorthbound) AddGateway(router, physicalIP string) Gateway {
+	gateway := &Gateway{
+		Router:        router,
+		PhysicalIP:    physicalIP,
+		LoadBalancers: make(map[kapi.Protocol]string),
+	}
+	for _, protocol := range clusterProtocols {
+		externalID := "k8s-gateway-lb-" + strings.ToLower(string(protocol))
+		gateway.LoadBalancers[protocol] = nb.AddLoadBalancer(map[string]string{externalID: router})
+	}
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	nb.gateways[router] = gateway
+	return *gateway
+}
+
+// DeleteGateway removes a gateway router and its load balancers
+func (nb *MemoryNorthbound) DeleteGateway(router string) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	if gateway, ok := nb.gateways[router]; ok {
+		for _, lb := range gateway.LoadBalancers {
+			delete(nb.loadBalancers, lb)
+		}
+		delete(nb.gateways, router)
+	}
+}
+
+// LogicalSwitchPorts returns the names of the ports of a switch
+func (nb *MemoryNorthbound) LogicalSwitchPorts(logicalSwitch string) []string {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	ports := make([]string, 0)
+	if ls, ok := nb.switches[logicalSwitch]; ok {
+		for name := range ls.ports {
+			ports = append(ports, name)
+		}
+	}
+	return ports
+}
+
+// ACLs returns the ACLs of a switch
+func (nb *MemoryNorthbound) ACLs(logicalSwitch string) []ACL {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	acls := make([]ACL, 0)
+	if ls, ok := nb.switches[logicalSwitch]; ok {
+		acls = append(acls, ls.acls...)
+	}
+	return acls
+}
+
+// AddressSet returns the sorted addresses of an address set and whether it
+// exists
+func (nb *MemoryNorthbound) AddressSet(name string) ([]string, bool) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	as, ok := nb.addressSets[name]
+	if !ok {
+		return nil, false
+	}
+	return sortedCopy(as.addresses), true
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func (nb *MemoryNorthbound) allocateIP(ls *memorySwitch, subnet *net.IPNet) (net.IP, error) {
+	used := make(map[string]bool)
+	for name := range ls.ports {
+		for _, ip := range nb.ports[name].ips {
+			used[ip] = true
+		}
+	}
+	// skip the network address and the gateway
+	ip := nextIP(nextIP(subnet.IP.Mask(subnet.Mask)))
+	for subnet.Contains(ip) {
+		if !used[ip.String()] && subnet.Contains(nextIP(ip)) {
+			return ip, nil
+		}
+		ip = nextIP(ip)
+	}
+	return nil, fmt.Errorf("subnet %s is exhausted", subnet)
+}
+
+func (nb *MemoryNorthbound) AddLogicalSwitchPort(logicalSwitch, portName string, externalIDs map[string]string) error {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	ls, ok := nb.switches[logicalSwitch]
+	if !ok {
+		return fmt.Errorf("no logical switch %s", logicalSwitch)
+	}
+	existing, ok := nb.ports[portName]
+	if ok && existing.logicalSwitch == logicalSwitch {
+		return nil
+	}
+	port := &memoryPort{
+		logicalSwitch: logicalSwitch,
+		externalIDs:   externalIDs,
+	}
+	for _, subnet := range ls.subnets {
+		ip, err := nb.allocateIP(ls, subnet)
+		if err != nil {
+			return err
+		}
+		if port.mac == "" {
+			// the last 4 bytes of the first address
+			b := ip[len(ip)-4:]
+			port.mac = fmt.Sprintf("0a:00:%02x:%02x:%02x:%02x", b[0], b[1], b[2], b[3])
+		}
+		port.ips = append(port.ips, ip.String())
+	}
+	if existing != nil {
+		delete(nb.switches[existing.logicalSwitch].ports, portName)
+	}
+	nb.ports[portName] = port
+	ls.ports[portName] = true
+	return nil
+}
+
+func (nb *MemoryNorthbound) DeleteLogicalSwitchPort(portName string) error {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	port, ok := nb.ports[portName]
+	if !ok {
+		return nil
+	}
+	delete(nb.switches[port.logicalSwitch].ports, portName)
+	delete(nb.ports, portName)
+	return nil
+}
+
+func (nb *MemoryNorthbound) GetLogicalSwitchPortAddresses(portName string) (string, []string, error) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	port, ok := nb.ports[portName]
+	if !ok {
+		return "", nil, fmt.Errorf("no logical switch port %s", portName)
+	}
+	if len(port.ips) == 0 {
+		return "", nil, ErrNoAddresses
+	}
+	return port.mac, port.ips, nil
+}
+
+func (nb *MemoryNorthbound) GetLogicalSwitchExternalID(logicalSwitch, key string) (string, error) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	ls, ok := nb.switches[logicalSwitch]
+	if !ok {
+		return "", fmt.Errorf("no logical switch %s", logicalSwitch)
+	}
+	value, ok := ls.externalIDs[key]
+	if !ok {
+		return "", fmt.Errorf("no external_ids:%s set on logical switch %s", key, logicalSwitch)
+	}
+	return value, nil
+}
+
+func (nb *MemoryNorthbound) ListLogicalSwitchPorts(externalIDs map[string]string) ([]string, error) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	ports := make([]string, 0)
+	for name, port := range nb.ports {
+		if hasExternalIDs(port.externalIDs, externalIDs) {
+			ports = append(ports, name)
+		}
+	}
+	return ports, nil
+}
+
+func (nb *MemoryNorthbound) FindLoadBalancer(externalIDs map[string]string) (string, error) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	for uuid, lb := range nb.loadBalancers {
+		if hasExternalIDs(lb.externalIDs, externalIDs) {
+			return uuid, nil
+		}
+	}
+	return "", fmt.Errorf("no load balancer with external_ids %v", externalIDs)
+}
+
+func (nb *MemoryNorthbound) SetLoadBalancerVIP(lb, vip, targets string) error {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	l, ok := nb.loadBalancers[lb]
+	if !ok {
+		return fmt.Errorf("no load balancer %s", lb)
+	}
+	l.vips[vip] = targets
+	return nil
+}
+
+func (nb *MemoryNorthbound) DeleteLoadBalancerVIP(lb, vip string) error {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	l, ok := nb.loadBalancers[lb]
+	if !ok {
+		return fmt.Errorf("no load balancer %s", lb)
+	}
+	delete(l.vips, vip)
+	return nil
+}
+
+func (nb *MemoryNorthbound) GetLoadBalancerVIPs(lb string) (map[string]string, error) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	l, ok := nb.loadBalancers[lb]
+	if !ok {
+		return nil, fmt.Errorf("no load balancer %s", lb)
+	}
+	vips := make(map[string]string, len(l.vips))
+	for vip, targets := range l.vips {
+		vips[vip] = targets
+	}
+	return vips, nil
+}
+
+func (nb *MemoryNorthbound) ListGateways() ([]Gateway, error) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	gateways := make([]Gateway, 0, len(nb.gateways))
+	for _, gateway := range nb.gateways {
+		lbs := make(map[kapi.Protocol]string, len(gateway.LoadBalancers))
+		for protocol, lb := range gateway.LoadBalancers {
+			lbs[protocol] = lb
+		}
+		gateways = append(gateways, Gateway{
+			Router:        gateway.Router,
+			PhysicalIP:    gateway.PhysicalIP,
+			LoadBalancers: lbs,
+		})
+	}
+	sort.Sort(gatewaysByRouter(gateways))
+	return gateways, nil
+}
+
+func (nb *MemoryNorthbound) EnsureServiceLoadBalancer(service string, protocol kapi.Protocol, options map[string]string) (string, error) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	for uuid, lb := range nb.loadBalancers {
+		if lb.externalIDs["k8s-service"] == service && lb.protocol == protocol {
+			lb.options = options
+			return uuid, nil
+		}
+	}
+	uuid := nb.addLoadBalancer(protocol, map[string]string{"k8s-service": service})
+	nb.loadBalancers[uuid].options = options
+	nb.lbGroup[uuid] = true
+	return uuid, nil
+}
+
+func (nb *MemoryNorthbound) ListServiceLoadBalancers() (map[string]map[kapi.Protocol]string, error) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	lbs := make(map[string]map[kapi.Protocol]string)
+	for uuid, lb := range nb.loadBalancers {
+		service, ok := lb.externalIDs["k8s-service"]
+		if !ok {
+			continue
+		}
+		if lbs[service] == nil {
+			lbs[service] = make(map[kapi.Protocol]string)
+		}
+		lbs[service][lb.protocol] = uuid
+	}
+	return lbs, nil
+}
+
+func (nb *MemoryNorthbound) DeleteLoadBalancer(lb string) error {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	delete(nb.lbGroup, lb)
+	delete(nb.loadBalancers, lb)
+	return nil
+}
+
+func (nb *MemoryNorthbound) SetACLs(logicalSwitch string, externalIDs map[string]string, acls []ACL) error {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	ls, ok := nb.switches[logicalSwitch]
+	if !ok {
+		return fmt.Errorf("no logical switch %s", logicalSwitch)
+	}
+	kept := make([]ACL, 0, len(ls.acls)+len(acls))
+	for _, acl := range ls.acls {
+		if !hasExternalIDs(acl.ExternalIDs, externalIDs) {
+			kept = append(kept, acl)
+		}
+	}
+	ls.acls = append(kept, acls...)
+	return nil
+}
+
+func (nb *MemoryNorthbound) ListACLs(externalIDs map[string]string) (map[string][]ACL, error) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	acls := make(map[string][]ACL)
+	for name, ls := range nb.switches {
+		for _, acl := range ls.acls {
+			if hasExternalIDs(acl.ExternalIDs, externalIDs) {
+				acls[name] = append(acls[name], acl)
+			}
+		}
+	}
+	return acls, nil
+}
+
+func (nb *MemoryNorthbound) SetAddressSet(name string, externalIDs map[string]string, addresses []string) error {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	if as, ok := nb.addressSets[name]; ok {
+		as.addresses = addresses
+		return nil
+	}
+	nb.addressSets[name] = &memoryAddressSet{
+		externalIDs: externalIDs,
+		addresses:   addresses,
+	}
+	return nil
+}
+
+func (nb *MemoryNorthbound) DeleteAddressSet(name string) error {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	delete(nb.addressSets, name)
+	return nil
+}
+
+func (nb *MemoryNorthbound) ListAddressSets() (map[string]map[string]string, error) {
+	nb.mutex.Lock()
+	defer nb.mutex.Unlock()
+	sets := make(map[string]map[string]string)
+	for name, as := range nb.addressSets {
+		sets[name] = as.externalIDs
+	}
+	return sets, nil
+}
@@ -0,0 +1,149 @@
+package ovn
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	kapi "k8s.io/client-go/pkg/api/v1"
+
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb/fake"
+)
+
+// newTestOvsdbNorthbound returns a northbound client on a fake server with
+// the switch of node1 and the load balancer group
+func newTestOvsdbNorthbound(t *testing.T) (*fake.Server, *ovsdb.Client, NorthboundClient) {
+	server := fake.NewServer(ovsdb.NBDatabase)
+	address, err := server.Start()
+	if err != nil {
+		t.Fatalf("failed to start the fake server: %v", err)
+	}
+	client, err := ovsdb.Dial(address, nil)
+	if err != nil {
+		server.Close()
+		t.Fatalf("failed to connect to the fake server: %v", err)
+	}
+	if err := client.Monitor(ovsdb.NBDatabase, ovsdb.NBTables...); err != nil {
+		client.Close()
+		server.Close()
+		t.Fatalf("failed to monitor: %v", err)
+	}
+	server.Insert(ovsdb.LogicalSwitchTable, ovsdb.Row{"name": "node1"})
+	server.Insert(ovsdb.LoadBalancerGroupTable, ovsdb.Row{"name": clusterLBGroup})
+	waitForSwitch(t, client, "node1")
+	return server, client, NewOvsdbNorthbound(client)
+}
+
+// waitForSwitch waits for a switch inserted on the server to be in the cache
+func waitForSwitch(t *testing.T, client *ovsdb.Client, name string) {
+	if err := utilwait.PollImmediate(10*time.Millisecond, time.Second, func() (bool, error) {
+		_, err := client.LogicalSwitchByName(name)
+		return err == nil, nil
+	}); err != nil {
+		t.Fatalf("switch %s is not in the cache", name)
+	}
+}
+
+func TestOvsdbServiceLoadBalancers(t *testing.T) {
+	server, client, nb := newTestOvsdbNorthbound(t)
+	defer server.Close()
+	defer client.Close()
+
+	tcp, err := nb.EnsureServiceLoadBalancer("default/web", kapi.ProtocolTCP, map[string]string{"reject": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the load balancer is found on the server, not created again
+	again, err := nb.EnsureServiceLoadBalancer("default/web", kapi.ProtocolTCP, map[string]string{"reject": "true", "affinity_timeout": "600"})
+	if err != nil || again != tcp {
+		t.Errorf("expected the load balancer %s again, got %s (%v)", tcp, again, err)
+	}
+	udp, err := nb.EnsureServiceLoadBalancer("default/web", kapi.ProtocolUDP, nil)
+	if err != nil || udp == tcp {
+		t.Errorf("expected another load balancer for udp, got %s (%v)", udp, err)
+	}
+	if err := nb.SetLoadBalancerVIP(tcp, "172.30.0.10:80", "10.128.1.2:8080"); err != nil {
+		t.Fatal(err)
+	}
+	vips, err := nb.GetLoadBalancerVIPs(tcp)
+	if err != nil || !reflect.DeepEqual(vips, map[string]string{"172.30.0.10:80": "10.128.1.2:8080"}) {
+		t.Errorf("unexpected vips %v (%v)", vips, err)
+	}
+
+	lbs, _ := nb.ListServiceLoadBalancers()
+	expected := map[string]map[kapi.Protocol]string{"default/web": {kapi.ProtocolTCP: tcp, kapi.ProtocolUDP: udp}}
+	if !reflect.DeepEqual(lbs, expected) {
+		t.Errorf("expected service load balancers %v, got %v", expected, lbs)
+	}
+	rows := server.Rows(ovsdb.LoadBalancerTable)
+	if len(rows) != 2 {
+		t.Errorf("expected 2 load balancers, got %v", rows)
+	}
+	for _, row := range rows {
+		if row.UUID() == tcp && row.StringMap("options")["affinity_timeout"] != "600" {
+			t.Errorf("expected the options of the tcp load balancer to be updated, got %v", row.StringMap("options"))
+		}
+	}
+	group := server.Rows(ovsdb.LoadBalancerGroupTable)[0].StringSet("load_balancer")
+	if len(group) != 2 {
+		t.Errorf("expected the load balancers in the group, got %v", group)
+	}
+}
+
+func TestOvsdbAddLogicalSwitchPort(t *testing.T) {
+	server, client, nb := newTestOvsdbNorthbound(t)
+	defer server.Close()
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := nb.AddLogicalSwitchPort("node1", "default_web", map[string]string{"pod": "true"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ports := server.Rows(ovsdb.LogicalSwitchPortTable); len(ports) != 1 {
+		t.Errorf("expected a single port, got %v", ports)
+	}
+
+	// the port of a pod that moved to node2 is moved to its switch
+	node2 := server.Insert(ovsdb.LogicalSwitchTable, ovsdb.Row{"name": "node2"})
+	waitForSwitch(t, client, "node2")
+	if err := nb.AddLogicalSwitchPort("node2", "default_web", map[string]string{"pod": "true"}); err != nil {
+		t.Fatal(err)
+	}
+	ports := server.Rows(ovsdb.LogicalSwitchPortTable)
+	if len(ports) != 1 {
+		t.Fatalf("expected a single port, got %v", ports)
+	}
+	for _, ls := range server.Rows(ovsdb.LogicalSwitchTable) {
+		expected := []string{}
+		if ls.UUID() == node2 {
+			expected = []string{ports[0].UUID()}
+		}
+		if got := ls.StringSet("ports"); !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected ports %v on switch %s, got %v", expected, ls.String("name"), got)
+		}
+	}
+}
+
+func TestMemoryMoveLogicalSwitchPort(t *testing.T) {
+	nb := NewMemoryNorthbound()
+	nb.AddLogicalSwitch("node1", "10.128.1.0/24")
+	nb.AddLogicalSwitch("node2", "10.128.2.0/24")
+	if err := nb.AddLogicalSwitchPort("node1", "default_web", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := nb.AddLogicalSwitchPort("node2", "default_web", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ports := nb.LogicalSwitchPorts("node1"); len(ports) != 0 {
+		t.Errorf("expected no port on node1, got %v", ports)
+	}
+	if ports := nb.LogicalSwitchPorts("node2"); !reflect.DeepEqual(ports, []string{"default_web"}) {
+		t.Errorf("expected the port on node2, got %v", ports)
+	}
+	if _, ips, err := nb.GetLogicalSwitchPortAddresses("default_web"); err != nil || !reflect.DeepEqual(ips, []string{"10.128.2.2"}) {
+		t.Errorf("expected an address of node2, got %v (%v)", ips, err)
+	}
+}
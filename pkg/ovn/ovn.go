@@ -1,40 +1,147 @@
 package ovn
 
 import (
+	"reflect"
+	"sync"
+
 	"github.com/golang/glog"
 
 	"github.com/rajatchopra/ovn-kube/pkg/kube"
+	listers "k8s.io/client-go/listers/core/v1"
 	kapi "k8s.io/client-go/pkg/api/v1"
+	extensions "k8s.io/client-go/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
 type OvnController struct {
-	Kube kube.KubeInterface
+	Kube  kube.KubeInterface
+	OvnNB NorthboundClient
+
+	StartPodWatch       func(handler cache.ResourceEventHandler)
+	StartEndpointWatch  func(handler cache.ResourceEventHandler)
+	StartServiceWatch   func(handler cache.ResourceEventHandler)
+	StartPolicyWatch    func(handler cache.ResourceEventHandler)
+	StartNamespaceWatch func(handler cache.ResourceEventHandler)
+	StartNodeWatch      func(handler cache.ResourceEventHandler)
+
+	// the informer caches, the northbound database is reconciled with them
+	PodLister       listers.PodLister
+	ServiceLister   listers.ServiceLister
+	EndpointsLister listers.EndpointsLister
+	// PolicyStore holds the network policies, there is no lister for them in
+	// the client we build against
+	PolicyStore cache.Store
+
+	// PodWorkers is the number of pods processed concurrently
+	PodWorkers int
+	// ServiceWorkers is the number of services, and of endpoints, processed concurrently
+	ServiceWorkers int
+	// PerServiceLoadBalancers gives every service load balancers of its own,
+	// in the load balancer group of the nodes, instead of sharing the cluster
+	// and gateway ones
+	PerServiceLoadBalancers bool
+
+	podQueue        *eventQueue
+	serviceQueue    *eventQueue
+	endpointsQueue  *eventQueue
+	policyQueue     *eventQueue
+	namespaceQueue  *eventQueue
+	addressSetQueue *eventQueue
+
+	gatewayMutex sync.Mutex
+	gatewayCache map[string][]string
 
-	StartPodWatch      func(handler cache.ResourceEventHandler)
-	StartEndpointWatch func(handler cache.ResourceEventHandler)
+	// lbMutex guards the service and endpoints caches and the programming of
+	// the load balancer vips from them
+	lbMutex sync.Mutex
+	// serviceCache holds the known services, keyed by namespace/name
+	serviceCache map[string]*kapi.Service
+	// endpointsCache holds the known endpoints, keyed by namespace/name
+	endpointsCache map[string]*kapi.Endpoints
+	// gateways are the gateway routers the gateway vips were last queued for
+	gateways []Gateway
 
-	gatewayCache map[string]string
+	// policyMutex guards all of the network policy state below
+	policyMutex sync.Mutex
+	// namespacePolicies holds the policies of each namespace, keyed by name
+	namespacePolicies map[string]map[string]*namespacePolicy
+	// namespaceLabels holds the labels of every known namespace
+	namespaceLabels map[string]map[string]string
+	// logicalPorts holds the pods that have been given a logical port, keyed by port name
+	logicalPorts map[string]*logicalPortInfo
+	// lspDenyCount counts the policies that isolate each logical port
+	lspDenyCount map[string]int
+	// addressSets maps the address sets to the rules owning them
+	addressSets map[string]*ingressRule
 }
 
 const (
 	OVN_NBCTL = "ovn-nbctl"
 )
 
-func (oc *OvnController) Run() {
-	oc.gatewayCache = make(map[string]string)
+func (oc *OvnController) init() {
+	oc.podQueue = newEventQueue("pods", workqueue.DefaultControllerRateLimiter(),
+		func(obj interface{}) error { return oc.syncPod(obj.(*kapi.Pod)) },
+		func(obj interface{}) error { return oc.deleteLogicalPort(obj.(*kapi.Pod)) })
+	oc.serviceQueue = newEventQueue("services", workqueue.DefaultControllerRateLimiter(),
+		func(obj interface{}) error { return oc.addService(obj.(*kapi.Service)) },
+		func(obj interface{}) error { return oc.deleteService(obj.(*kapi.Service)) })
+	oc.endpointsQueue = newEventQueue("endpoints", workqueue.DefaultControllerRateLimiter(),
+		func(obj interface{}) error { return oc.addEndpoints(obj.(*kapi.Endpoints)) },
+		func(obj interface{}) error { return oc.deleteEndpoints(obj.(*kapi.Endpoints)) })
+	oc.policyQueue = newEventQueue("network policies", workqueue.DefaultControllerRateLimiter(),
+		func(obj interface{}) error { return oc.addNetworkPolicy(obj.(*extensions.NetworkPolicy)) },
+		func(obj interface{}) error { return oc.deleteNetworkPolicy(obj.(*extensions.NetworkPolicy)) })
+	oc.namespaceQueue = newEventQueue("namespaces", workqueue.DefaultControllerRateLimiter(),
+		func(obj interface{}) error {
+			ns := obj.(*kapi.Namespace)
+			return oc.updateNamespaceLabels(ns.Name, ns.Labels)
+		},
+		func(obj interface{}) error { return oc.deleteNamespaceLabels(obj.(*kapi.Namespace).Name) })
+	// address sets are queued by name, both for writes and deletions
+	oc.addressSetQueue = newEventQueue("address sets", workqueue.DefaultControllerRateLimiter(),
+		func(obj interface{}) error { return oc.syncAddressSet(string(obj.(cache.ExplicitKey))) },
+		func(obj interface{}) error { return oc.syncAddressSet(string(obj.(cache.ExplicitKey))) })
+	oc.gatewayCache = make(map[string][]string)
+	oc.serviceCache = make(map[string]*kapi.Service)
+	oc.endpointsCache = make(map[string]*kapi.Endpoints)
+	oc.namespacePolicies = make(map[string]map[string]*namespacePolicy)
+	oc.namespaceLabels = make(map[string]map[string]string)
+	oc.logicalPorts = make(map[string]*logicalPortInfo)
+	oc.lspDenyCount = make(map[string]int)
+	oc.addressSets = make(map[string]*ingressRule)
+}
+
+// Run registers the handlers of all the watches and starts the workers of
+// the queues, the events are delivered concurrently once the watches are
+// started. The workers run until stopChan is closed.
+func (oc *OvnController) Run(stopChan <-chan struct{}) {
+	oc.init()
+	oc.WatchNamespaces()
+	oc.WatchNetworkPolicy()
+	oc.WatchServices()
 	oc.WatchPods()
 	oc.WatchEndpoints()
+	oc.WatchNodes()
+
+	oc.podQueue.run(oc.PodWorkers, stopChan)
+	oc.serviceQueue.run(oc.ServiceWorkers, stopChan)
+	oc.endpointsQueue.run(oc.ServiceWorkers, stopChan)
+	// the policy state is behind a single lock, a worker each is enough
+	oc.policyQueue.run(1, stopChan)
+	oc.namespaceQueue.run(1, stopChan)
+	oc.addressSetQueue.run(1, stopChan)
 }
 
 func (oc *OvnController) WatchPods() {
 	oc.StartPodWatch(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			pod := obj.(*kapi.Pod)
-			oc.addLogicalPort(pod)
+			oc.podQueue.add(obj.(*kapi.Pod))
 			return
 		},
 		UpdateFunc: func(old, new interface{}) {
+			oc.podQueue.add(new.(*kapi.Pod))
 			return
 		},
 		DeleteFunc: func(obj interface{}) {
@@ -51,7 +158,7 @@ func (oc *OvnController) WatchPods() {
 					return
 				}
 			}
-			oc.deleteLogicalPort(pod)
+			oc.podQueue.delete(pod)
 			return
 		},
 	})
@@ -60,13 +167,13 @@ func (oc *OvnController) WatchPods() {
 func (oc *OvnController) WatchEndpoints() {
 	oc.StartEndpointWatch(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			ep := obj.(*kapi.Endpoints)
-			err := oc.addEndpoints(ep)
-			if err != nil {
-				glog.Errorf("Error in adding load balancer: %v", err)
-			}
+			oc.endpointsQueue.add(obj.(*kapi.Endpoints))
+		},
+		UpdateFunc: func(old, new interface{}) {
+			// resyncs are queued too, the load balancers are only written
+			// when they differ
+			oc.endpointsQueue.add(new.(*kapi.Endpoints))
 		},
-		UpdateFunc: func(old, new interface{}) { return },
 		DeleteFunc: func(obj interface{}) {
 			ep, ok := obj.(*kapi.Endpoints)
 			if !ok {
@@ -77,14 +184,127 @@ func (oc *OvnController) WatchEndpoints() {
 				}
 				ep, ok = tombstone.Obj.(*kapi.Endpoints)
 				if !ok {
-					glog.Errorf("tombstone contained object that is not a pod %#v", obj)
+					glog.Errorf("tombstone contained object that is not an endpoints %#v", obj)
+					return
+				}
+			}
+			oc.endpointsQueue.delete(ep)
+			return
+		},
+	})
+}
+
+func (oc *OvnController) WatchServices() {
+	oc.StartServiceWatch(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			oc.serviceQueue.add(obj.(*kapi.Service))
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oc.serviceQueue.add(new.(*kapi.Service))
+		},
+		DeleteFunc: func(obj interface{}) {
+			svc, ok := obj.(*kapi.Service)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					glog.Errorf("couldn't get object from tombstone %+v", obj)
+					return
+				}
+				svc, ok = tombstone.Obj.(*kapi.Service)
+				if !ok {
+					glog.Errorf("tombstone contained object that is not a service %#v", obj)
+					return
+				}
+			}
+			oc.serviceQueue.delete(svc)
+			return
+		},
+	})
+}
+
+// WatchNodes follows the gateway routers that the nodes set up, any node event
+// may come with a new or removed gateway
+func (oc *OvnController) WatchNodes() {
+	oc.StartNodeWatch(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			oc.syncGateways()
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oc.syncGateways()
+		},
+		DeleteFunc: func(obj interface{}) {
+			oc.syncGateways()
+		},
+	})
+}
+
+func (oc *OvnController) WatchNetworkPolicy() {
+	oc.StartPolicyWatch(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			oc.policyQueue.add(obj.(*extensions.NetworkPolicy))
+			return
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldPolicy := old.(*extensions.NetworkPolicy)
+			newPolicy := new.(*extensions.NetworkPolicy)
+			if reflect.DeepEqual(oldPolicy.Spec, newPolicy.Spec) {
+				return
+			}
+			// the new policy replaces the old one without a window in
+			// which its pods are left unprotected
+			oc.policyQueue.add(newPolicy)
+			return
+		},
+		DeleteFunc: func(obj interface{}) {
+			policy, ok := obj.(*extensions.NetworkPolicy)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					glog.Errorf("couldn't get object from tombstone %+v", obj)
+					return
+				}
+				policy, ok = tombstone.Obj.(*extensions.NetworkPolicy)
+				if !ok {
+					glog.Errorf("tombstone contained object that is not a network policy %#v", obj)
 					return
 				}
 			}
-			err := oc.deleteEndpoints(ep)
-			if err != nil {
-				glog.Errorf("Error in deleting endpoints - %v", err)
+			oc.policyQueue.delete(policy)
+			return
+		},
+	})
+}
+
+func (oc *OvnController) WatchNamespaces() {
+	oc.StartNamespaceWatch(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			oc.namespaceQueue.add(obj.(*kapi.Namespace))
+			return
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldNs := old.(*kapi.Namespace)
+			newNs := new.(*kapi.Namespace)
+			if reflect.DeepEqual(oldNs.Labels, newNs.Labels) {
+				return
+			}
+			oc.namespaceQueue.add(newNs)
+			return
+		},
+		DeleteFunc: func(obj interface{}) {
+			ns, ok := obj.(*kapi.Namespace)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					glog.Errorf("couldn't get object from tombstone %+v", obj)
+					return
+				}
+				ns, ok = tombstone.Obj.(*kapi.Namespace)
+				if !ok {
+					glog.Errorf("tombstone contained object that is not a namespace %#v", obj)
+					return
+				}
 			}
+			oc.namespaceQueue.delete(ns)
 			return
 		},
 	})
@@ -0,0 +1,14 @@
+package ovn
+
+import (
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+)
+
+func newTestController(k *kube.FakeKube, nb *MemoryNorthbound) *OvnController {
+	oc := &OvnController{
+		Kube:  k,
+		OvnNB: nb,
+	}
+	oc.init()
+	return oc
+}
@@ -3,116 +3,150 @@ package ovn
 import (
 	"fmt"
 	"github.com/golang/glog"
-	"os/exec"
-	"strings"
-	"time"
-	"unicode"
+	"net"
 
 	kapi "k8s.io/client-go/pkg/api/v1"
+
+	"github.com/rajatchopra/ovn-kube/pkg/annotation"
 )
 
-func (oc *OvnController) getGatewayFromSwitch(logical_switch string) (string, string, error) {
-	var gateway_ip_mask_str string
-	var ok bool
-	if gateway_ip_mask_str, ok = oc.gatewayCache[logical_switch]; !ok {
-		gateway_ip_bytes, err := exec.Command(OVN_NBCTL, "--if-exists", "get",
-			"logical_switch", logical_switch,
-			"external_ids:gateway_ip").Output()
+// gatewayExternalIDs are the external_ids keys of a node switch holding its
+// IPv4 and IPv6 gateway addresses, with their prefix length
+var gatewayExternalIDs = []string{"gateway_ip", "gateway_ip_v6"}
+
+// getGatewaysFromSwitch returns the gateway addresses of the switch with the
+// mask of its subnets, one of each IP family of the switch
+func (oc *OvnController) getGatewaysFromSwitch(logical_switch string) ([]*net.IPNet, error) {
+	oc.gatewayMutex.Lock()
+	gateway_ip_masks, ok := oc.gatewayCache[logical_switch]
+	oc.gatewayMutex.Unlock()
+	if !ok {
+		var err error
+		for _, key := range gatewayExternalIDs {
+			gateway_ip_mask_str, e := oc.OvnNB.GetLogicalSwitchExternalID(logical_switch, key)
+			if e != nil {
+				err = e
+				continue
+			}
+			gateway_ip_masks = append(gateway_ip_masks, gateway_ip_mask_str)
+		}
+		if len(gateway_ip_masks) == 0 {
+			glog.V(4).Infof("Gateway IP of switch %s: %v", logical_switch, err)
+			return nil, err
+		}
+		oc.gatewayMutex.Lock()
+		oc.gatewayCache[logical_switch] = gateway_ip_masks
+		oc.gatewayMutex.Unlock()
+	}
+	gateways := make([]*net.IPNet, 0, len(gateway_ip_masks))
+	for _, gateway_ip_mask_str := range gateway_ip_masks {
+		gateway_ip, subnet, err := net.ParseCIDR(gateway_ip_mask_str)
 		if err != nil {
-			glog.V(4).Infof("Gateway IP:  %s, %v", string(gateway_ip_bytes), err)
-			return "", "", err
+			return nil, fmt.Errorf("invalid gateway ip %q on logical switch %s", gateway_ip_mask_str, logical_switch)
+		}
+		glog.V(4).Infof("Gateway IP: %s, Mask: %s", gateway_ip, subnet.Mask)
+		gateways = append(gateways, &net.IPNet{IP: gateway_ip, Mask: subnet.Mask})
+	}
+	return gateways, nil
+}
+
+// gatewayOfFamily returns the gateway of the IP family of ip, nil if there is
+// none
+func gatewayOfFamily(gateways []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, gateway := range gateways {
+		if (gateway.IP.To4() == nil) == (ip.To4() == nil) {
+			return gateway
 		}
-		gateway_ip_mask_str = strings.TrimFunc(string(gateway_ip_bytes), unicode.IsSpace)
-		gateway_ip_mask_str = strings.Trim(gateway_ip_mask_str, `"`)
-		oc.gatewayCache[logical_switch] = gateway_ip_mask_str
 	}
-	gateway_ip_mask := strings.Split(gateway_ip_mask_str, "/")
-	gateway_ip := gateway_ip_mask[0]
-	mask := gateway_ip_mask[1]
-	glog.V(4).Infof("Gateway IP: %s, Mask: %s", gateway_ip, mask)
-	return gateway_ip, mask, nil
+	return nil
 }
 
-func (oc *OvnController) deleteLogicalPort(pod *kapi.Pod) {
+func (oc *OvnController) deleteLogicalPort(pod *kapi.Pod) error {
 	glog.V(4).Infof("Deleting pod: %s", pod.Name)
-	out, err := exec.Command(OVN_NBCTL, "lsp-del", fmt.Sprintf("%s_%s", pod.Namespace, pod.Name)).CombinedOutput()
+	err := oc.deletePodPolicy(pod)
 	if err != nil {
-		glog.Errorf("Error in deleting pod network switch - %v(%v)", out, err)
+		return err
 	}
-	return
+	portName := fmt.Sprintf("%s_%s", pod.Namespace, pod.Name)
+	err = oc.OvnNB.DeleteLogicalSwitchPort(portName)
+	if err != nil {
+		return fmt.Errorf("Error in deleting pod network switch port %s - %v", portName, err)
+	}
+	return nil
 }
 
-func (oc *OvnController) addLogicalPort(pod *kapi.Pod) {
+// syncPod gives a scheduled pod its logical port, or updates the policies of
+// a pod that already has one
+func (oc *OvnController) syncPod(pod *kapi.Pod) error {
+	if pod.Spec.NodeName == "" {
+		// the pod is synced again once it is scheduled
+		return nil
+	}
+	portName := fmt.Sprintf("%s_%s", pod.Namespace, pod.Name)
+	oc.policyMutex.Lock()
+	_, ok := oc.logicalPorts[portName]
+	oc.policyMutex.Unlock()
+	if ok {
+		return oc.updatePodPolicy(pod)
+	}
+	return oc.addLogicalPort(pod)
+}
 
-	count := 30
+func (oc *OvnController) addLogicalPort(pod *kapi.Pod) error {
 	logical_switch := pod.Spec.NodeName
-	for count > 0 {
-		if logical_switch != "" {
-			break
-		}
-		if count != 30 {
-			time.Sleep(1 * time.Second)
-			count--
-		}
-		p, err := oc.Kube.GetPod(pod.Namespace, pod.Name)
-		if err != nil {
-			glog.Errorf("Could not get pod %s/%s for obtaining the logical switch it belongs to", pod.Namespace, pod.Name)
-			return
-		}
-		logical_switch = p.Spec.NodeName
-	}
 	if logical_switch == "" {
-		glog.Errorf("Could not find the logical switch that the pod %s/%s belongs to", pod.Namespace, pod.Name)
-		return
+		return fmt.Errorf("Could not find the logical switch that the pod %s/%s belongs to", pod.Namespace, pod.Name)
 	}
 
 	portName := fmt.Sprintf("%s_%s", pod.Namespace, pod.Name)
 	glog.V(4).Infof("Creating logical port for %s on switch %s", portName, logical_switch)
 
-	out, err := exec.Command(OVN_NBCTL, "--wait=sb", "--", "--may-exist", "lsp-add",
-		logical_switch, portName, "--", "lsp-set-addresses",
-		portName, "dynamic", "--", "set",
-		"logical_switch_port", portName,
-		"external-ids:namespace="+pod.Namespace,
-		"external-ids:pod=true").CombinedOutput()
+	err := oc.OvnNB.AddLogicalSwitchPort(logical_switch, portName, map[string]string{
+		"namespace": pod.Namespace,
+		"pod":       "true",
+	})
 	if err != nil {
-		glog.Errorf("Error while creating logical port %s - %v (%s)", portName, err, string(out))
-		return
+		return fmt.Errorf("Error while creating logical port %s - %v", portName, err)
 	}
 
-	gateway_ip, mask, err := oc.getGatewayFromSwitch(logical_switch)
+	gateways, err := oc.getGatewaysFromSwitch(logical_switch)
 	if err != nil {
-		glog.Errorf("Error obtaining gateway address for switch %s", logical_switch)
-		return
+		return fmt.Errorf("Error obtaining gateway address for switch %s - %v", logical_switch, err)
 	}
 
-	count = 30
-	for count > 0 {
-		out, err = exec.Command(OVN_NBCTL, "get", "logical_switch_port", portName, "dynamic_addresses").Output()
-		if err == nil {
-			break
+	// the dynamic addresses are allocated by ovn-northd, until then the pod
+	// is retried with backoff
+	mac, ips, err := oc.OvnNB.GetLogicalSwitchPortAddresses(portName)
+	if err != nil {
+		return fmt.Errorf("Error while obtaining addresses for %s - %v", portName, err)
+	}
+
+	// a dual stack pod has an address of each family, the first one is also
+	// the ip_address of the pods that have a single one
+	podNetwork := &annotation.PodNetwork{MACAddress: mac}
+	for _, ip := range ips {
+		gateway := gatewayOfFamily(gateways, net.ParseIP(ip))
+		if gateway == nil {
+			return fmt.Errorf("No gateway on switch %s for address %s of %s", logical_switch, ip, portName)
 		}
-		glog.V(4).Infof("Error while obtaining addresses for %s - %v", portName, err)
-		time.Sleep(time.Second)
+		prefixLen, _ := gateway.Mask.Size()
+		podNetwork.IPAddresses = append(podNetwork.IPAddresses, fmt.Sprintf("%s/%d", ip, prefixLen))
+		podNetwork.GatewayIPs = append(podNetwork.GatewayIPs, gateway.IP.String())
 	}
-	if count == 0 {
-		glog.Errorf("Error while obtaining addresses for %s", portName)
-		return
+	podNetwork.IPAddress = podNetwork.IPAddresses[0]
+	podNetwork.GatewayIP = podNetwork.GatewayIPs[0]
+	if len(ips) == 1 {
+		podNetwork.IPAddresses = nil
+		podNetwork.GatewayIPs = nil
 	}
-
-	outStr := strings.TrimFunc(string(out), unicode.IsSpace)
-	outStr = strings.Trim(outStr, `"`)
-	addresses := strings.Split(outStr, " ")
-	if len(addresses) != 2 {
-		glog.Errorf("Error while obtaining addresses for %s", portName)
-		return
+	value, err := annotation.MarshalPodNetwork(podNetwork)
+	if err != nil {
+		return fmt.Errorf("Error encoding the network of pod %s - %v", pod.Name, err)
 	}
-
-	annotation := fmt.Sprintf(`{\"ip_address\":\"%s/%s\", \"mac_address\":\"%s\", \"gateway_ip\": \"%s\"}`, addresses[1], mask, addresses[0], gateway_ip)
-	glog.V(4).Infof("Annotation values: ip=%s/%s ; mac=%s ; gw=%s\nAnnotation=%s", addresses[1], mask, addresses[0], gateway_ip, annotation)
-	err = oc.Kube.SetAnnotationOnPod(pod, "ovn", annotation)
+	glog.V(4).Infof("Annotation values: ips=%v ; mac=%s\nAnnotation=%s", ips, mac, value)
+	err = oc.Kube.SetAnnotationOnPod(pod, annotation.PodNetworkAnnotation, value)
 	if err != nil {
-		glog.Errorf("Failed to set annotation on pod %s - %v", pod.Name, err)
+		return fmt.Errorf("Failed to set annotation on pod %s - %v", pod.Name, err)
 	}
-	return
+	return oc.addPodPolicy(pod, logical_switch, ips)
 }
@@ -0,0 +1,171 @@
+package ovn
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rajatchopra/ovn-kube/pkg/annotation"
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kapi "k8s.io/client-go/pkg/api/v1"
+)
+
+func newPod(namespace, name, node string) *kapi.Pod {
+	return &kapi.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       kapi.PodSpec{NodeName: node},
+	}
+}
+
+func TestAddLogicalPort(t *testing.T) {
+	tests := []struct {
+		name string
+		// subnets of the switch of node1, 10.128.1.0/24 when empty
+		subnets []string
+		// existing pods on node1, added before the tested pod
+		existing []*kapi.Pod
+		pod      *kapi.Pod
+		port     string
+		// network expected in the pod annotation, nil for none
+		network   *annotation.PodNetwork
+		expectErr bool
+	}{
+		{
+			name: "pod scheduled on a node",
+			pod:  newPod("default", "web", "node1"),
+			port: "default_web",
+			network: &annotation.PodNetwork{
+				Version:    1,
+				IPAddress:  "10.128.1.2/24",
+				MACAddress: "0a:00:0a:80:01:02",
+				GatewayIP:  "10.128.1.1",
+			},
+		},
+		{
+			name:     "addresses are not reused",
+			existing: []*kapi.Pod{newPod("default", "db", "node1")},
+			pod:      newPod("default", "web", "node1"),
+			port:     "default_web",
+			network: &annotation.PodNetwork{
+				Version:    1,
+				IPAddress:  "10.128.1.3/24",
+				MACAddress: "0a:00:0a:80:01:03",
+				GatewayIP:  "10.128.1.1",
+			},
+		},
+		{
+			name:    "dual stack pod",
+			subnets: []string{"10.128.1.0/24", "fd00:10:128:1::/64"},
+			pod:     newPod("default", "web", "node1"),
+			port:    "default_web",
+			network: &annotation.PodNetwork{
+				Version:     1,
+				IPAddress:   "10.128.1.2/24",
+				MACAddress:  "0a:00:0a:80:01:02",
+				GatewayIP:   "10.128.1.1",
+				IPAddresses: []string{"10.128.1.2/24", "fd00:10:128:1::2/64"},
+				GatewayIPs:  []string{"10.128.1.1", "fd00:10:128:1::1"},
+			},
+		},
+		{
+			name:    "IPv6 pod",
+			subnets: []string{"fd00:10:128:1::/64"},
+			pod:     newPod("default", "web", "node1"),
+			port:    "default_web",
+			network: &annotation.PodNetwork{
+				Version:    1,
+				IPAddress:  "fd00:10:128:1::2/64",
+				MACAddress: "0a:00:00:00:00:02",
+				GatewayIP:  "fd00:10:128:1::1",
+			},
+		},
+		{
+			name: "pod not scheduled yet",
+			pod:  newPod("ns1", "web", ""),
+		},
+		{
+			name:      "node without a logical switch",
+			pod:       newPod("default", "web", "node2"),
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		fakeKube := kube.NewFakeKube()
+		nb := NewMemoryNorthbound()
+		subnets := test.subnets
+		if len(subnets) == 0 {
+			subnets = []string{"10.128.1.0/24"}
+		}
+		if err := nb.AddLogicalSwitch("node1", subnets...); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		oc := newTestController(fakeKube, nb)
+
+		for _, pod := range test.existing {
+			fakeKube.AddPod(pod)
+			if err := oc.syncPod(pod); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		fakeKube.AddPod(test.pod)
+		err := oc.syncPod(test.pod)
+		if test.expectErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.expectErr, err)
+		}
+
+		_, _, err = nb.GetLogicalSwitchPortAddresses(test.port)
+		if test.port != "" && err != nil {
+			t.Errorf("%s: expected logical port %s: %v", test.name, test.port, err)
+		}
+		pod, _ := fakeKube.GetPod(test.pod.Namespace, test.pod.Name)
+		network, err := annotation.GetPodNetwork(pod)
+		if test.network == nil {
+			if err == nil {
+				t.Errorf("%s: expected no pod network, got %+v", test.name, network)
+			}
+		} else if !reflect.DeepEqual(network, test.network) {
+			t.Errorf("%s: expected pod network %+v, got %+v (%v)", test.name, test.network, network, err)
+		}
+	}
+}
+
+func TestDeleteLogicalPort(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	nb := NewMemoryNorthbound()
+	if err := nb.AddLogicalSwitch("node1", "10.128.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	oc := newTestController(fakeKube, nb)
+
+	pods := []*kapi.Pod{newPod("default", "web", "node1"), newPod("default", "db", "node1")}
+	for _, pod := range pods {
+		fakeKube.AddPod(pod)
+		if err := oc.syncPod(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := oc.deleteLogicalPort(pods[0]); err != nil {
+		t.Fatal(err)
+	}
+	// a pod that never got a port is deleted without errors
+	if err := oc.deleteLogicalPort(newPod("default", "pending", "")); err != nil {
+		t.Errorf("unexpected error deleting a pod without a port: %v", err)
+	}
+
+	ports := nb.LogicalSwitchPorts("node1")
+	if len(ports) != 1 || ports[0] != "default_db" {
+		t.Errorf("expected only default_db left on node1, got %v", ports)
+	}
+
+	// the released address is handed out again
+	pod := newPod("default", "cache", "node1")
+	fakeKube.AddPod(pod)
+	if err := oc.syncPod(pod); err != nil {
+		t.Fatal(err)
+	}
+	_, ips, err := nb.GetLogicalSwitchPortAddresses("default_cache")
+	if err != nil || !reflect.DeepEqual(ips, []string{"10.128.1.2"}) {
+		t.Errorf("expected default_cache to get 10.128.1.2, got %v (%v)", ips, err)
+	}
+}
@@ -0,0 +1,592 @@
+package ovn
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kapi "k8s.io/client-go/pkg/api/v1"
+	extensions "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// A pod selected by at least one NetworkPolicy is isolated: a default deny ACL
+// drops all IP traffic towards its logical port, and every ingress rule of the
+// selecting policies is added on top of it as a higher priority allow ACL.
+// The sources allowed by a rule are kept in an OVN address set per IP family,
+// so that pods and namespaces coming and going only rewrite the address sets,
+// not the ACLs. The address sets are written from a queue keyed by their name,
+// without the policy lock held, and a pod or namespace change only queues the
+// address sets of the rules whose peers it changes.
+const (
+	defaultDenyPriority  = 1000
+	defaultAllowPriority = 1001
+)
+
+type logicalPortInfo struct {
+	pod           *kapi.Pod
+	logicalSwitch string
+	ips           []string
+	// synced is cleared when the policies of the pod could not all be
+	// applied, the next sync of the pod applies them again
+	synced bool
+}
+
+type ingressRule struct {
+	// ports opened by the rule, empty when all ports are allowed
+	ports []extensions.NetworkPolicyPort
+	// allowAll is set when the rule does not restrict the traffic source
+	allowAll           bool
+	podSelectors       []labels.Selector
+	namespaceSelectors []labels.Selector
+	// name identifies the rule in the external_ids of its address sets
+	name string
+	// addressSet is the name of the address set holding the IPv4 peer
+	// addresses, and addressSet6 the one of the IPv6 ones
+	addressSet  string
+	addressSet6 string
+	// peers holds the logical ports of the pods selected by the rule
+	peers map[string]bool
+}
+
+type namespacePolicy struct {
+	name        string
+	namespace   string
+	podSelector labels.Selector
+	ingress     []*ingressRule
+	// localPods maps the logical ports the policy is applied to, to their switch
+	localPods map[string]string
+}
+
+// ruleName returns the name of the i-th ingress rule of a policy
+func ruleName(namespace, policy string, i int) string {
+	return fmt.Sprintf("%s_%s_ingress_%d", namespace, policy, i)
+}
+
+func hashedAddressSet(name string) string {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("a%d", h.Sum64())
+}
+
+// addNetworkPolicy applies a policy, replacing the one of the same name if
+// any: the ACLs of each pod are swapped in a single transaction and the pods
+// stay isolated, then what only the old policy used is removed. A policy that
+// could not be fully applied is applied again by the next call.
+func (oc *OvnController) addNetworkPolicy(policy *extensions.NetworkPolicy) error {
+	glog.V(4).Infof("Adding network policy %s/%s", policy.Namespace, policy.Name)
+
+	oc.policyMutex.Lock()
+	defer oc.policyMutex.Unlock()
+
+	podSelector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+	if err != nil {
+		// retrying does not make the policy valid
+		glog.Errorf("Invalid pod selector in network policy %s/%s - %v", policy.Namespace, policy.Name, err)
+		return nil
+	}
+	np := &namespacePolicy{
+		name:        policy.Name,
+		namespace:   policy.Namespace,
+		podSelector: podSelector,
+		localPods:   make(map[string]string),
+	}
+
+	for i, rule := range policy.Spec.Ingress {
+		ir := &ingressRule{
+			ports:    rule.Ports,
+			allowAll: len(rule.From) == 0,
+			peers:    make(map[string]bool),
+		}
+		for _, peer := range rule.From {
+			if peer.PodSelector != nil {
+				sel, err := metav1.LabelSelectorAsSelector(peer.PodSelector)
+				if err != nil {
+					glog.Errorf("Invalid peer pod selector in network policy %s/%s - %v", policy.Namespace, policy.Name, err)
+					continue
+				}
+				ir.podSelectors = append(ir.podSelectors, sel)
+			}
+			if peer.NamespaceSelector != nil {
+				sel, err := metav1.LabelSelectorAsSelector(peer.NamespaceSelector)
+				if err != nil {
+					glog.Errorf("Invalid peer namespace selector in network policy %s/%s - %v", policy.Namespace, policy.Name, err)
+					continue
+				}
+				ir.namespaceSelectors = append(ir.namespaceSelectors, sel)
+			}
+		}
+		if !ir.allowAll {
+			ir.name = ruleName(policy.Namespace, policy.Name, i)
+			ir.addressSet = hashedAddressSet(ir.name)
+			ir.addressSet6 = hashedAddressSet(ir.name + "_v6")
+			for portName, info := range oc.logicalPorts {
+				if ir.selectsPeer(np.namespace, info.pod, oc.namespaceLabels[info.pod.Namespace]) {
+					ir.peers[portName] = true
+				}
+			}
+		}
+		np.ingress = append(np.ingress, ir)
+	}
+
+	previous := oc.namespacePolicies[np.namespace][np.name]
+	if oc.namespacePolicies[np.namespace] == nil {
+		oc.namespacePolicies[np.namespace] = make(map[string]*namespacePolicy)
+	}
+	oc.namespacePolicies[np.namespace][np.name] = np
+
+	// the address sets are written before the ACLs that refer to them, and
+	// queued too so that a write of an older state in flight is overridden
+	errs := make([]error, 0)
+	for _, ir := range np.ingress {
+		if ir.allowAll {
+			continue
+		}
+		oc.addressSets[ir.addressSet] = ir
+		oc.addressSets[ir.addressSet6] = ir
+		addresses, addresses6 := oc.ingressPeerAddresses(ir)
+		err := oc.OvnNB.SetAddressSet(ir.addressSet, map[string]string{"name": ir.name}, addresses)
+		if err == nil {
+			err = oc.OvnNB.SetAddressSet(ir.addressSet6, map[string]string{"name": ir.name + "_v6"}, addresses6)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error creating address set for network policy %s/%s - %v", np.namespace, np.name, err))
+		}
+		oc.queueAddressSets(ir)
+	}
+
+	for portName, info := range oc.logicalPorts {
+		if info.pod.Namespace == np.namespace && np.podSelector.Matches(labels.Set(info.pod.Labels)) {
+			if err := oc.applyPolicyToPort(np, portName, info, previous); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if previous != nil {
+		if err := oc.removePolicy(previous); err != nil {
+			errs = append(errs, err)
+		}
+		// the ports the previous policy could not be removed from are
+		// removed by the next sync of the policy or of the pods
+		for portName, logicalSwitch := range previous.localPods {
+			np.localPods[portName] = logicalSwitch
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// deleteNetworkPolicy removes a policy from its pods. The policy is kept,
+// selecting no pods, until it is removed from all of them.
+func (oc *OvnController) deleteNetworkPolicy(policy *extensions.NetworkPolicy) error {
+	glog.V(4).Infof("Deleting network policy %s/%s", policy.Namespace, policy.Name)
+
+	oc.policyMutex.Lock()
+	defer oc.policyMutex.Unlock()
+
+	np, ok := oc.namespacePolicies[policy.Namespace][policy.Name]
+	if !ok {
+		return nil
+	}
+	np.podSelector = labels.Nothing()
+	if err := oc.removePolicy(np); err != nil {
+		return err
+	}
+	delete(oc.namespacePolicies[policy.Namespace], policy.Name)
+	if len(oc.namespacePolicies[policy.Namespace]) == 0 {
+		delete(oc.namespacePolicies, policy.Namespace)
+	}
+	return nil
+}
+
+// removePolicy removes a policy from the ports it is applied to and queues the
+// deletion of its address sets, except the ones a replacing policy took over.
+func (oc *OvnController) removePolicy(np *namespacePolicy) error {
+	errs := make([]error, 0)
+	for portName, logicalSwitch := range np.localPods {
+		if err := oc.removePolicyFromPort(np, portName, logicalSwitch); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, ir := range np.ingress {
+		if ir.allowAll || oc.addressSets[ir.addressSet] != ir {
+			continue
+		}
+		delete(oc.addressSets, ir.addressSet)
+		delete(oc.addressSets, ir.addressSet6)
+		oc.queueAddressSets(ir)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// addPodPolicy records a pod that has been given a logical port and applies
+// the network policies selecting it.
+func (oc *OvnController) addPodPolicy(pod *kapi.Pod, logicalSwitch string, ips []string) error {
+	oc.policyMutex.Lock()
+	defer oc.policyMutex.Unlock()
+
+	portName := fmt.Sprintf("%s_%s", pod.Namespace, pod.Name)
+	oc.logicalPorts[portName] = &logicalPortInfo{
+		pod:           pod,
+		logicalSwitch: logicalSwitch,
+		ips:           ips,
+	}
+	oc.updatePodPeers(portName)
+	return oc.syncPortPolicies(portName)
+}
+
+func (oc *OvnController) updatePodPolicy(pod *kapi.Pod) error {
+	oc.policyMutex.Lock()
+	defer oc.policyMutex.Unlock()
+
+	portName := fmt.Sprintf("%s_%s", pod.Namespace, pod.Name)
+	info, ok := oc.logicalPorts[portName]
+	if !ok || (info.synced && reflect.DeepEqual(info.pod.Labels, pod.Labels)) {
+		return nil
+	}
+	info.pod = pod
+	oc.updatePodPeers(portName)
+	return oc.syncPortPolicies(portName)
+}
+
+// deletePodPolicy removes the policies from the port of a deleted pod. The
+// pod is forgotten once they are all removed.
+func (oc *OvnController) deletePodPolicy(pod *kapi.Pod) error {
+	oc.policyMutex.Lock()
+	defer oc.policyMutex.Unlock()
+
+	portName := fmt.Sprintf("%s_%s", pod.Namespace, pod.Name)
+	info, ok := oc.logicalPorts[portName]
+	if !ok {
+		return nil
+	}
+	errs := make([]error, 0)
+	for _, np := range oc.namespacePolicies[pod.Namespace] {
+		if err := oc.removePolicyFromPort(np, portName, info.logicalSwitch); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+	delete(oc.logicalPorts, portName)
+	oc.updatePodPeers(portName)
+	return nil
+}
+
+func (oc *OvnController) updateNamespaceLabels(namespace string, nsLabels map[string]string) error {
+	oc.policyMutex.Lock()
+	defer oc.policyMutex.Unlock()
+
+	oldLabels := oc.namespaceLabels[namespace]
+	oc.namespaceLabels[namespace] = nsLabels
+	oc.updateNamespacePeers(namespace, oldLabels, nsLabels)
+	return nil
+}
+
+func (oc *OvnController) deleteNamespaceLabels(namespace string) error {
+	oc.policyMutex.Lock()
+	defer oc.policyMutex.Unlock()
+
+	oldLabels := oc.namespaceLabels[namespace]
+	delete(oc.namespaceLabels, namespace)
+	oc.updateNamespacePeers(namespace, oldLabels, nil)
+	return nil
+}
+
+// syncPortPolicies applies the policies of the port's namespace that select
+// it and removes the ones that no longer do.
+func (oc *OvnController) syncPortPolicies(portName string) error {
+	info := oc.logicalPorts[portName]
+	errs := make([]error, 0)
+	for _, np := range oc.namespacePolicies[info.pod.Namespace] {
+		var err error
+		if np.podSelector.Matches(labels.Set(info.pod.Labels)) {
+			err = oc.applyPolicyToPort(np, portName, info, nil)
+		} else {
+			err = oc.removePolicyFromPort(np, portName, info.logicalSwitch)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	info.synced = len(errs) == 0
+	return utilerrors.NewAggregate(errs)
+}
+
+// activeRules calls f with every rule that restricts its peers, of the
+// policies that are not being removed
+func (oc *OvnController) activeRules(f func(np *namespacePolicy, ir *ingressRule)) {
+	for _, policies := range oc.namespacePolicies {
+		for _, np := range policies {
+			for _, ir := range np.ingress {
+				if !ir.allowAll && oc.addressSets[ir.addressSet] == ir {
+					f(np, ir)
+				}
+			}
+		}
+	}
+}
+
+// updatePodPeers updates the rules selecting the pod of a port after it was
+// added, relabeled or deleted
+func (oc *OvnController) updatePodPeers(portName string) {
+	info, ok := oc.logicalPorts[portName]
+	oc.activeRules(func(np *namespacePolicy, ir *ingressRule) {
+		selected := ok && ir.selectsPeer(np.namespace, info.pod, oc.namespaceLabels[info.pod.Namespace])
+		oc.setPeer(ir, portName, selected)
+	})
+}
+
+// updateNamespacePeers updates the rules whose namespace selectors select the
+// namespace before or after its labels changed
+func (oc *OvnController) updateNamespacePeers(namespace string, oldLabels, newLabels map[string]string) {
+	oc.activeRules(func(np *namespacePolicy, ir *ingressRule) {
+		if ir.selectsNamespace(oldLabels) == ir.selectsNamespace(newLabels) {
+			return
+		}
+		for portName, info := range oc.logicalPorts {
+			if info.pod.Namespace == namespace {
+				oc.setPeer(ir, portName, ir.selectsPeer(np.namespace, info.pod, newLabels))
+			}
+		}
+	})
+}
+
+// setPeer adds a port to the peers of a rule or removes it, and queues the
+// address sets of the rule when they change
+func (oc *OvnController) setPeer(ir *ingressRule, portName string, selected bool) {
+	if ir.peers[portName] == selected {
+		return
+	}
+	if selected {
+		ir.peers[portName] = true
+	} else {
+		delete(ir.peers, portName)
+	}
+	oc.queueAddressSets(ir)
+}
+
+func (oc *OvnController) queueAddressSets(ir *ingressRule) {
+	oc.addressSetQueue.add(cache.ExplicitKey(ir.addressSet))
+	oc.addressSetQueue.add(cache.ExplicitKey(ir.addressSet6))
+}
+
+// syncAddressSet writes the addresses of the peers of the rule owning an
+// address set, or deletes the address set when no rule owns it. The database
+// is written with the policy lock released.
+func (oc *OvnController) syncAddressSet(name string) error {
+	oc.policyMutex.Lock()
+	ir, ok := oc.addressSets[name]
+	var externalIDs map[string]string
+	var addresses []string
+	if ok {
+		addresses4, addresses6 := oc.ingressPeerAddresses(ir)
+		if name == ir.addressSet6 {
+			externalIDs, addresses = map[string]string{"name": ir.name + "_v6"}, addresses6
+		} else {
+			externalIDs, addresses = map[string]string{"name": ir.name}, addresses4
+		}
+	}
+	oc.policyMutex.Unlock()
+
+	if !ok {
+		return oc.OvnNB.DeleteAddressSet(name)
+	}
+	return oc.OvnNB.SetAddressSet(name, externalIDs, addresses)
+}
+
+// ingressPeerAddresses returns the IPv4 and the IPv6 addresses of the peers
+// of the rule
+func (oc *OvnController) ingressPeerAddresses(ir *ingressRule) ([]string, []string) {
+	addresses := make([]string, 0)
+	addresses6 := make([]string, 0)
+	for portName := range ir.peers {
+		info, ok := oc.logicalPorts[portName]
+		if !ok {
+			continue
+		}
+		for _, ip := range info.ips {
+			if net.ParseIP(ip).To4() != nil {
+				addresses = append(addresses, ip)
+			} else {
+				addresses6 = append(addresses6, ip)
+			}
+		}
+	}
+	sort.Strings(addresses)
+	sort.Strings(addresses6)
+	return addresses, addresses6
+}
+
+// selectsNamespace tells if a namespace selector of the rule selects the
+// namespace with the given labels
+func (ir *ingressRule) selectsNamespace(nsLabels map[string]string) bool {
+	for _, sel := range ir.namespaceSelectors {
+		if sel.Matches(labels.Set(nsLabels)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ir *ingressRule) selectsPeer(policyNamespace string, pod *kapi.Pod, nsLabels map[string]string) bool {
+	for _, sel := range ir.podSelectors {
+		if pod.Namespace == policyNamespace && sel.Matches(labels.Set(pod.Labels)) {
+			return true
+		}
+	}
+	return ir.selectsNamespace(nsLabels)
+}
+
+// aclMatch returns the match of the allow ACL of the rule on the given port,
+// or false if the rule cannot match any traffic towards the pod.
+func (ir *ingressRule) aclMatch(portName string, pod *kapi.Pod) (string, bool) {
+	match := fmt.Sprintf(`outport == "%s" && ip`, portName)
+	if !ir.allowAll {
+		match += fmt.Sprintf(" && (ip4.src == $%s || ip6.src == $%s)", ir.addressSet, ir.addressSet6)
+	}
+	if len(ir.ports) == 0 {
+		return match, true
+	}
+
+	l4Matches := make([]string, 0)
+	for _, p := range ir.ports {
+		protocol := kapi.ProtocolTCP
+		if p.Protocol != nil {
+			protocol = *p.Protocol
+		}
+		proto := strings.ToLower(string(protocol))
+		if p.Port == nil {
+			l4Matches = append(l4Matches, proto)
+			continue
+		}
+		port, ok := resolvePolicyPort(pod, *p.Port, protocol)
+		if !ok {
+			continue
+		}
+		l4Matches = append(l4Matches, fmt.Sprintf("%s.dst == %d", proto, port))
+	}
+	if len(l4Matches) == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("%s && (%s)", match, strings.Join(l4Matches, " || ")), true
+}
+
+// resolvePolicyPort looks named ports up in the container ports of the pod
+func resolvePolicyPort(pod *kapi.Pod, port intstr.IntOrString, protocol kapi.Protocol) (int32, bool) {
+	if port.Type == intstr.Int {
+		return port.IntVal, true
+	}
+	for _, c := range pod.Spec.Containers {
+		for _, cp := range c.Ports {
+			if cp.Name == port.StrVal && cp.Protocol == protocol {
+				return cp.ContainerPort, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// applyPolicyToPort isolates the port and writes the ACLs of the policy, they
+// are only changed in the database when they differ. When the policy replaces
+// a previous one applied to the port, the port keeps its default deny ACL and
+// the ACLs of the previous policy are replaced at once.
+func (oc *OvnController) applyPolicyToPort(np *namespacePolicy, portName string, info *logicalPortInfo, previous *namespacePolicy) error {
+	if _, ok := np.localPods[portName]; !ok {
+		glog.V(4).Infof("Applying network policy %s/%s to %s", np.namespace, np.name, portName)
+		handedOver := false
+		if previous != nil {
+			_, handedOver = previous.localPods[portName]
+		}
+		if handedOver {
+			// the port stays isolated, the new policy takes the count over
+			delete(previous.localPods, portName)
+		} else {
+			oc.lspDenyCount[portName]++
+		}
+		np.localPods[portName] = info.logicalSwitch
+	}
+
+	denyIDs := denyExternalIDs(portName)
+	err := oc.OvnNB.SetACLs(info.logicalSwitch, denyIDs, []ACL{{
+		Priority:    defaultDenyPriority,
+		Match:       fmt.Sprintf(`outport == "%s" && ip`, portName),
+		Action:      "drop",
+		ExternalIDs: denyIDs,
+	}})
+	if err != nil {
+		return fmt.Errorf("Error adding default deny ACL for %s - %v", portName, err)
+	}
+
+	externalIDs := policyExternalIDs(np, portName)
+	acls := make([]ACL, 0, len(np.ingress))
+	for _, ir := range np.ingress {
+		match, ok := ir.aclMatch(portName, info.pod)
+		if !ok {
+			continue
+		}
+		acls = append(acls, ACL{
+			Priority:    defaultAllowPriority,
+			Match:       match,
+			Action:      "allow-related",
+			ExternalIDs: externalIDs,
+		})
+	}
+	err = oc.OvnNB.SetACLs(info.logicalSwitch, externalIDs, acls)
+	if err != nil {
+		return fmt.Errorf("Error adding ACLs of network policy %s/%s for %s - %v", np.namespace, np.name, portName, err)
+	}
+	return nil
+}
+
+// removePolicyFromPort removes the ACLs of the policy from the port, and the
+// default deny ACL with them when no other policy isolates the port. The port
+// is only forgotten by the policy once its ACLs are gone.
+func (oc *OvnController) removePolicyFromPort(np *namespacePolicy, portName, logicalSwitch string) error {
+	if _, ok := np.localPods[portName]; !ok {
+		return nil
+	}
+	glog.V(4).Infof("Removing network policy %s/%s from %s", np.namespace, np.name, portName)
+
+	externalIDs := policyExternalIDs(np, portName)
+	if oc.lspDenyCount[portName] <= 1 {
+		// the last policy isolating the port takes all its ACLs along
+		externalIDs = map[string]string{"logical_port": portName}
+	}
+	err := oc.OvnNB.SetACLs(logicalSwitch, externalIDs, nil)
+	if err != nil {
+		return fmt.Errorf("Error deleting ACLs of network policy %s/%s for %s - %v", np.namespace, np.name, portName, err)
+	}
+	delete(np.localPods, portName)
+	oc.lspDenyCount[portName]--
+	if oc.lspDenyCount[portName] <= 0 {
+		delete(oc.lspDenyCount, portName)
+	}
+	return nil
+}
+
+// denyExternalIDs returns the external_ids of the default deny ACL of a port
+func denyExternalIDs(portName string) map[string]string {
+	return map[string]string{
+		"logical_port": portName,
+		"default-deny": "true",
+	}
+}
+
+// policyExternalIDs returns the external_ids of the ACLs of a policy on a port
+func policyExternalIDs(np *namespacePolicy, portName string) map[string]string {
+	return map[string]string{
+		"namespace":    np.namespace,
+		"policy":       np.name,
+		"logical_port": portName,
+	}
+}
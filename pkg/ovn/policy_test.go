@@ -0,0 +1,725 @@
+package ovn
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kapi "k8s.io/client-go/pkg/api/v1"
+	extensions "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+func selectorOf(t *testing.T, matchLabels map[string]string) labels.Selector {
+	sel, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{MatchLabels: matchLabels})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sel
+}
+
+func policyPort(protocol kapi.Protocol, port intstr.IntOrString) extensions.NetworkPolicyPort {
+	return extensions.NetworkPolicyPort{Protocol: &protocol, Port: &port}
+}
+
+func TestSelectsPeer(t *testing.T) {
+	tests := []struct {
+		name               string
+		podSelectors       []map[string]string
+		namespaceSelectors []map[string]string
+		namespace          string
+		podLabels          map[string]string
+		nsLabels           map[string]string
+		selected           bool
+	}{
+		{
+			name:         "pod selector in the policy namespace",
+			podSelectors: []map[string]string{{"role": "web"}},
+			namespace:    "default",
+			podLabels:    map[string]string{"role": "web"},
+			selected:     true,
+		},
+		{
+			name:         "pod selector in another namespace",
+			podSelectors: []map[string]string{{"role": "web"}},
+			namespace:    "ns1",
+			podLabels:    map[string]string{"role": "web"},
+		},
+		{
+			name:         "pod selector not matching",
+			podSelectors: []map[string]string{{"role": "web"}},
+			namespace:    "default",
+			podLabels:    map[string]string{"role": "db"},
+		},
+		{
+			name:               "namespace selector",
+			namespaceSelectors: []map[string]string{{"team": "a"}},
+			namespace:          "ns1",
+			nsLabels:           map[string]string{"team": "a"},
+			selected:           true,
+		},
+		{
+			name:               "namespace selector not matching",
+			namespaceSelectors: []map[string]string{{"team": "a"}},
+			namespace:          "ns1",
+			nsLabels:           map[string]string{"team": "b"},
+		},
+	}
+
+	for _, test := range tests {
+		ir := &ingressRule{}
+		for _, sel := range test.podSelectors {
+			ir.podSelectors = append(ir.podSelectors, selectorOf(t, sel))
+		}
+		for _, sel := range test.namespaceSelectors {
+			ir.namespaceSelectors = append(ir.namespaceSelectors, selectorOf(t, sel))
+		}
+		pod := &kapi.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: test.namespace, Name: "pod", Labels: test.podLabels}}
+		if selected := ir.selectsPeer("default", pod, test.nsLabels); selected != test.selected {
+			t.Errorf("%s: expected selected %v, got %v", test.name, test.selected, selected)
+		}
+	}
+}
+
+func TestACLMatch(t *testing.T) {
+	pod := &kapi.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: kapi.PodSpec{Containers: []kapi.Container{{
+			Ports: []kapi.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: kapi.ProtocolTCP}},
+		}}},
+	}
+	udp := kapi.ProtocolUDP
+
+	tests := []struct {
+		name  string
+		rule  *ingressRule
+		match string
+		ok    bool
+	}{
+		{
+			name:  "all sources and ports",
+			rule:  &ingressRule{allowAll: true},
+			match: `outport == "default_web" && ip`,
+			ok:    true,
+		},
+		{
+			name:  "peers",
+			rule:  &ingressRule{addressSet: "a1", addressSet6: "a2"},
+			match: `outport == "default_web" && ip && (ip4.src == $a1 || ip6.src == $a2)`,
+			ok:    true,
+		},
+		{
+			name: "ports",
+			rule: &ingressRule{allowAll: true, ports: []extensions.NetworkPolicyPort{
+				policyPort(kapi.ProtocolTCP, intstr.FromInt(80)),
+				policyPort(kapi.ProtocolTCP, intstr.FromString("http")),
+				{Protocol: &udp},
+			}},
+			match: `outport == "default_web" && ip && (tcp.dst == 80 || tcp.dst == 8080 || udp)`,
+			ok:    true,
+		},
+		{
+			name: "named port missing on the pod",
+			rule: &ingressRule{allowAll: true, ports: []extensions.NetworkPolicyPort{
+				policyPort(kapi.ProtocolUDP, intstr.FromString("http")),
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		match, ok := test.rule.aclMatch("default_web", pod)
+		if ok != test.ok || match != test.match {
+			t.Errorf("%s: expected %q %v, got %q %v", test.name, test.match, test.ok, match, ok)
+		}
+	}
+}
+
+func TestIngressPeerAddresses(t *testing.T) {
+	oc := &OvnController{
+		logicalPorts: map[string]*logicalPortInfo{
+			"default_web": {
+				pod: &kapi.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Labels: map[string]string{"role": "web"}}},
+				ips: []string{"10.128.1.3", "fd00:10:128:1::3"},
+			},
+			"default_db": {
+				pod: &kapi.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Labels: map[string]string{"role": "db"}}},
+				ips: []string{"10.128.1.2"},
+			},
+			"ns1_client": {
+				pod: &kapi.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns1"}},
+				ips: []string{"10.128.2.2"},
+			},
+		},
+	}
+	// a peer whose port is gone has no addresses
+	ir := &ingressRule{peers: map[string]bool{"default_web": true, "ns1_client": true, "ns1_gone": true}}
+	addresses, addresses6 := oc.ingressPeerAddresses(ir)
+	if expected := []string{"10.128.1.3", "10.128.2.2"}; !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("expected addresses %v, got %v", expected, addresses)
+	}
+	if expected := []string{"fd00:10:128:1::3"}; !reflect.DeepEqual(addresses6, expected) {
+		t.Errorf("expected IPv6 addresses %v, got %v", expected, addresses6)
+	}
+}
+
+func newLabeledPod(namespace, name string, podLabels map[string]string) *kapi.Pod {
+	pod := newPod(namespace, name, "node1")
+	pod.Labels = podLabels
+	return pod
+}
+
+func newPolicy(name string, podSelector map[string]string, ingress ...extensions.NetworkPolicyIngressRule) *extensions.NetworkPolicy {
+	return &extensions.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec: extensions.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: podSelector},
+			Ingress:     ingress,
+		},
+	}
+}
+
+func fromPods(podLabels map[string]string) extensions.NetworkPolicyPeer {
+	return extensions.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: podLabels}}
+}
+
+func fromNamespaces(nsLabels map[string]string) extensions.NetworkPolicyPeer {
+	return extensions.NetworkPolicyPeer{NamespaceSelector: &metav1.LabelSelector{MatchLabels: nsLabels}}
+}
+
+// denyACL and allowACL render the ACLs as returned by aclStrings
+func denyACL(port string) string {
+	return fmt.Sprintf(`1000 drop outport == "%s" && ip`, port)
+}
+
+func allowACL(port, rule, l4 string) string {
+	match := fmt.Sprintf(`outport == "%s" && ip`, port)
+	if rule != "" {
+		match += fmt.Sprintf(" && (ip4.src == $%s || ip6.src == $%s)", hashedAddressSet(rule), hashedAddressSet(rule+"_v6"))
+	}
+	if l4 != "" {
+		match += " && (" + l4 + ")"
+	}
+	return "1001 allow-related " + match
+}
+
+// aclStrings returns the sorted ACLs of the switch of node1
+func aclStrings(nb *MemoryNorthbound) []string {
+	acls := make([]string, 0)
+	for _, acl := range nb.ACLs("node1") {
+		acls = append(acls, fmt.Sprintf("%d %s %s", acl.Priority, acl.Action, acl.Match))
+	}
+	sort.Strings(acls)
+	return acls
+}
+
+// flushAddressSets writes the queued address sets
+func flushAddressSets(oc *OvnController) {
+	for oc.addressSetQueue.queue.Len() > 0 {
+		oc.addressSetQueue.processNextItem()
+	}
+}
+
+// ruleAddresses returns the IPv4 addresses of the address set of a rule once
+// the queued address sets are written, nil when the set does not exist
+func ruleAddresses(oc *OvnController, nb *MemoryNorthbound, rule string) []string {
+	flushAddressSets(oc)
+	addresses, ok := nb.AddressSet(hashedAddressSet(rule))
+	if !ok {
+		return nil
+	}
+	return addresses
+}
+
+func newTestPolicyController(t *testing.T) (*OvnController, *MemoryNorthbound) {
+	nb := NewMemoryNorthbound()
+	if err := nb.AddLogicalSwitch("node1", "10.128.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	return newTestController(kube.NewFakeKube(), nb), nb
+}
+
+func addTestPods(t *testing.T, oc *OvnController, pods ...*kapi.Pod) {
+	fakeKube := oc.Kube.(*kube.FakeKube)
+	for _, pod := range pods {
+		fakeKube.AddPod(pod)
+		if err := oc.syncPod(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAddNetworkPolicy(t *testing.T) {
+	webPod := newLabeledPod("default", "web", map[string]string{"role": "web"})
+	webPod.Spec.Containers = []kapi.Container{{
+		Ports: []kapi.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: kapi.ProtocolTCP}},
+	}}
+
+	tests := []struct {
+		name       string
+		namespaces map[string]map[string]string
+		// pods added before the policy, given 10.128.1.2 onwards
+		pods   []*kapi.Pod
+		policy *extensions.NetworkPolicy
+		acls   []string
+		// addresses expected in the address set of the first rule
+		addresses []string
+	}{
+		{
+			name: "pod selector",
+			pods: []*kapi.Pod{
+				newLabeledPod("default", "db", map[string]string{"role": "db"}),
+				newLabeledPod("default", "web", map[string]string{"role": "web"}),
+				newLabeledPod("ns1", "web", map[string]string{"role": "web"}),
+			},
+			policy: newPolicy("p", map[string]string{"role": "db"}, extensions.NetworkPolicyIngressRule{
+				From: []extensions.NetworkPolicyPeer{fromPods(map[string]string{"role": "web"})},
+			}),
+			acls: []string{
+				denyACL("default_db"),
+				allowACL("default_db", "default_p_ingress_0", ""),
+			},
+			addresses: []string{"10.128.1.3"},
+		},
+		{
+			name: "namespace selector",
+			namespaces: map[string]map[string]string{
+				"default": {},
+				"ns1":     {"team": "a"},
+				"ns2":     {"team": "b"},
+			},
+			pods: []*kapi.Pod{
+				newLabeledPod("default", "db", map[string]string{"role": "db"}),
+				newLabeledPod("ns1", "client", nil),
+				newLabeledPod("ns2", "client", nil),
+			},
+			policy: newPolicy("p", map[string]string{"role": "db"}, extensions.NetworkPolicyIngressRule{
+				From: []extensions.NetworkPolicyPeer{fromNamespaces(map[string]string{"team": "a"})},
+			}),
+			acls: []string{
+				denyACL("default_db"),
+				allowACL("default_db", "default_p_ingress_0", ""),
+			},
+			addresses: []string{"10.128.1.3"},
+		},
+		{
+			name: "ports from anywhere",
+			pods: []*kapi.Pod{webPod},
+			policy: newPolicy("p", nil, extensions.NetworkPolicyIngressRule{
+				Ports: []extensions.NetworkPolicyPort{
+					policyPort(kapi.ProtocolTCP, intstr.FromInt(80)),
+					policyPort(kapi.ProtocolTCP, intstr.FromString("http")),
+					policyPort(kapi.ProtocolUDP, intstr.FromString("http")),
+				},
+			}),
+			acls: []string{
+				denyACL("default_web"),
+				allowACL("default_web", "", "tcp.dst == 80 || tcp.dst == 8080"),
+			},
+		},
+		{
+			name: "named port missing on the pod",
+			pods: []*kapi.Pod{newLabeledPod("default", "db", nil)},
+			policy: newPolicy("p", nil, extensions.NetworkPolicyIngressRule{
+				Ports: []extensions.NetworkPolicyPort{policyPort(kapi.ProtocolTCP, intstr.FromString("http"))},
+			}),
+			acls: []string{denyACL("default_db")},
+		},
+		{
+			name:   "no ingress rules",
+			pods:   []*kapi.Pod{newLabeledPod("default", "db", nil)},
+			policy: newPolicy("p", nil),
+			acls:   []string{denyACL("default_db")},
+		},
+		{
+			name: "no pod selected",
+			pods: []*kapi.Pod{newLabeledPod("default", "web", map[string]string{"role": "web"})},
+			policy: newPolicy("p", map[string]string{"role": "db"}, extensions.NetworkPolicyIngressRule{
+				From: []extensions.NetworkPolicyPeer{fromPods(map[string]string{"role": "web"})},
+			}),
+			acls:      []string{},
+			addresses: []string{"10.128.1.2"},
+		},
+	}
+
+	for _, test := range tests {
+		oc, nb := newTestPolicyController(t)
+		for namespace, nsLabels := range test.namespaces {
+			if err := oc.updateNamespaceLabels(namespace, nsLabels); err != nil {
+				t.Fatal(err)
+			}
+		}
+		addTestPods(t, oc, test.pods...)
+		if err := oc.addNetworkPolicy(test.policy); err != nil {
+			t.Fatal(err)
+		}
+
+		if acls := aclStrings(nb); !reflect.DeepEqual(acls, test.acls) {
+			t.Errorf("%s: expected ACLs %q, got %q", test.name, test.acls, acls)
+		}
+		if test.addresses != nil {
+			addresses := ruleAddresses(oc, nb, "default_p_ingress_0")
+			if !reflect.DeepEqual(addresses, test.addresses) {
+				t.Errorf("%s: expected addresses %v, got %v", test.name, test.addresses, addresses)
+			}
+		}
+	}
+}
+
+func TestNetworkPolicyPeers(t *testing.T) {
+	oc, nb := newTestPolicyController(t)
+	if err := oc.updateNamespaceLabels("default", map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := oc.updateNamespaceLabels("ns1", map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	addTestPods(t, oc, newLabeledPod("default", "db", map[string]string{"role": "db"}))
+	if err := oc.addNetworkPolicy(newPolicy("p", map[string]string{"role": "db"}, extensions.NetworkPolicyIngressRule{
+		From: []extensions.NetworkPolicyPeer{
+			fromPods(map[string]string{"role": "web"}),
+			fromNamespaces(map[string]string{"team": "a"}),
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name      string
+		change    func()
+		addresses []string
+	}{
+		{
+			name:      "no peers",
+			change:    func() {},
+			addresses: []string{},
+		},
+		{
+			name: "peer pod added",
+			change: func() {
+				addTestPods(t, oc, newLabeledPod("default", "web", map[string]string{"role": "web"}))
+			},
+			addresses: []string{"10.128.1.3"},
+		},
+		{
+			name: "pod in an unselected namespace added",
+			change: func() {
+				addTestPods(t, oc, newLabeledPod("ns1", "client", nil))
+			},
+			addresses: []string{"10.128.1.3"},
+		},
+		{
+			name: "namespace labeled",
+			change: func() {
+				if err := oc.updateNamespaceLabels("ns1", map[string]string{"team": "a"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			addresses: []string{"10.128.1.3", "10.128.1.4"},
+		},
+		{
+			name: "peer pod relabeled",
+			change: func() {
+				addTestPods(t, oc, newLabeledPod("default", "web", map[string]string{"role": "other"}))
+			},
+			addresses: []string{"10.128.1.4"},
+		},
+		{
+			name: "namespace deleted",
+			change: func() {
+				if err := oc.deleteNamespaceLabels("ns1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			addresses: []string{},
+		},
+		{
+			name: "peer pod deleted",
+			change: func() {
+				if err := oc.updateNamespaceLabels("ns1", map[string]string{"team": "a"}); err != nil {
+					t.Fatal(err)
+				}
+				if err := oc.deleteLogicalPort(newPod("ns1", "client", "node1")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			addresses: []string{},
+		},
+	}
+
+	for _, step := range steps {
+		step.change()
+		addresses := ruleAddresses(oc, nb, "default_p_ingress_0")
+		if !reflect.DeepEqual(addresses, step.addresses) {
+			t.Errorf("%s: expected addresses %v, got %v", step.name, step.addresses, addresses)
+		}
+	}
+}
+
+func TestNetworkPolicyPods(t *testing.T) {
+	oc, nb := newTestPolicyController(t)
+	if err := oc.addNetworkPolicy(newPolicy("p", map[string]string{"role": "db"}, extensions.NetworkPolicyIngressRule{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := oc.addNetworkPolicy(newPolicy("q", map[string]string{"tier": "back"})); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name   string
+		change func()
+		acls   []string
+	}{
+		{
+			name: "selected pod added",
+			change: func() {
+				addTestPods(t, oc, newLabeledPod("default", "db", map[string]string{"role": "db"}))
+			},
+			acls: []string{denyACL("default_db"), allowACL("default_db", "", "")},
+		},
+		{
+			name: "pod selected by a second policy",
+			change: func() {
+				addTestPods(t, oc, newLabeledPod("default", "db", map[string]string{"role": "db", "tier": "back"}))
+			},
+			acls: []string{denyACL("default_db"), allowACL("default_db", "", "")},
+		},
+		{
+			name: "pod no longer selected by the first policy",
+			change: func() {
+				addTestPods(t, oc, newLabeledPod("default", "db", map[string]string{"tier": "back"}))
+			},
+			acls: []string{denyACL("default_db")},
+		},
+		{
+			name: "pod no longer selected",
+			change: func() {
+				addTestPods(t, oc, newLabeledPod("default", "db", nil))
+			},
+			acls: []string{},
+		},
+		{
+			name: "selected pod deleted",
+			change: func() {
+				addTestPods(t, oc, newLabeledPod("default", "db", map[string]string{"role": "db"}))
+				if err := oc.deleteLogicalPort(newPod("default", "db", "node1")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			acls: []string{},
+		},
+	}
+
+	for _, step := range steps {
+		step.change()
+		if acls := aclStrings(nb); !reflect.DeepEqual(acls, step.acls) {
+			t.Errorf("%s: expected ACLs %q, got %q", step.name, step.acls, acls)
+		}
+	}
+}
+
+// isolationCheckingNorthbound fails the test if a port loses its default
+// deny ACL while the ACLs are changed
+type isolationCheckingNorthbound struct {
+	*MemoryNorthbound
+	t    *testing.T
+	port string
+}
+
+func (nb *isolationCheckingNorthbound) SetACLs(logicalSwitch string, externalIDs map[string]string, acls []ACL) error {
+	err := nb.MemoryNorthbound.SetACLs(logicalSwitch, externalIDs, acls)
+	for _, acl := range aclStrings(nb.MemoryNorthbound) {
+		if acl == denyACL(nb.port) {
+			return err
+		}
+	}
+	nb.t.Errorf("%s lost its default deny ACL", nb.port)
+	return err
+}
+
+func TestUpdateNetworkPolicy(t *testing.T) {
+	oc, nb := newTestPolicyController(t)
+	if err := oc.updateNamespaceLabels("default", map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	addTestPods(t, oc,
+		newLabeledPod("default", "db", map[string]string{"role": "db"}),
+		newLabeledPod("default", "web", map[string]string{"role": "web"}),
+	)
+	if err := oc.addNetworkPolicy(newPolicy("p", map[string]string{"role": "db"},
+		extensions.NetworkPolicyIngressRule{
+			From: []extensions.NetworkPolicyPeer{fromPods(map[string]string{"role": "web"})},
+		},
+		extensions.NetworkPolicyIngressRule{
+			From: []extensions.NetworkPolicyPeer{fromPods(map[string]string{"role": "db"})},
+		},
+	)); err != nil {
+		t.Fatal(err)
+	}
+	oc.OvnNB = &isolationCheckingNorthbound{MemoryNorthbound: nb, t: t, port: "default_db"}
+
+	if err := oc.addNetworkPolicy(newPolicy("p", map[string]string{"role": "db"}, extensions.NetworkPolicyIngressRule{
+		Ports: []extensions.NetworkPolicyPort{policyPort(kapi.ProtocolTCP, intstr.FromInt(5432))},
+		From:  []extensions.NetworkPolicyPeer{fromPods(map[string]string{"role": "web"})},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	acls := []string{
+		denyACL("default_db"),
+		allowACL("default_db", "default_p_ingress_0", "tcp.dst == 5432"),
+	}
+	if got := aclStrings(nb); !reflect.DeepEqual(got, acls) {
+		t.Errorf("expected ACLs %q, got %q", acls, got)
+	}
+	if addresses := ruleAddresses(oc, nb, "default_p_ingress_0"); !reflect.DeepEqual(addresses, []string{"10.128.1.3"}) {
+		t.Errorf("expected the address set of the kept rule, got %v", addresses)
+	}
+	if ruleAddresses(oc, nb, "default_p_ingress_1") != nil {
+		t.Errorf("expected the address set of the removed rule to be deleted")
+	}
+	if count := oc.lspDenyCount["default_db"]; count != 1 {
+		t.Errorf("expected default_db to be isolated once, got %d", count)
+	}
+
+	// the pod is no longer selected after the next update
+	oc.OvnNB = nb
+	if err := oc.addNetworkPolicy(newPolicy("p", map[string]string{"role": "web"})); err != nil {
+		t.Fatal(err)
+	}
+	acls = []string{denyACL("default_web")}
+	if got := aclStrings(nb); !reflect.DeepEqual(got, acls) {
+		t.Errorf("expected ACLs %q, got %q", acls, got)
+	}
+}
+
+func TestDeleteNetworkPolicy(t *testing.T) {
+	oc, nb := newTestPolicyController(t)
+	addTestPods(t, oc, newLabeledPod("default", "db", map[string]string{"role": "db"}))
+	p := newPolicy("p", map[string]string{"role": "db"}, extensions.NetworkPolicyIngressRule{
+		From: []extensions.NetworkPolicyPeer{fromPods(map[string]string{"role": "web"})},
+	})
+	if err := oc.addNetworkPolicy(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := oc.addNetworkPolicy(newPolicy("q", map[string]string{"role": "db"})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := oc.deleteNetworkPolicy(p); err != nil {
+		t.Fatal(err)
+	}
+	if acls := aclStrings(nb); !reflect.DeepEqual(acls, []string{denyACL("default_db")}) {
+		t.Errorf("expected the pod to stay isolated by the other policy, got %q", acls)
+	}
+	if ruleAddresses(oc, nb, "default_p_ingress_0") != nil {
+		t.Errorf("expected the address set of the policy to be deleted")
+	}
+
+	if err := oc.deleteNetworkPolicy(newPolicy("q", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if acls := aclStrings(nb); len(acls) != 0 {
+		t.Errorf("expected no ACLs, got %q", acls)
+	}
+	if len(oc.namespacePolicies) != 0 || len(oc.lspDenyCount) != 0 {
+		t.Errorf("expected no policy state left, got %v %v", oc.namespacePolicies, oc.lspDenyCount)
+	}
+}
+
+// failingNorthbound fails the ACL and address set writes while fail is set
+type failingNorthbound struct {
+	*MemoryNorthbound
+	fail bool
+}
+
+func (nb *failingNorthbound) SetACLs(logicalSwitch string, externalIDs map[string]string, acls []ACL) error {
+	if nb.fail {
+		return fmt.Errorf("failing on purpose")
+	}
+	return nb.MemoryNorthbound.SetACLs(logicalSwitch, externalIDs, acls)
+}
+
+func (nb *failingNorthbound) SetAddressSet(name string, externalIDs map[string]string, addresses []string) error {
+	if nb.fail {
+		return fmt.Errorf("failing on purpose")
+	}
+	return nb.MemoryNorthbound.SetAddressSet(name, externalIDs, addresses)
+}
+
+func TestNetworkPolicyRetries(t *testing.T) {
+	oc, nb := newTestPolicyController(t)
+	failing := &failingNorthbound{MemoryNorthbound: nb}
+	oc.OvnNB = failing
+	addTestPods(t, oc, newLabeledPod("default", "db", map[string]string{"role": "db"}))
+	p := newPolicy("p", map[string]string{"role": "db"}, extensions.NetworkPolicyIngressRule{
+		From: []extensions.NetworkPolicyPeer{fromPods(map[string]string{"role": "web"})},
+	})
+
+	failing.fail = true
+	if err := oc.addNetworkPolicy(p); err == nil {
+		t.Fatalf("expected the policy to fail")
+	}
+	failing.fail = false
+	if err := oc.addNetworkPolicy(p); err != nil {
+		t.Fatal(err)
+	}
+	acls := []string{denyACL("default_db"), allowACL("default_db", "default_p_ingress_0", "")}
+	if got := aclStrings(nb); !reflect.DeepEqual(got, acls) {
+		t.Errorf("expected the retried policy ACLs %q, got %q", acls, got)
+	}
+
+	// a pod whose policies failed is synced again even if unchanged
+	web := newLabeledPod("default", "web", map[string]string{"role": "web"})
+	api := newLabeledPod("default", "api", map[string]string{"role": "db"})
+	oc.Kube.(*kube.FakeKube).AddPod(api)
+	failing.fail = true
+	if err := oc.syncPod(api); err == nil {
+		t.Fatalf("expected the pod policies to fail")
+	}
+	failing.fail = false
+	addTestPods(t, oc, api, web)
+	acls = append(acls, denyACL("default_api"), allowACL("default_api", "default_p_ingress_0", ""))
+	sort.Strings(acls)
+	if got := aclStrings(nb); !reflect.DeepEqual(got, acls) {
+		t.Errorf("expected the retried pod ACLs %q, got %q", acls, got)
+	}
+
+	// a failed address set write is retried by the queue
+	failing.fail = true
+	if err := oc.syncAddressSet(hashedAddressSet("default_p_ingress_0")); err == nil {
+		t.Fatalf("expected the address set write to fail")
+	}
+	failing.fail = false
+	if addresses := ruleAddresses(oc, nb, "default_p_ingress_0"); !reflect.DeepEqual(addresses, []string{"10.128.1.4"}) {
+		t.Errorf("expected the address set to be written, got %v", addresses)
+	}
+
+	// the policy and the pod are only forgotten once their ACLs are gone
+	failing.fail = true
+	if err := oc.deletePodPolicy(api); err == nil {
+		t.Fatalf("expected the pod deletion to fail")
+	}
+	if err := oc.deleteNetworkPolicy(p); err == nil {
+		t.Fatalf("expected the policy deletion to fail")
+	}
+	failing.fail = false
+	if err := oc.deletePodPolicy(api); err != nil {
+		t.Fatal(err)
+	}
+	if err := oc.deleteNetworkPolicy(p); err != nil {
+		t.Fatal(err)
+	}
+	if got := aclStrings(nb); len(got) != 0 {
+		t.Errorf("expected no ACLs left, got %q", got)
+	}
+	if ruleAddresses(oc, nb, "default_p_ingress_0") != nil {
+		t.Errorf("expected the address set to be deleted")
+	}
+	if len(oc.namespacePolicies) != 0 || len(oc.lspDenyCount) != 0 {
+		t.Errorf("expected no policy state left, got %v %v", oc.namespacePolicies, oc.lspDenyCount)
+	}
+}
@@ -0,0 +1,129 @@
+package ovn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// maxRetries is the number of times an object is retried before it is dropped
+// out of its queue. A dropped object is picked up again on the next resync.
+const maxRetries = 15
+
+// deletedObject is the last known state of an object that was deleted
+type deletedObject struct {
+	obj interface{}
+}
+
+// eventQueue hands the latest state of each object to its sync or delete
+// function from a keyed, rate limited work queue. Events for an object that
+// is queued are merged, an object is never processed by two workers at once
+// and failures are retried with exponential backoff.
+type eventQueue struct {
+	name  string
+	queue workqueue.RateLimitingInterface
+	sync  func(obj interface{}) error
+	del   func(obj interface{}) error
+
+	mutex sync.Mutex
+	// pending holds the latest state of the queued objects, keyed by namespace/name
+	pending map[string]interface{}
+}
+
+func newEventQueue(name string, rateLimiter workqueue.RateLimiter, sync, del func(obj interface{}) error) *eventQueue {
+	return &eventQueue{
+		name:    name,
+		queue:   workqueue.NewNamedRateLimitingQueue(rateLimiter, name),
+		sync:    sync,
+		del:     del,
+		pending: make(map[string]interface{}),
+	}
+}
+
+func (q *eventQueue) enqueue(obj interface{}, state interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Couldn't get key for %s %+v: %v", q.name, obj, err)
+		return
+	}
+	q.mutex.Lock()
+	q.pending[key] = state
+	q.mutex.Unlock()
+	q.queue.Add(key)
+}
+
+// add queues the sync of an added or updated object
+func (q *eventQueue) add(obj interface{}) {
+	q.enqueue(obj, obj)
+}
+
+// delete queues the deletion of an object
+func (q *eventQueue) delete(obj interface{}) {
+	q.enqueue(obj, deletedObject{obj: obj})
+}
+
+// run starts the workers of the queue, they stop and the queue is shut down
+// once stopChan is closed
+func (q *eventQueue) run(workers int, stopChan <-chan struct{}) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go utilwait.Until(q.worker, time.Second, stopChan)
+	}
+	go func() {
+		<-stopChan
+		q.queue.ShutDown()
+	}()
+}
+
+func (q *eventQueue) worker() {
+	for q.processNextItem() {
+	}
+}
+
+func (q *eventQueue) processNextItem() bool {
+	item, quit := q.queue.Get()
+	if quit {
+		return false
+	}
+	defer q.queue.Done(item)
+	key := item.(string)
+
+	q.mutex.Lock()
+	state, ok := q.pending[key]
+	q.mutex.Unlock()
+	if !ok {
+		q.queue.Forget(key)
+		return true
+	}
+
+	var err error
+	if deleted, ok := state.(deletedObject); ok {
+		err = q.del(deleted.obj)
+	} else {
+		err = q.sync(state)
+	}
+	if err != nil && q.queue.NumRequeues(key) < maxRetries {
+		glog.Errorf("Error syncing %s %s, retrying: %v", q.name, key, err)
+		q.queue.AddRateLimited(key)
+		return true
+	}
+	if err != nil {
+		glog.Errorf("Dropping %s %s out of the queue after %d retries: %v", q.name, key, maxRetries, err)
+	}
+	q.queue.Forget(key)
+
+	// a newer state queued while this one was processed is kept
+	q.mutex.Lock()
+	if q.pending[key] == state {
+		delete(q.pending, key)
+	}
+	q.mutex.Unlock()
+	return true
+}
@@ -0,0 +1,129 @@
+package ovn
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rajatchopra/ovn-kube/pkg/annotation"
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+	kapi "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// recorder records the objects handed out by an eventQueue, failing the
+// first failures calls
+type recorder struct {
+	mutex    sync.Mutex
+	failures int
+	synced   []string
+	deleted  []string
+}
+
+func (r *recorder) record(list *[]string, obj interface{}) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return fmt.Errorf("failing on purpose")
+	}
+	pod := obj.(*kapi.Pod)
+	*list = append(*list, pod.Spec.NodeName)
+	return nil
+}
+
+func (r *recorder) calls() ([]string, []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.synced...), append([]string{}, r.deleted...)
+}
+
+func newTestQueue(r *recorder) *eventQueue {
+	return newEventQueue("test", workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, 10*time.Millisecond),
+		func(obj interface{}) error { return r.record(&r.synced, obj) },
+		func(obj interface{}) error { return r.record(&r.deleted, obj) })
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for the queue")
+}
+
+func TestEventQueueRetries(t *testing.T) {
+	r := &recorder{failures: 3}
+	q := newTestQueue(r)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+
+	q.add(newPod("default", "web", "node1"))
+	q.run(2, stopChan)
+
+	waitFor(t, func() bool {
+		synced, _ := r.calls()
+		return len(synced) == 1
+	})
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.pending) != 0 {
+		t.Errorf("expected nothing pending after the sync, got %v", q.pending)
+	}
+}
+
+func TestEventQueueLatestState(t *testing.T) {
+	r := &recorder{}
+	q := newTestQueue(r)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+
+	// events queued before the workers run are merged into the latest one
+	q.add(newPod("default", "web", "node1"))
+	q.add(newPod("default", "web", "node2"))
+	q.add(newPod("default", "db", "node3"))
+	q.delete(newPod("default", "db", "node3"))
+	q.run(1, stopChan)
+
+	waitFor(t, func() bool {
+		synced, deleted := r.calls()
+		return len(synced)+len(deleted) == 2
+	})
+	synced, deleted := r.calls()
+	if len(synced) != 1 || synced[0] != "node2" {
+		t.Errorf("expected only the latest state of default/web to be synced, got %v", synced)
+	}
+	if len(deleted) != 1 || deleted[0] != "node3" {
+		t.Errorf("expected default/db to be deleted, got %v", deleted)
+	}
+}
+
+func TestPodRetriedUntilSwitchExists(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	nb := NewMemoryNorthbound()
+	oc := newTestController(fakeKube, nb)
+	oc.podQueue = newEventQueue("pods", workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, 10*time.Millisecond),
+		func(obj interface{}) error { return oc.syncPod(obj.(*kapi.Pod)) },
+		func(obj interface{}) error { return oc.deleteLogicalPort(obj.(*kapi.Pod)) })
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	oc.podQueue.run(1, stopChan)
+
+	pod := newPod("default", "web", "node1")
+	fakeKube.AddPod(pod)
+	oc.podQueue.add(pod)
+	time.Sleep(20 * time.Millisecond)
+	if err := nb.AddLogicalSwitch("node1", "10.128.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		p, _ := fakeKube.GetPod("default", "web")
+		_, err := annotation.GetPodNetwork(p)
+		return err == nil
+	})
+}
@@ -0,0 +1,294 @@
+package ovn
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	kapi "k8s.io/client-go/pkg/api/v1"
+	extensions "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// RunReconciler reconciles the northbound database with the informer caches
+// right away and then every interval, until stopChan is closed. The caches
+// must have been synced.
+func (oc *OvnController) RunReconciler(interval time.Duration, stopChan <-chan struct{}) {
+	go utilwait.Until(oc.reconcile, interval, stopChan)
+}
+
+// reconcile removes the logical ports, ACLs, address sets and vips left
+// behind by objects that were deleted while ovnkube was down, and queues the
+// objects whose ports or vips are missing
+func (oc *OvnController) reconcile() {
+	err := oc.reconcilePods()
+	if err != nil {
+		glog.Errorf("Error reconciling the logical ports: %v", err)
+	}
+	err = oc.reconcilePolicies()
+	if err != nil {
+		glog.Errorf("Error reconciling the network policy ACLs and address sets: %v", err)
+	}
+	err = oc.reconcileVIPs()
+	if err != nil {
+		glog.Errorf("Error reconciling the load balancer vips: %v", err)
+	}
+}
+
+func (oc *OvnController) reconcilePods() error {
+	// the ports are listed before the pods, so that a port created in
+	// between belongs to a pod that is already in the cache
+	ports, err := oc.OvnNB.ListLogicalSwitchPorts(map[string]string{"pod": "true"})
+	if err != nil {
+		return err
+	}
+	pods, err := oc.PodLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	expected := make(map[string]*kapi.Pod)
+	for _, pod := range pods {
+		if pod.Spec.NodeName != "" {
+			expected[fmt.Sprintf("%s_%s", pod.Namespace, pod.Name)] = pod
+		}
+	}
+	existing := make(map[string]bool)
+	for _, portName := range ports {
+		existing[portName] = true
+		if _, ok := expected[portName]; ok {
+			continue
+		}
+		glog.Infof("Deleting stale logical port %s", portName)
+		err = oc.deleteLogicalPort(portPod(portName))
+		if err != nil {
+			glog.Errorf("Error in deleting stale logical port %s - %v", portName, err)
+		}
+	}
+	for portName, pod := range expected {
+		if !existing[portName] {
+			glog.V(4).Infof("Queueing pod %s/%s without a logical port", pod.Namespace, pod.Name)
+			oc.podQueue.add(pod)
+		}
+	}
+	return nil
+}
+
+// portPod returns a pod with the namespace and the name of a logical port,
+// the name of a namespace has no '_'
+func portPod(portName string) *kapi.Pod {
+	pod := &kapi.Pod{}
+	parts := strings.SplitN(portName, "_", 2)
+	pod.Namespace = parts[0]
+	if len(parts) == 2 {
+		pod.Name = parts[1]
+	}
+	return pod
+}
+
+// reconcilePolicies removes the ACLs of the logical ports of deleted pods and
+// of deleted network policies, and the default deny ACLs of the ports no
+// policy selects. The address sets of deleted policies are queued, the
+// address sets no rule owns are deleted by the queue.
+func (oc *OvnController) reconcilePolicies() error {
+	// the ACLs are only written with policyMutex held, the ones of the pods
+	// and policies added after the caches are listed wait for it
+	oc.policyMutex.Lock()
+	defer oc.policyMutex.Unlock()
+
+	pods, err := oc.PodLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	portPods := make(map[string]*kapi.Pod)
+	for _, pod := range pods {
+		portPods[fmt.Sprintf("%s_%s", pod.Namespace, pod.Name)] = pod
+	}
+	policies := make(map[string]bool)
+	selectors := make(map[string][]labels.Selector)
+	addressSets := make(map[string]bool)
+	for _, obj := range oc.PolicyStore.List() {
+		policy := obj.(*extensions.NetworkPolicy)
+		policies[cacheKey(policy.Namespace, policy.Name)] = true
+		if sel, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector); err == nil {
+			selectors[policy.Namespace] = append(selectors[policy.Namespace], sel)
+		}
+		for i, rule := range policy.Spec.Ingress {
+			if len(rule.From) == 0 {
+				continue
+			}
+			name := ruleName(policy.Namespace, policy.Name, i)
+			addressSets[hashedAddressSet(name)] = true
+			addressSets[hashedAddressSet(name+"_v6")] = true
+		}
+	}
+	isolated := func(pod *kapi.Pod) bool {
+		for _, sel := range selectors[pod.Namespace] {
+			if sel.Matches(labels.Set(pod.Labels)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	acls, err := oc.OvnNB.ListACLs(nil)
+	if err != nil {
+		return err
+	}
+	for logicalSwitch, switchACLs := range acls {
+		stale := make(map[string]map[string]string)
+		for _, acl := range switchACLs {
+			portName, ok := acl.ExternalIDs["logical_port"]
+			if !ok {
+				continue
+			}
+			var externalIDs map[string]string
+			pod, ok := portPods[portName]
+			switch {
+			case !ok:
+				externalIDs = map[string]string{"logical_port": portName}
+			case acl.ExternalIDs["default-deny"] == "true":
+				if isolated(pod) {
+					continue
+				}
+				externalIDs = denyExternalIDs(portName)
+			default:
+				np := &namespacePolicy{namespace: acl.ExternalIDs["namespace"], name: acl.ExternalIDs["policy"]}
+				if policies[cacheKey(np.namespace, np.name)] {
+					continue
+				}
+				externalIDs = policyExternalIDs(np, portName)
+			}
+			stale[fmt.Sprint(externalIDs)] = externalIDs
+		}
+		for _, externalIDs := range stale {
+			glog.Infof("Deleting stale ACLs %v of logical switch %s", externalIDs, logicalSwitch)
+			err = oc.OvnNB.SetACLs(logicalSwitch, externalIDs, nil)
+			if err != nil {
+				glog.Errorf("Error in deleting stale ACLs %v - %v", externalIDs, err)
+			}
+		}
+	}
+
+	sets, err := oc.OvnNB.ListAddressSets()
+	if err != nil {
+		return err
+	}
+	for name, externalIDs := range sets {
+		// the address sets of the rules are named after the hash of the
+		// name in their external_ids
+		if rule, ok := externalIDs["name"]; !ok || hashedAddressSet(rule) != name || addressSets[name] {
+			continue
+		}
+		glog.V(4).Infof("Queueing stale address set %s of rule %s", name, externalIDs["name"])
+		oc.addressSetQueue.add(cache.ExplicitKey(name))
+	}
+	return nil
+}
+
+func (oc *OvnController) reconcileVIPs() error {
+	// the vips are only written with lbMutex held, from objects that are
+	// already in the informer caches
+	oc.lbMutex.Lock()
+	defer oc.lbMutex.Unlock()
+
+	lbs, err := oc.getLoadBalancers()
+	if err != nil {
+		return err
+	}
+	current := make(map[string]map[string]string)
+	for _, lb := range lbs.all() {
+		vips, err := oc.OvnNB.GetLoadBalancerVIPs(lb)
+		if err != nil {
+			return err
+		}
+		current[lb] = vips
+	}
+
+	services, err := oc.ServiceLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	// the own load balancers of services that were deleted, or stopped
+	// needing them, go with all their vips
+	owners := make(map[string]bool)
+	for _, svc := range services {
+		if isLoadBalanced(svc) && lbs.hasOwnLoadBalancers(svc) {
+			owners[cacheKey(svc.Namespace, svc.Name)] = true
+		}
+	}
+	for key, serviceLBs := range lbs.services {
+		if owners[key] {
+			continue
+		}
+		for _, lb := range serviceLBs {
+			glog.Infof("Deleting stale load balancer %s of service %s", lb, key)
+			err = oc.OvnNB.DeleteLoadBalancer(lb)
+			if err != nil {
+				glog.Errorf("Error in deleting stale load balancer %s - %v", lb, err)
+			}
+			delete(current, lb)
+		}
+	}
+
+	expected := make(map[string]map[string]bool)
+	for _, svc := range services {
+		for lb, keys := range serviceVIPKeys(svc, lbs) {
+			if expected[lb] == nil {
+				expected[lb] = make(map[string]bool)
+			}
+			for vip := range keys {
+				expected[lb][vip] = true
+			}
+		}
+	}
+	for lb, vips := range current {
+		for vip := range vips {
+			if expected[lb][vip] {
+				continue
+			}
+			glog.Infof("Deleting stale vip %s", vip)
+			err = oc.deleteLoadBalancerVIP(lb, vip)
+			if err != nil {
+				glog.Errorf("Error in deleting stale vip %s - %v", vip, err)
+			}
+		}
+	}
+
+	endpoints, err := oc.EndpointsLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, ep := range endpoints {
+		svc, err := oc.ServiceLister.Services(ep.Namespace).Get(ep.Name)
+		if err != nil {
+			continue
+		}
+		missingLBs := owners[cacheKey(svc.Namespace, svc.Name)] && len(lbs.services[cacheKey(svc.Namespace, svc.Name)]) == 0
+		if missingLBs || !vipsMatch(serviceVIPs(svc, ep, lbs), current) {
+			glog.V(4).Infof("Queueing service %s/%s with missing or outdated vips", svc.Namespace, svc.Name)
+			oc.serviceQueue.add(svc)
+			oc.endpointsQueue.add(ep)
+		}
+	}
+	return nil
+}
+
+// vipsMatch tells if all the desired vips are on the load balancers with
+// their targets
+func vipsMatch(desired lbVIPs, current map[string]map[string]string) bool {
+	for lb, vips := range desired {
+		for vip, targets := range vips {
+			currentTargets, ok := current[lb][vip]
+			if !ok || currentTargets != strings.Join(targets, ",") {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+package ovn
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/rajatchopra/ovn-kube/pkg/kube"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	listers "k8s.io/client-go/listers/core/v1"
+	kapi "k8s.io/client-go/pkg/api/v1"
+	extensions "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestIndexer(objs ...interface{}) cache.Indexer {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, obj := range objs {
+		indexer.Add(obj)
+	}
+	return indexer
+}
+
+func pendingKeys(q *eventQueue) []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	keys := make([]string, 0)
+	for key := range q.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestReconcilePods(t *testing.T) {
+	fakeKube := kube.NewFakeKube()
+	nb := NewMemoryNorthbound()
+	if err := nb.AddLogicalSwitch("node1", "10.128.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	oc := newTestController(fakeKube, nb)
+
+	// ports of pods that went away while the controller was down
+	web := newPod("default", "web", "node1")
+	fakeKube.AddPod(web)
+	if err := oc.syncPod(web); err != nil {
+		t.Fatal(err)
+	}
+	nb.AddLogicalSwitchPort("node1", "default_gone", map[string]string{"namespace": "default", "pod": "true"})
+	// ports not owned by pods are left alone
+	nb.AddLogicalSwitchPort("node1", "k8s-node1", nil)
+
+	oc.PodLister = listers.NewPodLister(newTestIndexer(
+		web,
+		newPod("default", "db", "node1"),
+		newPod("default", "pending", "")))
+	if err := oc.reconcilePods(); err != nil {
+		t.Fatal(err)
+	}
+
+	ports := nb.LogicalSwitchPorts("node1")
+	sort.Strings(ports)
+	if expected := []string{"default_web", "k8s-node1"}; !reflect.DeepEqual(ports, expected) {
+		t.Errorf("expected ports %v, got %v", expected, ports)
+	}
+	if keys := pendingKeys(oc.podQueue); !reflect.DeepEqual(keys, []string{"default/db"}) {
+		t.Errorf("expected default/db to be queued, got %v", keys)
+	}
+}
+
+func TestReconcileVIPs(t *testing.T) {
+	oc, nb, tcpLB, udpLB := newTestLBController()
+	gw := nb.AddGateway("GR_node1", "192.168.1.10")
+
+	web := newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080)))
+	webEp := newEndpoints("web", newSubset([]string{"10.128.1.2"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 8080}))
+	db := newService("db", "172.30.0.11", newServicePort("", kapi.ProtocolTCP, 5432, intstr.FromInt(5432)))
+	dbEp := newEndpoints("db", newSubset([]string{"10.128.1.3", "10.128.1.4"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 5432}))
+	oc.addService(web)
+	oc.addEndpoints(webEp)
+	oc.addService(db)
+	oc.addEndpoints(newEndpoints("db", newSubset([]string{"10.128.1.3"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 5432})))
+	// vips of services deleted while the controller was down
+	nb.SetLoadBalancerVIP(tcpLB, "172.30.0.12:80", "10.128.1.5:80")
+	nb.SetLoadBalancerVIP(udpLB, "172.30.0.10:80", "10.128.1.2:8080")
+	nb.SetLoadBalancerVIP(gw.LoadBalancers[kapi.ProtocolTCP], "192.168.1.10:30080", "10.128.1.5:80")
+	nb.EnsureServiceLoadBalancer("default/gone", kapi.ProtocolTCP, nil)
+
+	oc.ServiceLister = listers.NewServiceLister(newTestIndexer(web, db))
+	oc.EndpointsLister = listers.NewEndpointsLister(newTestIndexer(webEp, dbEp))
+	if err := oc.reconcileVIPs(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"172.30.0.10:80":   "10.128.1.2:8080",
+		"172.30.0.11:5432": "10.128.1.3:5432",
+	}
+	if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, expected) {
+		t.Errorf("expected tcp vips %v, got %v", expected, vips)
+	}
+	if vips, _ := nb.GetLoadBalancerVIPs(udpLB); len(vips) != 0 {
+		t.Errorf("expected no udp vips, got %v", vips)
+	}
+	if vips, _ := nb.GetLoadBalancerVIPs(gw.LoadBalancers[kapi.ProtocolTCP]); len(vips) != 0 {
+		t.Errorf("expected no gateway vips, got %v", vips)
+	}
+	if lbs, _ := nb.ListServiceLoadBalancers(); len(lbs) != 0 {
+		t.Errorf("expected the load balancer of the deleted service to be removed, got %v", lbs)
+	}
+	// the outdated db vip is fixed by the queues
+	if keys := pendingKeys(oc.endpointsQueue); !reflect.DeepEqual(keys, []string{"default/db"}) {
+		t.Errorf("expected default/db endpoints to be queued, got %v", keys)
+	}
+	if keys := pendingKeys(oc.serviceQueue); !reflect.DeepEqual(keys, []string{"default/db"}) {
+		t.Errorf("expected default/db service to be queued, got %v", keys)
+	}
+}
+
+func TestReconcilePolicies(t *testing.T) {
+	oc, nb := newTestPolicyController(t)
+	db := newLabeledPod("default", "db", map[string]string{"role": "db"})
+	web := newLabeledPod("default", "web", map[string]string{"role": "web"})
+	gone := newLabeledPod("default", "gone", map[string]string{"role": "db"})
+	addTestPods(t, oc, db, web, gone)
+	p := newPolicy("p", map[string]string{"role": "db"}, extensions.NetworkPolicyIngressRule{
+		From: []extensions.NetworkPolicyPeer{fromPods(map[string]string{"role": "web"})},
+	})
+	q := newPolicy("q", map[string]string{"role": "web"}, extensions.NetworkPolicyIngressRule{
+		From: []extensions.NetworkPolicyPeer{fromPods(map[string]string{"role": "db"})},
+	})
+	for _, policy := range []*extensions.NetworkPolicy{p, q} {
+		if err := oc.addNetworkPolicy(policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAddressSets(oc)
+
+	// the stale port of a pod the controller knows goes with its policies
+	oc.PodLister = listers.NewPodLister(newTestIndexer(db, web))
+	if err := oc.reconcilePods(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := oc.logicalPorts["default_gone"]; ok {
+		t.Errorf("expected the stale port to be forgotten")
+	}
+	expected := []string{
+		denyACL("default_db"),
+		denyACL("default_web"),
+		allowACL("default_db", "default_p_ingress_0", ""),
+		allowACL("default_web", "default_q_ingress_0", ""),
+	}
+	sort.Strings(expected)
+	if acls := aclStrings(nb); !reflect.DeepEqual(acls, expected) {
+		t.Errorf("expected ACLs %q, got %q", expected, acls)
+	}
+
+	// after a restart, the ACLs of a pod and a policy deleted while the
+	// controller was down are left, with the address sets of the policy
+	denyIDs := denyExternalIDs("default_old")
+	nb.SetACLs("node1", denyIDs, []ACL{{Priority: defaultDenyPriority, Match: `outport == "default_old" && ip`, Action: "drop", ExternalIDs: denyIDs}})
+	restarted := newTestController(oc.Kube.(*kube.FakeKube), nb)
+	restarted.PodLister = oc.PodLister
+	restarted.PolicyStore = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	restarted.PolicyStore.Add(p)
+	if err := restarted.reconcilePolicies(); err != nil {
+		t.Fatal(err)
+	}
+	flushAddressSets(restarted)
+
+	expected = []string{denyACL("default_db"), allowACL("default_db", "default_p_ingress_0", "")}
+	sort.Strings(expected)
+	if acls := aclStrings(nb); !reflect.DeepEqual(acls, expected) {
+		t.Errorf("expected ACLs %q, got %q", expected, acls)
+	}
+	for _, rule := range []string{"default_q_ingress_0", "default_q_ingress_0_v6"} {
+		if _, ok := nb.AddressSet(hashedAddressSet(rule)); ok {
+			t.Errorf("expected the address set of %s to be deleted", rule)
+		}
+	}
+	for _, rule := range []string{"default_p_ingress_0", "default_p_ingress_0_v6"} {
+		if _, ok := nb.AddressSet(hashedAddressSet(rule)); !ok {
+			t.Errorf("expected the address set of %s to be kept", rule)
+		}
+	}
+}
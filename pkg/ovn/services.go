@@ -0,0 +1,102 @@
+package ovn
+
+import (
+	"reflect"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/client-go/pkg/api/v1"
+)
+
+func cacheKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// addService caches the service and programs its vips from its endpoints. A
+// service that is already cached is updated, removing the vips of the
+// previous version that it no longer has.
+func (oc *OvnController) addService(svc *kapi.Service) error {
+	oc.lbMutex.Lock()
+	defer oc.lbMutex.Unlock()
+
+	key := cacheKey(svc.Namespace, svc.Name)
+	old, hasOld := oc.serviceCache[key]
+	if isLoadBalanced(svc) && (!hasOld || !reflect.DeepEqual(old.Spec.Ports, svc.Spec.Ports)) {
+		warnUnsupportedPorts(svc)
+	}
+	oc.serviceCache[key] = svc
+	ep := oc.endpointsCache[key]
+	if hasOld {
+		return oc.syncServiceVIPs(svc, ep, old)
+	}
+	if ep == nil {
+		return nil
+	}
+	return oc.syncServiceVIPs(svc, ep)
+}
+
+func (oc *OvnController) deleteService(svc *kapi.Service) error {
+	oc.lbMutex.Lock()
+	defer oc.lbMutex.Unlock()
+
+	key := cacheKey(svc.Namespace, svc.Name)
+	if cached, ok := oc.serviceCache[key]; ok {
+		svc = cached
+	}
+	delete(oc.serviceCache, key)
+	return oc.removeServiceVIPs(svc)
+}
+
+// warnUnsupportedPorts logs the ports of the service that are not load
+// balanced, the other ports of the service are
+func warnUnsupportedPorts(svc *kapi.Service) {
+	for _, svcPort := range svc.Spec.Ports {
+		supported := false
+		for _, protocol := range clusterProtocols {
+			if svcPort.Protocol == protocol {
+				supported = true
+			}
+		}
+		if !supported {
+			glog.Warningf("Port %d of service %s/%s has the unsupported protocol %q, it is not load balanced",
+				svcPort.Port, svc.Namespace, svc.Name, svcPort.Protocol)
+		}
+	}
+}
+
+// hasGatewayVIPs tells if the service has vips on the gateway routers, for
+// its node ports or its external IPs
+func hasGatewayVIPs(svc *kapi.Service) bool {
+	if !isLoadBalanced(svc) {
+		return false
+	}
+	for _, svcPort := range svc.Spec.Ports {
+		if svcPort.NodePort != 0 {
+			return true
+		}
+	}
+	return len(serviceExternalIPs(svc)) > 0
+}
+
+// syncGateways queues the services with gateway vips when the gateway routers
+// changed, so that their vips follow the nodes as they join or leave
+func (oc *OvnController) syncGateways() {
+	gateways, err := oc.OvnNB.ListGateways()
+	if err != nil {
+		glog.Errorf("Error listing the gateway routers: %v", err)
+		return
+	}
+
+	oc.lbMutex.Lock()
+	defer oc.lbMutex.Unlock()
+	if reflect.DeepEqual(gateways, oc.gateways) {
+		return
+	}
+	glog.V(4).Infof("Gateway routers changed to %v", gateways)
+	oc.gateways = gateways
+	for _, svc := range oc.serviceCache {
+		if hasGatewayVIPs(svc) {
+			oc.serviceQueue.add(svc)
+		}
+	}
+}
@@ -0,0 +1,612 @@
+package ovn
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+	listers "k8s.io/client-go/listers/core/v1"
+	kapi "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestServiceChanges(t *testing.T) {
+	web := newService("web", "172.30.0.10", newServicePort("http", kapi.ProtocolTCP, 80, intstr.FromString("web")))
+	webEp := newEndpoints("web", newSubset([]string{"10.128.1.2"},
+		kapi.EndpointPort{Name: "http", Protocol: kapi.ProtocolTCP, Port: 8080}))
+
+	tests := []struct {
+		name    string
+		change  func(oc *OvnController) error
+		tcpVIPs map[string]string
+	}{
+		{
+			name: "service port changed",
+			change: func(oc *OvnController) error {
+				return oc.addService(newService("web", "172.30.0.10",
+					newServicePort("http", kapi.ProtocolTCP, 8000, intstr.FromString("web"))))
+			},
+			tcpVIPs: map[string]string{
+				"172.30.0.10:8000": "10.128.1.2:8080",
+				"172.30.0.11:80":   "10.128.3.2:80",
+			},
+		},
+		{
+			name: "cluster ip changed",
+			change: func(oc *OvnController) error {
+				return oc.addService(newService("web", "172.30.0.20",
+					newServicePort("http", kapi.ProtocolTCP, 80, intstr.FromString("web"))))
+			},
+			tcpVIPs: map[string]string{
+				"172.30.0.20:80": "10.128.1.2:8080",
+				"172.30.0.11:80": "10.128.3.2:80",
+			},
+		},
+		{
+			name: "target port renamed",
+			change: func(oc *OvnController) error {
+				err := oc.addService(newService("web", "172.30.0.10",
+					newServicePort("web", kapi.ProtocolTCP, 80, intstr.FromString("web"))))
+				if err != nil {
+					return err
+				}
+				return oc.addEndpoints(newEndpoints("web", newSubset([]string{"10.128.1.2"},
+					kapi.EndpointPort{Name: "web", Protocol: kapi.ProtocolTCP, Port: 8080})))
+			},
+			tcpVIPs: map[string]string{
+				"172.30.0.10:80": "10.128.1.2:8080",
+				"172.30.0.11:80": "10.128.3.2:80",
+			},
+		},
+		{
+			name: "service deleted",
+			change: func(oc *OvnController) error {
+				return oc.deleteService(web)
+			},
+			tcpVIPs: map[string]string{
+				"172.30.0.11:80": "10.128.3.2:80",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		oc, nb, tcpLB, _ := newTestLBController()
+		// the endpoints may be seen before their service
+		if err := oc.addEndpoints(webEp); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); len(vips) != 0 {
+			t.Errorf("%s: expected no vips without a service, got %v", test.name, vips)
+		}
+		oc.addService(web)
+		oc.addService(newService("other", "172.30.0.11", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(80))))
+		oc.addEndpoints(newEndpoints("other", newSubset([]string{"10.128.3.2"},
+			kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 80})))
+
+		if err := test.change(oc); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, test.tcpVIPs) {
+			t.Errorf("%s: expected tcp vips %v, got %v", test.name, test.tcpVIPs, vips)
+		}
+	}
+}
+
+func newNodePortService(name, clusterIP string, protocol kapi.Protocol, port, nodePort int32) *kapi.Service {
+	svcPort := newServicePort("", protocol, port, intstr.FromInt(int(port)))
+	svcPort.NodePort = nodePort
+	svc := newService(name, clusterIP, svcPort)
+	svc.Spec.Type = kapi.ServiceTypeNodePort
+	return svc
+}
+
+func TestNodePortVIPs(t *testing.T) {
+	web := newNodePortService("web", "172.30.0.10", kapi.ProtocolTCP, 80, 30080)
+	webEp := newEndpoints("web", newSubset([]string{"10.128.1.2"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 80}))
+
+	tests := []struct {
+		name    string
+		svc     *kapi.Service
+		tcpVIPs map[string]string
+		gwVIPs  map[string]string
+		gw2VIPs map[string]string
+	}{
+		{
+			name:    "node port service",
+			svc:     web,
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.2:80"},
+			gwVIPs:  map[string]string{"192.168.1.10:30080": "10.128.1.2:80"},
+			gw2VIPs: map[string]string{"192.168.1.11:30080": "10.128.1.2:80"},
+		},
+		{
+			name:    "node port changed",
+			svc:     newNodePortService("web", "172.30.0.10", kapi.ProtocolTCP, 80, 30081),
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.2:80"},
+			gwVIPs:  map[string]string{"192.168.1.10:30081": "10.128.1.2:80"},
+			gw2VIPs: map[string]string{"192.168.1.11:30081": "10.128.1.2:80"},
+		},
+		{
+			name:    "changed to a cluster ip service",
+			svc:     newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(80))),
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.2:80"},
+			gwVIPs:  map[string]string{},
+			gw2VIPs: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		oc, nb, tcpLB, _ := newTestLBController()
+		gw := nb.AddGateway("GR_node1", "192.168.1.10")
+		gw2 := nb.AddGateway("GR_node2", "192.168.1.11")
+		oc.addService(web)
+		if err := oc.addEndpoints(webEp); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if err := oc.addService(test.svc); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, test.tcpVIPs) {
+			t.Errorf("%s: expected tcp vips %v, got %v", test.name, test.tcpVIPs, vips)
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(gw.LoadBalancers[kapi.ProtocolTCP]); !reflect.DeepEqual(vips, test.gwVIPs) {
+			t.Errorf("%s: expected GR_node1 vips %v, got %v", test.name, test.gwVIPs, vips)
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(gw2.LoadBalancers[kapi.ProtocolTCP]); !reflect.DeepEqual(vips, test.gw2VIPs) {
+			t.Errorf("%s: expected GR_node2 vips %v, got %v", test.name, test.gw2VIPs, vips)
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(gw.LoadBalancers[kapi.ProtocolUDP]); len(vips) != 0 {
+			t.Errorf("%s: expected no udp gateway vips, got %v", test.name, vips)
+		}
+	}
+}
+
+func TestIPv6GatewayVIPs(t *testing.T) {
+	web := newNodePortService("web", "fd00:172:30::10", kapi.ProtocolTCP, 80, 30080)
+	web.Spec.ExternalIPs = []string{"2001:db8::10", "203.0.113.10"}
+	webEp := newEndpoints("web", newSubset([]string{"fd00:10:128:1::2"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 80}))
+
+	oc, nb, tcpLB, _ := newTestLBController()
+	gw := nb.AddGateway("GR_node1", "192.168.1.10")
+	gw6 := nb.AddGateway("GR_node2", "2001:db8::11")
+	if err := oc.addService(web); err != nil {
+		t.Fatal(err)
+	}
+	if err := oc.addEndpoints(webEp); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"[fd00:172:30::10]:80": "[fd00:10:128:1::2]:80"}
+	if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, expected) {
+		t.Errorf("expected tcp vips %v, got %v", expected, vips)
+	}
+	// the vips of another family than the cluster ip would have no targets
+	expected = map[string]string{"[2001:db8::10]:80": "[fd00:10:128:1::2]:80"}
+	if vips, _ := nb.GetLoadBalancerVIPs(gw.LoadBalancers[kapi.ProtocolTCP]); !reflect.DeepEqual(vips, expected) {
+		t.Errorf("expected IPv4 gateway vips %v, got %v", expected, vips)
+	}
+	expected = map[string]string{
+		"[2001:db8::10]:80":    "[fd00:10:128:1::2]:80",
+		"[2001:db8::11]:30080": "[fd00:10:128:1::2]:80",
+	}
+	if vips, _ := nb.GetLoadBalancerVIPs(gw6.LoadBalancers[kapi.ProtocolTCP]); !reflect.DeepEqual(vips, expected) {
+		t.Errorf("expected IPv6 gateway vips %v, got %v", expected, vips)
+	}
+}
+
+func TestGatewayChanges(t *testing.T) {
+	oc, nb, _, _ := newTestLBController()
+	gw := nb.AddGateway("GR_node1", "192.168.1.10")
+	oc.syncGateways()
+
+	web := newNodePortService("web", "172.30.0.10", kapi.ProtocolTCP, 80, 30080)
+	oc.addService(web)
+	oc.addService(newService("db", "172.30.0.11", newServicePort("", kapi.ProtocolTCP, 5432, intstr.FromInt(5432))))
+	oc.addEndpoints(newEndpoints("web", newSubset([]string{"10.128.1.2"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 80})))
+
+	// node events without a gateway change do not queue anything
+	oc.syncGateways()
+	if keys := pendingKeys(oc.serviceQueue); len(keys) != 0 {
+		t.Errorf("expected no queued services, got %v", keys)
+	}
+
+	// a node joins with its gateway
+	gw2 := nb.AddGateway("GR_node2", "192.168.1.11")
+	oc.syncGateways()
+	if keys := pendingKeys(oc.serviceQueue); !reflect.DeepEqual(keys, []string{"default/web"}) {
+		t.Fatalf("expected default/web to be queued, got %v", keys)
+	}
+	if err := oc.addService(web); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"192.168.1.11:30080": "10.128.1.2:80"}
+	if vips, _ := nb.GetLoadBalancerVIPs(gw2.LoadBalancers[kapi.ProtocolTCP]); !reflect.DeepEqual(vips, expected) {
+		t.Errorf("expected GR_node2 vips %v, got %v", expected, vips)
+	}
+
+	// and the other one leaves
+	nb.DeleteGateway(gw.Router)
+	oc.syncGateways()
+	if gateways := oc.gateways; len(gateways) != 1 || gateways[0].Router != "GR_node2" {
+		t.Errorf("expected only GR_node2 to be left, got %v", gateways)
+	}
+	if err := oc.addService(web); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExternalVIPs(t *testing.T) {
+	web := newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080)))
+	web.Spec.ExternalIPs = []string{"203.0.113.10"}
+	webEp := newEndpoints("web", newSubset([]string{"10.128.1.2"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 8080}))
+
+	withIngress := *web
+	withIngress.Spec.Type = kapi.ServiceTypeLoadBalancer
+	withIngress.Status.LoadBalancer.Ingress = []kapi.LoadBalancerIngress{
+		{IP: "203.0.113.20"},
+		{Hostname: "web.example.com"},
+	}
+	externalIPChanged := withIngress
+	externalIPChanged.Spec.ExternalIPs = []string{"203.0.113.11"}
+	externalIPChanged.Status.LoadBalancer.Ingress = nil
+
+	tests := []struct {
+		name string
+		// updates are the versions of the service seen after the first one
+		updates []*kapi.Service
+		tcpVIPs map[string]string
+		gwVIPs  map[string]string
+	}{
+		{
+			name:    "external ip",
+			updates: []*kapi.Service{web},
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.2:8080"},
+			gwVIPs:  map[string]string{"203.0.113.10:80": "10.128.1.2:8080"},
+		},
+		{
+			name:    "load balancer ingress",
+			updates: []*kapi.Service{&withIngress},
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.2:8080"},
+			gwVIPs: map[string]string{
+				"203.0.113.10:80": "10.128.1.2:8080",
+				"203.0.113.20:80": "10.128.1.2:8080",
+			},
+		},
+		{
+			name:    "external ip changed and ingress removed",
+			updates: []*kapi.Service{&withIngress, &externalIPChanged},
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.2:8080"},
+			gwVIPs:  map[string]string{"203.0.113.11:80": "10.128.1.2:8080"},
+		},
+	}
+
+	for _, test := range tests {
+		oc, nb, tcpLB, _ := newTestLBController()
+		gw := nb.AddGateway("GR_node1", "192.168.1.10")
+		oc.addService(web)
+		if err := oc.addEndpoints(webEp); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		// the ingress shows up in status updates of the service
+		for _, svc := range test.updates {
+			if err := oc.addService(svc); err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, test.tcpVIPs) {
+			t.Errorf("%s: expected tcp vips %v, got %v", test.name, test.tcpVIPs, vips)
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(gw.LoadBalancers[kapi.ProtocolTCP]); !reflect.DeepEqual(vips, test.gwVIPs) {
+			t.Errorf("%s: expected gateway vips %v, got %v", test.name, test.gwVIPs, vips)
+		}
+	}
+}
+
+func TestSessionAffinity(t *testing.T) {
+	oc, nb, tcpLB, _ := newTestLBController()
+	gw := nb.AddGateway("GR_node1", "192.168.1.10")
+
+	web := newNodePortService("web", "172.30.0.10", kapi.ProtocolTCP, 80, 30080)
+	web.Spec.SessionAffinity = kapi.ServiceAffinityClientIP
+	oc.addService(web)
+	if err := oc.addEndpoints(newEndpoints("web", newSubset([]string{"10.128.1.2", "10.128.2.2"},
+		kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 80}))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the vips go to a load balancer of the service, in the group
+	lbs, _ := nb.ListServiceLoadBalancers()
+	webLB, ok := lbs["default/web"][kapi.ProtocolTCP]
+	if !ok {
+		t.Fatalf("expected a tcp load balancer for default/web, got %v", lbs)
+	}
+	if group := nb.LoadBalancerGroup(); !reflect.DeepEqual(group, []string{webLB}) {
+		t.Errorf("expected the load balancer group to be %v, got %v", []string{webLB}, group)
+	}
+	if options := nb.LoadBalancerOptions(webLB); options["affinity_timeout"] != "10800" {
+		t.Errorf("expected an affinity timeout of 10800, got %v", options)
+	}
+	expected := map[string]string{
+		"172.30.0.10:80":     "10.128.1.2:80,10.128.2.2:80",
+		"192.168.1.10:30080": "10.128.1.2:80,10.128.2.2:80",
+	}
+	if vips, _ := nb.GetLoadBalancerVIPs(webLB); !reflect.DeepEqual(vips, expected) {
+		t.Errorf("expected service vips %v, got %v", expected, vips)
+	}
+	for _, lb := range []string{tcpLB, gw.LoadBalancers[kapi.ProtocolTCP]} {
+		if vips, _ := nb.GetLoadBalancerVIPs(lb); len(vips) != 0 {
+			t.Errorf("expected no vips on the shared load balancer %s, got %v", lb, vips)
+		}
+	}
+
+	// without affinity the vips move back to the shared load balancers
+	noAffinity := newNodePortService("web", "172.30.0.10", kapi.ProtocolTCP, 80, 30080)
+	if err := oc.addService(noAffinity); err != nil {
+		t.Fatal(err)
+	}
+	if lbs, _ := nb.ListServiceLoadBalancers(); len(lbs) != 0 {
+		t.Errorf("expected the service load balancer to be deleted, got %v", lbs)
+	}
+	if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, map[string]string{"172.30.0.10:80": "10.128.1.2:80,10.128.2.2:80"}) {
+		t.Errorf("unexpected cluster vips %v", vips)
+	}
+
+	// and back, until the service is deleted
+	if err := oc.addService(web); err != nil {
+		t.Fatal(err)
+	}
+	if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); len(vips) != 0 {
+		t.Errorf("expected no cluster vips, got %v", vips)
+	}
+
+	// the annotation changes the affinity timeout, an invalid one is ignored
+	for _, test := range []struct {
+		timeout  string
+		expected string
+	}{
+		{"600", "600"},
+		{"forever", "10800"},
+		{"86401", "10800"},
+	} {
+		annotated := newNodePortService("web", "172.30.0.10", kapi.ProtocolTCP, 80, 30080)
+		annotated.Spec.SessionAffinity = kapi.ServiceAffinityClientIP
+		annotated.Annotations = map[string]string{AffinityTimeoutAnnotation: test.timeout}
+		if err := oc.addService(annotated); err != nil {
+			t.Fatal(err)
+		}
+		lbs, _ := nb.ListServiceLoadBalancers()
+		if options := nb.LoadBalancerOptions(lbs["default/web"][kapi.ProtocolTCP]); options["affinity_timeout"] != test.expected {
+			t.Errorf("expected an affinity timeout of %s for %q, got %v", test.expected, test.timeout, options)
+		}
+	}
+
+	if err := oc.deleteService(web); err != nil {
+		t.Fatal(err)
+	}
+	if lbs, _ := nb.ListServiceLoadBalancers(); len(lbs) != 0 {
+		t.Errorf("expected the service load balancer to be deleted, got %v", lbs)
+	}
+	if group := nb.LoadBalancerGroup(); len(group) != 0 {
+		t.Errorf("expected an empty load balancer group, got %v", group)
+	}
+}
+
+// ensureCountingNorthbound counts the load balancers ensured for the services
+type ensureCountingNorthbound struct {
+	*MemoryNorthbound
+	ensured int
+}
+
+func (nb *ensureCountingNorthbound) EnsureServiceLoadBalancer(service string, protocol kapi.Protocol, options map[string]string) (string, error) {
+	nb.ensured++
+	return nb.MemoryNorthbound.EnsureServiceLoadBalancer(service, protocol, options)
+}
+
+// deleteWithoutLoadBalancer deletes a service whose load balancer is already
+// gone, which must not create it again
+func deleteWithoutLoadBalancer(t *testing.T, oc *OvnController, nb *MemoryNorthbound, svc *kapi.Service) {
+	lbs, _ := nb.ListServiceLoadBalancers()
+	key := cacheKey(svc.Namespace, svc.Name)
+	if len(lbs[key]) == 0 {
+		t.Fatalf("expected load balancers for %s, got %v", key, lbs)
+	}
+	for _, lb := range lbs[key] {
+		if err := nb.DeleteLoadBalancer(lb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counting := &ensureCountingNorthbound{MemoryNorthbound: nb}
+	oc.OvnNB = counting
+	defer func() { oc.OvnNB = nb }()
+	if err := oc.deleteService(svc); err != nil {
+		t.Fatal(err)
+	}
+	if counting.ensured != 0 {
+		t.Errorf("expected no load balancer to be ensured for %s, got %d", key, counting.ensured)
+	}
+	if lbs, _ := nb.ListServiceLoadBalancers(); len(lbs[key]) != 0 {
+		t.Errorf("expected no load balancers for %s, got %v", key, lbs[key])
+	}
+}
+
+func TestDeleteServiceWithoutLoadBalancer(t *testing.T) {
+	oc, nb, _, _ := newTestLBController()
+
+	web := newNodePortService("web", "172.30.0.10", kapi.ProtocolTCP, 80, 30080)
+	web.Spec.SessionAffinity = kapi.ServiceAffinityClientIP
+	if err := oc.addService(web); err != nil {
+		t.Fatal(err)
+	}
+	if err := oc.addEndpoints(newEndpoints("web", newSubset([]string{"10.128.1.2"},
+		kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 80}))); err != nil {
+		t.Fatal(err)
+	}
+	deleteWithoutLoadBalancer(t, oc, nb, web)
+}
+
+func TestPerServiceLoadBalancers(t *testing.T) {
+	oc, nb, tcpLB, udpLB := newTestLBController()
+	oc.PerServiceLoadBalancers = true
+
+	dns := newService("dns", "172.30.0.53",
+		newServicePort("dns-tcp", kapi.ProtocolTCP, 53, intstr.FromInt(5353)),
+		newServicePort("dns", kapi.ProtocolUDP, 53, intstr.FromInt(5353)))
+	dnsEp := newEndpoints("dns", newSubset([]string{"10.128.1.3"},
+		kapi.EndpointPort{Name: "dns-tcp", Protocol: kapi.ProtocolTCP, Port: 5353},
+		kapi.EndpointPort{Name: "dns", Protocol: kapi.ProtocolUDP, Port: 5353}))
+	web := newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080)))
+	webEp := newEndpoints("web", newSubset([]string{"10.128.1.2"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 8080}))
+	for _, svc := range []*kapi.Service{dns, web} {
+		if err := oc.addService(svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ep := range []*kapi.Endpoints{dnsEp, webEp} {
+		if err := oc.addEndpoints(ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lbs, _ := nb.ListServiceLoadBalancers()
+	expected := map[string]map[kapi.Protocol]map[string]string{
+		"default/dns": {
+			kapi.ProtocolTCP: {"172.30.0.53:53": "10.128.1.3:5353"},
+			kapi.ProtocolUDP: {"172.30.0.53:53": "10.128.1.3:5353"},
+		},
+		"default/web": {
+			kapi.ProtocolTCP: {"172.30.0.10:80": "10.128.1.2:8080"},
+		},
+	}
+	for key, protocols := range expected {
+		if len(lbs[key]) != len(protocols) {
+			t.Errorf("expected %d load balancers for %s, got %v", len(protocols), key, lbs[key])
+		}
+		for protocol, expectedVIPs := range protocols {
+			lb := lbs[key][protocol]
+			if vips, _ := nb.GetLoadBalancerVIPs(lb); !reflect.DeepEqual(vips, expectedVIPs) {
+				t.Errorf("expected %s %s vips %v, got %v", key, protocol, expectedVIPs, vips)
+			}
+			if options := nb.LoadBalancerOptions(lb); !reflect.DeepEqual(options, map[string]string{"reject": "true"}) {
+				t.Errorf("expected only the reject option on the %s %s load balancer, got %v", key, protocol, options)
+			}
+		}
+	}
+	if group := nb.LoadBalancerGroup(); len(group) != 3 {
+		t.Errorf("expected 3 load balancers in the group, got %v", group)
+	}
+	for _, lb := range []string{tcpLB, udpLB} {
+		if vips, _ := nb.GetLoadBalancerVIPs(lb); len(vips) != 0 {
+			t.Errorf("expected no vips on the cluster load balancer %s, got %v", lb, vips)
+		}
+	}
+
+	// a port removed from the service takes its load balancer with it
+	if err := oc.addService(newService("dns", "172.30.0.53", newServicePort("dns", kapi.ProtocolUDP, 53, intstr.FromInt(5353)))); err != nil {
+		t.Fatal(err)
+	}
+	lbs, _ = nb.ListServiceLoadBalancers()
+	if _, ok := lbs["default/dns"][kapi.ProtocolTCP]; ok || len(lbs["default/dns"]) != 1 {
+		t.Errorf("expected only the udp load balancer of default/dns to be left, got %v", lbs["default/dns"])
+	}
+
+	// a service whose load balancers are already gone is deleted without
+	// creating them again
+	deleteWithoutLoadBalancer(t, oc, nb, web)
+	if lbs, _ := nb.ListServiceLoadBalancers(); len(lbs["default/dns"]) != 1 {
+		t.Errorf("expected the load balancer of default/dns to be left, got %v", lbs)
+	}
+}
+
+func TestServiceTypes(t *testing.T) {
+	selector := map[string]string{"app": "web"}
+	withSelector := func(svc *kapi.Service) *kapi.Service {
+		svc.Spec.Selector = selector
+		return svc
+	}
+	headless := withSelector(newService("web", kapi.ClusterIPNone, newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080))))
+	externalName := newService("web", "", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(80)))
+	externalName.Spec.Type = kapi.ServiceTypeExternalName
+	externalName.Spec.ExternalName = "web.example.com"
+
+	tests := []struct {
+		name    string
+		svc     *kapi.Service
+		ep      *kapi.Endpoints
+		tcpVIPs map[string]string
+	}{
+		{
+			name: "cluster ip service",
+			svc:  withSelector(newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(8080)))),
+			ep: newEndpoints("web", newSubset([]string{"10.128.1.2"},
+				kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 8080})),
+			tcpVIPs: map[string]string{"172.30.0.10:80": "10.128.1.2:8080"},
+		},
+		{
+			name: "headless service",
+			svc:  headless,
+			ep: newEndpoints("web", newSubset([]string{"10.128.1.2"},
+				kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 8080})),
+			tcpVIPs: map[string]string{},
+		},
+		{
+			name: "external name service",
+			svc:  externalName,
+			// endpoints of the same name are ignored
+			ep: newEndpoints("web", newSubset([]string{"10.128.1.2"},
+				kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 80})),
+			tcpVIPs: map[string]string{},
+		},
+		{
+			name: "service without selector and manual endpoints",
+			svc:  newService("web", "172.30.0.10", newServicePort("db", kapi.ProtocolTCP, 5432, intstr.FromInt(5432))),
+			// outside the cluster network
+			ep: newEndpoints("web", newSubset([]string{"192.168.10.5", "192.168.10.6"},
+				kapi.EndpointPort{Name: "db", Protocol: kapi.ProtocolTCP, Port: 5432})),
+			tcpVIPs: map[string]string{"172.30.0.10:5432": "192.168.10.5:5432,192.168.10.6:5432"},
+		},
+	}
+
+	for _, test := range tests {
+		oc, nb, tcpLB, _ := newTestLBController()
+		gw := nb.AddGateway("GR_node1", "192.168.1.10")
+		if err := oc.addService(test.svc); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if err := oc.addEndpoints(test.ep); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, test.tcpVIPs) {
+			t.Errorf("%s: expected tcp vips %v, got %v", test.name, test.tcpVIPs, vips)
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(gw.LoadBalancers[kapi.ProtocolTCP]); len(vips) != 0 {
+			t.Errorf("%s: expected no gateway vips, got %v", test.name, vips)
+		}
+
+		// the reconciler agrees with the handlers
+		oc.ServiceLister = listers.NewServiceLister(newTestIndexer(test.svc))
+		oc.EndpointsLister = listers.NewEndpointsLister(newTestIndexer(test.ep))
+		if err := oc.reconcileVIPs(); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); !reflect.DeepEqual(vips, test.tcpVIPs) {
+			t.Errorf("%s: expected tcp vips %v after reconciling, got %v", test.name, test.tcpVIPs, vips)
+		}
+		if keys := pendingKeys(oc.serviceQueue); len(keys) != 0 {
+			t.Errorf("%s: expected nothing to be queued, got %v", test.name, keys)
+		}
+	}
+
+	// a service that becomes an ExternalName one loses its vips
+	oc, nb, tcpLB, _ := newTestLBController()
+	oc.addService(newService("web", "172.30.0.10", newServicePort("", kapi.ProtocolTCP, 80, intstr.FromInt(80))))
+	oc.addEndpoints(newEndpoints("web", newSubset([]string{"10.128.1.2"}, kapi.EndpointPort{Protocol: kapi.ProtocolTCP, Port: 80})))
+	if err := oc.addService(externalName); err != nil {
+		t.Fatal(err)
+	}
+	if vips, _ := nb.GetLoadBalancerVIPs(tcpLB); len(vips) != 0 {
+		t.Errorf("expected no vips for the ExternalName service, got %v", vips)
+	}
+}
@@ -0,0 +1,475 @@
+package ovsdb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// ErrNotConnected is returned for calls made while the connection to the
+	// server is down, or when it goes down before the reply arrives
+	ErrNotConnected = errors.New("not connected to the ovsdb server")
+	// ErrNotFound is returned when a row is not in the cache
+	ErrNotFound = errors.New("row not found")
+)
+
+// Error is an error returned by the server for a JSON-RPC call
+type Error struct {
+	Method  string
+	Err     string
+	Details string
+}
+
+func (e *Error) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("ovsdb %s failed: %s (%s)", e.Method, e.Err, e.Details)
+	}
+	return fmt.Sprintf("ovsdb %s failed: %s", e.Method, e.Err)
+}
+
+// TransactionError is returned when an operation of a transaction fails, in
+// which case none of the operations are committed
+type TransactionError struct {
+	// Index of the failed operation, equal to the number of operations
+	// when the commit itself failed
+	Index   int
+	Err     string
+	Details string
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("ovsdb transaction failed at operation %d: %s (%s)", e.Index, e.Err, e.Details)
+}
+
+const (
+	// CallTimeout bounds the time to wait for the reply of a call
+	CallTimeout = 30 * time.Second
+
+	maxReconnectInterval = 30 * time.Second
+)
+
+type request struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	ID     interface{}   `json:"id"`
+}
+
+type response struct {
+	Result interface{} `json:"result"`
+	Error  interface{} `json:"error"`
+	ID     interface{} `json:"id"`
+}
+
+// message is any of a request, a notification or a response
+type message struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result json.RawMessage   `json:"result"`
+	Error  interface{}       `json:"error"`
+	ID     interface{}       `json:"id"`
+
+	// err is set when the result of a response failed to be handled
+	err error
+}
+
+// pendingCall is a call waiting for its response
+type pendingCall struct {
+	ch chan *message
+	// handle, when set, handles the result in the read loop, before any
+	// message that follows the response
+	handle func(result json.RawMessage) error
+}
+
+// Client is an OVSDB JSON-RPC client, RFC 7047. It keeps an in-memory cache of
+// the tables it monitors, and reconnects and monitors them again when the
+// connection to the server is lost.
+type Client struct {
+	address   string
+	tlsConfig *tls.Config
+
+	// mutex guards the connection and the call state
+	mutex    sync.Mutex
+	conn     net.Conn
+	encoder  *json.Encoder
+	nextID   uint64
+	pending  map[uint64]*pendingCall
+	monitors map[string][]string
+	closed   bool
+
+	cacheMutex sync.RWMutex
+	cache      map[string]map[string]Row
+}
+
+// Dial connects to the server at address, which is one of "tcp:host:port",
+// "ssl:host:port" or "unix:path". tlsConfig is only used for ssl.
+func Dial(address string, tlsConfig *tls.Config) (*Client, error) {
+	c := &Client{
+		address:   address,
+		tlsConfig: tlsConfig,
+		pending:   make(map[uint64]*pendingCall),
+		monitors:  make(map[string][]string),
+		cache:     make(map[string]map[string]Row),
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewTLSConfig builds the configuration of ssl connections from the client
+// private key, client certificate and CA certificate files
+func NewTLSConfig(privKeyFile, certFile, caCertFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, privKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the client certificate: %v", err)
+	}
+	caCert, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the CA certificate: %v", err)
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificate found in %s", caCertFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+	}, nil
+}
+
+func dial(address string, tlsConfig *tls.Config) (net.Conn, error) {
+	parts := strings.SplitN(address, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid ovsdb address %q", address)
+	}
+	switch parts[0] {
+	case "tcp", "unix":
+		return net.Dial(parts[0], parts[1])
+	case "ssl":
+		if tlsConfig == nil {
+			return nil, fmt.Errorf("no TLS configuration given for %q", address)
+		}
+		return tls.Dial("tcp", parts[1], tlsConfig)
+	}
+	return nil, fmt.Errorf("invalid ovsdb address %q", address)
+}
+
+func (c *Client) connect() error {
+	conn, err := dial(c.address, c.tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.conn = conn
+	c.encoder = json.NewEncoder(conn)
+	monitors := make(map[string][]string, len(c.monitors))
+	for db, tables := range c.monitors {
+		monitors[db] = tables
+	}
+	c.mutex.Unlock()
+
+	go c.readLoop(conn)
+
+	for db, tables := range monitors {
+		if err := c.Monitor(db, tables...); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) readLoop(conn net.Conn) {
+	decoder := json.NewDecoder(conn)
+	for {
+		var msg message
+		if err := decoder.Decode(&msg); err != nil {
+			c.disconnected(conn, err)
+			return
+		}
+		c.handleMessage(&msg)
+	}
+}
+
+func (c *Client) disconnected(conn net.Conn, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn != conn {
+		return
+	}
+	conn.Close()
+	c.conn = nil
+	c.encoder = nil
+	for id, call := range c.pending {
+		close(call.ch)
+		delete(c.pending, id)
+	}
+	if c.closed {
+		return
+	}
+	glog.Errorf("Lost connection to ovsdb server %s: %v", c.address, err)
+	go c.reconnect()
+}
+
+func (c *Client) reconnect() {
+	interval := time.Second
+	for {
+		time.Sleep(interval)
+		c.mutex.Lock()
+		closed := c.closed
+		c.mutex.Unlock()
+		if closed {
+			return
+		}
+		err := c.connect()
+		if err == nil {
+			glog.Infof("Reconnected to ovsdb server %s", c.address)
+			return
+		}
+		glog.V(4).Infof("Error reconnecting to ovsdb server %s: %v", c.address, err)
+		if interval < maxReconnectInterval {
+			interval *= 2
+		}
+	}
+}
+
+func (c *Client) handleMessage(msg *message) {
+	switch msg.Method {
+	case "echo":
+		params := make([]interface{}, 0, len(msg.Params))
+		for _, p := range msg.Params {
+			params = append(params, p)
+		}
+		c.send(response{Result: params, ID: msg.ID})
+		return
+	case "update":
+		if len(msg.Params) != 2 {
+			glog.Errorf("Invalid update notification from ovsdb server %s", c.address)
+			return
+		}
+		var updates TableUpdates
+		if err := json.Unmarshal(msg.Params[1], &updates); err != nil {
+			glog.Errorf("Invalid update notification from ovsdb server %s: %v", c.address, err)
+			return
+		}
+		c.applyUpdates(updates)
+		return
+	case "":
+	default:
+		glog.V(4).Infof("Ignoring %s request from ovsdb server %s", msg.Method, c.address)
+		return
+	}
+
+	id, ok := msg.ID.(float64)
+	if !ok {
+		return
+	}
+	c.mutex.Lock()
+	call, ok := c.pending[uint64(id)]
+	delete(c.pending, uint64(id))
+	c.mutex.Unlock()
+	if !ok {
+		return
+	}
+	if call.handle != nil && msg.Error == nil {
+		msg.err = call.handle(msg.Result)
+	}
+	call.ch <- msg
+}
+
+func (c *Client) send(v interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	return c.encoder.Encode(v)
+}
+
+func (c *Client) call(method string, params ...interface{}) (json.RawMessage, error) {
+	return c.callWithHandler(method, nil, params...)
+}
+
+// callWithHandler makes a call whose result is handled by handle in the read
+// loop, so that the notifications sent after the response are handled after
+// it
+func (c *Client) callWithHandler(method string, handle func(json.RawMessage) error, params ...interface{}) (json.RawMessage, error) {
+	c.mutex.Lock()
+	if c.conn == nil {
+		c.mutex.Unlock()
+		return nil, ErrNotConnected
+	}
+	id := c.nextID
+	c.nextID++
+	ch := make(chan *message, 1)
+	c.pending[id] = &pendingCall{ch: ch, handle: handle}
+	err := c.encoder.Encode(request{Method: method, Params: params, ID: id})
+	c.mutex.Unlock()
+	if err != nil {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return nil, err
+	}
+
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return nil, ErrNotConnected
+		}
+		if msg.Error != nil {
+			return nil, newError(method, msg.Error)
+		}
+		return msg.Result, msg.err
+	case <-time.After(CallTimeout):
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("timed out waiting for the reply to ovsdb %s", method)
+	}
+}
+
+func newError(method string, rpcErr interface{}) *Error {
+	e := &Error{Method: method}
+	switch v := rpcErr.(type) {
+	case string:
+		e.Err = v
+	case map[string]interface{}:
+		e.Err, _ = v["error"].(string)
+		e.Details, _ = v["details"].(string)
+	default:
+		e.Err = fmt.Sprint(v)
+	}
+	return e
+}
+
+// Transact runs the operations on db as one transaction
+func (c *Client) Transact(db string, ops ...Operation) ([]OperationResult, error) {
+	params := make([]interface{}, 0, len(ops)+1)
+	params = append(params, db)
+	for _, op := range ops {
+		params = append(params, op)
+	}
+	raw, err := c.call("transact", params...)
+	if err != nil {
+		return nil, err
+	}
+	var results []OperationResult
+	if err := json.Unmarshal(raw, &results); err != nil {
+		return nil, fmt.Errorf("invalid transact reply: %v", err)
+	}
+	for i, r := range results {
+		if r.Error != "" {
+			return results, &TransactionError{Index: i, Err: r.Error, Details: r.Details}
+		}
+	}
+	if len(results) < len(ops) {
+		return results, fmt.Errorf("invalid transact reply: %d results for %d operations", len(results), len(ops))
+	}
+	return results, nil
+}
+
+// Select returns the rows of the table of db that match all the conditions,
+// read from the server rather than from the cache
+func (c *Client) Select(db, table string, where ...Condition) ([]Row, error) {
+	results, err := c.Transact(db, Operation{Op: "select", Table: table, Where: where})
+	if err != nil {
+		return nil, err
+	}
+	return results[0].Rows, nil
+}
+
+// Monitored tells if the rows of the table are in the cache
+func (c *Client) Monitored(table string) bool {
+	c.cacheMutex.RLock()
+	defer c.cacheMutex.RUnlock()
+	_, ok := c.cache[table]
+	return ok
+}
+
+// Monitor fills the cache with all the columns of the given tables of db and
+// keeps them up to date. The tables are replaced by the initial contents in
+// the read loop, before the updates that follow them.
+func (c *Client) Monitor(db string, tables ...string) error {
+	requests := make(map[string]interface{}, len(tables))
+	for _, table := range tables {
+		requests[table] = map[string]interface{}{}
+	}
+	_, err := c.callWithHandler("monitor", func(raw json.RawMessage) error {
+		var updates TableUpdates
+		if err := json.Unmarshal(raw, &updates); err != nil {
+			return fmt.Errorf("invalid monitor reply: %v", err)
+		}
+		c.cacheMutex.Lock()
+		defer c.cacheMutex.Unlock()
+		for _, table := range tables {
+			c.cache[table] = make(map[string]Row)
+		}
+		c.applyUpdatesLocked(updates)
+		return nil
+	}, db, db, requests)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.monitors[db] = tables
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *Client) applyUpdates(updates TableUpdates) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	c.applyUpdatesLocked(updates)
+}
+
+func (c *Client) applyUpdatesLocked(updates TableUpdates) {
+	for table, rows := range updates {
+		if c.cache[table] == nil {
+			c.cache[table] = make(map[string]Row)
+		}
+		for uuid, update := range rows {
+			if update.New == nil {
+				delete(c.cache[table], uuid)
+				continue
+			}
+			update.New["_uuid"] = UUID{GoUUID: uuid}
+			c.cache[table][uuid] = update.New
+		}
+	}
+}
+
+// Rows returns the cached rows of a monitored table keyed by uuid. The rows
+// must not be modified.
+func (c *Client) Rows(table string) map[string]Row {
+	c.cacheMutex.RLock()
+	defer c.cacheMutex.RUnlock()
+	rows := make(map[string]Row, len(c.cache[table]))
+	for uuid, row := range c.cache[table] {
+		rows[uuid] = row
+	}
+	return rows
+}
+
+// Close closes the connection to the server for good
+func (c *Client) Close() {
+	c.mutex.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,307 @@
+package ovsdb_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb/fake"
+)
+
+func newTestClient(t *testing.T) (*fake.Server, *ovsdb.Client) {
+	server := fake.NewServer(ovsdb.NBDatabase)
+	address, err := server.Start()
+	if err != nil {
+		t.Fatalf("failed to start the fake server: %v", err)
+	}
+	client, err := ovsdb.Dial(address, nil)
+	if err != nil {
+		server.Close()
+		t.Fatalf("failed to connect to the fake server: %v", err)
+	}
+	if err := client.Monitor(ovsdb.NBDatabase, ovsdb.NBTables...); err != nil {
+		client.Close()
+		server.Close()
+		t.Fatalf("failed to monitor: %v", err)
+	}
+	return server, client
+}
+
+func TestValueEncoding(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		wire  string
+	}{
+		{"string", "foo", `"foo"`},
+		{"uuid", ovsdb.UUID{GoUUID: "7a0c4ad1-0ffc-4e3b-a1ce-98c6b1f2e0ab"}, `["uuid","7a0c4ad1-0ffc-4e3b-a1ce-98c6b1f2e0ab"]`},
+		{"named uuid", ovsdb.UUID{GoUUID: "lsp"}, `["named-uuid","lsp"]`},
+		{"set", ovsdb.NewOvsSet([]string{"a", "b"}), `["set",["a","b"]]`},
+		{"empty set", ovsdb.NewOvsSet([]string{}), `["set",[]]`},
+		{"map", ovsdb.NewOvsMap(map[string]string{"b": "2", "a": "1"}), `["map",[["a","1"],["b","2"]]]`},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(test.value)
+		if err != nil {
+			t.Errorf("%s: marshal failed: %v", test.name, err)
+			continue
+		}
+		if string(data) != test.wire {
+			t.Errorf("%s: expected %s, got %s", test.name, test.wire, string(data))
+		}
+		var raw interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			t.Errorf("%s: unmarshal failed: %v", test.name, err)
+			continue
+		}
+		decoded, err := ovsdb.DecodeValue(raw)
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", test.name, err)
+			continue
+		}
+		again, _ := json.Marshal(decoded)
+		if string(again) != test.wire {
+			t.Errorf("%s: round trip gave %s", test.name, string(again))
+		}
+	}
+}
+
+func TestTransactUpdatesCache(t *testing.T) {
+	server, client := newTestClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	_, err := client.Transact(ovsdb.NBDatabase,
+		ovsdb.Operation{
+			Op:       "insert",
+			Table:    ovsdb.LogicalSwitchPortTable,
+			Row:      ovsdb.Row{"name": "ns_pod", "addresses": ovsdb.NewOvsSet("dynamic")},
+			UUIDName: "lsp",
+		},
+		ovsdb.Operation{
+			Op:    "insert",
+			Table: ovsdb.LogicalSwitchTable,
+			Row: ovsdb.Row{
+				"name":         "node1",
+				"ports":        ovsdb.NewOvsSet(ovsdb.UUID{GoUUID: "lsp"}),
+				"external_ids": ovsdb.NewOvsMap(map[string]string{"gateway_ip": "10.0.0.1/24"}),
+			},
+		})
+	if err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+
+	// the updates are applied before the transaction returns
+	ls, err := client.LogicalSwitchByName("node1")
+	if err != nil {
+		t.Fatalf("switch not in the cache: %v", err)
+	}
+	lsp, err := client.LogicalSwitchPortByName("ns_pod")
+	if err != nil {
+		t.Fatalf("port not in the cache: %v", err)
+	}
+	if !reflect.DeepEqual(ls.Ports, []string{lsp.UUID}) {
+		t.Errorf("expected switch ports [%s], got %v", lsp.UUID, ls.Ports)
+	}
+	if ls.ExternalIDs["gateway_ip"] != "10.0.0.1/24" {
+		t.Errorf("unexpected switch external ids %v", ls.ExternalIDs)
+	}
+
+	_, err = client.Transact(ovsdb.NBDatabase,
+		ovsdb.Operation{
+			Op:    "mutate",
+			Table: ovsdb.LogicalSwitchTable,
+			Where: []ovsdb.Condition{ovsdb.NewCondition("_uuid", "==", ovsdb.UUID{GoUUID: ls.UUID})},
+			Mutations: []ovsdb.Mutation{
+				ovsdb.NewMutation("ports", "delete", ovsdb.NewOvsSet(ovsdb.UUID{GoUUID: lsp.UUID})),
+			},
+		},
+		ovsdb.Operation{
+			Op:    "delete",
+			Table: ovsdb.LogicalSwitchPortTable,
+			Where: []ovsdb.Condition{ovsdb.NewCondition("name", "==", "ns_pod")},
+		})
+	if err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+	if _, err := client.LogicalSwitchPortByName("ns_pod"); err != ovsdb.ErrNotFound {
+		t.Errorf("expected the port to be deleted, got %v", err)
+	}
+	ls, _ = client.LogicalSwitchByName("node1")
+	if len(ls.Ports) != 0 {
+		t.Errorf("expected no switch ports, got %v", ls.Ports)
+	}
+}
+
+func TestMapMutations(t *testing.T) {
+	server, client := newTestClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	results, err := client.Transact(ovsdb.NBDatabase, ovsdb.Operation{
+		Op:    "insert",
+		Table: ovsdb.LoadBalancerTable,
+		Row:   ovsdb.Row{"vips": ovsdb.NewOvsMap(map[string]string{"172.30.0.1:80": "10.0.0.2:8080"})},
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+	lb := results[0].UUID
+
+	tests := []struct {
+		name      string
+		mutations []ovsdb.Mutation
+		vips      map[string]string
+	}{
+		{
+			name: "insert does not overwrite",
+			mutations: []ovsdb.Mutation{
+				ovsdb.NewMutation("vips", "insert", ovsdb.NewOvsMap(map[string]string{"172.30.0.1:80": "10.0.0.3:8080"})),
+			},
+			vips: map[string]string{"172.30.0.1:80": "10.0.0.2:8080"},
+		},
+		{
+			name: "delete then insert replaces",
+			mutations: []ovsdb.Mutation{
+				ovsdb.NewMutation("vips", "delete", ovsdb.NewOvsSet("172.30.0.1:80")),
+				ovsdb.NewMutation("vips", "insert", ovsdb.NewOvsMap(map[string]string{"172.30.0.1:80": "10.0.0.3:8080"})),
+			},
+			vips: map[string]string{"172.30.0.1:80": "10.0.0.3:8080"},
+		},
+		{
+			name: "delete by key",
+			mutations: []ovsdb.Mutation{
+				ovsdb.NewMutation("vips", "delete", ovsdb.NewOvsSet("172.30.0.1:80")),
+			},
+			vips: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		_, err := client.Transact(ovsdb.NBDatabase, ovsdb.Operation{
+			Op:        "mutate",
+			Table:     ovsdb.LoadBalancerTable,
+			Where:     []ovsdb.Condition{ovsdb.NewCondition("_uuid", "==", lb)},
+			Mutations: test.mutations,
+		})
+		if err != nil {
+			t.Errorf("%s: transaction failed: %v", test.name, err)
+			continue
+		}
+		lbs := client.LoadBalancers()
+		if len(lbs) != 1 || !reflect.DeepEqual(lbs[0].Vips, test.vips) {
+			t.Errorf("%s: expected vips %v, got %v", test.name, test.vips, lbs)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server, client := newTestClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	_, err := client.Transact(ovsdb.NBDatabase,
+		ovsdb.Operation{Op: "insert", Table: ovsdb.LogicalSwitchTable, Row: ovsdb.Row{"name": "node1"}},
+		ovsdb.Operation{Op: "frobnicate", Table: ovsdb.LogicalSwitchTable})
+	if txnErr, ok := err.(*ovsdb.TransactionError); !ok || txnErr.Index != 1 {
+		t.Errorf("expected a transaction error on operation 1, got %v", err)
+	}
+	if len(client.LogicalSwitches()) != 0 {
+		t.Errorf("failed transaction was committed")
+	}
+
+	_, err = client.Transact("Open_vSwitch", ovsdb.Operation{Op: "comment", Comment: "hello"})
+	if _, ok := err.(*ovsdb.Error); !ok {
+		t.Errorf("expected an rpc error for an unknown database, got %v", err)
+	}
+
+	server.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err = client.Transact(ovsdb.NBDatabase, ovsdb.Operation{Op: "comment", Comment: "hello"})
+		if err == ovsdb.ErrNotConnected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected ErrNotConnected after the server went away, got %v", err)
+}
+
+func TestExternalUpdates(t *testing.T) {
+	server, client := newTestClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	uuid := server.Insert(ovsdb.LogicalSwitchPortTable, ovsdb.Row{"name": "ns_pod"})
+	err := server.Update(ovsdb.LogicalSwitchPortTable, uuid, ovsdb.Row{"dynamic_addresses": "0a:00:00:00:00:02 10.0.0.2"})
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		lsp, err := client.LogicalSwitchPortByName("ns_pod")
+		if err == nil && lsp.DynamicAddresses == "0a:00:00:00:00:02 10.0.0.2" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("update from another writer never reached the cache")
+}
+
+func TestUpdatesAfterMonitor(t *testing.T) {
+	server, client := newTestClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	uuid := server.Insert(ovsdb.LogicalSwitchPortTable, ovsdb.Row{"name": "ns_pod"})
+	// the update sent right after the initial contents must not be lost to
+	// them, whichever of the read loop and the caller runs first
+	for i := 0; i < 20; i++ {
+		addresses := fmt.Sprintf("0a:00:00:00:00:%02x 10.0.0.%d", i, i)
+		server.UpdateAfterMonitor(ovsdb.LogicalSwitchPortTable, uuid, ovsdb.Row{"dynamic_addresses": addresses})
+		if err := client.Monitor(ovsdb.NBDatabase, ovsdb.NBTables...); err != nil {
+			t.Fatalf("monitor failed: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			lsp, err := client.LogicalSwitchPortByName("ns_pod")
+			if err == nil && lsp.DynamicAddresses == addresses {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the update after monitor %d never reached the cache, got %+v", i, lsp)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestLoadBalancerGroupWithoutMonitor(t *testing.T) {
+	server, client := newTestClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	if client.Monitored(ovsdb.LoadBalancerGroupTable) {
+		t.Fatalf("expected the load balancer group not to be monitored")
+	}
+	if _, err := client.LoadBalancerGroupByName("group"); err != ovsdb.ErrNotFound {
+		t.Errorf("expected no load balancer group, got %v", err)
+	}
+	uuid := server.Insert(ovsdb.LoadBalancerGroupTable, ovsdb.Row{"name": "group"})
+	// the group is read from the server, not from the cache
+	group, err := client.LoadBalancerGroupByName("group")
+	if err != nil {
+		t.Fatalf("expected the load balancer group, got %v", err)
+	}
+	if group.UUID != uuid || group.Name != "group" {
+		t.Errorf("expected group %s, got %+v", uuid, group)
+	}
+
+	rows, err := client.Select(ovsdb.NBDatabase, ovsdb.LoadBalancerGroupTable, ovsdb.NewCondition("name", "==", "other"))
+	if err != nil || len(rows) != 0 {
+		t.Errorf("expected no rows, got %v (%v)", rows, err)
+	}
+}
@@ -0,0 +1,781 @@
+package fake
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/rajatchopra/ovn-kube/pkg/ovsdb"
+)
+
+// Server is an in-process OVSDB server holding a single database in memory.
+// It implements echo, list_dbs, transact and monitor well enough to exercise
+// clients of the ovsdb package. There is no schema: tables are created on
+// first insert and neither column types, referential integrity nor garbage
+// collection are enforced.
+type Server struct {
+	db string
+
+	mutex    sync.Mutex
+	tables   map[string]map[string]ovsdb.Row
+	listener net.Listener
+	conns    map[*serverConn]bool
+	// afterMonitor are the updates made right after the reply to the next
+	// monitor request
+	afterMonitor []func()
+}
+
+type serverConn struct {
+	conn     net.Conn
+	mutex    sync.Mutex
+	encoder  *json.Encoder
+	monitors map[string][]string
+}
+
+type message struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     interface{}       `json:"id"`
+}
+
+type response struct {
+	Result interface{} `json:"result"`
+	Error  interface{} `json:"error"`
+	ID     interface{} `json:"id"`
+}
+
+type notification struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	ID     interface{}   `json:"id"`
+}
+
+type rpcError struct {
+	Error   string `json:"error"`
+	Details string `json:"details,omitempty"`
+}
+
+func NewServer(db string) *Server {
+	return &Server{
+		db:     db,
+		tables: make(map[string]map[string]ovsdb.Row),
+		conns:  make(map[*serverConn]bool),
+	}
+}
+
+// Start listens on a local tcp port and returns the address to dial
+func (s *Server) Start() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	s.listener = l
+	s.mutex.Unlock()
+	go s.serve(l)
+	return "tcp:" + l.Addr().String(), nil
+}
+
+// Address returns the address to dial, once started
+func (s *Server) Address() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return "tcp:" + s.listener.Addr().String()
+}
+
+// Close stops listening and drops every client connection
+func (s *Server) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for sc := range s.conns {
+		sc.conn.Close()
+	}
+}
+
+func (s *Server) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		sc := &serverConn{
+			conn:     conn,
+			encoder:  json.NewEncoder(conn),
+			monitors: make(map[string][]string),
+		}
+		s.mutex.Lock()
+		s.conns[sc] = true
+		s.mutex.Unlock()
+		go s.handleConn(sc)
+	}
+}
+
+func (s *Server) handleConn(sc *serverConn) {
+	decoder := json.NewDecoder(sc.conn)
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, sc)
+		s.mutex.Unlock()
+		sc.conn.Close()
+	}()
+	for {
+		var msg message
+		if err := decoder.Decode(&msg); err != nil {
+			return
+		}
+		if msg.ID == nil {
+			continue
+		}
+		s.handleRequest(sc, &msg)
+	}
+}
+
+func (sc *serverConn) send(v interface{}) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.encoder.Encode(v)
+}
+
+func (s *Server) handleRequest(sc *serverConn, msg *message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch msg.Method {
+	case "echo":
+		sc.send(response{Result: msg.Params, ID: msg.ID})
+	case "list_dbs":
+		sc.send(response{Result: []string{s.db}, ID: msg.ID})
+	case "transact":
+		results, err := s.transact(msg.Params)
+		if err != nil {
+			sc.send(response{Error: err, ID: msg.ID})
+			return
+		}
+		sc.send(response{Result: results, ID: msg.ID})
+	case "monitor":
+		updates, err := s.monitor(sc, msg.Params)
+		if err != nil {
+			sc.send(response{Error: err, ID: msg.ID})
+			return
+		}
+		sc.send(response{Result: updates, ID: msg.ID})
+		for _, update := range s.afterMonitor {
+			update()
+		}
+		s.afterMonitor = nil
+	default:
+		sc.send(response{Error: rpcError{Error: "unknown method", Details: msg.Method}, ID: msg.ID})
+	}
+}
+
+func (s *Server) checkDB(raw json.RawMessage) *rpcError {
+	var db string
+	if err := json.Unmarshal(raw, &db); err != nil || db != s.db {
+		return &rpcError{Error: "unknown database", Details: string(raw)}
+	}
+	return nil
+}
+
+func (s *Server) monitor(sc *serverConn, params []json.RawMessage) (ovsdb.TableUpdates, *rpcError) {
+	if len(params) != 3 {
+		return nil, &rpcError{Error: "syntax error", Details: "monitor takes 3 parameters"}
+	}
+	if err := s.checkDB(params[0]); err != nil {
+		return nil, err
+	}
+	var id string
+	var requests map[string]json.RawMessage
+	if err := json.Unmarshal(params[1], &id); err != nil {
+		return nil, &rpcError{Error: "syntax error", Details: "monitor id must be a string"}
+	}
+	if err := json.Unmarshal(params[2], &requests); err != nil {
+		return nil, &rpcError{Error: "syntax error", Details: err.Error()}
+	}
+	tables := make([]string, 0, len(requests))
+	updates := make(ovsdb.TableUpdates)
+	for table := range requests {
+		tables = append(tables, table)
+		updates[table] = make(map[string]ovsdb.RowUpdate)
+		for uuid, row := range s.tables[table] {
+			updates[table][uuid] = ovsdb.RowUpdate{New: row}
+		}
+	}
+	sc.monitors[id] = tables
+	return updates, nil
+}
+
+func (s *Server) transact(params []json.RawMessage) ([]interface{}, *rpcError) {
+	if len(params) < 1 {
+		return nil, &rpcError{Error: "syntax error", Details: "transact takes a database"}
+	}
+	if err := s.checkDB(params[0]); err != nil {
+		return nil, err
+	}
+
+	t := &txn{
+		tables: make(map[string]map[string]ovsdb.Row, len(s.tables)),
+		named:  make(map[string]string),
+	}
+	for table, rows := range s.tables {
+		t.tables[table] = make(map[string]ovsdb.Row, len(rows))
+		for uuid, row := range rows {
+			t.tables[table][uuid] = row
+		}
+	}
+
+	results := make([]interface{}, len(params)-1)
+	for i, raw := range params[1:] {
+		var op ovsdb.Operation
+		if err := json.Unmarshal(raw, &op); err != nil {
+			results[i] = ovsdb.OperationResult{Error: "syntax error", Details: err.Error()}
+			return results, nil
+		}
+		result, err := t.apply(&op)
+		if err != nil {
+			results[i] = ovsdb.OperationResult{Error: err.Error, Details: err.Details}
+			return results, nil
+		}
+		results[i] = result
+	}
+
+	old := s.tables
+	s.tables = t.tables
+	s.notify(old)
+	return results, nil
+}
+
+// notify sends the changes from old to the current tables to the monitors
+func (s *Server) notify(old map[string]map[string]ovsdb.Row) {
+	for sc := range s.conns {
+		for id, tables := range sc.monitors {
+			updates := make(ovsdb.TableUpdates)
+			for _, table := range tables {
+				rows := diffRows(old[table], s.tables[table])
+				if len(rows) > 0 {
+					updates[table] = rows
+				}
+			}
+			if len(updates) > 0 {
+				sc.send(notification{Method: "update", Params: []interface{}{id, updates}})
+			}
+		}
+	}
+}
+
+func diffRows(old, new map[string]ovsdb.Row) map[string]ovsdb.RowUpdate {
+	updates := make(map[string]ovsdb.RowUpdate)
+	for uuid, row := range old {
+		newRow, ok := new[uuid]
+		if !ok {
+			updates[uuid] = ovsdb.RowUpdate{Old: row}
+			continue
+		}
+		if reflect.DeepEqual(row, newRow) {
+			continue
+		}
+		changed := make(ovsdb.Row)
+		for column, value := range row {
+			if !valuesEqual(value, newRow[column]) {
+				changed[column] = value
+			}
+		}
+		updates[uuid] = ovsdb.RowUpdate{Old: changed, New: newRow}
+	}
+	for uuid, row := range new {
+		if _, ok := old[uuid]; !ok {
+			updates[uuid] = ovsdb.RowUpdate{New: row}
+		}
+	}
+	return updates
+}
+
+// Rows returns a copy of the rows of a table, with their _uuid column set
+func (s *Server) Rows(table string) []ovsdb.Row {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows := make([]ovsdb.Row, 0, len(s.tables[table]))
+	for uuid, row := range s.tables[table] {
+		rows = append(rows, withUUID(row, uuid))
+	}
+	return rows
+}
+
+// Insert adds a row behind the back of the clients, the way another client
+// or ovn-northd would, and returns its uuid
+func (s *Server) Insert(table string, row ovsdb.Row) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old := s.snapshot()
+	uuid := newUUID()
+	if s.tables[table] == nil {
+		s.tables[table] = make(map[string]ovsdb.Row)
+	}
+	s.tables[table][uuid] = copyRow(row)
+	s.notify(old)
+	return uuid
+}
+
+// Update sets columns of a row behind the back of the clients
+func (s *Server) Update(table, uuid string, columns ovsdb.Row) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.update(table, uuid, columns)
+}
+
+// UpdateAfterMonitor sets columns of a row right after the reply to the next
+// monitor request is sent, before any other request is handled
+func (s *Server) UpdateAfterMonitor(table, uuid string, columns ovsdb.Row) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.afterMonitor = append(s.afterMonitor, func() {
+		s.update(table, uuid, columns)
+	})
+}
+
+func (s *Server) update(table, uuid string, columns ovsdb.Row) error {
+	row, ok := s.tables[table][uuid]
+	if !ok {
+		return fmt.Errorf("no row %s in table %s", uuid, table)
+	}
+	old := s.snapshot()
+	row = copyRow(row)
+	for column, value := range columns {
+		row[column] = value
+	}
+	s.tables[table][uuid] = row
+	s.notify(old)
+	return nil
+}
+
+func (s *Server) snapshot() map[string]map[string]ovsdb.Row {
+	old := make(map[string]map[string]ovsdb.Row, len(s.tables))
+	for table, rows := range s.tables {
+		old[table] = make(map[string]ovsdb.Row, len(rows))
+		for uuid, row := range rows {
+			old[table][uuid] = row
+		}
+	}
+	return old
+}
+
+type txn struct {
+	tables map[string]map[string]ovsdb.Row
+	// named maps the uuid-names of the rows inserted by the transaction
+	named map[string]string
+}
+
+func (t *txn) apply(op *ovsdb.Operation) (ovsdb.OperationResult, *rpcError) {
+	switch op.Op {
+	case "comment":
+		return ovsdb.OperationResult{}, nil
+	case "insert":
+		uuid := newUUID()
+		if op.UUIDName != "" {
+			t.named[op.UUIDName] = uuid
+		}
+		row := make(ovsdb.Row, len(op.Row))
+		for column, value := range op.Row {
+			row[column] = t.resolve(value)
+		}
+		if t.tables[op.Table] == nil {
+			t.tables[op.Table] = make(map[string]ovsdb.Row)
+		}
+		t.tables[op.Table][uuid] = row
+		return ovsdb.OperationResult{UUID: ovsdb.UUID{GoUUID: uuid}}, nil
+	case "select":
+		uuids, err := t.where(op)
+		if err != nil {
+			return ovsdb.OperationResult{}, err
+		}
+		rows := make([]ovsdb.Row, 0, len(uuids))
+		for _, uuid := range uuids {
+			row := withUUID(t.tables[op.Table][uuid], uuid)
+			if op.Columns != nil {
+				selected := make(ovsdb.Row, len(op.Columns))
+				for _, column := range op.Columns {
+					selected[column] = row[column]
+				}
+				row = selected
+			}
+			rows = append(rows, row)
+		}
+		return ovsdb.OperationResult{Rows: rows}, nil
+	case "update":
+		uuids, err := t.where(op)
+		if err != nil {
+			return ovsdb.OperationResult{}, err
+		}
+		for _, uuid := range uuids {
+			row := copyRow(t.tables[op.Table][uuid])
+			for column, value := range op.Row {
+				row[column] = t.resolve(value)
+			}
+			t.tables[op.Table][uuid] = row
+		}
+		return ovsdb.OperationResult{Count: len(uuids)}, nil
+	case "mutate":
+		uuids, err := t.where(op)
+		if err != nil {
+			return ovsdb.OperationResult{}, err
+		}
+		for _, uuid := range uuids {
+			row := copyRow(t.tables[op.Table][uuid])
+			for _, m := range op.Mutations {
+				column, _ := m[0].(string)
+				mutator, _ := m[1].(string)
+				value, err := mutate(row[column], mutator, t.resolve(m[2]))
+				if err != nil {
+					return ovsdb.OperationResult{}, err
+				}
+				row[column] = value
+			}
+			t.tables[op.Table][uuid] = row
+		}
+		return ovsdb.OperationResult{Count: len(uuids)}, nil
+	case "delete":
+		uuids, err := t.where(op)
+		if err != nil {
+			return ovsdb.OperationResult{}, err
+		}
+		for _, uuid := range uuids {
+			delete(t.tables[op.Table], uuid)
+		}
+		return ovsdb.OperationResult{Count: len(uuids)}, nil
+	case "wait":
+		uuids, err := t.where(op)
+		if err != nil {
+			return ovsdb.OperationResult{}, err
+		}
+		rows := make([]ovsdb.Row, 0, len(uuids))
+		for _, uuid := range uuids {
+			rows = append(rows, t.tables[op.Table][uuid])
+		}
+		// the wait has no timeout, it fails at once when the condition
+		// does not hold
+		if rowsMatch(rows, op.Rows, op.Columns) != (op.Until == "==") {
+			return ovsdb.OperationResult{}, &rpcError{Error: "timed out"}
+		}
+		return ovsdb.OperationResult{}, nil
+	}
+	return ovsdb.OperationResult{}, &rpcError{Error: "unknown operation", Details: op.Op}
+}
+
+// where returns the uuids of the rows of the operation table matching all of
+// its conditions, in a stable order
+func (t *txn) where(op *ovsdb.Operation) ([]string, *rpcError) {
+	uuids := make([]string, 0)
+	for uuid, row := range t.tables[op.Table] {
+		matched := true
+		for _, c := range op.Where {
+			column, _ := c[0].(string)
+			function, _ := c[1].(string)
+			value := t.resolve(c[2])
+			var actual interface{} = row[column]
+			if column == "_uuid" {
+				actual = ovsdb.UUID{GoUUID: uuid}
+			}
+			ok, err := compare(actual, function, value)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			uuids = append(uuids, uuid)
+		}
+	}
+	sort.Strings(uuids)
+	return uuids, nil
+}
+
+// resolve replaces the named-uuids inserted earlier in the transaction
+func (t *txn) resolve(value interface{}) interface{} {
+	switch v := value.(type) {
+	case ovsdb.UUID:
+		if uuid, ok := t.named[v.GoUUID]; ok {
+			return ovsdb.UUID{GoUUID: uuid}
+		}
+	case ovsdb.OvsSet:
+		set := ovsdb.OvsSet{GoSet: make([]interface{}, 0, len(v.GoSet))}
+		for _, e := range v.GoSet {
+			set.GoSet = append(set.GoSet, t.resolve(e))
+		}
+		return set
+	case ovsdb.OvsMap:
+		m := ovsdb.OvsMap{GoMap: make(map[interface{}]interface{}, len(v.GoMap))}
+		for k, val := range v.GoMap {
+			m.GoMap[t.resolve(k)] = t.resolve(val)
+		}
+		return m
+	}
+	return value
+}
+
+func compare(actual interface{}, function string, value interface{}) (bool, *rpcError) {
+	switch function {
+	case "==":
+		return valuesEqual(actual, value), nil
+	case "!=":
+		return !valuesEqual(actual, value), nil
+	case "includes":
+		return includes(actual, value), nil
+	case "excludes":
+		return excludes(actual, value), nil
+	case "<", "<=", ">", ">=":
+		a, ok1 := actual.(float64)
+		b, ok2 := value.(float64)
+		if !ok1 || !ok2 {
+			return false, &rpcError{Error: "syntax error", Details: "ordering on a non number"}
+		}
+		switch function {
+		case "<":
+			return a < b, nil
+		case "<=":
+			return a <= b, nil
+		case ">":
+			return a > b, nil
+		}
+		return a >= b, nil
+	}
+	return false, &rpcError{Error: "unknown function", Details: function}
+}
+
+// rowsMatch tells if the rows have the columns of the expected rows, in any
+// order
+func rowsMatch(rows, expected []ovsdb.Row, columns []string) bool {
+	if len(rows) != len(expected) {
+		return false
+	}
+	matched := make([]bool, len(rows))
+	for _, e := range expected {
+		found := false
+		for i, row := range rows {
+			if matched[i] {
+				continue
+			}
+			equal := true
+			for _, column := range columns {
+				if !valuesEqual(row[column], e[column]) {
+					equal = false
+					break
+				}
+			}
+			if equal {
+				matched[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func atomKey(atom interface{}) string {
+	data, _ := json.Marshal(atom)
+	return string(data)
+}
+
+// setElems returns the elements of a set, a bare atom being a set of one
+func setElems(v interface{}) []interface{} {
+	switch s := v.(type) {
+	case nil:
+		return nil
+	case ovsdb.OvsSet:
+		return s.GoSet
+	}
+	return []interface{}{v}
+}
+
+func valuesEqual(a, b interface{}) bool {
+	am, aIsMap := a.(ovsdb.OvsMap)
+	bm, bIsMap := b.(ovsdb.OvsMap)
+	if aIsMap || bIsMap {
+		return len(am.GoMap) == len(bm.GoMap) && includes(a, b)
+	}
+	ae, be := setElems(a), setElems(b)
+	if len(ae) != len(be) {
+		return false
+	}
+	return includes(a, b)
+}
+
+func includes(actual, value interface{}) bool {
+	if vm, ok := value.(ovsdb.OvsMap); ok {
+		am, _ := actual.(ovsdb.OvsMap)
+		for k, v := range vm.GoMap {
+			if !mapHas(am, k, v) {
+				return false
+			}
+		}
+		return true
+	}
+	have := make(map[string]bool)
+	for _, e := range setElems(actual) {
+		have[atomKey(e)] = true
+	}
+	for _, e := range setElems(value) {
+		if !have[atomKey(e)] {
+			return false
+		}
+	}
+	return true
+}
+
+func excludes(actual, value interface{}) bool {
+	if vm, ok := value.(ovsdb.OvsMap); ok {
+		am, _ := actual.(ovsdb.OvsMap)
+		for k, v := range vm.GoMap {
+			if mapHas(am, k, v) {
+				return false
+			}
+		}
+		return true
+	}
+	have := make(map[string]bool)
+	for _, e := range setElems(actual) {
+		have[atomKey(e)] = true
+	}
+	for _, e := range setElems(value) {
+		if have[atomKey(e)] {
+			return false
+		}
+	}
+	return true
+}
+
+func mapHas(m ovsdb.OvsMap, key, value interface{}) bool {
+	for k, v := range m.GoMap {
+		if atomKey(k) == atomKey(key) {
+			return atomKey(v) == atomKey(value)
+		}
+	}
+	return false
+}
+
+func mutate(current interface{}, mutator string, value interface{}) (interface{}, *rpcError) {
+	switch mutator {
+	case "insert", "delete":
+		if vm, ok := value.(ovsdb.OvsMap); ok || isMap(current) {
+			cm, _ := current.(ovsdb.OvsMap)
+			return mutateMap(cm, mutator, vm, value), nil
+		}
+		return mutateSet(setElems(current), mutator, setElems(value)), nil
+	case "+=", "-=", "*=", "/=", "%=":
+		a, ok1 := current.(float64)
+		b, ok2 := value.(float64)
+		if !ok1 || !ok2 {
+			return nil, &rpcError{Error: "domain error", Details: "arithmetic on a non number"}
+		}
+		switch mutator {
+		case "+=":
+			return a + b, nil
+		case "-=":
+			return a - b, nil
+		case "*=":
+			return a * b, nil
+		}
+		if b == 0 {
+			return nil, &rpcError{Error: "domain error", Details: "division by zero"}
+		}
+		if mutator == "/=" {
+			return float64(int64(a) / int64(b)), nil
+		}
+		return float64(int64(a) % int64(b)), nil
+	}
+	return nil, &rpcError{Error: "unknown mutator", Details: mutator}
+}
+
+func isMap(v interface{}) bool {
+	_, ok := v.(ovsdb.OvsMap)
+	return ok
+}
+
+func mutateSet(current []interface{}, mutator string, elems []interface{}) ovsdb.OvsSet {
+	set := ovsdb.OvsSet{GoSet: make([]interface{}, 0, len(current)+len(elems))}
+	if mutator == "insert" {
+		have := make(map[string]bool)
+		for _, e := range current {
+			have[atomKey(e)] = true
+			set.GoSet = append(set.GoSet, e)
+		}
+		for _, e := range elems {
+			if !have[atomKey(e)] {
+				have[atomKey(e)] = true
+				set.GoSet = append(set.GoSet, e)
+			}
+		}
+		return set
+	}
+	remove := make(map[string]bool)
+	for _, e := range elems {
+		remove[atomKey(e)] = true
+	}
+	for _, e := range current {
+		if !remove[atomKey(e)] {
+			set.GoSet = append(set.GoSet, e)
+		}
+	}
+	return set
+}
+
+// mutateMap inserts the pairs whose key is not in the map yet, or deletes
+// either the given pairs or, when value is a set, the given keys
+func mutateMap(current ovsdb.OvsMap, mutator string, pairs ovsdb.OvsMap, value interface{}) ovsdb.OvsMap {
+	m := ovsdb.OvsMap{GoMap: make(map[interface{}]interface{}, len(current.GoMap))}
+	for k, v := range current.GoMap {
+		m.GoMap[k] = v
+	}
+	if mutator == "insert" {
+		for k, v := range pairs.GoMap {
+			if _, ok := m.GoMap[k]; !ok {
+				m.GoMap[k] = v
+			}
+		}
+		return m
+	}
+	if !isMap(value) {
+		for _, k := range setElems(value) {
+			delete(m.GoMap, k)
+		}
+		return m
+	}
+	for k, v := range pairs.GoMap {
+		if mapHas(m, k, v) {
+			delete(m.GoMap, k)
+		}
+	}
+	return m
+}
+
+func copyRow(row ovsdb.Row) ovsdb.Row {
+	c := make(ovsdb.Row, len(row))
+	for column, value := range row {
+		c[column] = value
+	}
+	return c
+}
+
+func withUUID(row ovsdb.Row, uuid string) ovsdb.Row {
+	c := copyRow(row)
+	c["_uuid"] = ovsdb.UUID{GoUUID: uuid}
+	return c
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,435 @@
+package ovsdb
+
+import (
+	"fmt"
+)
+
+const (
+	NBDatabase = "OVN_Northbound"
+
+	LogicalSwitchTable     = "Logical_Switch"
+	LogicalSwitchPortTable = "Logical_Switch_Port"
+	LoadBalancerTable      = "Load_Balancer"
+	LoadBalancerGroupTable = "Load_Balancer_Group"
+	LogicalRouterTable     = "Logical_Router"
+	LogicalRouterPortTable = "Logical_Router_Port"
+	StaticRouteTable       = "Logical_Router_Static_Route"
+	NATTable               = "NAT"
+	ACLTable               = "ACL"
+	AddressSetTable        = "Address_Set"
+)
+
+// NBTables are the northbound tables with a typed row. The load balancer
+// group is only monitored along with the per service load balancers, see
+// LoadBalancerGroupByName.
+var NBTables = []string{
+	LogicalSwitchTable,
+	LogicalSwitchPortTable,
+	LoadBalancerTable,
+	LogicalRouterTable,
+	LogicalRouterPortTable,
+	StaticRouteTable,
+	NATTable,
+}
+
+// NBPolicyTables are the northbound tables of the network policies, only
+// needed by the central controller
+var NBPolicyTables = []string{
+	ACLTable,
+	AddressSetTable,
+}
+
+type LogicalSwitch struct {
+	UUID              string
+	Name              string
+	Ports             []string
+	LoadBalancer      []string
+	LoadBalancerGroup []string
+	ACLs              []string
+	ExternalIDs       map[string]string
+	OtherConfig       map[string]string
+}
+
+type LogicalSwitchPort struct {
+	UUID             string
+	Name             string
+	Type             string
+	Addresses        []string
+	DynamicAddresses string
+	Options          map[string]string
+	ExternalIDs      map[string]string
+}
+
+type LoadBalancer struct {
+	UUID        string
+	Name        string
+	Protocol    string
+	Vips        map[string]string
+	Options     map[string]string
+	ExternalIDs map[string]string
+}
+
+type LoadBalancerGroup struct {
+	UUID         string
+	Name         string
+	LoadBalancer []string
+}
+
+type LogicalRouter struct {
+	UUID              string
+	Name              string
+	Ports             []string
+	StaticRoutes      []string
+	Nat               []string
+	LoadBalancer      []string
+	LoadBalancerGroup []string
+	Options           map[string]string
+	ExternalIDs       map[string]string
+}
+
+type LogicalRouterPort struct {
+	UUID        string
+	Name        string
+	MAC         string
+	Networks    []string
+	ExternalIDs map[string]string
+}
+
+type StaticRoute struct {
+	UUID     string
+	IPPrefix string
+	Nexthop  string
+	Policy   string
+}
+
+type NAT struct {
+	UUID       string
+	Type       string
+	ExternalIP string
+	LogicalIP  string
+}
+
+type ACL struct {
+	UUID        string
+	Priority    int
+	Direction   string
+	Match       string
+	Action      string
+	ExternalIDs map[string]string
+}
+
+type AddressSet struct {
+	UUID        string
+	Name        string
+	Addresses   []string
+	ExternalIDs map[string]string
+}
+
+func NewLogicalSwitch(row Row) *LogicalSwitch {
+	return &LogicalSwitch{
+		UUID:              row.UUID(),
+		Name:              row.String("name"),
+		Ports:             row.StringSet("ports"),
+		LoadBalancer:      row.StringSet("load_balancer"),
+		LoadBalancerGroup: row.StringSet("load_balancer_group"),
+		ACLs:              row.StringSet("acls"),
+		ExternalIDs:       row.StringMap("external_ids"),
+		OtherConfig:       row.StringMap("other_config"),
+	}
+}
+
+func NewLogicalSwitchPort(row Row) *LogicalSwitchPort {
+	return &LogicalSwitchPort{
+		UUID:             row.UUID(),
+		Name:             row.String("name"),
+		Type:             row.String("type"),
+		Addresses:        row.StringSet("addresses"),
+		DynamicAddresses: row.String("dynamic_addresses"),
+		Options:          row.StringMap("options"),
+		ExternalIDs:      row.StringMap("external_ids"),
+	}
+}
+
+func NewLoadBalancer(row Row) *LoadBalancer {
+	return &LoadBalancer{
+		UUID:        row.UUID(),
+		Name:        row.String("name"),
+		Protocol:    row.String("protocol"),
+		Vips:        row.StringMap("vips"),
+		Options:     row.StringMap("options"),
+		ExternalIDs: row.StringMap("external_ids"),
+	}
+}
+
+func NewLoadBalancerGroup(row Row) *LoadBalancerGroup {
+	return &LoadBalancerGroup{
+		UUID:         row.UUID(),
+		Name:         row.String("name"),
+		LoadBalancer: row.StringSet("load_balancer"),
+	}
+}
+
+func NewLogicalRouter(row Row) *LogicalRouter {
+	return &LogicalRouter{
+		UUID:              row.UUID(),
+		Name:              row.String("name"),
+		Ports:             row.StringSet("ports"),
+		StaticRoutes:      row.StringSet("static_routes"),
+		Nat:               row.StringSet("nat"),
+		LoadBalancer:      row.StringSet("load_balancer"),
+		LoadBalancerGroup: row.StringSet("load_balancer_group"),
+		Options:           row.StringMap("options"),
+		ExternalIDs:       row.StringMap("external_ids"),
+	}
+}
+
+func NewLogicalRouterPort(row Row) *LogicalRouterPort {
+	return &LogicalRouterPort{
+		UUID:        row.UUID(),
+		Name:        row.String("name"),
+		MAC:         row.String("mac"),
+		Networks:    row.StringSet("networks"),
+		ExternalIDs: row.StringMap("external_ids"),
+	}
+}
+
+func NewStaticRoute(row Row) *StaticRoute {
+	return &StaticRoute{
+		UUID:     row.UUID(),
+		IPPrefix: row.String("ip_prefix"),
+		Nexthop:  row.String("nexthop"),
+		Policy:   row.String("policy"),
+	}
+}
+
+func NewNAT(row Row) *NAT {
+	return &NAT{
+		UUID:       row.UUID(),
+		Type:       row.String("type"),
+		ExternalIP: row.String("external_ip"),
+		LogicalIP:  row.String("logical_ip"),
+	}
+}
+
+func NewACL(row Row) *ACL {
+	return &ACL{
+		UUID:        row.UUID(),
+		Priority:    row.Int("priority"),
+		Direction:   row.String("direction"),
+		Match:       row.String("match"),
+		Action:      row.String("action"),
+		ExternalIDs: row.StringMap("external_ids"),
+	}
+}
+
+func NewAddressSet(row Row) *AddressSet {
+	return &AddressSet{
+		UUID:        row.UUID(),
+		Name:        row.String("name"),
+		Addresses:   row.StringSet("addresses"),
+		ExternalIDs: row.StringMap("external_ids"),
+	}
+}
+
+// LogicalSwitches returns the cached logical switches
+func (c *Client) LogicalSwitches() []*LogicalSwitch {
+	switches := make([]*LogicalSwitch, 0)
+	for _, row := range c.Rows(LogicalSwitchTable) {
+		switches = append(switches, NewLogicalSwitch(row))
+	}
+	return switches
+}
+
+// LogicalSwitchByName returns the cached logical switch with the given name
+func (c *Client) LogicalSwitchByName(name string) (*LogicalSwitch, error) {
+	for _, row := range c.Rows(LogicalSwitchTable) {
+		if row.String("name") == name {
+			return NewLogicalSwitch(row), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// LogicalSwitchPorts returns the cached logical switch ports
+func (c *Client) LogicalSwitchPorts() []*LogicalSwitchPort {
+	ports := make([]*LogicalSwitchPort, 0)
+	for _, row := range c.Rows(LogicalSwitchPortTable) {
+		ports = append(ports, NewLogicalSwitchPort(row))
+	}
+	return ports
+}
+
+// LogicalSwitchPortByName returns the cached logical switch port with the given name
+func (c *Client) LogicalSwitchPortByName(name string) (*LogicalSwitchPort, error) {
+	for _, row := range c.Rows(LogicalSwitchPortTable) {
+		if row.String("name") == name {
+			return NewLogicalSwitchPort(row), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// LoadBalancers returns the cached load balancers
+func (c *Client) LoadBalancers() []*LoadBalancer {
+	lbs := make([]*LoadBalancer, 0)
+	for _, row := range c.Rows(LoadBalancerTable) {
+		lbs = append(lbs, NewLoadBalancer(row))
+	}
+	return lbs
+}
+
+// LoadBalancerGroupByName returns the load balancer group with the given
+// name, from the cache when the table is monitored and else from the server
+func (c *Client) LoadBalancerGroupByName(name string) (*LoadBalancerGroup, error) {
+	if !c.Monitored(LoadBalancerGroupTable) {
+		rows, err := c.Select(NBDatabase, LoadBalancerGroupTable, NewCondition("name", "==", name))
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return nil, ErrNotFound
+		}
+		return NewLoadBalancerGroup(rows[0]), nil
+	}
+	for _, row := range c.Rows(LoadBalancerGroupTable) {
+		if row.String("name") == name {
+			return NewLoadBalancerGroup(row), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// LogicalRouters returns the cached logical routers
+func (c *Client) LogicalRouters() []*LogicalRouter {
+	routers := make([]*LogicalRouter, 0)
+	for _, row := range c.Rows(LogicalRouterTable) {
+		routers = append(routers, NewLogicalRouter(row))
+	}
+	return routers
+}
+
+// LogicalRouterByName returns the cached logical router with the given name
+func (c *Client) LogicalRouterByName(name string) (*LogicalRouter, error) {
+	for _, row := range c.Rows(LogicalRouterTable) {
+		if row.String("name") == name {
+			return NewLogicalRouter(row), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// LogicalRouterPorts returns the cached logical router ports
+func (c *Client) LogicalRouterPorts() []*LogicalRouterPort {
+	ports := make([]*LogicalRouterPort, 0)
+	for _, row := range c.Rows(LogicalRouterPortTable) {
+		ports = append(ports, NewLogicalRouterPort(row))
+	}
+	return ports
+}
+
+// LogicalRouterPortByName returns the cached logical router port with the given name
+func (c *Client) LogicalRouterPortByName(name string) (*LogicalRouterPort, error) {
+	for _, row := range c.Rows(LogicalRouterPortTable) {
+		if row.String("name") == name {
+			return NewLogicalRouterPort(row), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// ACLs returns the cached ACLs
+func (c *Client) ACLs() []*ACL {
+	acls := make([]*ACL, 0)
+	for _, row := range c.Rows(ACLTable) {
+		acls = append(acls, NewACL(row))
+	}
+	return acls
+}
+
+// AddressSets returns the cached address sets
+func (c *Client) AddressSets() []*AddressSet {
+	sets := make([]*AddressSet, 0)
+	for _, row := range c.Rows(AddressSetTable) {
+		sets = append(sets, NewAddressSet(row))
+	}
+	return sets
+}
+
+// AddressSetByName returns the cached address set with the given name
+func (c *Client) AddressSetByName(name string) (*AddressSet, error) {
+	for _, row := range c.Rows(AddressSetTable) {
+		if row.String("name") == name {
+			return NewAddressSet(row), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// UUID returns the _uuid column of the row
+func (r Row) UUID() string {
+	if u, ok := r["_uuid"].(UUID); ok {
+		return u.GoUUID
+	}
+	return ""
+}
+
+// String returns a string column, or an optional string column that is
+// encoded as a set of at most one element
+func (r Row) String(column string) string {
+	switch v := r[column].(type) {
+	case string:
+		return v
+	case OvsSet:
+		if len(v.GoSet) == 1 {
+			return atomString(v.GoSet[0])
+		}
+	}
+	return ""
+}
+
+// Int returns an integer column, which is decoded as a number
+func (r Row) Int(column string) int {
+	switch v := r[column].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// StringSet returns a set column of strings or uuids
+func (r Row) StringSet(column string) []string {
+	set := make([]string, 0)
+	switch v := r[column].(type) {
+	case nil:
+	case OvsSet:
+		for _, e := range v.GoSet {
+			set = append(set, atomString(e))
+		}
+	default:
+		set = append(set, atomString(v))
+	}
+	return set
+}
+
+// StringMap returns a map column of strings
+func (r Row) StringMap(column string) map[string]string {
+	m := make(map[string]string)
+	if v, ok := r[column].(OvsMap); ok {
+		for k, val := range v.GoMap {
+			m[atomString(k)] = atomString(val)
+		}
+	}
+	return m
+}
+
+func atomString(atom interface{}) string {
+	switch v := atom.(type) {
+	case string:
+		return v
+	case UUID:
+		return v.GoUUID
+	}
+	return fmt.Sprint(atom)
+}
@@ -0,0 +1,33 @@
+package ovsdb
+
+const (
+	SBDatabase = "OVN_Southbound"
+
+	ChassisTable = "Chassis"
+)
+
+// SBTables are the southbound tables with a typed row
+var SBTables = []string{ChassisTable}
+
+type Chassis struct {
+	UUID     string
+	Name     string
+	Hostname string
+}
+
+func NewChassis(row Row) *Chassis {
+	return &Chassis{
+		UUID:     row.UUID(),
+		Name:     row.String("name"),
+		Hostname: row.String("hostname"),
+	}
+}
+
+// Chassis returns the cached chassis
+func (c *Client) Chassis() []*Chassis {
+	chassis := make([]*Chassis, 0)
+	for _, row := range c.Rows(ChassisTable) {
+		chassis = append(chassis, NewChassis(row))
+	}
+	return chassis
+}
@@ -0,0 +1,347 @@
+package ovsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// UUID is an OVSDB uuid atom. A UUID that is not a real uuid is encoded as a
+// named-uuid, which refers to a row inserted earlier in the same transaction.
+type UUID struct {
+	GoUUID string
+}
+
+func (u UUID) MarshalJSON() ([]byte, error) {
+	if uuidRegexp.MatchString(u.GoUUID) {
+		return json.Marshal([]string{"uuid", u.GoUUID})
+	}
+	return json.Marshal([]string{"named-uuid", u.GoUUID})
+}
+
+// OvsSet is an OVSDB set. Sets with exactly one element may also be sent on
+// the wire as the bare atom, the decoder accepts both forms.
+type OvsSet struct {
+	GoSet []interface{}
+}
+
+// NewOvsSet builds a set out of a slice of atoms
+func NewOvsSet(elems interface{}) OvsSet {
+	set := OvsSet{GoSet: make([]interface{}, 0)}
+	v := reflect.ValueOf(elems)
+	if v.Kind() != reflect.Slice {
+		set.GoSet = append(set.GoSet, elems)
+		return set
+	}
+	for i := 0; i < v.Len(); i++ {
+		set.GoSet = append(set.GoSet, v.Index(i).Interface())
+	}
+	return set
+}
+
+func (s OvsSet) MarshalJSON() ([]byte, error) {
+	elems := s.GoSet
+	if elems == nil {
+		elems = make([]interface{}, 0)
+	}
+	return json.Marshal([]interface{}{"set", elems})
+}
+
+// OvsMap is an OVSDB map
+type OvsMap struct {
+	GoMap map[interface{}]interface{}
+}
+
+// NewOvsMap builds a map out of a map of string keys and values
+func NewOvsMap(m map[string]string) OvsMap {
+	ovsMap := OvsMap{GoMap: make(map[interface{}]interface{})}
+	for k, v := range m {
+		ovsMap.GoMap[k] = v
+	}
+	return ovsMap
+}
+
+func (m OvsMap) MarshalJSON() ([]byte, error) {
+	// keep the encoding stable, it makes the wire format easier to debug
+	keys := make([]string, 0, len(m.GoMap))
+	byKey := make(map[string]interface{}, len(m.GoMap))
+	for k := range m.GoMap {
+		keys = append(keys, fmt.Sprint(k))
+		byKey[fmt.Sprint(k)] = k
+	}
+	sort.Strings(keys)
+	pairs := make([][]interface{}, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, []interface{}{byKey[k], m.GoMap[byKey[k]]})
+	}
+	return json.Marshal([]interface{}{"map", pairs})
+}
+
+// Row is a table row. Values are strings, float64 numbers, booleans, UUIDs,
+// OvsSets or OvsMaps.
+type Row map[string]interface{}
+
+func (r *Row) UnmarshalJSON(data []byte) error {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	row := make(Row, len(raw))
+	for column, value := range raw {
+		v, err := DecodeValue(value)
+		if err != nil {
+			return fmt.Errorf("column %s: %v", column, err)
+		}
+		row[column] = v
+	}
+	*r = row
+	return nil
+}
+
+// DecodeValue converts a value decoded by encoding/json into its OVSDB type
+func DecodeValue(value interface{}) (interface{}, error) {
+	arr, ok := value.([]interface{})
+	if !ok {
+		return value, nil
+	}
+	if len(arr) != 2 {
+		return nil, fmt.Errorf("invalid ovsdb value %v", value)
+	}
+	tag, ok := arr[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid ovsdb value %v", value)
+	}
+	switch tag {
+	case "uuid", "named-uuid":
+		u, ok := arr[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid ovsdb uuid %v", value)
+		}
+		return UUID{GoUUID: u}, nil
+	case "set":
+		elems, ok := arr[1].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid ovsdb set %v", value)
+		}
+		set := OvsSet{GoSet: make([]interface{}, 0, len(elems))}
+		for _, e := range elems {
+			atom, err := DecodeValue(e)
+			if err != nil {
+				return nil, err
+			}
+			set.GoSet = append(set.GoSet, atom)
+		}
+		return set, nil
+	case "map":
+		pairs, ok := arr[1].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid ovsdb map %v", value)
+		}
+		m := OvsMap{GoMap: make(map[interface{}]interface{}, len(pairs))}
+		for _, p := range pairs {
+			pair, ok := p.([]interface{})
+			if !ok || len(pair) != 2 {
+				return nil, fmt.Errorf("invalid ovsdb map pair %v", p)
+			}
+			k, err := DecodeValue(pair[0])
+			if err != nil {
+				return nil, err
+			}
+			v, err := DecodeValue(pair[1])
+			if err != nil {
+				return nil, err
+			}
+			m.GoMap[k] = v
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("invalid ovsdb value tag %q", tag)
+}
+
+// Condition is a [column, function, value] where clause
+type Condition []interface{}
+
+func NewCondition(column, function string, value interface{}) Condition {
+	return Condition{column, function, value}
+}
+
+// Mutation is a [column, mutator, value] mutation
+type Mutation []interface{}
+
+func NewMutation(column, mutator string, value interface{}) Mutation {
+	return Mutation{column, mutator, value}
+}
+
+// Operation is a single operation of a transaction, RFC 7047 section 5.2
+type Operation struct {
+	Op        string
+	Table     string
+	Row       Row
+	Where     []Condition
+	Mutations []Mutation
+	Columns   []string
+	UUIDName  string
+	Comment   string
+	// Until and Rows are the condition of a wait, which waits until the
+	// Columns of the rows matched by Where are, or are not, Rows. The wait
+	// fails at once as it has no timeout.
+	Until string
+	Rows  []Row
+}
+
+func (o Operation) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{"op": o.Op}
+	if o.Op == "comment" {
+		m["comment"] = o.Comment
+		return json.Marshal(m)
+	}
+	m["table"] = o.Table
+	switch o.Op {
+	case "insert":
+		m["row"] = o.Row
+		if o.UUIDName != "" {
+			m["uuid-name"] = o.UUIDName
+		}
+		return json.Marshal(m)
+	case "update":
+		m["row"] = o.Row
+	case "mutate":
+		m["mutations"] = o.Mutations
+	case "select":
+		if o.Columns != nil {
+			m["columns"] = o.Columns
+		}
+	case "wait":
+		m["timeout"] = 0
+		m["columns"] = o.Columns
+		m["until"] = o.Until
+		rows := o.Rows
+		if rows == nil {
+			rows = make([]Row, 0)
+		}
+		m["rows"] = rows
+	}
+	where := o.Where
+	if where == nil {
+		where = make([]Condition, 0)
+	}
+	m["where"] = where
+	return json.Marshal(m)
+}
+
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Op        string          `json:"op"`
+		Table     string          `json:"table"`
+		Row       Row             `json:"row"`
+		Where     [][]interface{} `json:"where"`
+		Mutations [][]interface{} `json:"mutations"`
+		Columns   []string        `json:"columns"`
+		UUIDName  string          `json:"uuid-name"`
+		Comment   string          `json:"comment"`
+		Until     string          `json:"until"`
+		Rows      []Row           `json:"rows"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*o = Operation{
+		Op:       raw.Op,
+		Table:    raw.Table,
+		Row:      raw.Row,
+		Columns:  raw.Columns,
+		UUIDName: raw.UUIDName,
+		Comment:  raw.Comment,
+		Until:    raw.Until,
+		Rows:     raw.Rows,
+	}
+	for _, w := range raw.Where {
+		c, err := decodeTriple(w)
+		if err != nil {
+			return err
+		}
+		o.Where = append(o.Where, Condition(c))
+	}
+	for _, mu := range raw.Mutations {
+		m, err := decodeTriple(mu)
+		if err != nil {
+			return err
+		}
+		o.Mutations = append(o.Mutations, Mutation(m))
+	}
+	return nil
+}
+
+func decodeTriple(t []interface{}) ([]interface{}, error) {
+	if len(t) != 3 {
+		return nil, fmt.Errorf("invalid condition or mutation %v", t)
+	}
+	v, err := DecodeValue(t[2])
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{t[0], t[1], v}, nil
+}
+
+// OperationResult is the result of a single operation of a transaction
+type OperationResult struct {
+	Count   int    `json:"count,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Details string `json:"details,omitempty"`
+	UUID    UUID   `json:"-"`
+	Rows    []Row  `json:"rows,omitempty"`
+}
+
+func (r OperationResult) MarshalJSON() ([]byte, error) {
+	type alias OperationResult
+	m := make(map[string]interface{})
+	data, err := json.Marshal(alias(r))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if r.UUID.GoUUID != "" {
+		m["uuid"] = r.UUID
+	}
+	return json.Marshal(m)
+}
+
+func (r *OperationResult) UnmarshalJSON(data []byte) error {
+	type alias OperationResult
+	var a alias
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+	var raw struct {
+		UUID interface{} `json:"uuid"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*r = OperationResult(a)
+	if raw.UUID != nil {
+		u, err := DecodeValue(raw.UUID)
+		if err != nil {
+			return err
+		}
+		if uuid, ok := u.(UUID); ok {
+			r.UUID = uuid
+		}
+	}
+	return nil
+}
+
+// RowUpdate is the old and new contents of a row in a monitor update
+type RowUpdate struct {
+	Old Row `json:"old,omitempty"`
+	New Row `json:"new,omitempty"`
+}
+
+// TableUpdates maps table names to the updated rows, keyed by uuid
+type TableUpdates map[string]map[string]RowUpdate
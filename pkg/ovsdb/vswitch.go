@@ -0,0 +1,111 @@
+package ovsdb
+
+const (
+	OVSDatabase = "Open_vSwitch"
+
+	OpenvSwitchTable = "Open_vSwitch"
+	BridgeTable      = "Bridge"
+	PortTable        = "Port"
+	InterfaceTable   = "Interface"
+)
+
+// OVSTables are the Open_vSwitch tables with a typed row
+var OVSTables = []string{OpenvSwitchTable, BridgeTable, PortTable, InterfaceTable}
+
+type OpenvSwitch struct {
+	UUID        string
+	Bridges     []string
+	ExternalIDs map[string]string
+}
+
+type Bridge struct {
+	UUID  string
+	Name  string
+	Ports []string
+}
+
+type Port struct {
+	UUID       string
+	Name       string
+	Interfaces []string
+}
+
+type Interface struct {
+	UUID        string
+	Name        string
+	Type        string
+	MAC         string
+	ExternalIDs map[string]string
+}
+
+func NewOpenvSwitch(row Row) *OpenvSwitch {
+	return &OpenvSwitch{
+		UUID:        row.UUID(),
+		Bridges:     row.StringSet("bridges"),
+		ExternalIDs: row.StringMap("external_ids"),
+	}
+}
+
+func NewBridge(row Row) *Bridge {
+	return &Bridge{
+		UUID:  row.UUID(),
+		Name:  row.String("name"),
+		Ports: row.StringSet("ports"),
+	}
+}
+
+func NewPort(row Row) *Port {
+	return &Port{
+		UUID:       row.UUID(),
+		Name:       row.String("name"),
+		Interfaces: row.StringSet("interfaces"),
+	}
+}
+
+func NewInterface(row Row) *Interface {
+	return &Interface{
+		UUID:        row.UUID(),
+		Name:        row.String("name"),
+		Type:        row.String("type"),
+		MAC:         row.String("mac"),
+		ExternalIDs: row.StringMap("external_ids"),
+	}
+}
+
+// OpenvSwitchRoot returns the cached single row of the Open_vSwitch table
+func (c *Client) OpenvSwitchRoot() (*OpenvSwitch, error) {
+	for _, row := range c.Rows(OpenvSwitchTable) {
+		return NewOpenvSwitch(row), nil
+	}
+	return nil, ErrNotFound
+}
+
+// BridgeByName returns the cached bridge with the given name
+func (c *Client) BridgeByName(name string) (*Bridge, error) {
+	for _, row := range c.Rows(BridgeTable) {
+		if row.String("name") == name {
+			return NewBridge(row), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// PortByName returns the cached port with the given name
+func (c *Client) PortByName(name string) (*Port, error) {
+	for _, row := range c.Rows(PortTable) {
+		if row.String("name") == name {
+			return NewPort(row), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// InterfaceByName returns the cached interface with the given name
+func (c *Client) InterfaceByName(name string) (*Interface, error) {
+	for _, row := range c.Rows(InterfaceTable) {
+		if row.String("name") == name {
+			return NewInterface(row), nil
+		}
+	}
+	return nil, ErrNotFound
+}